@@ -17,12 +17,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/jsimonetti/hodos/internal/build"
 	"github.com/jsimonetti/hodos/internal/cap"
 	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/icmp"
 	logger "github.com/jsimonetti/hodos/internal/log"
 	"github.com/jsimonetti/hodos/internal/server"
 
@@ -36,7 +39,7 @@ const defaultCfgFile = "hodos.toml"
 var (
 	cfgFlag     = flag.String("c", defaultCfgFile, "path to configuration file")
 	exampleFlag = flag.Bool("example", false, "print out an example configuration")
-	debug       = flag.Bool("d", false, "enable debug logging")
+	debug       = flag.Bool("d", false, "enable debug logging of all components, regardless of log_level and log_levels")
 )
 
 func main() {
@@ -60,11 +63,6 @@ func main() {
 		return
 	}
 
-	if !cap.HasCapabilities() {
-		log.Print("you don't have the proper rights")
-		log.Fatalf("either add CAP_NET_ADMIN (setcap 'cap_net_admin+p' %s) or run as root", os.Args[0])
-	}
-
 	l.Print(fmt.Sprintf("%s starting with configuration file %q", build.Banner(thisApp), *cfgFlag))
 
 	// open the config file
@@ -80,9 +78,15 @@ func main() {
 	}
 	_ = f.Close()
 
-	go func() {
-		l.Print(http.ListenAndServe(":6060", nil))
-	}()
+	// log as configured from here on, -d enables debug
+	// logging of every component, also those with a level
+	level, levels := cfg.LogLevel, cfg.LogLevels
+	if *debug {
+		level, levels = logger.LevelDebug, nil
+	}
+	l = newLogger(l, ll, cfg, level, levels)
+
+	checkCapabilities(l, cfg)
 
 	ctx := context.Background()
 	// run the server
@@ -90,7 +94,93 @@ func main() {
 	if err != nil {
 		l.Fatalf("failed to start server: %s", err)
 	}
+
+	// serve pprof and the control api on the control listener,
+	// and only the status api and the metrics on the metrics listener
+	if cfg.ListenAddress != "" {
+		server.RegisterControlHandlers(http.DefaultServeMux)
+		serve(l, cfg.ListenNetwork, cfg.ListenAddress, http.DefaultServeMux)
+	}
+	if cfg.MetricsListenAddress != "" {
+		mux := http.NewServeMux()
+		server.RegisterHandlers(mux)
+		serve(l, cfg.MetricsListenNetwork, cfg.MetricsListenAddress, mux)
+	}
 	server.Start()
 
 	l.Debugf("shut down with this many routines left: %d\n", runtime.NumGoroutine())
 }
+
+// serve serves handler on the address in the background,
+// after removing a unix socket left by a previous run
+func serve(l logger.Logger, network, address string, handler http.Handler) {
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			l.Fatalf("failed to remove stale socket %q: %s", address, err)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		l.Fatalf("failed to listen on %q: %s", address, err)
+	}
+	go func() {
+		l.Error(http.Serve(ln, handler))
+	}()
+}
+
+// newLogger returns the logger for the configured output. Messages that
+// the journal or syslog fail to take are written to ll. When the output
+// can not be opened, l is used to report it.
+func newLogger(l logger.Logger, ll *log.Logger, cfg *config.Config, level logger.Level, levels map[string]logger.Level) logger.Logger {
+	switch cfg.LogOutput {
+	case config.LOGOUTPUT_JOURNALD:
+		sink, err := logger.NewJournal(cfg.JournaldSocket, thisApp)
+		if err != nil {
+			l.Fatalf("failed to open the journal: %s", err)
+		}
+		return logger.NewSinkLogger(sink, ll, level, levels)
+	case config.LOGOUTPUT_SYSLOG:
+		sink, err := logger.NewSyslog(cfg.SyslogNetwork, cfg.SyslogAddress, thisApp)
+		if err != nil {
+			l.Fatalf("failed to open syslog: %s", err)
+		}
+		return logger.NewSinkLogger(sink, ll, level, levels)
+	}
+	// without the journal collecting stderr,
+	// the text lines need a timestamp
+	if cfg.LogFormat == config.LOGFORMAT_TEXT && os.Getenv("JOURNAL_STREAM") == "" {
+		ll.SetFlags(log.LstdFlags)
+	}
+	return logger.NewStructured(ll, cfg.LogFormat, level, levels)
+}
+
+// checkCapabilities exits if the process lacks a capability
+// that is needed for the configured features.
+func checkCapabilities(l logger.Logger, cfg *config.Config) {
+	reqs := []cap.Requirement{
+		{Capability: cap.NetAdmin, Feature: "managing routes and rules"},
+	}
+	if icmp.Privileged(cfg.ICMPMode) {
+		reqs = append(reqs, cap.Requirement{Capability: cap.NetRaw, Feature: "raw icmp sockets (see icmp_mode)"})
+	}
+	for _, ifi := range cfg.Interfaces {
+		if ifi.TracerouteInterval > 0 || ifi.TracerouteOnFailover {
+			reqs = append(reqs, cap.Requirement{Capability: cap.NetRaw, Feature: fmt.Sprintf("traceroute on %q", ifi.Name)})
+		}
+	}
+
+	missing, err := cap.Missing(reqs...)
+	if err != nil {
+		l.Fatalf("%s", err)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	l.Error("you don't have the proper rights")
+	names := make([]string, 0, len(missing))
+	for _, req := range missing {
+		l.Errorf("missing capability %s", req)
+		names = append(names, strings.ToLower("cap_"+req.Name()))
+	}
+	l.Fatalf("either add the capabilities (setcap '%s+p' %s) or run as root", strings.Join(names, ","), os.Args[0])
+}
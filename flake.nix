@@ -38,5 +38,9 @@
         inherit nixpkgs; pkgs = nixpkgs.legacyPackages."x86_64-linux";
         system = "x86_64-linux";
       };
+      checks."x86_64-linux".bfd = import ./test/bfd.nix {
+        inherit nixpkgs; pkgs = nixpkgs.legacyPackages."x86_64-linux";
+        system = "x86_64-linux";
+      };
     };
 }
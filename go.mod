@@ -6,16 +6,11 @@ require (
 	github.com/jsimonetti/rtnetlink v1.3.0
 	github.com/mdlayher/netlink v1.7.1
 	github.com/pelletier/go-toml v1.9.5
-	github.com/prometheus-community/pro-bing v0.1.0
 	github.com/syndtr/gocapability v0.0.0-20200815063812-42c35b437635
+	golang.org/x/net v0.2.0
 	golang.org/x/sys v0.4.0
 )
 
-require (
-	github.com/google/uuid v1.3.0 // indirect
-	golang.org/x/net v0.2.0 // indirect
-)
-
 require (
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/josharian/native v1.0.0 // indirect
@@ -0,0 +1,184 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bfd
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	version      = 1
+	packetLength = 24 // control packet without authentication
+)
+
+// State is the state of a BFD session (RFC 5880 section 4.1)
+type State uint8
+
+const (
+	StateAdminDown State = iota
+	StateDown
+	StateInit
+	StateUp
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAdminDown:
+		return "AdminDown"
+	case StateDown:
+		return "Down"
+	case StateInit:
+		return "Init"
+	case StateUp:
+		return "Up"
+	default:
+		return "Unknown"
+	}
+}
+
+// Diagnostic is the reason for the last state change of a
+// BFD session (RFC 5880 section 4.1)
+type Diagnostic uint8
+
+const (
+	DiagNone Diagnostic = iota
+	DiagControlDetectionTimeExpired
+	DiagEchoFunctionFailed
+	DiagNeighborSignaledSessionDown
+	DiagForwardingPlaneReset
+	DiagPathDown
+	DiagConcatenatedPathDown
+	DiagAdministrativelyDown
+	DiagReverseConcatenatedPathDown
+)
+
+func (d Diagnostic) String() string {
+	switch d {
+	case DiagNone:
+		return "No Diagnostic"
+	case DiagControlDetectionTimeExpired:
+		return "Control Detection Time Expired"
+	case DiagEchoFunctionFailed:
+		return "Echo Function Failed"
+	case DiagNeighborSignaledSessionDown:
+		return "Neighbor Signaled Session Down"
+	case DiagForwardingPlaneReset:
+		return "Forwarding Plane Reset"
+	case DiagPathDown:
+		return "Path Down"
+	case DiagConcatenatedPathDown:
+		return "Concatenated Path Down"
+	case DiagAdministrativelyDown:
+		return "Administratively Down"
+	case DiagReverseConcatenatedPathDown:
+		return "Reverse Concatenated Path Down"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	flagPoll       = 1 << 5
+	flagFinal      = 1 << 4
+	flagCPI        = 1 << 3
+	flagAuth       = 1 << 2
+	flagDemand     = 1 << 1
+	flagMultipoint = 1 << 0
+)
+
+var errInvalidPacket = errors.New("invalid bfd control packet")
+
+// packet is a BFD control packet (RFC 5880 section 4.1)
+// Authentication is not supported.
+type packet struct {
+	Diag                  Diagnostic
+	State                 State
+	Poll, Final           bool
+	Demand, Multipoint    bool
+	Auth                  bool
+	DetectMult            uint8
+	MyDiscriminator       uint32
+	YourDiscriminator     uint32
+	DesiredMinTxInterval  time.Duration
+	RequiredMinRxInterval time.Duration
+	RequiredMinEchoRx     time.Duration
+}
+
+func (p *packet) MarshalBinary() ([]byte, error) {
+	b := make([]byte, packetLength)
+	b[0] = version<<5 | uint8(p.Diag)&0x1f
+	b[1] = uint8(p.State) << 6
+	if p.Poll {
+		b[1] |= flagPoll
+	}
+	if p.Final {
+		b[1] |= flagFinal
+	}
+	b[2] = p.DetectMult
+	b[3] = packetLength
+	binary.BigEndian.PutUint32(b[4:8], p.MyDiscriminator)
+	binary.BigEndian.PutUint32(b[8:12], p.YourDiscriminator)
+	binary.BigEndian.PutUint32(b[12:16], micros(p.DesiredMinTxInterval))
+	binary.BigEndian.PutUint32(b[16:20], micros(p.RequiredMinRxInterval))
+	binary.BigEndian.PutUint32(b[20:24], micros(p.RequiredMinEchoRx))
+	return b, nil
+}
+
+// UnmarshalBinary decodes a control packet and does the
+// validation from RFC 5880 section 6.8.6 that does not
+// depend on the discriminators or session state.
+func (p *packet) UnmarshalBinary(b []byte) error {
+	if len(b) < packetLength {
+		return errInvalidPacket
+	}
+	if b[0]>>5 != version {
+		return errInvalidPacket
+	}
+	length := int(b[3])
+	if length < packetLength || length > len(b) {
+		return errInvalidPacket
+	}
+
+	p.Diag = Diagnostic(b[0] & 0x1f)
+	p.State = State(b[1] >> 6)
+	p.Poll = b[1]&flagPoll != 0
+	p.Final = b[1]&flagFinal != 0
+	p.Auth = b[1]&flagAuth != 0
+	p.Demand = b[1]&flagDemand != 0
+	p.Multipoint = b[1]&flagMultipoint != 0
+	p.DetectMult = b[2]
+	p.MyDiscriminator = binary.BigEndian.Uint32(b[4:8])
+	p.YourDiscriminator = binary.BigEndian.Uint32(b[8:12])
+	p.DesiredMinTxInterval = duration(binary.BigEndian.Uint32(b[12:16]))
+	p.RequiredMinRxInterval = duration(binary.BigEndian.Uint32(b[16:20]))
+	p.RequiredMinEchoRx = duration(binary.BigEndian.Uint32(b[20:24]))
+
+	if p.DetectMult == 0 || p.Multipoint || p.MyDiscriminator == 0 {
+		return errInvalidPacket
+	}
+	if p.Auth {
+		// we do not support authentication
+		return errInvalidPacket
+	}
+	return nil
+}
+
+func micros(d time.Duration) uint32 {
+	return uint32(d / time.Microsecond)
+}
+
+func duration(us uint32) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
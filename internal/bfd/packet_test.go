@@ -0,0 +1,127 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bfd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacketMarshal(t *testing.T) {
+	p := &packet{
+		Diag:                  DiagNeighborSignaledSessionDown,
+		State:                 StateUp,
+		Poll:                  true,
+		DetectMult:            3,
+		MyDiscriminator:       0x01020304,
+		YourDiscriminator:     0x05060708,
+		DesiredMinTxInterval:  300 * time.Millisecond,
+		RequiredMinRxInterval: time.Second,
+	}
+	want := []byte{
+		0x23, 0xe0, 0x03, 0x18,
+		0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07, 0x08,
+		0x00, 0x04, 0x93, 0xe0,
+		0x00, 0x0f, 0x42, 0x40,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	got, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("MarshalBinary() = % x, want % x", got, want)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    packet
+	}{
+		{
+			name: "down without remote discriminator",
+			p:    packet{State: StateDown, DetectMult: 3, MyDiscriminator: 1},
+		},
+		{
+			name: "up with poll",
+			p: packet{
+				State: StateUp, Poll: true, DetectMult: 5,
+				MyDiscriminator: 7, YourDiscriminator: 9,
+				DesiredMinTxInterval: 100 * time.Millisecond, RequiredMinRxInterval: 50 * time.Millisecond,
+			},
+		},
+		{
+			name: "final",
+			p:    packet{State: StateUp, Final: true, DetectMult: 1, MyDiscriminator: 2, YourDiscriminator: 3},
+		},
+		{
+			name: "admin down",
+			p: packet{
+				Diag: DiagAdministrativelyDown, State: StateAdminDown, DetectMult: 3,
+				MyDiscriminator: 0xffffffff, RequiredMinEchoRx: time.Microsecond,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.p.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got packet
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.p) {
+				t.Fatalf("round trip = %+v, want %+v", got, tt.p)
+			}
+		})
+	}
+}
+
+func TestPacketUnmarshalInvalid(t *testing.T) {
+	valid := func() []byte {
+		p := &packet{State: StateUp, DetectMult: 3, MyDiscriminator: 1, YourDiscriminator: 2}
+		b, _ := p.MarshalBinary()
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		mangle func(b []byte) []byte
+	}{
+		{name: "short", mangle: func(b []byte) []byte { return b[:packetLength-1] }},
+		{name: "version", mangle: func(b []byte) []byte { b[0] = 2<<5 | b[0]&0x1f; return b }},
+		{name: "length below minimum", mangle: func(b []byte) []byte { b[3] = packetLength - 1; return b }},
+		{name: "length beyond packet", mangle: func(b []byte) []byte { b[3] = packetLength + 1; return b }},
+		{name: "zero multiplier", mangle: func(b []byte) []byte { b[2] = 0; return b }},
+		{name: "multipoint", mangle: func(b []byte) []byte { b[1] |= flagMultipoint; return b }},
+		{name: "zero my discriminator", mangle: func(b []byte) []byte { copy(b[4:8], []byte{0, 0, 0, 0}); return b }},
+		{name: "authentication", mangle: func(b []byte) []byte { b[1] |= flagAuth; return b }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p packet
+			if err := p.UnmarshalBinary(tt.mangle(valid())); err != errInvalidPacket {
+				t.Fatalf("UnmarshalBinary() = %v, want %v", err, errInvalidPacket)
+			}
+		})
+	}
+}
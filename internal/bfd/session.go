@@ -0,0 +1,533 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ControlPort is the destination port for single-hop
+	// control packets (RFC 5881 section 4)
+	ControlPort = 3784
+
+	// source ports must be in this range (RFC 5881 section 4)
+	sourcePortMin = 49152
+	sourcePortMax = 65535
+
+	// single-hop sessions use the GTSM (RFC 5881 section 5)
+	ttl = 255
+
+	// the transmit interval while the session is not up
+	// (RFC 5880 section 6.8.3)
+	slowTxInterval = time.Second
+
+	// heartbeat is the longest the session
+	// loop waits without going through its loop
+	heartbeat = time.Second
+)
+
+// Session is a single-hop asynchronous mode BFD session
+// (RFC 5880 and RFC 5881) with a single peer.
+type Session struct {
+	local     net.IP
+	peer      net.IP
+	interFace string
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	downFunc func()
+	upFunc   func()
+	l        log.Logger
+
+	desiredMinTx  time.Duration
+	requiredMinRx time.Duration
+	detectMult    uint8
+
+	// session state variables (RFC 5880 section 6.8.1)
+	state        State
+	remoteState  State
+	localDiscr   uint32
+	remoteDiscr  uint32
+	localDiag    Diagnostic
+	remoteMinRx  time.Duration
+	remoteMinTx  time.Duration
+	remoteMult   uint8
+	pollActive   bool
+	lastReceived time.Time
+
+	rx, tx *net.UDPConn
+
+	alive int64 // unix nanoseconds of the last loop, read atomically
+
+	wg *sync.WaitGroup
+}
+
+// New returns a BFD session from local to peer, bound to interface ifi.
+func New(ctx context.Context, local, peer net.IP, ifi string, opts ...Option) (*Session, error) {
+	if (local.To4() == nil) != (peer.To4() == nil) {
+		return nil, fmt.Errorf("bfd: local %s and peer %s are of different families", local, peer)
+	}
+	s := &Session{
+		local:     local,
+		peer:      peer,
+		interFace: ifi,
+
+		downFunc: func() {},
+		upFunc:   func() {},
+		l:        log.Default(),
+
+		desiredMinTx:  300 * time.Millisecond,
+		requiredMinRx: 300 * time.Millisecond,
+		detectMult:    3,
+
+		state:       StateDown,
+		remoteState: StateDown,
+		localDiscr:  rand.Uint32() | 1, // must be non-zero
+		remoteMinRx: time.Microsecond,
+		wg:          &sync.WaitGroup{},
+	}
+	s.ctx, s.ctxCancel = context.WithCancel(ctx)
+
+	for _, option := range opts {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Up is used to add a callback that is run
+// when the session transitions into the Up state.
+func (s *Session) Up(upFunc func()) {
+	s.upFunc = upFunc
+}
+
+// Down is used to add a callback that is run
+// when the session transitions out of the Up state.
+func (s *Session) Down(downFunc func()) {
+	s.downFunc = downFunc
+}
+
+// Option is a functional argument to *Session
+type Option func(s *Session) error
+
+// MinTx is a functional Option to set
+// the desired minimum transmit interval.
+// Defaults to 300 miliseconds.
+func MinTx(t time.Duration) Option {
+	return func(s *Session) error {
+		if t < time.Microsecond {
+			return errors.New("bfd: minimum tx interval must be at least 1µs")
+		}
+		s.desiredMinTx = t
+		return nil
+	}
+}
+
+// MinRx is a functional Option to set
+// the required minimum receive interval.
+// Defaults to 300 miliseconds.
+func MinRx(t time.Duration) Option {
+	return func(s *Session) error {
+		s.requiredMinRx = t
+		return nil
+	}
+}
+
+// Multiplier is a functional Option to set
+// the detection time multiplier.
+// Defaults to 3.
+func Multiplier(m uint8) Option {
+	return func(s *Session) error {
+		if m == 0 {
+			return errors.New("bfd: multiplier must be non-zero")
+		}
+		s.detectMult = m
+		return nil
+	}
+}
+
+// Logger is a functional Option to set
+// a new logger for this session
+func Logger(l log.Logger) Option {
+	return func(s *Session) error {
+		s.l = l
+		return nil
+	}
+}
+
+// Run runs the session until it is stopped.
+func (s *Session) Run() error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	if err := s.listen(); err != nil {
+		return err
+	}
+	defer s.rx.Close()
+	defer s.tx.Close()
+
+	s.l.Debugf("bfd: starting session on %q from %s to %s", s.interFace, s.local, s.peer)
+	defer s.l.Debugf("bfd: ended session on %q from %s to %s", s.interFace, s.local, s.peer)
+
+	packets := make(chan packet)
+	go s.receive(packets)
+
+	txTimer := time.NewTimer(0)
+	defer txTimer.Stop()
+	// the detection timer is only armed once we receive packets
+	detectTimer := time.NewTimer(time.Hour)
+	detectTimer.Stop()
+	defer detectTimer.Stop()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	defer atomic.StoreInt64(&s.alive, 0)
+
+	for {
+		atomic.StoreInt64(&s.alive, time.Now().UnixNano())
+		select {
+		case <-s.ctx.Done():
+			// let our peer know we are going away, without
+			// running the down callback since we are stopped
+			s.state = StateAdminDown
+			s.localDiag = DiagAdministrativelyDown
+			s.send(false)
+			return nil
+		case p := <-packets:
+			s.handle(p)
+			if s.state == StateInit || s.state == StateUp {
+				if !detectTimer.Stop() {
+					select {
+					case <-detectTimer.C:
+					default:
+					}
+				}
+				detectTimer.Reset(s.detectionTime())
+			}
+		case <-detectTimer.C:
+			s.checkDetectionTime()
+		case <-txTimer.C:
+			s.send(false)
+			txTimer.Reset(s.txInterval())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Alive returns when the session last went through its loop,
+// or the zero time if it is not running (yet)
+func (s *Session) Alive() time.Time {
+	if alive := atomic.LoadInt64(&s.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
+func (s *Session) Stop() {
+	s.l.Debugf("bfd: stopping session on %q to %s", s.interFace, s.peer)
+	s.ctxCancel()
+	s.wg.Wait()
+}
+
+// handle processes a received control packet
+// (RFC 5880 section 6.8.6)
+func (s *Session) handle(p packet) {
+	if p.YourDiscriminator != 0 && p.YourDiscriminator != s.localDiscr {
+		return
+	}
+	// only a peer that has not heard from us yet
+	// may leave our discriminator out
+	if p.YourDiscriminator == 0 && p.State != StateDown && p.State != StateAdminDown {
+		return
+	}
+
+	s.lastReceived = time.Now()
+	s.remoteDiscr = p.MyDiscriminator
+	s.remoteState = p.State
+	s.remoteMinRx = p.RequiredMinRxInterval
+	s.remoteMinTx = p.DesiredMinTxInterval
+	s.remoteMult = p.DetectMult
+
+	if p.Final {
+		s.pollActive = false
+	}
+
+	if s.state == StateAdminDown {
+		return
+	}
+
+	if p.State == StateAdminDown {
+		if s.state != StateDown {
+			s.setState(StateDown, DiagNeighborSignaledSessionDown)
+		}
+	} else {
+		switch s.state {
+		case StateDown:
+			if p.State == StateDown {
+				s.setState(StateInit, DiagNone)
+			} else if p.State == StateInit {
+				s.setState(StateUp, DiagNone)
+			}
+		case StateInit:
+			if p.State == StateInit || p.State == StateUp {
+				s.setState(StateUp, DiagNone)
+			}
+		case StateUp:
+			if p.State == StateDown {
+				s.setState(StateDown, DiagNeighborSignaledSessionDown)
+			}
+		}
+	}
+
+	// a poll must be answered right away with a final
+	if p.Poll {
+		s.send(true)
+	}
+}
+
+// checkDetectionTime takes the session down when no control
+// packets were received within the detection time
+func (s *Session) checkDetectionTime() {
+	if s.state != StateInit && s.state != StateUp {
+		return
+	}
+	if time.Since(s.lastReceived) >= s.detectionTime() {
+		s.setState(StateDown, DiagControlDetectionTimeExpired)
+	}
+}
+
+func (s *Session) setState(state State, diag Diagnostic) {
+	if s.state == state {
+		return
+	}
+	old := s.state
+	s.state = state
+	s.localDiag = diag
+	s.l.Printf("bfd: session on %q to %s changed from %s to %s (%s)", s.interFace, s.peer, old, state, diag)
+
+	if state == StateUp {
+		// the transmit interval changes from the slow interval to the
+		// desired interval, which must be signalled with a poll sequence
+		if s.desiredMinTx != slowTxInterval {
+			s.pollActive = true
+		}
+		s.upFunc()
+		return
+	}
+	if old == StateUp {
+		s.remoteDiscr = 0
+		s.downFunc()
+	}
+	if state == StateDown {
+		s.remoteDiscr = 0
+	}
+}
+
+// detectionTime is the time without control packets
+// after which the session is declared down
+// (RFC 5880 section 6.8.4)
+func (s *Session) detectionTime() time.Duration {
+	interval := s.requiredMinRx
+	if s.remoteMinTx > interval {
+		interval = s.remoteMinTx
+	}
+	return time.Duration(s.remoteMult) * interval
+}
+
+// txInterval returns the jittered interval until the next
+// periodic control packet (RFC 5880 section 6.8.7)
+func (s *Session) txInterval() time.Duration {
+	interval := s.localMinTx()
+	if s.remoteMinRx > interval {
+		interval = s.remoteMinRx
+	}
+	// reduce the interval by a random 0 up to 25 percent
+	// or 10 up to 25 percent when the multiplier is 1
+	jitter := 75 + rand.Intn(26)
+	if s.detectMult == 1 {
+		jitter = 75 + rand.Intn(16)
+	}
+	return interval * time.Duration(jitter) / 100
+}
+
+// localMinTx is the desired minimum transmit interval
+// we advertise to our peer.
+func (s *Session) localMinTx() time.Duration {
+	if s.state != StateUp && s.desiredMinTx < slowTxInterval {
+		return slowTxInterval
+	}
+	return s.desiredMinTx
+}
+
+func (s *Session) send(final bool) {
+	// the remote system does not want to receive any packets
+	if s.remoteDiscr != 0 && s.remoteMinRx == 0 && !final {
+		return
+	}
+	p := &packet{
+		Diag:                  s.localDiag,
+		State:                 s.state,
+		Poll:                  s.pollActive && !final,
+		Final:                 final,
+		DetectMult:            s.detectMult,
+		MyDiscriminator:       s.localDiscr,
+		YourDiscriminator:     s.remoteDiscr,
+		DesiredMinTxInterval:  s.localMinTx(),
+		RequiredMinRxInterval: s.requiredMinRx,
+	}
+	b, _ := p.MarshalBinary()
+	if _, err := s.tx.WriteToUDP(b, &net.UDPAddr{IP: s.peer, Port: ControlPort, Zone: s.zone()}); err != nil {
+		s.l.Debugf("bfd: could not send control packet on %q to %s: %s", s.interFace, s.peer, err)
+	}
+}
+
+// receive reads control packets from the receive socket and
+// passes the valid ones from our peer to packets.
+func (s *Session) receive(packets chan<- packet) {
+	b := make([]byte, 128)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := s.rx.ReadMsgUDP(b, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.l.Debugf("bfd: receive error on %q: %s", s.interFace, err)
+			continue
+		}
+		if !src.IP.Equal(s.peer) {
+			continue
+		}
+		// single-hop packets must have been sent with a ttl
+		// of 255 to prevent spoofing from off-link
+		if receivedTTL(oob[:oobn]) != ttl {
+			s.l.Debugf("bfd: dropping packet from %s on %q with invalid ttl", src, s.interFace)
+			continue
+		}
+		var p packet
+		if err := p.UnmarshalBinary(b[:n]); err != nil {
+			s.l.Debugf("bfd: dropping packet from %s on %q: %s", src, s.interFace, err)
+			continue
+		}
+		select {
+		case packets <- p:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// listen opens the receive socket on the control port and
+// the transmit socket on a port from the source port range.
+func (s *Session) listen() error {
+	network := "udp4"
+	if s.local.To4() == nil {
+		network = "udp6"
+	}
+
+	lc := net.ListenConfig{Control: s.control}
+	rx, err := lc.ListenPacket(s.ctx, network, net.JoinHostPort(s.addr(), strconv.Itoa(ControlPort)))
+	if err != nil {
+		return fmt.Errorf("bfd: could not listen on %q: %w", s.interFace, err)
+	}
+	s.rx = rx.(*net.UDPConn)
+
+	// pick a random source port, retrying when it is already in use
+	for i := 0; i < 16; i++ {
+		port := sourcePortMin + rand.Intn(sourcePortMax-sourcePortMin+1)
+		tx, err := lc.ListenPacket(s.ctx, network, net.JoinHostPort(s.addr(), strconv.Itoa(port)))
+		if err == nil {
+			s.tx = tx.(*net.UDPConn)
+			return nil
+		}
+	}
+	s.rx.Close()
+	return fmt.Errorf("bfd: could not find a free source port on %q", s.interFace)
+}
+
+// control sets the socket options needed for single-hop sessions
+func (s *Session) control(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+			return
+		}
+		if serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, s.interFace); serr != nil {
+			return
+		}
+		if network == "udp4" {
+			if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl); serr != nil {
+				return
+			}
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+			return
+		}
+		if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl); serr != nil {
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (s *Session) addr() string {
+	if zone := s.zone(); zone != "" {
+		return s.local.String() + "%" + zone
+	}
+	return s.local.String()
+}
+
+// zone returns the interface as zone for link-local addresses
+func (s *Session) zone() string {
+	if s.local.To4() == nil && s.local.IsLinkLocalUnicast() {
+		return s.interFace
+	}
+	return ""
+}
+
+// receivedTTL returns the ttl or hop limit from the control
+// messages, or 0 if it was not present.
+func receivedTTL(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if len(msg.Data) < 4 {
+			continue
+		}
+		if (msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_TTL) ||
+			(msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_HOPLIMIT) {
+			return int(nlenc.Int32(msg.Data[:4]))
+		}
+	}
+	return 0
+}
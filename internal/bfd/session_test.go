@@ -0,0 +1,289 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bfd
+
+import (
+	"context"
+	"io"
+	stdlog "log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+// testSession returns a session that is not running, with the
+// up and down callbacks appended to events
+func testSession(t *testing.T, events *[]string) *Session {
+	t.Helper()
+	s, err := New(context.Background(), net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), "lo",
+		Logger(log.New(stdlog.New(io.Discard, "", 0))),
+		MinTx(100*time.Millisecond),
+		MinRx(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Up(func() { *events = append(*events, "up") })
+	s.Down(func() { *events = append(*events, "down") })
+	return s
+}
+
+func TestSessionHandle(t *testing.T) {
+	// rx is a received packet, with our discriminator
+	// in Your Discriminator unless noYour is set
+	type rx struct {
+		state  State
+		noYour bool
+		wrong  bool
+	}
+
+	tests := []struct {
+		name   string
+		start  State
+		rx     []rx
+		want   []State // the state after each packet
+		diag   Diagnostic
+		events []string
+	}{
+		{
+			name:   "three way handshake",
+			start:  StateDown,
+			rx:     []rx{{state: StateDown, noYour: true}, {state: StateUp}},
+			want:   []State{StateInit, StateUp},
+			events: []string{"up"},
+		},
+		{
+			name:   "peer in init",
+			start:  StateDown,
+			rx:     []rx{{state: StateInit}},
+			want:   []State{StateUp},
+			events: []string{"up"},
+		},
+		{
+			name:  "peer up while we are down",
+			start: StateDown,
+			rx:    []rx{{state: StateUp}},
+			want:  []State{StateDown},
+		},
+		{
+			name:   "peer goes down",
+			start:  StateUp,
+			rx:     []rx{{state: StateInit}, {state: StateDown, noYour: true}},
+			want:   []State{StateUp, StateDown},
+			diag:   DiagNeighborSignaledSessionDown,
+			events: []string{"down"},
+		},
+		{
+			name:   "peer goes admin down",
+			start:  StateUp,
+			rx:     []rx{{state: StateAdminDown, noYour: true}},
+			want:   []State{StateDown},
+			diag:   DiagNeighborSignaledSessionDown,
+			events: []string{"down"},
+		},
+		{
+			name:  "peer admin down while we are down",
+			start: StateDown,
+			rx:    []rx{{state: StateAdminDown}},
+			want:  []State{StateDown},
+		},
+		{
+			name:  "we are admin down",
+			start: StateAdminDown,
+			rx:    []rx{{state: StateDown, noYour: true}, {state: StateInit}, {state: StateUp}},
+			want:  []State{StateAdminDown, StateAdminDown, StateAdminDown},
+		},
+		{
+			name:  "init without our discriminator",
+			start: StateDown,
+			rx:    []rx{{state: StateInit, noYour: true}},
+			want:  []State{StateDown},
+		},
+		{
+			name:  "up without our discriminator",
+			start: StateUp,
+			rx:    []rx{{state: StateUp, noYour: true}, {state: StateDown}},
+			want:  []State{StateUp, StateDown},
+			diag:  DiagNeighborSignaledSessionDown,
+			// only the second packet is accepted
+			events: []string{"down"},
+		},
+		{
+			name:  "another discriminator",
+			start: StateDown,
+			rx:    []rx{{state: StateInit, wrong: true}, {state: StateDown, wrong: true}},
+			want:  []State{StateDown, StateDown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			s := testSession(t, &events)
+			s.state = tt.start
+			if tt.start == StateUp {
+				s.remoteDiscr = 42
+			}
+
+			for i, r := range tt.rx {
+				p := packet{State: r.state, DetectMult: 3, MyDiscriminator: 42, YourDiscriminator: s.localDiscr}
+				if r.noYour {
+					p.YourDiscriminator = 0
+				}
+				if r.wrong {
+					p.YourDiscriminator = s.localDiscr + 1
+				}
+				s.handle(p)
+				if s.state != tt.want[i] {
+					t.Fatalf("packet %d (%s): state = %s, want %s", i, r.state, s.state, tt.want[i])
+				}
+			}
+			if s.localDiag != tt.diag {
+				t.Fatalf("diagnostic = %s, want %s", s.localDiag, tt.diag)
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Fatalf("callbacks = %v, want %v", events, tt.events)
+			}
+		})
+	}
+}
+
+func TestSessionPollFinal(t *testing.T) {
+	var events []string
+	s := testSession(t, &events)
+
+	// the peer of the session listens on the control port
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: s.peer, Port: ControlPort})
+	if err != nil {
+		t.Skipf("cannot listen on the control port: %v", err)
+	}
+	defer peer.Close()
+	s.tx, err = net.ListenUDP("udp4", &net.UDPAddr{IP: s.local})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.tx.Close()
+
+	read := func() packet {
+		t.Helper()
+		b := make([]byte, 128)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var p packet
+		if err := p.UnmarshalBinary(b[:n]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return p
+	}
+
+	// going up changes the transmit interval from the slow
+	// interval, which starts a poll sequence
+	s.handle(packet{State: StateInit, DetectMult: 3, MyDiscriminator: 42, YourDiscriminator: s.localDiscr,
+		DesiredMinTxInterval: 100 * time.Millisecond, RequiredMinRxInterval: 100 * time.Millisecond})
+	if s.state != StateUp || !s.pollActive {
+		t.Fatalf("state = %s, poll = %v, want Up with a poll sequence", s.state, s.pollActive)
+	}
+	s.send(false)
+	if p := read(); !p.Poll || p.Final || p.DesiredMinTxInterval != 100*time.Millisecond {
+		t.Fatalf("periodic packet = %+v, want a poll with the desired interval", p)
+	}
+
+	// the peer polls us, which we answer with a final
+	// right away that does not carry our own poll
+	s.handle(packet{State: StateUp, Poll: true, DetectMult: 3, MyDiscriminator: 42, YourDiscriminator: s.localDiscr,
+		RequiredMinRxInterval: 100 * time.Millisecond})
+	if p := read(); p.Poll || !p.Final || p.YourDiscriminator != 42 {
+		t.Fatalf("answer to poll = %+v, want a final", p)
+	}
+	if !s.pollActive {
+		t.Fatal("poll sequence ended by a poll from the peer")
+	}
+
+	// the final of the peer ends our poll sequence
+	s.handle(packet{State: StateUp, Final: true, DetectMult: 3, MyDiscriminator: 42, YourDiscriminator: s.localDiscr,
+		RequiredMinRxInterval: 100 * time.Millisecond})
+	if s.pollActive {
+		t.Fatal("poll sequence still active after a final")
+	}
+	s.send(false)
+	if p := read(); p.Poll || p.Final {
+		t.Fatalf("periodic packet = %+v, want neither poll nor final", p)
+	}
+}
+
+func TestSessionDetection(t *testing.T) {
+	var events []string
+	s := testSession(t, &events)
+
+	s.handle(packet{State: StateInit, DetectMult: 5, MyDiscriminator: 42, YourDiscriminator: s.localDiscr,
+		DesiredMinTxInterval: 200 * time.Millisecond, RequiredMinRxInterval: 100 * time.Millisecond})
+	if s.state != StateUp {
+		t.Fatalf("state = %s, want Up", s.state)
+	}
+
+	// the multiplier of the peer times the slowest of the interval
+	// the peer sends at and the interval we want to receive at
+	if got, want := s.detectionTime(), time.Second; got != want {
+		t.Fatalf("detectionTime() = %s, want %s", got, want)
+	}
+
+	s.checkDetectionTime()
+	if s.state != StateUp {
+		t.Fatalf("state = %s within the detection time, want Up", s.state)
+	}
+
+	s.lastReceived = time.Now().Add(-time.Second)
+	s.checkDetectionTime()
+	if s.state != StateDown || s.localDiag != DiagControlDetectionTimeExpired {
+		t.Fatalf("state = %s (%s), want Down (%s)", s.state, s.localDiag, DiagControlDetectionTimeExpired)
+	}
+	if !reflect.DeepEqual(events, []string{"up", "down"}) {
+		t.Fatalf("callbacks = %v, want [up down]", events)
+	}
+}
+
+func TestSessionTxInterval(t *testing.T) {
+	tests := []struct {
+		name        string
+		state       State
+		mult        uint8
+		remoteMinRx time.Duration
+		min, max    time.Duration
+	}{
+		{name: "slow while down", state: StateDown, mult: 3, remoteMinRx: time.Microsecond, min: 750 * time.Millisecond, max: time.Second},
+		{name: "desired while up", state: StateUp, mult: 3, remoteMinRx: time.Microsecond, min: 75 * time.Millisecond, max: 100 * time.Millisecond},
+		{name: "remote minimum", state: StateUp, mult: 3, remoteMinRx: 400 * time.Millisecond, min: 300 * time.Millisecond, max: 400 * time.Millisecond},
+		{name: "multiplier of one", state: StateUp, mult: 1, remoteMinRx: time.Microsecond, min: 75 * time.Millisecond, max: 90 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			s := testSession(t, &events)
+			s.state = tt.state
+			s.detectMult = tt.mult
+			s.remoteMinRx = tt.remoteMinRx
+			for i := 0; i < 100; i++ {
+				if got := s.txInterval(); got < tt.min || got > tt.max {
+					t.Fatalf("txInterval() = %s, want between %s and %s", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
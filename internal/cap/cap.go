@@ -13,21 +13,52 @@
 package cap
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/syndtr/gocapability/capability"
 )
 
-func HasCapabilities() bool {
+var (
+	NetAdmin = capability.CAP_NET_ADMIN
+	NetRaw   = capability.CAP_NET_RAW
+)
+
+// Requirement is a capability that is needed by a feature.
+type Requirement struct {
+	Capability capability.Cap
+	Feature    string
+}
+
+func (r Requirement) String() string {
+	return fmt.Sprintf("CAP_%s (needed for %s)", r.Name(), r.Feature)
+}
+
+// Name returns the name of the capability, without the CAP_ prefix.
+func (r Requirement) Name() string {
+	return capNames[r.Capability]
+}
+
+var capNames = map[capability.Cap]string{
+	capability.CAP_NET_ADMIN: "NET_ADMIN",
+	capability.CAP_NET_RAW:   "NET_RAW",
+}
+
+// Missing returns the requirements for which the capability
+// is not in the permitted set of this process.
+func Missing(reqs ...Requirement) ([]Requirement, error) {
 	caps, err := capability.NewPid2(0)
 	if err != nil {
-		log.Fatalf("Could not detemine the proper capabilities: %s", err)
+		return nil, fmt.Errorf("could not determine the capabilities: %w", err)
 	}
 	if err := caps.Load(); err != nil {
-		log.Fatalf("Could not detemine the proper capabilities: %s", err)
+		return nil, fmt.Errorf("could not determine the capabilities: %w", err)
 	}
-	if !caps.Get(capability.PERMITTED, capability.CAP_NET_ADMIN) {
-		return false
+
+	var missing []Requirement
+	for _, req := range reqs {
+		if !caps.Get(capability.PERMITTED, req.Capability) {
+			missing = append(missing, req)
+		}
 	}
-	return caps.Get(capability.PERMITTED, capability.CAP_NET_RAW)
+	return missing, nil
 }
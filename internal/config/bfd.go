@@ -0,0 +1,75 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DEF_BFDMINTX      = 300 * time.Millisecond
+	DEF_BFDMINRX      = 300 * time.Millisecond
+	DEF_BFDMULTIPLIER = 3
+	BFDMULTIPLIER_MAX = 255
+)
+
+// BFD provides configuration for a single-hop BFD session
+// with a peer on the interface.
+type BFD struct {
+	Peer   *net.IP
+	Family uint8
+
+	MinTx      time.Duration
+	MinRx      time.Duration
+	Multiplier uint8
+}
+
+func parseBFD(cfg cfgBFD) (*BFD, error) {
+	var err error
+	ip := net.ParseIP(cfg.Peer)
+	if ip == nil {
+		return nil, fmt.Errorf("bfd peer ip address could not be parsed: %q", cfg.Peer)
+	}
+
+	b := &BFD{
+		Peer:       &ip,
+		Family:     unix.AF_INET,
+		Multiplier: DEF_BFDMULTIPLIER,
+	}
+	if ip.To4() == nil {
+		b.Family = unix.AF_INET6
+	}
+
+	if cfg.Multiplier != nil {
+		if *cfg.Multiplier < 1 || *cfg.Multiplier > BFDMULTIPLIER_MAX {
+			return nil, fmt.Errorf("multiplier is incorrect: %d, should be between %d and %d", *cfg.Multiplier, 1, BFDMULTIPLIER_MAX)
+		}
+		b.Multiplier = uint8(*cfg.Multiplier)
+	}
+
+	if b.MinTx, err = parseDuration(cfg.MinTx, DEF_BFDMINTX); err != nil {
+		return nil, err
+	}
+	if b.MinRx, err = parseDuration(cfg.MinRx, DEF_BFDMINRX); err != nil {
+		return nil, err
+	}
+	if b.MinTx < time.Microsecond {
+		return nil, fmt.Errorf("min_tx is incorrect: %s, should be at least 1µs", b.MinTx)
+	}
+
+	return b, nil
+}
@@ -16,36 +16,152 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/jsimonetti/hodos/internal/log"
 	"github.com/pelletier/go-toml"
 )
 
 const (
 	DEF_MINIMUMUP = 1
+	DEF_WEIGHT    = 1
+	WEIGHT_MAX    = 1000
 	BURSTSIZE_MIN = 1
 	BURSTSIZE_MAX = 5
 	TABLE_MAX     = 4294967295
+	METRIC_MAX    = 32764
+	MARK_MAX      = 4294967295
+	SIZE_MIN      = 8
+	SIZE_MAX      = 65000
+	TTL_MAX       = 255
+	DSCP_MAX      = 63
+	PMTU_MIN      = 68
+	PMTU_MAX      = 65535
+	SCORE_MAX     = 100
+	RETRANS_MAX   = 100
+
+	NFTABLESNAME_MAX = 255
 
 	DEF_BURSTSIZE     int           = 3
 	DEF_BURSTINTERVAL time.Duration = 15 * time.Second
 	DEF_ICMPINTERVAL                = 2 * time.Second
 	DEF_ICMPTIMEOUT                 = 250 * time.Millisecond
+
+	DEF_STATSINTERVAL time.Duration = 10 * time.Second
+
+	DEF_ACTIONTIMEOUT time.Duration = 30 * time.Second
+	ACTIONTIMEOUT_MAX               = time.Hour
+
+	DEF_PASSIVEINTERVAL       time.Duration = 10 * time.Second
+	DEF_PASSIVEMAXRETRANSMITS float64       = 5
+	DEF_PASSIVEMINIMUMSCORE   int           = 50
+
+	ICMPMODE_AUTO         = "auto"
+	ICMPMODE_PRIVILEGED   = "privileged"
+	ICMPMODE_UNPRIVILEGED = "unprivileged"
+
+	TRACEROUTE_ICMP = "icmp"
+	TRACEROUTE_UDP  = "udp"
+
+	DEF_NFTABLESTABLE = "hodos"
+	DEF_STATEFILE     = "/var/lib/hodos/state.json"
+	DEF_LISTEN        = "127.0.0.1:6060"
+
+	FAILBACK_IMMEDIATE      = "immediate"
+	FAILBACK_DELAY          = "delay"
+	FAILBACK_MANUAL         = "manual"
+	FAILBACK_NEWCONNECTIONS = "new-connections-only"
+
+	DEF_DAMPENINGPENALTY  = 1000
+	DEF_DAMPENINGSUPPRESS = 2000
+	DEF_DAMPENINGREUSE    = 750
+	DAMPENING_MAX         = 100000
+
+	DEF_DATACAPRESETDAY               = 1
+	DEF_DATACAPINTERVAL time.Duration = time.Minute
+	DEF_DATACAPMETRIC                 = METRIC_MAX
+	RESETDAY_MAX                      = 31
+
+	DATACAP_DEMOTE    = "demote"
+	DATACAP_ADMINDOWN = "admin_down"
+	DATACAP_WARN      = "warn"
+
+	LOGFORMAT_TEXT   = log.FormatText
+	LOGFORMAT_JSON   = log.FormatJSON
+	LOGFORMAT_LOGFMT = log.FormatLogfmt
+
+	LOGOUTPUT_STDERR   = "stderr"
+	LOGOUTPUT_JOURNALD = "journald"
+	LOGOUTPUT_SYSLOG   = "syslog"
+
+	DEF_JOURNALDSOCKET = log.JournalSocket
+	DEF_SYSLOGADDRESS  = "unix:///dev/log"
+
+	ADMIN_DOWN = "admin_down"
+	ADMIN_UP   = "admin_up"
+	FORCE_UP   = "force_up"
+
+	EVENT_FAMILY = "family"
+	EVENT_HOST   = "host"
+	EVENT_ADMIN  = "admin"
+
+	DEF_WEBHOOKTIMEOUT time.Duration = 5 * time.Second
+	DEF_WEBHOOKBACKOFF time.Duration = time.Second
+	DEF_WEBHOOKRETRIES               = 5
+	DEF_WEBHOOKQUEUE                 = 100
+	RETRIES_MAX                      = 100
+	QUEUE_MAX                        = 10000
+
+	DEF_MQTTTOPICPREFIX               = "hodos"
+	DEF_MQTTKEEPALIVE   time.Duration = 30 * time.Second
+	DEF_MQTTQUEUE                     = 100
+	KEEPALIVE_MAX                     = 65535 * time.Second
 )
 
+// DEF_DATACAPWARNINGS are the percentages of the data cap to warn at
+var DEF_DATACAPWARNINGS = []int{80, 90}
+
+// LOG_COMPONENTS are the components that log_levels sets the level of
+var LOG_COMPONENTS = []string{"server", "linkstate", "neighbor", "routesync", "icmp", "pmtu", "traceroute", "bfd", "sockdiag", "webhook", "mqtt"}
+
 // cfgFile is the top-level of the configuration
 type cfgFile struct {
 	Debug bool `toml:"debug"` // wether to do tracing or not
 
-	BurstInterval *string `toml:"burst_interval,omit_empty"` // global default ping interval (default 5s)
-	BurstSize     *int    `toml:"burst_size,omit_empty"`     // number of pings to send (default 1)
-	ICMPInterval  *string `toml:"icmp_interval,omit_empty"`  // global default ping interval (default 1s)
-	ICMPTimeout   *string `toml:"icmp_timeout,omit_empty"`   // global default ping timeout (default 200ms)
+	LogFormat *string           `toml:"log_format,omit_empty"` // text, json or logfmt (default text)
+	LogLevel  *string           `toml:"log_level,omit_empty"`  // debug, info, warn or error (default info, debug with debug)
+	LogLevels map[string]string `toml:"log_levels,omit_empty"` // level per component, such as { icmp = "warn" }
+
+	LogOutput      *string `toml:"log_output,omit_empty"`      // stderr, journald or syslog (default stderr)
+	JournaldSocket *string `toml:"journald_socket,omit_empty"` // socket of the journal (default /run/systemd/journal/socket)
+	SyslogAddress  *string `toml:"syslog_address,omit_empty"`  // unix:///path or udp://host:port of the syslog daemon (default unix:///dev/log)
+
+	BurstInterval *string `toml:"burst_interval,omit_empty"` // interval between the bursts of pings (default 15s)
+	BurstSize     *int    `toml:"burst_size,omit_empty"`     // number of pings in a burst (default 3)
+	ICMPInterval  *string `toml:"icmp_interval,omit_empty"`  // interval between the pings of a burst (default 2s)
+	ICMPTimeout   *string `toml:"icmp_timeout,omit_empty"`   // ping timeout, a burst waits burst_size * (icmp_timeout + icmp_interval) for its replies (default 250ms)
+	ICMPMode      *string `toml:"icmp_mode,omit_empty"`      // auto, privileged (raw sockets) or unprivileged (datagram sockets) (default auto)
+
+	NFTables      bool    `toml:"nftables"`                  // manage an nftables table with the masquerade and sticky rules of the interfaces (default: false)
+	NFTablesTable *string `toml:"nftables_table,omit_empty"` // name of the inet table to manage (default hodos)
+
+	StatsInterval *string `toml:"stats_interval,omit_empty"` // how often to sample the traffic counters of the interfaces, 0 disables it (default 10s)
 
-	UpAction   string `toml:"up_action"`   // command to run when an interface goes up (also run at startup)
-	DownAction string `toml:"down_action"` // command to run when an interface goes down
+	StateFile *string `toml:"state_file,omit_empty"` // file to keep state across restarts in, empty disables it (default /var/lib/hodos/state.json)
+
+	Listen        *string `toml:"listen,omit_empty"`         // host:port or unix:///path of the control api, empty disables it (default 127.0.0.1:6060)
+	MetricsListen *string `toml:"metrics_listen,omit_empty"` // host:port or unix:///path of the read-only status and metrics (default: disabled)
+
+	UpAction      string  `toml:"up_action"`                 // command to run when an interface goes up (also run at startup)
+	DownAction    string  `toml:"down_action"`               // command to run when an interface goes down
+	ActionTimeout *string `toml:"action_timeout,omit_empty"` // time an action may run before it is killed (default 30s)
 
 	Interfaces []cfgInterface `toml:"interfaces"`
+	Schedules  []cfgSchedule  `toml:"schedules,omitempty"`
+	Webhooks   []cfgWebhook   `toml:"webhooks,omitempty"`
+	MQTT       *cfgMQTT       `toml:"mqtt,omit_empty"`
 }
 
 type cfgInterface struct {
@@ -56,27 +172,121 @@ type cfgInterface struct {
 	Table  *int `toml:"table,omit_empty"`  // route table number for this interface
 	Metric *int `toml:"metric,omit_empty"` // route table number for this interface
 
+	ProbeMark *int `toml:"probe_mark,omit_empty"` // fwmark to set on probes, routed through table by a single rule (default: unset)
+
 	UpAction   *string `toml:"up_action,omit_empty"`   // command to run when interface goes up (also run at startup)
 	DownAction *string `toml:"down_action,omit_empty"` // command to run when interface goes down
 
-	BurstInterval *string `toml:"burst_interval"` // global default ping interval (default 5s)
-	BurstSize     *int    `toml:"burst_size"`     // number of pings to send (default 1)
-	ICMPInterval  *string `toml:"icmp_interval"`  // global default ping interval (default 1s)
-	ICMPTimeout   *string `toml:"icmp_timeout"`   // global default ping timeout (default 200ms)
+	Failback *string `toml:"failback,omit_empty"`  // immediate, delay=<duration>, manual or new-connections-only (default immediate)
+	UpDelay  *string `toml:"up_delay,omit_empty"`  // time a family has to stay available before it is taken into use (default: 0)
+	HoldDown *string `toml:"hold_down,omit_empty"` // minimum time a family stays down after it failed (default: 0)
+
+	DampeningHalfLife    *string `toml:"dampening_half_life,omit_empty"`    // half-life of the flap penalty, enables dampening (default: disabled)
+	DampeningPenalty     *int    `toml:"dampening_penalty,omit_empty"`      // penalty added when the family fails (default 1000)
+	DampeningSuppress    *int    `toml:"dampening_suppress,omit_empty"`     // penalty above which the family is suppressed (default 2000)
+	DampeningReuse       *int    `toml:"dampening_reuse,omit_empty"`        // penalty below which a suppressed family is used again (default 750)
+	DampeningMaxSuppress *string `toml:"dampening_max_suppress,omit_empty"` // maximum time a family is suppressed (default 4 half-lives)
+
+	BurstInterval *string `toml:"burst_interval"` // interval between the bursts of pings (default 15s)
+	BurstSize     *int    `toml:"burst_size"`     // number of pings in a burst (default 3)
+	ICMPInterval  *string `toml:"icmp_interval"`  // interval between the pings of a burst (default 2s)
+	ICMPTimeout   *string `toml:"icmp_timeout"`   // ping timeout, a burst waits burst_size * (icmp_timeout + icmp_interval) for its replies (default 250ms)
 	MinimumUp     *int    `toml:"minimum_up"`     // minimum amount of hosts to be up for this interface to be considered up (default: 1)
+	MinimumWeight *int    `toml:"minimum_weight"` // minimum total weight of the hosts that are up, instead of minimum_up
+
+	NeighborMonitor bool `toml:"neighbor_monitor"` // watch the kernel neighbor entries of the gateways (default: false)
+	AutoGateway     bool `toml:"auto_gateway"`     // probe the gateway of the interface (default: false)
+	ConntrackFlush  bool `toml:"conntrack_flush"`  // delete the conntrack entries of the interface addresses when it goes down (default: false)
+	Masquerade      bool `toml:"masquerade"`       // masquerade the connections leaving through the interface, needs nftables (default: false)
+	Sticky          bool `toml:"sticky"`           // keep connections on the interface they started on with probe_mark as connmark, needs nftables (default: false)
+
+	PMTUInterval *string `toml:"pmtu_interval,omit_empty"` // how often to discover the path mtu to each host (default: disabled)
+	PMTUMinimum  *int    `toml:"pmtu_minimum,omit_empty"`  // path mtu below which the path is considered broken
+	PMTUDegrade  bool    `toml:"pmtu_degrade"`             // hold the family down while a path mtu is below pmtu_minimum (default: false)
+	PMTUAction   *string `toml:"pmtu_action,omit_empty"`   // command to run when a path mtu drops below pmtu_minimum
+
+	TracerouteInterval   *string `toml:"traceroute_interval,omit_empty"` // how often to trace the path to each host (default: disabled)
+	TracerouteOnFailover bool    `toml:"traceroute_on_failover"`         // trace the path to each host when the family goes down (default: false)
+	TracerouteMethod     *string `toml:"traceroute_method,omit_empty"`   // icmp or udp (default: icmp)
+	TracerouteAction     *string `toml:"traceroute_action,omit_empty"`   // command to run when a path changed or died
+
+	PassiveMonitor        bool     `toml:"passive_monitor"`                    // score the tcp connections on the interface (default: false)
+	PassiveInterval       *string  `toml:"passive_interval,omit_empty"`        // how often to sample the tcp connections (default 10s)
+	PassiveMaxRetransmits *float64 `toml:"passive_max_retransmits,omit_empty"` // percentage of retransmitted segments that halves the score (default 5)
+	PassiveMaxRTT         *string  `toml:"passive_max_rtt,omit_empty"`         // average round trip time that halves the score (default: not scored)
+	PassiveMinimumScore   *int     `toml:"passive_minimum_score,omit_empty"`   // score below which the interface is considered down (default 50)
+
+	DataCap         *string `toml:"data_cap,omit_empty"`           // bytes per billing period, such as 50GB or 20GiB (default: disabled)
+	DataCapResetDay *int    `toml:"data_cap_reset_day,omit_empty"` // day of the month the billing period starts, the last day in shorter months (default 1)
+	DataCapPolicy   *string `toml:"data_cap_policy,omit_empty"`    // demote, admin_down or warn when the data cap is reached (default demote)
+	DataCapMetric   *int    `toml:"data_cap_metric,omit_empty"`    // metric to move the routes of a demoted interface to, needs table (default 32764)
+	DataCapWarnings []int   `toml:"data_cap_warnings,omit_empty"`  // percentages of the data cap to warn at (default [80, 90])
+	DataCapInterval *string `toml:"data_cap_interval,omit_empty"`  // how often to read the byte counters of the interface (default 1m)
+	DataCapAction   *string `toml:"data_cap_action,omit_empty"`    // command to run at a warning, when the data cap is reached and when it resets
 
 	Hosts []cfgHost `toml:"hosts,omitempty"`
+	BFD   []cfgBFD  `toml:"bfd,omitempty"`
+}
+
+type cfgSchedule struct {
+	Name      string `toml:"name"`      // name of the schedule, as seen in the logs and status
+	Cron      string `toml:"cron"`      // minute hour day-of-month month day-of-week, in local time
+	Interface string `toml:"interface"` // interface to change
+
+	Metric        *int    `toml:"metric,omit_empty"`         // metric to move the routes of the interface to, needs table
+	MinimumWeight *int    `toml:"minimum_weight,omit_empty"` // minimum weight of the hosts that are up to use, the weights of the hosts are not scheduled
+	Admin         *string `toml:"admin,omit_empty"`          // admin state to set: admin_down, admin_up or force_up
+}
+
+type cfgWebhook struct {
+	URL    string   `toml:"url"`              // http or https url to post the events to
+	Secret string   `toml:"secret"`           // secret to sign the payloads with in the X-Hodos-Signature header (default: unsigned)
+	Events []string `toml:"events,omitempty"` // events to post: family, host and admin (default: all)
+
+	Timeout   *string `toml:"timeout,omit_empty"`    // timeout of a single post (default 5s)
+	Retries   *int    `toml:"retries,omit_empty"`    // how often to retry a failed post (default 5)
+	Backoff   *string `toml:"backoff,omit_empty"`    // time before the first retry, doubling every retry up to 1m (default 1s)
+	QueueSize *int    `toml:"queue_size,omit_empty"` // how many events to queue for a slow endpoint before dropping them (default 100)
+}
+
+type cfgMQTT struct {
+	Broker      string  `toml:"broker"`                  // tcp://host:port, or ssl://host:port for tls
+	ClientID    *string `toml:"client_id,omit_empty"`    // client identifier (default hodos-<hostname>)
+	Username    string  `toml:"username"`                // user name to authenticate with (default: none)
+	Password    string  `toml:"password"`                // password to authenticate with (default: none)
+	TopicPrefix *string `toml:"topic_prefix,omit_empty"` // prefix of the topics (default hodos)
+	Commands    bool    `toml:"commands"`                // subscribe to <prefix>/<interface>/admin/set to set the admin state (default: false)
+
+	KeepAlive *string `toml:"keep_alive,omit_empty"` // interval of the pings to the broker (default 30s)
+	QueueSize *int    `toml:"queue_size,omit_empty"` // how many messages to queue while the broker is unreachable (default 100)
 }
 
 type cfgHost struct {
-	Name  string `toml:"name"`
-	Host  string `toml:"host"`  // ip to use for pinging
-	Debug bool   `toml:"debug"` // enable tracing for this host
-
-	BurstInterval *string `toml:"burst_interval,omit_empty"` // global default ping interval (default 5s)
-	BurstSize     *int    `toml:"burst_size,omit_empty"`     // number of pings to send (default 1)
-	ICMPInterval  *string `toml:"icmp_interval,omit_empty"`  // global default ping interval (default 1s)
-	ICMPTimeout   *string `toml:"icmp_timeout,omit_empty"`   // global default ping timeout (default 200ms)
+	Name   string `toml:"name"`
+	Host   string `toml:"host"`   // ip, hostname or "gateway" to use for pinging
+	Debug  bool   `toml:"debug"`  // enable tracing for this host
+	Weight *int   `toml:"weight"` // weight of this host in the quorum (default: 1)
+
+	Family              *string  `toml:"family,omit_empty"`     // families to resolve a hostname for: ipv4, ipv6 or any (default any)
+	Resolvers           []string `toml:"resolvers,omit_empty"`  // nameservers to resolve a hostname with (default from resolv.conf)
+	ResolveViaInterface bool     `toml:"resolve_via_interface"` // send the queries for a hostname through the monitored interface
+
+	Size         *int `toml:"size,omit_empty"` // payload size of the probes in bytes (default 8)
+	TTL          *int `toml:"ttl,omit_empty"`  // ttl or hop limit of the probes (default from the system)
+	DSCP         *int `toml:"dscp,omit_empty"` // dscp of the probes (default 0)
+	DontFragment bool `toml:"dont_fragment"`   // set the don't fragment bit on the probes (default false)
+
+	BurstInterval *string `toml:"burst_interval,omit_empty"` // interval between the bursts of pings (default 15s)
+	BurstSize     *int    `toml:"burst_size,omit_empty"`     // number of pings in a burst (default 3)
+	ICMPInterval  *string `toml:"icmp_interval,omit_empty"`  // interval between the pings of a burst (default 2s)
+	ICMPTimeout   *string `toml:"icmp_timeout,omit_empty"`   // ping timeout, a burst waits burst_size * (icmp_timeout + icmp_interval) for its replies (default 250ms)
+}
+
+type cfgBFD struct {
+	Peer       string  `toml:"peer"`                  // ip of the directly connected bfd peer
+	MinTx      *string `toml:"min_tx,omit_empty"`     // desired minimum transmit interval (default 300ms)
+	MinRx      *string `toml:"min_rx,omit_empty"`     // required minimum receive interval (default 300ms)
+	Multiplier *int    `toml:"multiplier,omit_empty"` // detection time multiplier (default 3)
 }
 
 func Parse(r io.Reader) (*Config, error) {
@@ -98,6 +308,10 @@ func Parse(r io.Reader) (*Config, error) {
 		DownAction: cfg.DownAction,
 	}
 
+	if err := parseLogging(cfg, c); err != nil {
+		return nil, err
+	}
+
 	c.BurstSize = DEF_BURSTSIZE
 	if cfg.BurstSize != nil {
 		if *cfg.BurstSize < BURSTSIZE_MIN || *cfg.BurstSize > BURSTSIZE_MAX {
@@ -116,9 +330,61 @@ func Parse(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	c.ICMPMode = ICMPMODE_AUTO
+	if cfg.ICMPMode != nil {
+		switch *cfg.ICMPMode {
+		case ICMPMODE_AUTO, ICMPMODE_PRIVILEGED, ICMPMODE_UNPRIVILEGED:
+			c.ICMPMode = *cfg.ICMPMode
+		default:
+			return nil, fmt.Errorf("icmp_mode is incorrect: %q, should be one of %s, %s or %s", *cfg.ICMPMode, ICMPMODE_AUTO, ICMPMODE_PRIVILEGED, ICMPMODE_UNPRIVILEGED)
+		}
+	}
+
+	c.NFTables = cfg.NFTables
+	c.NFTablesTable = DEF_NFTABLESTABLE
+	if cfg.NFTablesTable != nil {
+		if *cfg.NFTablesTable == "" || len(*cfg.NFTablesTable) > NFTABLESNAME_MAX {
+			return nil, fmt.Errorf("nftables_table is incorrect: %q, should be between %d and %d characters", *cfg.NFTablesTable, 1, NFTABLESNAME_MAX)
+		}
+		c.NFTablesTable = *cfg.NFTablesTable
+	}
+
+	if c.StatsInterval, err = parseDuration(cfg.StatsInterval, DEF_STATSINTERVAL); err != nil {
+		return nil, err
+	}
+	if c.StatsInterval < 0 {
+		return nil, fmt.Errorf("stats_interval is incorrect: %s, should not be negative", c.StatsInterval)
+	}
+
+	if c.ActionTimeout, err = parseDuration(cfg.ActionTimeout, DEF_ACTIONTIMEOUT); err != nil {
+		return nil, err
+	}
+	if c.ActionTimeout < time.Second || c.ActionTimeout > ACTIONTIMEOUT_MAX {
+		return nil, fmt.Errorf("action_timeout is incorrect: %s, should be between %s and %s", c.ActionTimeout, time.Second, ACTIONTIMEOUT_MAX)
+	}
+
+	c.StateFile = DEF_STATEFILE
+	if cfg.StateFile != nil {
+		c.StateFile = *cfg.StateFile
+	}
+
+	listen := DEF_LISTEN
+	if cfg.Listen != nil {
+		listen = *cfg.Listen
+	}
+	if c.ListenNetwork, c.ListenAddress, err = parseListen("listen", listen); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsListen != nil {
+		if c.MetricsListenNetwork, c.MetricsListenAddress, err = parseListen("metrics_listen", *cfg.MetricsListen); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check that each interface is unique.
 	// TODO(jsi): add check for unique tables
 	seen := make(map[string]bool)
+	seenMarks := make(map[uint32]string)
 	for i, iface := range cfg.Interfaces {
 		ifi, err := parseInterface(iface, c)
 		if err != nil {
@@ -131,24 +397,191 @@ func Parse(r io.Reader) (*Config, error) {
 		}
 		seen[ifi.Name] = true
 
+		if ifi.ProbeMark != 0 {
+			if other, ok := seenMarks[ifi.ProbeMark]; ok {
+				return nil, fmt.Errorf("interface %d: probe_mark %d is already used by %q", i, ifi.ProbeMark, other)
+			}
+			seenMarks[ifi.ProbeMark] = ifi.Name
+		}
+
 		c.Interfaces = append(c.Interfaces, *ifi)
 	}
 
+	// established connections are pinned to the other interfaces
+	// by the mark that routes them through the table of that interface
+	for i, ifi := range c.Interfaces {
+		if ifi.Failback != FAILBACK_NEWCONNECTIONS {
+			continue
+		}
+		for _, other := range c.Interfaces {
+			if other.Name != ifi.Name && (other.ProbeMark == 0 || other.Table == 0) {
+				return nil, fmt.Errorf("interface %d: failback is incorrect: %s needs probe_mark and table on %q", i, FAILBACK_NEWCONNECTIONS, other.Name)
+			}
+		}
+	}
+
+	seenSchedules := make(map[string]bool)
+	for i, sched := range cfg.Schedules {
+		schedule, err := parseSchedule(sched, c)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %v", i, err)
+		}
+
+		if _, ok := seenSchedules[schedule.Name]; ok {
+			return nil, fmt.Errorf("schedule %d: %q cannot appear multiple times in configuration", i, schedule.Name)
+		}
+		seenSchedules[schedule.Name] = true
+
+		c.Schedules = append(c.Schedules, *schedule)
+	}
+
+	for i, hook := range cfg.Webhooks {
+		webhook, err := parseWebhook(hook)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d: %v", i, err)
+		}
+		c.Webhooks = append(c.Webhooks, *webhook)
+	}
+
+	if cfg.MQTT != nil {
+		if c.MQTT, err = parseMQTT(*cfg.MQTT); err != nil {
+			return nil, fmt.Errorf("mqtt: %v", err)
+		}
+	}
+
 	return c, nil
 }
 
 type Config struct {
 	Debug bool
 
+	LogFormat string
+	LogLevel  log.Level
+	LogLevels map[string]log.Level
+
+	LogOutput      string
+	JournaldSocket string
+	SyslogNetwork  string
+	SyslogAddress  string
+
 	BurstInterval time.Duration
 	BurstSize     int
 	ICMPInterval  time.Duration
 	ICMPTimeout   time.Duration
+	ICMPMode      string
+
+	NFTables      bool
+	NFTablesTable string
 
-	UpAction   string
-	DownAction string
+	StatsInterval time.Duration
+
+	StateFile string
+
+	ListenNetwork        string
+	ListenAddress        string
+	MetricsListenNetwork string
+	MetricsListenAddress string
+
+	UpAction      string
+	DownAction    string
+	ActionTimeout time.Duration
 
 	Interfaces []Interface
+	Schedules  []Schedule
+	Webhooks   []Webhook
+	MQTT       *MQTT // nil without a broker
+}
+
+// parseLogging parses the format and levels of the logs
+func parseLogging(cfg cfgFile, c *Config) error {
+	c.LogFormat = LOGFORMAT_TEXT
+	if cfg.LogFormat != nil {
+		switch *cfg.LogFormat {
+		case LOGFORMAT_TEXT, LOGFORMAT_JSON, LOGFORMAT_LOGFMT:
+			c.LogFormat = *cfg.LogFormat
+		default:
+			return fmt.Errorf("log_format is incorrect: %q, should be one of %s, %s or %s", *cfg.LogFormat, LOGFORMAT_TEXT, LOGFORMAT_JSON, LOGFORMAT_LOGFMT)
+		}
+	}
+
+	c.LogLevel = log.LevelInfo
+	if cfg.Debug {
+		c.LogLevel = log.LevelDebug
+	}
+	if cfg.LogLevel != nil {
+		level, err := log.ParseLevel(*cfg.LogLevel)
+		if err != nil {
+			return fmt.Errorf("log_level is incorrect: %v", err)
+		}
+		c.LogLevel = level
+	}
+
+	c.LogLevels = make(map[string]log.Level)
+	for component, l := range cfg.LogLevels {
+		known := false
+		for _, name := range LOG_COMPONENTS {
+			known = known || name == component
+		}
+		if !known {
+			return fmt.Errorf("log_levels is incorrect: unknown component %q, should be one of %s", component, strings.Join(LOG_COMPONENTS, ", "))
+		}
+		level, err := log.ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("log_levels is incorrect: %s: %v", component, err)
+		}
+		c.LogLevels[component] = level
+	}
+
+	c.LogOutput = LOGOUTPUT_STDERR
+	if cfg.LogOutput != nil {
+		switch *cfg.LogOutput {
+		case LOGOUTPUT_STDERR, LOGOUTPUT_JOURNALD, LOGOUTPUT_SYSLOG:
+			c.LogOutput = *cfg.LogOutput
+		default:
+			return fmt.Errorf("log_output is incorrect: %q, should be one of %s, %s or %s", *cfg.LogOutput, LOGOUTPUT_STDERR, LOGOUTPUT_JOURNALD, LOGOUTPUT_SYSLOG)
+		}
+	}
+
+	c.JournaldSocket = DEF_JOURNALDSOCKET
+	if cfg.JournaldSocket != nil {
+		c.JournaldSocket = *cfg.JournaldSocket
+	}
+
+	address := DEF_SYSLOGADDRESS
+	if cfg.SyslogAddress != nil {
+		address = *cfg.SyslogAddress
+	}
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		c.SyslogNetwork, c.SyslogAddress = "unixgram", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "udp://"):
+		c.SyslogNetwork, c.SyslogAddress = "udp", strings.TrimPrefix(address, "udp://")
+	default:
+		return fmt.Errorf("syslog_address is incorrect: %q, should be unix:///path or udp://host:port", address)
+	}
+	if c.SyslogAddress == "" {
+		return fmt.Errorf("syslog_address is incorrect: %q, has no path or host", address)
+	}
+	return nil
+}
+
+// parseListen returns the network and address to listen on
+// for host:port or unix:///path, or nothing for an empty address
+func parseListen(key string, address string) (string, string, error) {
+	switch {
+	case address == "":
+		return "", "", nil
+	case strings.HasPrefix(address, "unix://"):
+		path := strings.TrimPrefix(address, "unix://")
+		if path == "" {
+			return "", "", fmt.Errorf("%s is incorrect: %q, has no path", key, address)
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("%s is incorrect: %q, should be host:port or unix:///path", key, address)
+	}
+	return "tcp", address, nil
 }
 
 // parseDuration parses a duration while also recognizing special values such
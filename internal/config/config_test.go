@@ -0,0 +1,53 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFailbackNewConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		other string // the settings of the other interface
+		ok    bool
+	}{
+		{name: "mark and table", other: "table = 3\nprobe_mark = 3", ok: true},
+		{name: "no mark", other: "table = 3"},
+		{name: "no table", other: "probe_mark = 3"},
+		{name: "neither"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := `
+nftables = true
+
+[[interfaces]]
+name = "eth0"
+table = 2
+probe_mark = 2
+failback = "new-connections-only"
+
+[[interfaces]]
+name = "eth1"
+` + tt.other
+
+			_, err := Parse(strings.NewReader(cfg))
+			if tt.ok != (err == nil) {
+				t.Fatalf("Parse() error = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
@@ -22,15 +22,76 @@ const defaultConfig = `# %s configuration file
 
 # global defaults (override per interface or per host)
 # debug = false
-# icmp_interval = "500ms"
-# icmp_timeout = "200ms"
-# burst_size = 1
-# burst_interval
+# icmp_interval = "2s"
+# icmp_timeout = "250ms"
+# burst_size = 3
+# burst_interval = "15s"
+# the replies to a burst are awaited for
+# burst_size * (icmp_timeout + icmp_interval)
+# after its first ping
 
-# command to run at up or down state
+# use raw icmp sockets (privileged, needs CAP_NET_RAW) or icmp
+# datagram sockets (unprivileged, needs the group of hodos to be
+# in net.ipv4.ping_group_range). auto uses datagram sockets
+# when ping_group_range allows it.
+# icmp_mode = "auto"
+
+# log as text, json or logfmt, with fields such as interface, host,
+# family and event. The level is debug, info, warn or error, and is
+# set per component (server, linkstate, neighbor, routesync, icmp,
+# pmtu, traceroute, bfd, sockdiag, webhook or mqtt) in log_levels.
+# Setting debug on an interface or host logs its debug messages only.
+# hodos -d logs the debug messages of every component, regardless
+# of log_level and log_levels.
+# log_format = "text"
+# log_level = "info"
+# log_levels = { icmp = "warn" }
+
+# log to stderr, to the systemd journal with the fields as journal
+# fields (log_format does not apply), or to syslog as RFC 5424 with
+# the fields as structured data, over unix:///path or udp://host:port
+# log_output = "stderr"
+# journald_socket = "/run/systemd/journal/socket"
+# syslog_address = "unix:///dev/log"
+
+# manage an nftables table (family inet) with the masquerade
+# and sticky rules of the interfaces below. The table is replaced
+# as interfaces go up and down, and removed when hodos stops.
+# nftables = false
+# nftables_table = "hodos"
+
+# file to keep state in across restarts, such as the admin state
+# of the interfaces. An empty string disables it.
+# state_file = "/var/lib/hodos/state.json"
+
+# the control api: the status (/status), the metrics (/metrics), the
+# admin state (/admin), the manual failback (/failback), on demand
+# traceroutes (/traceroute) and pprof. It has no authentication, keep
+# it on localhost or on a unix socket (unix:///run/hodos/control.sock).
+# An empty string disables it.
+# listen = "127.0.0.1:6060"
+
+# serve only the read-only status and metrics, such as to
+# a prometheus server on the network (default: disabled)
+# metrics_listen = ":9100"
+
+# how often to sample the traffic counters of the interfaces for
+# the status and metrics, "0s" disables it
+# stats_interval = "10s"
+
+# command to run at up or down state. It gets EVENT, FAMILY, NAME,
+# DESCRIPTION, TABLE, the number of hosts up in UP_HOSTS4 and
+# UP_HOSTS6, their weight in UP_WEIGHT4 and UP_WEIGHT6, MINIMUM_UP
+# and MINIMUM_WEIGHT in its environment
 # up_action = "/path/to/script"
 # down_action = "/path/to/script"
 
+# the down action runs before the routes of the family are failed and
+# the up action before they are added again, so the failover waits for
+# the action. An action running longer than this is killed, along
+# with its children.
+# action_timeout = "30s"
+
 # start monitoring interface eth0 and use routing table 2
 [[interfaces]]
 name = "eth0"
@@ -38,25 +99,142 @@ table = 2
 metric = 1000
 # debug = false
 
+# probes are bound to the interface, and additionally marked with
+# this fwmark. When a table is set, a single rule sends marked
+# traffic through the table of the interface.
+# probe_mark = 100
+
+# masquerade the connections leaving through this interface (needs nftables)
+# masquerade = false
+# keep connections on the interface they started on, by saving
+# probe_mark in their connmark and restoring it on the packets
+# of the connection (needs nftables, probe_mark and table). While a
+# family of the interface is down its mark is not restored, and its
+# connections take the other interfaces.
+# sticky = false
+
 # amount of hosts that need to be up for this interface to be considered up
 # minimum_up = 1
+# or the total weight of the hosts that need to be up (instead of minimum_up)
+# minimum_weight = 1
+# every family with hosts must be able to reach it, counting the gateway
+# and a hostname as a host of each family it is probed for
+
+# probe the gateway of the interface, this is the same as
+# adding a host with host = "gateway"
+# auto_gateway = false
+
+# mark the interface down as soon as the kernel fails to resolve
+# the neighbor entry of the gateway
+# neighbor_monitor = false
+
+# delete the conntrack entries of connections that were masqueraded
+# behind the addresses of the interface when it goes down, so they
+# are set up again over another interface instead of hanging
+# conntrack_flush = false
+
+# discover the path mtu to each host periodically, and hold the
+# interface down or run a command when it drops below a minimum
+# (e.g. a broken PPPoE MSS/MTU setup)
+# pmtu_interval = "10m"
+# pmtu_minimum = 1492
+# pmtu_degrade = false
+# pmtu_action = "/path/to/script"
+
+# trace the path to each host periodically and/or when the interface
+# goes down, and report where the path changed or died compared to
+# the last trace that reached the host
+# traceroute_interval = "1h"
+# traceroute_on_failover = false
+# traceroute_method = "icmp"
+# traceroute_action = "/path/to/script"
+
+# score the tcp connections leaving through the interface by their
+# retransmits and round trip times, and hold the interface down when
+# the score drops below a minimum (e.g. a congested or bufferbloated
+# link), without sending any probes. Without enough traffic the score
+# is unknown, and the interface stays as it is: once held down, it is
+# released by a score at or above the minimum, such as from the
+# connections that are kept on it
+# passive_monitor = false
+# passive_interval = "10s"
+# passive_max_retransmits = 5.0
+# passive_max_rtt = "300ms"
+# passive_minimum_score = 50
+
+# count the bytes received and sent on a metered link per billing
+# period, which starts on data_cap_reset_day. The usage is kept in the
+# state_file across restarts. At the data_cap_warnings percentages and
+# when the cap is reached, data_cap_action runs. Once reached, the
+# routes of the interface are moved to data_cap_metric so it is only
+# used as a backup (demote, needs table), the interface is set admin
+# down (admin_down), or it is only warned about (warn). The next
+# billing period moves the routes back, or clears the admin down when
+# it was not changed since the data cap set it.
+# data_cap = "50GB"
+# data_cap_reset_day = 1
+# data_cap_policy = "demote"
+# data_cap_metric = 32764
+# data_cap_warnings = [80, 90]
+# data_cap_interval = "1m"
+# data_cap_action = "/path/to/script"
 
 # command to run at up or down state
 # up_action = "/path/to/script"
 # down_action = "/path/to/script"
-# icmp_interval = "500ms"
-# icmp_timeout = "200ms"
-# burst_size = 1
-# burst_interval
+
+# when the interface recovers from a failure, switch back to it
+# immediately, after a delay it has to stay up for (delay=5m), only
+# after a POST to /failback?interface=eth0 (manual), or immediately
+# for new connections only, while established connections keep using
+# the interface they are on until they end (new-connections-only,
+# needs nftables, and a probe_mark and table on every other interface).
+# Connections are pinned to the interface they are masqueraded behind.
+# failback = "immediate"
+
+# a family has to stay available for up_delay before it is taken
+# into use, and stays down for at least hold_down after it failed
+# up_delay = "30s"
+# hold_down = "1m"
+
+# suppress an interface that flaps: every failure adds a penalty that
+# halves every half-life. Above the suppress threshold, the interface
+# is not taken into use until the penalty decays below reuse, for at
+# most dampening_max_suppress.
+# dampening_half_life = "5m"
+# dampening_penalty = 1000
+# dampening_suppress = 2000
+# dampening_reuse = 750
+# dampening_max_suppress = "20m"
+# icmp_interval = "2s"
+# icmp_timeout = "250ms"
+# burst_size = 3
+# burst_interval = "15s"
+
+# run a single-hop bfd session with the directly connected router,
+# the interface is only up while the session is up
+# [[interfaces.bfd]]
+# peer = "192.0.2.1"
+# min_tx = "300ms"
+# min_rx = "300ms"
+# multiplier = 3
 
 [[interfaces.hosts]]
 name = "Cloudflare"
 host = "1.1.1.1"
 # debug = false
-# icmp_interval = "500ms"
-# icmp_timeout = "200ms"
-# burst_size = 1
-# burst_interval
+# weight = 1
+# icmp_interval = "2s"
+# icmp_timeout = "250ms"
+# burst_size = 3
+# burst_interval = "15s"
+
+# probe packet options, a large payload with the don't fragment
+# bit set flags path mtu issues when only small probes are answered
+# size = 8
+# ttl = 64
+# dscp = 0
+# dont_fragment = false
 
 [[interfaces.hosts]]
 name = "Cloudflare"
@@ -69,6 +247,68 @@ host = "8.8.8.8"
 [[interfaces.hosts]]
 name = "Google"
 host = "2001:4860:4860::8888"
+
+# a hostname is resolved into a host for each family and
+# resolved again when the ttl of the records expires
+# [[interfaces.hosts]]
+# name = "Quad9"
+# host = "dns.quad9.net"
+# family = "any"
+# resolvers = ["9.9.9.9"]
+# resolve_via_interface = false
+
+# schedules change the metric, minimum weight or admin state of an
+# interface at the times of a cron spec (minute hour day-of-month month
+# day-of-week, in local time). At startup the schedules that fired
+# last are applied, so an interface starts as the schedules describe,
+# except for an admin state that was set after the schedule fired.
+# minimum_weight is the only weight a schedule sets, the weights of
+# the hosts stay as configured. Preference between interfaces is
+# scheduled with metric.
+# [[schedules]]
+# name = "business hours"
+# cron = "0 8 * * 1-5"
+# interface = "eth0"
+# metric = 100
+# minimum_weight = 2
+# admin = "admin_up"
+#
+# [[schedules]]
+# name = "after hours"
+# cron = "0 18 * * 1-5"
+# interface = "eth0"
+# metric = 300
+
+# webhooks receive a json payload on every state transition of an
+# interface family (family), a host (host) or the admin state (admin).
+# The payload is signed with the secret in the X-Hodos-Signature header
+# as sha256=<hex hmac of the body>. Failed posts are retried with a
+# doubling backoff, events for a slow endpoint are queued up to
+# queue_size and dropped when the queue is full.
+# [[webhooks]]
+# url = "https://example.com/hodos"
+# secret = "s3cr3t"
+# events = ["family", "host", "admin"]
+# timeout = "5s"
+# retries = 5
+# backoff = "1s"
+# queue_size = 100
+
+# mqtt publishes the state of every interface as retained json on
+# <topic_prefix>/<interface>/state, and the events of the webhooks on
+# <topic_prefix>/<interface>/event. <topic_prefix>/status is online while
+# connected and offline otherwise. With commands, the admin state is set
+# by publishing admin_down, admin_up or force_up on
+# <topic_prefix>/<interface>/admin/set.
+# [mqtt]
+# broker = "tcp://127.0.0.1:1883"
+# client_id = "hodos-router"
+# username = "hodos"
+# password = "s3cr3t"
+# topic_prefix = "hodos"
+# commands = false
+# keep_alive = "30s"
+# queue_size = 100
 `
 
 func DefaulConfig() string {
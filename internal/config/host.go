@@ -15,16 +15,32 @@ package config
 import (
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// GatewayHost is the host to use for probing the
+// gateway discovered from the routing table.
+const GatewayHost = "gateway"
+
 type Host struct {
 	Name   string
-	Host   *net.IP
+	Host   *net.IP // nil for hostnames until they are resolved
 	Debug  bool
 	Family uint8
+	Weight int
+
+	Gateway             bool     // set if the host is the gateway of the interface
+	Hostname            string   // set if the host is resolved at runtime
+	Resolvers           []string // nameservers to use instead of resolv.conf
+	ResolveViaInterface bool     // send queries through the monitored interface
+
+	Size         int // payload size in bytes
+	TTL          int // 0 for the system default
+	DSCP         int
+	DontFragment bool
 
 	BurstInterval time.Duration
 	BurstSize     int
@@ -32,26 +48,118 @@ type Host struct {
 	ICMPTimeout   time.Duration
 }
 
-func parseHost(cfg cfgHost, parent *Interface) (*Host, error) {
-	var err error
-	ip := net.ParseIP(cfg.Host)
-	if ip == nil {
-		return nil, fmt.Errorf("host ip address could not be parsed: %q, %q", cfg.Name, cfg.Host)
+// ID returns an identifier that is unique for
+// the host within an interface.
+func (h Host) ID() string {
+	name := h.Hostname
+	if h.Gateway {
+		name = GatewayHost
 	}
+	if name != "" {
+		if h.Family == unix.AF_INET6 {
+			return name + "/ipv6"
+		}
+		return name + "/ipv4"
+	}
+	return h.Host.String()
+}
 
+// parseHost parses the host configuration. A hostname is
+// turned into a host for every family it is resolved for.
+func parseHost(cfg cfgHost, parent *Interface) ([]Host, error) {
+	families, err := parseFamily(cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(cfg.Host); ip != nil {
+		host, err := parseHostFamily(cfg, parent, ip.String(), familyOf(ip))
+		if err != nil {
+			return nil, err
+		}
+		if len(families) == 1 && families[0] != host.Family {
+			return nil, fmt.Errorf("family is incorrect: %q does not match host ip address %q", *cfg.Family, cfg.Host)
+		}
+		if len(cfg.Resolvers) > 0 || cfg.ResolveViaInterface {
+			return nil, fmt.Errorf("host ip address %q cannot be resolved", cfg.Host)
+		}
+		host.Host = &ip
+		return []Host{*host}, nil
+	}
+
+	if cfg.Host == GatewayHost {
+		if len(cfg.Resolvers) > 0 || cfg.ResolveViaInterface {
+			return nil, fmt.Errorf("host %q cannot be resolved", cfg.Host)
+		}
+		hosts := make([]Host, 0, len(families))
+		for _, family := range families {
+			host, err := parseHostFamily(cfg, parent, GatewayHost, family)
+			if err != nil {
+				return nil, err
+			}
+			host.Gateway = true
+			hosts = append(hosts, *host)
+		}
+		return hosts, nil
+	}
+
+	if !isHostname(cfg.Host) {
+		return nil, fmt.Errorf("host ip address or hostname could not be parsed: %q, %q", cfg.Name, cfg.Host)
+	}
+	hosts := make([]Host, 0, len(families))
+	for _, family := range families {
+		host, err := parseHostFamily(cfg, parent, cfg.Host, family)
+		if err != nil {
+			return nil, err
+		}
+		host.Hostname = cfg.Host
+		host.Resolvers = cfg.Resolvers
+		host.ResolveViaInterface = cfg.ResolveViaInterface
+		hosts = append(hosts, *host)
+	}
+	return hosts, nil
+}
+
+func parseHostFamily(cfg cfgHost, parent *Interface, name string, family uint8) (*Host, error) {
+	var err error
 	host := &Host{
-		Name:  ip.String(),
-		Host:  &ip,
-		Debug: cfg.Debug,
+		Name:   name,
+		Debug:  cfg.Debug,
+		Weight: DEF_WEIGHT,
+		Family: family,
+		Size:   SIZE_MIN,
+
+		DontFragment: cfg.DontFragment,
 	}
 
 	if cfg.Name != "" {
 		host.Name = cfg.Name
 	}
 
-	host.Family = unix.AF_INET
-	if ip.To4() == nil {
-		host.Family = unix.AF_INET6
+	if cfg.Weight != nil {
+		if *cfg.Weight < 1 || *cfg.Weight > WEIGHT_MAX {
+			return nil, fmt.Errorf("weight is incorrect: %d, should be between %d and %d", *cfg.Weight, 1, WEIGHT_MAX)
+		}
+		host.Weight = *cfg.Weight
+	}
+
+	if cfg.Size != nil {
+		if *cfg.Size < SIZE_MIN || *cfg.Size > SIZE_MAX {
+			return nil, fmt.Errorf("size is incorrect: %d, should be between %d and %d", *cfg.Size, SIZE_MIN, SIZE_MAX)
+		}
+		host.Size = *cfg.Size
+	}
+	if cfg.TTL != nil {
+		if *cfg.TTL < 1 || *cfg.TTL > TTL_MAX {
+			return nil, fmt.Errorf("ttl is incorrect: %d, should be between %d and %d", *cfg.TTL, 1, TTL_MAX)
+		}
+		host.TTL = *cfg.TTL
+	}
+	if cfg.DSCP != nil {
+		if *cfg.DSCP < 0 || *cfg.DSCP > DSCP_MAX {
+			return nil, fmt.Errorf("dscp is incorrect: %d, should be between %d and %d", *cfg.DSCP, 0, DSCP_MAX)
+		}
+		host.DSCP = *cfg.DSCP
 	}
 
 	host.BurstSize = parent.BurstSize
@@ -74,3 +182,48 @@ func parseHost(cfg cfgHost, parent *Interface) (*Host, error) {
 
 	return host, nil
 }
+
+// parseFamily returns the families to use for a host.
+// Unset means both.
+func parseFamily(s *string) ([]uint8, error) {
+	if s == nil {
+		return []uint8{unix.AF_INET, unix.AF_INET6}, nil
+	}
+	switch *s {
+	case "ipv4":
+		return []uint8{unix.AF_INET}, nil
+	case "ipv6":
+		return []uint8{unix.AF_INET6}, nil
+	case "any":
+		return []uint8{unix.AF_INET, unix.AF_INET6}, nil
+	default:
+		return nil, fmt.Errorf("family is incorrect: %q, should be one of ipv4, ipv6 or any", *s)
+	}
+}
+
+func familyOf(ip net.IP) uint8 {
+	if ip.To4() == nil {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+// isHostname does a basic syntax check of a hostname
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
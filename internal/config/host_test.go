@@ -0,0 +1,54 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsHostname(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{in: "example.com", want: true},
+		{in: "example.com.", want: true},
+		{in: "localhost", want: true},
+		{in: "dns-1.example.net", want: true},
+		{in: "_service.example.org", want: true},
+		{in: "1.example", want: true},
+		{in: strings.Repeat("a", 63) + ".example", want: true},
+		{in: strings.Repeat("a.", 126) + "a", want: true},
+		{in: ""},
+		{in: "."},
+		{in: "example..com"},
+		{in: ".example.com"},
+		{in: "-example.com"},
+		{in: "example-.com"},
+		{in: "exa mple.com"},
+		{in: "example.com/24"},
+		{in: "exämple.com"},
+		{in: "2001:db8::1"},
+		{in: strings.Repeat("a", 64) + ".example"},
+		{in: strings.Repeat("a.", 127) + "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := isHostname(tt.in); got != tt.want {
+				t.Fatalf("isHostname(%q) = %t, want %t", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -14,6 +14,10 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -28,21 +32,117 @@ type Interface struct {
 
 	Table      uint32
 	Metric     uint32
+	ProbeMark  uint32
 	UpAction   string
 	DownAction string
 
+	Failback      string
+	FailbackDelay time.Duration
+	UpDelay       time.Duration
+	HoldDown      time.Duration
+
+	DampeningHalfLife    time.Duration
+	DampeningPenalty     int
+	DampeningSuppress    int
+	DampeningReuse       int
+	DampeningMaxSuppress time.Duration
+
 	BurstInterval time.Duration
 	BurstSize     int
 	ICMPInterval  time.Duration
 	ICMPTimeout   time.Duration
 
-	MinimumUp    int
-	upHostsv4    int32
-	upHostsv6    int32
-	totalHostsv4 int32
-	totalHostsv6 int32
+	MinimumUp     int
+	MinimumWeight int
+	minimumWeight int32 // set by a schedule, 0 uses MinimumWeight
+	upWeightv4    int32
+	upWeightv6    int32
+	totalWeightv4 int32
+	totalWeightv6 int32
+	upHostsv4     int32
+	upHostsv6     int32
+	totalHostsv4  int32
+	totalHostsv6  int32
+
+	PMTUInterval time.Duration
+	PMTUMinimum  int
+	PMTUDegrade  bool
+	PMTUAction   string
+
+	TracerouteInterval   time.Duration
+	TracerouteOnFailover bool
+	TracerouteMethod     string
+	TracerouteAction     string
+
+	PassiveMonitor        bool
+	PassiveInterval       time.Duration
+	PassiveMaxRetransmits float64
+	PassiveMaxRTT         time.Duration
+	PassiveMinimumScore   int
+
+	DataCap         uint64 // bytes per billing period, 0 disables it
+	DataCapResetDay int
+	DataCapPolicy   string
+	DataCapMetric   uint32 // metric of the routes while demoted
+	DataCapWarnings []int  // percentages of the data cap
+	DataCapInterval time.Duration
+	DataCapAction   string
+
+	ConntrackFlush bool
+	Masquerade     bool
+	Sticky         bool
+
+	NeighborMonitor bool
+	failedv4        uint32 // bitmask of failed sources
+	failedv6        uint32 // bitmask of failed sources
 
 	Hosts []Host
+	BFD   []BFD
+}
+
+// A Source is a health source, other then the icmp host quorum,
+// that is able to hold a family of an interface down.
+type Source uint32
+
+const (
+	// SourceNeighbor is set when the kernel failed
+	// to resolve the neighbor entry of the gateway.
+	SourceNeighbor Source = 1 << iota
+	// SourceBFD is set when the bfd session with
+	// the peer is not up.
+	SourceBFD
+	// SourcePMTU is set when the path mtu to a host
+	// is below the configured minimum.
+	SourcePMTU
+	// SourcePassive is set when the passive health score
+	// of the tcp connections is below the configured minimum.
+	SourcePassive
+)
+
+// List returns the individual sources in the bitmask.
+func (s Source) List() []Source {
+	var sources []Source
+	for bit := Source(1); bit != 0 && bit <= s; bit <<= 1 {
+		if s&bit != 0 {
+			sources = append(sources, bit)
+		}
+	}
+	return sources
+}
+
+func (s Source) String() string {
+	switch s {
+	case SourceNeighbor:
+		return "neighbor"
+	case SourceBFD:
+		return "bfd"
+	case SourcePMTU:
+		return "pmtu"
+	case SourcePassive:
+		return "passive"
+	default:
+		return "unknown"
+	}
 }
 
 func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
@@ -53,6 +153,11 @@ func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
 		Description: cfg.Description,
 		Debug:       cfg.Debug,
 
+		NeighborMonitor: cfg.NeighborMonitor,
+		ConntrackFlush:  cfg.ConntrackFlush,
+		Masquerade:      cfg.Masquerade,
+		Sticky:          cfg.Sticky,
+
 		Table:      0,
 		UpAction:   parent.UpAction,
 		DownAction: parent.DownAction,
@@ -60,6 +165,7 @@ func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
 		MinimumUp: DEF_MINIMUMUP,
 
 		Hosts: make([]Host, 0, len(cfg.Hosts)),
+		BFD:   make([]BFD, 0, len(cfg.BFD)),
 	}
 
 	if cfg.Table != nil {
@@ -73,8 +179,8 @@ func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
 	}
 
 	if cfg.Metric != nil {
-		if *cfg.Metric < 1 || *cfg.Metric > 32764 {
-			return nil, fmt.Errorf("metric is incorrect: %d, should be between %d and %d", *cfg.Metric, 1, 32764)
+		if *cfg.Metric < 1 || *cfg.Metric > METRIC_MAX {
+			return nil, fmt.Errorf("metric is incorrect: %d, should be between %d and %d", *cfg.Metric, 1, METRIC_MAX)
 		}
 		if ifi.Table == 0 { // route sync must be enabled
 			return nil, fmt.Errorf("table is incorrect: must be set to non-zero for metric to work")
@@ -82,11 +188,21 @@ func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
 		ifi.Metric = uint32(*cfg.Metric)
 	}
 
-	if cfg.MinimumUp != nil {
-		if *cfg.MinimumUp > len(cfg.Hosts) || *cfg.MinimumUp < 1 {
-			return nil, fmt.Errorf("minimum_up is incorrect: %d, should be between %d and %d", *cfg.MinimumUp, 1, len(cfg.Hosts))
+	if cfg.ProbeMark != nil {
+		if *cfg.ProbeMark < 1 || *cfg.ProbeMark > MARK_MAX {
+			return nil, fmt.Errorf("probe_mark is incorrect: %d, should be between %d and %d", *cfg.ProbeMark, 1, MARK_MAX)
 		}
-		ifi.MinimumUp = *cfg.MinimumUp
+		ifi.ProbeMark = uint32(*cfg.ProbeMark)
+	}
+
+	if (ifi.Masquerade || ifi.Sticky) && !parent.NFTables {
+		return nil, fmt.Errorf("nftables is incorrect: must be enabled for masquerade or sticky to work")
+	}
+	if ifi.Sticky && ifi.ProbeMark == 0 {
+		return nil, fmt.Errorf("probe_mark is incorrect: must be set for sticky to work")
+	}
+	if ifi.Sticky && ifi.Table == 0 { // the mark is routed through the table
+		return nil, fmt.Errorf("table is incorrect: must be set to non-zero for sticky to work")
 	}
 
 	ifi.BurstSize = parent.BurstSize
@@ -114,98 +230,538 @@ func parseInterface(cfg cfgInterface, parent *Config) (*Interface, error) {
 		ifi.DownAction = *cfg.DownAction
 	}
 
+	if ifi.Failback, ifi.FailbackDelay, err = parseFailback(cfg.Failback); err != nil {
+		return nil, err
+	}
+	if ifi.Failback == FAILBACK_NEWCONNECTIONS && !parent.NFTables {
+		return nil, fmt.Errorf("nftables is incorrect: must be enabled for failback %s to work", FAILBACK_NEWCONNECTIONS)
+	}
+
+	if ifi.UpDelay, err = parseDuration(cfg.UpDelay, 0); err != nil {
+		return nil, err
+	}
+	if ifi.UpDelay < 0 {
+		return nil, fmt.Errorf("up_delay is incorrect: %s, should not be negative", ifi.UpDelay)
+	}
+	if ifi.HoldDown, err = parseDuration(cfg.HoldDown, 0); err != nil {
+		return nil, err
+	}
+	if ifi.HoldDown < 0 {
+		return nil, fmt.Errorf("hold_down is incorrect: %s, should not be negative", ifi.HoldDown)
+	}
+	if err := parseDampening(cfg, ifi); err != nil {
+		return nil, err
+	}
+
+	if ifi.PMTUInterval, err = parseDuration(cfg.PMTUInterval, 0); err != nil {
+		return nil, err
+	}
+	if ifi.PMTUInterval < 0 {
+		return nil, fmt.Errorf("pmtu_interval is incorrect: %s, should not be negative", ifi.PMTUInterval)
+	}
+	if cfg.PMTUMinimum != nil {
+		if *cfg.PMTUMinimum < PMTU_MIN || *cfg.PMTUMinimum > PMTU_MAX {
+			return nil, fmt.Errorf("pmtu_minimum is incorrect: %d, should be between %d and %d", *cfg.PMTUMinimum, PMTU_MIN, PMTU_MAX)
+		}
+		if ifi.PMTUInterval == 0 {
+			return nil, fmt.Errorf("pmtu_interval is incorrect: must be set for pmtu_minimum to work")
+		}
+		ifi.PMTUMinimum = *cfg.PMTUMinimum
+	}
+	if cfg.PMTUAction != nil {
+		ifi.PMTUAction = *cfg.PMTUAction
+	}
+	if (cfg.PMTUDegrade || ifi.PMTUAction != "") && ifi.PMTUMinimum == 0 {
+		return nil, fmt.Errorf("pmtu_minimum is incorrect: must be set for pmtu_degrade or pmtu_action to work")
+	}
+	ifi.PMTUDegrade = cfg.PMTUDegrade
+
+	if ifi.TracerouteInterval, err = parseDuration(cfg.TracerouteInterval, 0); err != nil {
+		return nil, err
+	}
+	if ifi.TracerouteInterval < 0 {
+		return nil, fmt.Errorf("traceroute_interval is incorrect: %s, should not be negative", ifi.TracerouteInterval)
+	}
+	ifi.TracerouteOnFailover = cfg.TracerouteOnFailover
+	ifi.TracerouteMethod = TRACEROUTE_ICMP
+	if cfg.TracerouteMethod != nil {
+		switch *cfg.TracerouteMethod {
+		case TRACEROUTE_ICMP, TRACEROUTE_UDP:
+			ifi.TracerouteMethod = *cfg.TracerouteMethod
+		default:
+			return nil, fmt.Errorf("traceroute_method is incorrect: %q, should be one of %s or %s", *cfg.TracerouteMethod, TRACEROUTE_ICMP, TRACEROUTE_UDP)
+		}
+	}
+	if cfg.TracerouteAction != nil {
+		ifi.TracerouteAction = *cfg.TracerouteAction
+	}
+
+	ifi.PassiveMonitor = cfg.PassiveMonitor
+	if ifi.PassiveInterval, err = parseDuration(cfg.PassiveInterval, DEF_PASSIVEINTERVAL); err != nil {
+		return nil, err
+	}
+	if ifi.PassiveInterval <= 0 {
+		return nil, fmt.Errorf("passive_interval is incorrect: %s, should be positive", ifi.PassiveInterval)
+	}
+	ifi.PassiveMaxRetransmits = DEF_PASSIVEMAXRETRANSMITS
+	if cfg.PassiveMaxRetransmits != nil {
+		if *cfg.PassiveMaxRetransmits <= 0 || *cfg.PassiveMaxRetransmits > RETRANS_MAX {
+			return nil, fmt.Errorf("passive_max_retransmits is incorrect: %g, should be above %d and at most %d", *cfg.PassiveMaxRetransmits, 0, RETRANS_MAX)
+		}
+		ifi.PassiveMaxRetransmits = *cfg.PassiveMaxRetransmits
+	}
+	if ifi.PassiveMaxRTT, err = parseDuration(cfg.PassiveMaxRTT, 0); err != nil {
+		return nil, err
+	}
+	if ifi.PassiveMaxRTT < 0 {
+		return nil, fmt.Errorf("passive_max_rtt is incorrect: %s, should not be negative", ifi.PassiveMaxRTT)
+	}
+	ifi.PassiveMinimumScore = DEF_PASSIVEMINIMUMSCORE
+	if cfg.PassiveMinimumScore != nil {
+		if *cfg.PassiveMinimumScore < 0 || *cfg.PassiveMinimumScore > SCORE_MAX {
+			return nil, fmt.Errorf("passive_minimum_score is incorrect: %d, should be between %d and %d", *cfg.PassiveMinimumScore, 0, SCORE_MAX)
+		}
+		ifi.PassiveMinimumScore = *cfg.PassiveMinimumScore
+	}
+
+	if err := parseDataCap(cfg, ifi); err != nil {
+		return nil, err
+	}
+
+	cfgHosts := cfg.Hosts
+	if cfg.AutoGateway {
+		cfgHosts = append(cfgHosts, cfgHost{Host: GatewayHost})
+	}
+
 	seen := make(map[string]bool)
-	for i, h := range cfg.Hosts {
-		host, err := parseHost(h, ifi)
+	for i, h := range cfgHosts {
+		hosts, err := parseHost(h, ifi)
 		if err != nil {
 			return nil, fmt.Errorf("host %d: %v", i, err)
 		}
 
-		if _, ok := seen[host.Host.String()]; ok {
-			return nil, fmt.Errorf("host %d: %q cannot appear multiple times for interface %q", i, host.Host.String(), cfg.Name)
+		for _, host := range hosts {
+			if _, ok := seen[host.ID()]; ok {
+				return nil, fmt.Errorf("host %d: %q cannot appear multiple times for interface %q", i, host.ID(), cfg.Name)
+			}
+			seen[host.ID()] = true
+
+			ifi.Hosts = append(ifi.Hosts, host)
+			if host.Family == unix.AF_INET {
+				ifi.totalWeightv4 += int32(host.Weight)
+				ifi.totalHostsv4++
+			}
+			if host.Family == unix.AF_INET6 {
+				ifi.totalWeightv6 += int32(host.Weight)
+				ifi.totalHostsv6++
+			}
 		}
-		seen[host.Host.String()] = true
+	}
+
+	// the hosts of the gateway and of a hostname are only known
+	// now, and every family with hosts must reach the minimum
+	total := ifi.maxMinimum()
+	if cfg.MinimumUp != nil {
+		if *cfg.MinimumUp > total || *cfg.MinimumUp < 1 {
+			return nil, fmt.Errorf("minimum_up is incorrect: %d, should be between %d and %d", *cfg.MinimumUp, 1, total)
+		}
+		ifi.MinimumUp = *cfg.MinimumUp
+	}
 
-		ifi.Hosts = append(ifi.Hosts, *host)
-		if host.Family == unix.AF_INET {
-			//ifi.upHostsv4++
-			ifi.totalHostsv4++
+	// without weights, every host weighs 1, so
+	// the minimum weight equals the minimum hosts up
+	ifi.MinimumWeight = ifi.MinimumUp
+	if cfg.MinimumWeight != nil {
+		if cfg.MinimumUp != nil {
+			return nil, fmt.Errorf("minimum_weight is incorrect: cannot be combined with minimum_up")
 		}
-		if host.Family == unix.AF_INET6 {
-			//ifi.upHostsv6++
-			ifi.totalHostsv6++
+		if *cfg.MinimumWeight > total || *cfg.MinimumWeight < 1 {
+			return nil, fmt.Errorf("minimum_weight is incorrect: %d, should be between %d and %d", *cfg.MinimumWeight, 1, total)
 		}
+		ifi.MinimumWeight = *cfg.MinimumWeight
+	}
+
+	bfdFamilies := make(map[uint8]bool)
+	for i, b := range cfg.BFD {
+		session, err := parseBFD(b)
+		if err != nil {
+			return nil, fmt.Errorf("bfd %d: %v", i, err)
+		}
+
+		// the family state can only follow a single session
+		if _, ok := bfdFamilies[session.Family]; ok {
+			return nil, fmt.Errorf("bfd %d: only one bfd peer per family is allowed for interface %q", i, cfg.Name)
+		}
+		bfdFamilies[session.Family] = true
+
+		ifi.BFD = append(ifi.BFD, *session)
 	}
 
 	return ifi, nil
 }
 
+// LinkDown resets the hosts that are up. Failed sources are kept,
+// since these keep track of their own state across link changes.
 func (i *Interface) LinkDown() {
+	atomic.StoreInt32(&i.upWeightv4, 0)
+	atomic.StoreInt32(&i.upWeightv6, 0)
 	atomic.StoreInt32(&i.upHostsv4, 0)
 	atomic.StoreInt32(&i.upHostsv6, 0)
 }
 
-func (i *Interface) HostDown(family uint8) bool {
-	if family == unix.AF_INET {
-		return i.hostDownv4()
+// HostDown subtracts the weight of a host that went down.
+// It returns true when this caused the family to drop
+// below the minimum weight.
+func (i *Interface) HostDown(family uint8, weight int) bool {
+	hosts, _ := i.hosts(family)
+	if atomic.AddInt32(hosts, -1) < 0 {
+		atomic.StoreInt32(hosts, 0)
 	}
-	return i.hostDownv6()
+	up, _ := i.weights(family)
+	now := atomic.AddInt32(up, -int32(weight))
+	if now < 0 {
+		atomic.StoreInt32(up, 0)
+	}
+	// only trigger monitor down if we crossed the minimum
+	minimum := i.Minimum()
+	return now+int32(weight) >= minimum && now < minimum && i.Failed(family) == 0
 }
 
-func (i *Interface) HostUp(family uint8) bool {
-	if family == unix.AF_INET {
-		return i.hostUpv4()
+// HostUp adds the weight of a host that came up.
+// It returns true when this caused the family to reach
+// the minimum weight.
+func (i *Interface) HostUp(family uint8, weight int) bool {
+	hosts, totalHosts := i.hosts(family)
+	if atomic.AddInt32(hosts, 1) > totalHosts {
+		atomic.StoreInt32(hosts, totalHosts)
+	}
+	up, total := i.weights(family)
+	now := atomic.AddInt32(up, int32(weight))
+	if now > total {
+		atomic.StoreInt32(up, total)
+	}
+	// only trigger monitor up if we crossed the minimum
+	minimum := i.Minimum()
+	return now-int32(weight) < minimum && now >= minimum && i.Failed(family) == 0
+}
+
+// SourceDown marks the source as failed for the family.
+// It returns true when this caused the family to become
+// unavailable.
+func (i *Interface) SourceDown(family uint8, src Source) bool {
+	failed := i.failed(family)
+	for {
+		old := atomic.LoadUint32(failed)
+		if atomic.CompareAndSwapUint32(failed, old, old|uint32(src)) {
+			// only trigger monitor down if nothing else was holding
+			// the family down
+			return old == 0 && i.quorum(family)
+		}
 	}
-	return i.hostUpv6()
 }
 
-func (i *Interface) hostDownv4() bool {
-	up := atomic.AddInt32(&i.upHostsv4, -1)
-	if up < 0 {
-		atomic.StoreInt32(&i.upHostsv6, 0)
+// SourceUp clears the failure of the source for the family.
+// It returns true when this caused the family to become
+// available.
+func (i *Interface) SourceUp(family uint8, src Source) bool {
+	failed := i.failed(family)
+	for {
+		old := atomic.LoadUint32(failed)
+		if old&uint32(src) == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(failed, old, old&^uint32(src)) {
+			// only trigger monitor up if this was the last source
+			// holding the family down
+			return old&^uint32(src) == 0 && i.quorum(family)
+		}
 	}
-	// only trigger monitor down if we are one below mimimum
-	return up == int32(i.MinimumUp)-1
 }
 
-func (i *Interface) hostUpv4() bool {
-	up := atomic.AddInt32(&i.upHostsv4, 1)
-	if up > i.totalHostsv4 {
-		atomic.StoreInt32(&i.upHostsv4, i.totalHostsv4)
+// quorum returns true if enough weight of the family is up.
+// A family without any hosts only follows its sources.
+func (i *Interface) quorum(family uint8) bool {
+	_, total := i.weights(family)
+	return total == 0 || i.Up(family) >= i.Minimum()
+}
+
+// Minimum returns the minimum weight in use, which is
+// MinimumWeight unless a schedule changed it.
+func (i *Interface) Minimum() int32 {
+	if minimum := atomic.LoadInt32(&i.minimumWeight); minimum != 0 {
+		return minimum
+	}
+	return int32(i.MinimumWeight)
+}
+
+// SetMinimum changes the minimum weight in use.
+// A weight of 0 restores MinimumWeight.
+func (i *Interface) SetMinimum(weight int) {
+	atomic.StoreInt32(&i.minimumWeight, int32(weight))
+}
+
+// maxMinimum returns the highest minimum weight that every family
+// with hosts is able to reach, which is the total weight of the
+// family with the least weight.
+func (i *Interface) maxMinimum() int {
+	if i.totalWeightv4 == 0 || (i.totalWeightv6 != 0 && i.totalWeightv6 < i.totalWeightv4) {
+		return int(i.totalWeightv6)
+	}
+	return int(i.totalWeightv4)
+}
+
+// RouteMetric returns the metric of the routes of
+// the interface, which a schedule is able to change.
+func (i *Interface) RouteMetric() uint32 {
+	return atomic.LoadUint32(&i.Metric)
+}
+
+// SetRouteMetric changes the metric of the routes
+// of the interface, and returns the previous metric.
+func (i *Interface) SetRouteMetric(metric uint32) uint32 {
+	return atomic.SwapUint32(&i.Metric, metric)
+}
+
+// Available returns true if the family is not held down
+// by the host quorum or any source.
+func (i *Interface) Available(family uint8) bool {
+	return i.Failed(family) == 0 && i.quorum(family)
+}
+
+// Failed returns the bitmask of failed sources for the family.
+func (i *Interface) Failed(family uint8) Source {
+	return Source(atomic.LoadUint32(i.failed(family)))
+}
+
+func (i *Interface) failed(family uint8) *uint32 {
+	if family == unix.AF_INET {
+		return &i.failedv4
 	}
-	// only trigger monitor up if we are at mimimum, not above
-	return up == int32(i.MinimumUp)
+	return &i.failedv6
 }
 
-func (i *Interface) hostDownv6() bool {
-	up := atomic.AddInt32(&i.upHostsv6, -1)
-	if up < 0 {
-		atomic.StoreInt32(&i.upHostsv6, 0)
+func (i *Interface) weights(family uint8) (*int32, int32) {
+	if family == unix.AF_INET {
+		return &i.upWeightv4, i.totalWeightv4
 	}
-	// only trigger monitor down if we are one below mimimum
-	return up == int32(i.MinimumUp)-1
+	return &i.upWeightv6, i.totalWeightv6
 }
 
-func (i *Interface) hostUpv6() bool {
-	up := atomic.AddInt32(&i.upHostsv6, 1)
-	if up > i.totalHostsv6 {
-		atomic.StoreInt32(&i.upHostsv6, i.totalHostsv6)
+func (i *Interface) hosts(family uint8) (*int32, int32) {
+	if family == unix.AF_INET {
+		return &i.upHostsv4, i.totalHostsv4
 	}
-	// only trigger monitor up if we are at mimimum, not above
-	return up == int32(i.MinimumUp)
+	return &i.upHostsv6, i.totalHostsv6
+}
+
+// UpHosts returns the number of hosts of the family that are up.
+func (i *Interface) UpHosts(family uint8) int32 {
+	hosts, _ := i.hosts(family)
+	return atomic.LoadInt32(hosts)
 }
 
+// Up4 returns the weight of the IPv4 hosts that are up.
 func (i *Interface) Up4() int32 {
-	return atomic.LoadInt32(&i.upHostsv4)
+	return atomic.LoadInt32(&i.upWeightv4)
 }
 
+// Up6 returns the weight of the IPv6 hosts that are up.
 func (i *Interface) Up6() int32 {
-	return atomic.LoadInt32(&i.upHostsv6)
+	return atomic.LoadInt32(&i.upWeightv6)
 }
 
+// Up returns the weight of the hosts of the family that are up.
 func (i *Interface) Up(family uint8) int32 {
 	if family == unix.AF_INET {
 		return i.Up4()
 	}
 	return i.Up6()
 }
+
+// parseDampening parses the flap dampening of the interface
+func parseDampening(cfg cfgInterface, ifi *Interface) error {
+	var err error
+	if ifi.DampeningHalfLife, err = parseDuration(cfg.DampeningHalfLife, 0); err != nil {
+		return err
+	}
+	if ifi.DampeningHalfLife < 0 {
+		return fmt.Errorf("dampening_half_life is incorrect: %s, should not be negative", ifi.DampeningHalfLife)
+	}
+	if ifi.DampeningHalfLife == 0 {
+		if cfg.DampeningPenalty != nil || cfg.DampeningSuppress != nil || cfg.DampeningReuse != nil || cfg.DampeningMaxSuppress != nil {
+			return fmt.Errorf("dampening_half_life is incorrect: must be set for dampening to work")
+		}
+		return nil
+	}
+
+	ifi.DampeningPenalty = DEF_DAMPENINGPENALTY
+	ifi.DampeningSuppress = DEF_DAMPENINGSUPPRESS
+	ifi.DampeningReuse = DEF_DAMPENINGREUSE
+	for _, v := range []struct {
+		name  string
+		value *int
+		dst   *int
+	}{
+		{"dampening_penalty", cfg.DampeningPenalty, &ifi.DampeningPenalty},
+		{"dampening_suppress", cfg.DampeningSuppress, &ifi.DampeningSuppress},
+		{"dampening_reuse", cfg.DampeningReuse, &ifi.DampeningReuse},
+	} {
+		if v.value == nil {
+			continue
+		}
+		if *v.value < 1 || *v.value > DAMPENING_MAX {
+			return fmt.Errorf("%s is incorrect: %d, should be between %d and %d", v.name, *v.value, 1, DAMPENING_MAX)
+		}
+		*v.dst = *v.value
+	}
+	if ifi.DampeningReuse >= ifi.DampeningSuppress {
+		return fmt.Errorf("dampening_reuse is incorrect: %d, should be below dampening_suppress (%d)", ifi.DampeningReuse, ifi.DampeningSuppress)
+	}
+
+	if ifi.DampeningMaxSuppress, err = parseDuration(cfg.DampeningMaxSuppress, 4*ifi.DampeningHalfLife); err != nil {
+		return err
+	}
+	if ifi.DampeningMaxSuppress <= 0 {
+		return fmt.Errorf("dampening_max_suppress is incorrect: %s, should be positive", ifi.DampeningMaxSuppress)
+	}
+	return nil
+}
+
+// parseFailback parses the failback policy, with the delay for the
+// delay=<duration> policy.
+func parseFailback(s *string) (string, time.Duration, error) {
+	if s == nil {
+		return FAILBACK_IMMEDIATE, 0, nil
+	}
+	switch *s {
+	case FAILBACK_IMMEDIATE, FAILBACK_MANUAL, FAILBACK_NEWCONNECTIONS:
+		return *s, 0, nil
+	}
+	if delay := strings.TrimPrefix(*s, FAILBACK_DELAY+"="); delay != *s {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return "", 0, fmt.Errorf("failback is incorrect: %q, %s", *s, err)
+		}
+		if d <= 0 {
+			return "", 0, fmt.Errorf("failback is incorrect: %q, delay should be positive", *s)
+		}
+		return FAILBACK_DELAY, d, nil
+	}
+	return "", 0, fmt.Errorf("failback is incorrect: %q, should be one of %s, %s=<duration>, %s or %s", *s, FAILBACK_IMMEDIATE, FAILBACK_DELAY, FAILBACK_MANUAL, FAILBACK_NEWCONNECTIONS)
+}
+
+// parseDataCap parses the data cap of the interface
+func parseDataCap(cfg cfgInterface, ifi *Interface) error {
+	var err error
+	if cfg.DataCap == nil {
+		if cfg.DataCapResetDay != nil || cfg.DataCapPolicy != nil || cfg.DataCapMetric != nil || cfg.DataCapWarnings != nil || cfg.DataCapInterval != nil || cfg.DataCapAction != nil {
+			return fmt.Errorf("data_cap is incorrect: must be set for the data cap options to work")
+		}
+		return nil
+	}
+	if ifi.DataCap, err = parseBytes(*cfg.DataCap); err != nil {
+		return fmt.Errorf("data_cap is incorrect: %q, %s", *cfg.DataCap, err)
+	}
+	if ifi.DataCap == 0 {
+		return fmt.Errorf("data_cap is incorrect: %q, should be positive", *cfg.DataCap)
+	}
+
+	ifi.DataCapResetDay = DEF_DATACAPRESETDAY
+	if cfg.DataCapResetDay != nil {
+		if *cfg.DataCapResetDay < 1 || *cfg.DataCapResetDay > RESETDAY_MAX {
+			return fmt.Errorf("data_cap_reset_day is incorrect: %d, should be between %d and %d", *cfg.DataCapResetDay, 1, RESETDAY_MAX)
+		}
+		ifi.DataCapResetDay = *cfg.DataCapResetDay
+	}
+
+	ifi.DataCapPolicy = DATACAP_DEMOTE
+	if cfg.DataCapPolicy != nil {
+		switch *cfg.DataCapPolicy {
+		case DATACAP_DEMOTE, DATACAP_ADMINDOWN, DATACAP_WARN:
+			ifi.DataCapPolicy = *cfg.DataCapPolicy
+		default:
+			return fmt.Errorf("data_cap_policy is incorrect: %q, should be one of %s, %s or %s", *cfg.DataCapPolicy, DATACAP_DEMOTE, DATACAP_ADMINDOWN, DATACAP_WARN)
+		}
+	}
+
+	// a demoted interface is kept as a backup, behind the
+	// routes of the interfaces with a lower metric
+	if ifi.DataCapPolicy == DATACAP_DEMOTE {
+		if ifi.Table == 0 { // route sync must be enabled
+			return fmt.Errorf("table is incorrect: must be set to non-zero for data_cap_policy %s to work", DATACAP_DEMOTE)
+		}
+		ifi.DataCapMetric = DEF_DATACAPMETRIC
+		if cfg.DataCapMetric != nil {
+			if *cfg.DataCapMetric < 1 || *cfg.DataCapMetric > METRIC_MAX {
+				return fmt.Errorf("data_cap_metric is incorrect: %d, should be between %d and %d", *cfg.DataCapMetric, 1, METRIC_MAX)
+			}
+			ifi.DataCapMetric = uint32(*cfg.DataCapMetric)
+		}
+		if ifi.DataCapMetric <= ifi.Metric {
+			return fmt.Errorf("data_cap_metric is incorrect: %d, should be above the metric %d", ifi.DataCapMetric, ifi.Metric)
+		}
+	} else if cfg.DataCapMetric != nil {
+		return fmt.Errorf("data_cap_metric is incorrect: data_cap_policy must be %s for data_cap_metric to work", DATACAP_DEMOTE)
+	}
+
+	ifi.DataCapWarnings = DEF_DATACAPWARNINGS
+	if cfg.DataCapWarnings != nil {
+		ifi.DataCapWarnings = nil
+		for _, percent := range cfg.DataCapWarnings {
+			if percent < 1 || percent > 99 {
+				return fmt.Errorf("data_cap_warnings is incorrect: %d, should be between %d and %d", percent, 1, 99)
+			}
+			ifi.DataCapWarnings = append(ifi.DataCapWarnings, percent)
+		}
+		sort.Ints(ifi.DataCapWarnings)
+	}
+
+	if ifi.DataCapInterval, err = parseDuration(cfg.DataCapInterval, DEF_DATACAPINTERVAL); err != nil {
+		return err
+	}
+	if ifi.DataCapInterval <= 0 {
+		return fmt.Errorf("data_cap_interval is incorrect: %s, should be positive", ifi.DataCapInterval)
+	}
+	if cfg.DataCapAction != nil {
+		ifi.DataCapAction = *cfg.DataCapAction
+	}
+	return nil
+}
+
+// byteUnits are the units of a size, the decimal units as used
+// by the providers of metered links and the binary units.
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseBytes parses a size in bytes, such as 1073741824, 50GB or 1.5TiB
+func parseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	size := uint64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			size = unit.size
+			break
+		}
+	}
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if n > math.MaxUint64/size {
+			return 0, fmt.Errorf("size is too large")
+		}
+		return n * size, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("should be a size in bytes, with an optional unit such as MB, GB or GiB")
+	}
+	if f*float64(size) >= math.MaxUint64 {
+		return 0, fmt.Errorf("size is too large")
+	}
+	return uint64(f * float64(size)), nil
+}
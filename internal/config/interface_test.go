@@ -0,0 +1,218 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{in: "1073741824", want: 1073741824, ok: true},
+		{in: "0", want: 0, ok: true},
+		{in: "512B", want: 512, ok: true},
+		{in: "1KB", want: 1000, ok: true},
+		{in: "1KiB", want: 1024, ok: true},
+		{in: "10 MB", want: 10e6, ok: true},
+		{in: "50GB", want: 50e9, ok: true},
+		{in: "2GiB", want: 2 << 30, ok: true},
+		{in: "1.5TiB", want: 3 << 39, ok: true},
+		{in: "0.5KB", want: 500, ok: true},
+		{in: " 3TB ", want: 3e12, ok: true},
+		{in: "18446744073709551615", want: 18446744073709551615, ok: true},
+		{in: "20000000TB"},
+		{in: "17179869184GiB"},
+		{in: "1e30"},
+		{in: ""},
+		{in: "GB"},
+		{in: "abc"},
+		{in: "-1"},
+		{in: "-1GB"},
+		{in: "1.5XB"},
+		{in: "NaN"},
+		{in: "Inf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseBytes(tt.in)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("parseBytes = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBytes: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseBytes = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostUpDown(t *testing.T) {
+	// hosts of weight 1, 2 and 3, at least a weight of 3 up
+	ifi := &Interface{
+		MinimumWeight: 3,
+		totalWeightv4: 6,
+		totalHostsv4:  3,
+	}
+	steps := []struct {
+		up      bool
+		weight  int
+		crossed bool
+		hosts   int32
+		total   int32
+	}{
+		{up: true, weight: 1, hosts: 1, total: 1},
+		{up: true, weight: 2, crossed: true, hosts: 2, total: 3},
+		{up: true, weight: 3, hosts: 3, total: 6},
+		{up: false, weight: 3, hosts: 2, total: 3},
+		{up: false, weight: 1, crossed: true, hosts: 1, total: 2},
+		{up: false, weight: 2, hosts: 0, total: 0},
+	}
+
+	for i, step := range steps {
+		var crossed bool
+		if step.up {
+			crossed = ifi.HostUp(unix.AF_INET, step.weight)
+		} else {
+			crossed = ifi.HostDown(unix.AF_INET, step.weight)
+		}
+		if crossed != step.crossed {
+			t.Fatalf("step %d: crossed the minimum = %t, want %t", i, crossed, step.crossed)
+		}
+		if hosts, total := ifi.UpHosts(unix.AF_INET), ifi.Up4(); hosts != step.hosts || total != step.total {
+			t.Fatalf("step %d: %d hosts of weight %d up, want %d of weight %d", i, hosts, total, step.hosts, step.total)
+		}
+	}
+	if hosts, total := ifi.UpHosts(unix.AF_INET6), ifi.Up6(); hosts != 0 || total != 0 {
+		t.Fatalf("%d ipv6 hosts of weight %d up, want none", hosts, total)
+	}
+
+	ifi.HostUp(unix.AF_INET, 2)
+	ifi.LinkDown()
+	if hosts, total := ifi.UpHosts(unix.AF_INET), ifi.Up4(); hosts != 0 || total != 0 {
+		t.Fatalf("%d hosts of weight %d up after the link went down, want none", hosts, total)
+	}
+}
+
+func TestParseDataCapMetric(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(i int) *int { return &i }
+
+	tests := []struct {
+		name   string
+		table  uint32
+		metric uint32
+		policy *string
+		value  *int
+		want   uint32
+		ok     bool
+	}{
+		{name: "default", table: 2, want: DEF_DATACAPMETRIC, ok: true},
+		{name: "set", table: 2, metric: 100, value: num(200), want: 200, ok: true},
+		{name: "without table"},
+		{name: "not above the metric", table: 2, metric: 100, value: num(100)},
+		{name: "beyond the maximum", table: 2, value: num(METRIC_MAX + 1)},
+		{name: "admin down", policy: str(DATACAP_ADMINDOWN), ok: true},
+		{name: "admin down with a metric", table: 2, policy: str(DATACAP_ADMINDOWN), value: num(200)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ifi := &Interface{Table: tt.table, Metric: tt.metric}
+			cfg := cfgInterface{DataCap: str("1GB"), DataCapPolicy: tt.policy, DataCapMetric: tt.value}
+			err := parseDataCap(cfg, ifi)
+			if tt.ok != (err == nil) {
+				t.Fatalf("parseDataCap() error = %v, want ok %t", err, tt.ok)
+			}
+			if err == nil && ifi.DataCapMetric != tt.want {
+				t.Fatalf("data cap metric = %d, want %d", ifi.DataCapMetric, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMinimum(t *testing.T) {
+	num := func(i int) *int { return &i }
+	host := func(host string, weight int) cfgHost {
+		return cfgHost{Host: host, Weight: num(weight)}
+	}
+
+	tests := []struct {
+		name          string
+		hosts         []cfgHost
+		autoGateway   bool
+		minimumUp     *int
+		minimumWeight *int
+		want          int
+		ok            bool
+	}{
+		{name: "default", hosts: []cfgHost{host("192.0.2.1", 1)}, want: 1, ok: true},
+		{name: "all hosts", hosts: []cfgHost{host("192.0.2.1", 1), host("192.0.2.2", 1)}, minimumUp: num(2), want: 2, ok: true},
+		{name: "more than the hosts", hosts: []cfgHost{host("192.0.2.1", 1), host("192.0.2.2", 1)}, minimumUp: num(3)},
+		{name: "weighted hosts", hosts: []cfgHost{host("192.0.2.1", 2), host("192.0.2.2", 3)}, minimumUp: num(4), want: 4, ok: true},
+		{name: "a host per family", hosts: []cfgHost{host("192.0.2.1", 1), host("2001:db8::1", 1)}, minimumUp: num(2)},
+		{
+			name:        "gateway counts",
+			hosts:       []cfgHost{host("192.0.2.1", 1), host("2001:db8::1", 1)},
+			autoGateway: true,
+			minimumUp:   num(2),
+			want:        2,
+			ok:          true,
+		},
+		{name: "hostname for both families", hosts: []cfgHost{host("example.com", 2)}, minimumWeight: num(2), want: 2, ok: true},
+		{
+			name:      "every family must reach the minimum",
+			hosts:     []cfgHost{host("192.0.2.1", 3), host("2001:db8::1", 1)},
+			minimumUp: num(2),
+		},
+		{
+			name:          "weight of the lightest family",
+			hosts:         []cfgHost{host("192.0.2.1", 3), host("2001:db8::1", 2)},
+			minimumWeight: num(2),
+			want:          2,
+			ok:            true,
+		},
+		{name: "zero", hosts: []cfgHost{host("192.0.2.1", 1)}, minimumWeight: num(0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := cfgInterface{
+				Name:          "test0",
+				Hosts:         tt.hosts,
+				AutoGateway:   tt.autoGateway,
+				MinimumUp:     tt.minimumUp,
+				MinimumWeight: tt.minimumWeight,
+			}
+			ifi, err := parseInterface(cfg, &Config{})
+			if tt.ok != (err == nil) {
+				t.Fatalf("parseInterface() error = %v, want ok %t", err, tt.ok)
+			}
+			if err == nil && ifi.MinimumWeight != tt.want {
+				t.Fatalf("minimum weight = %d, want %d", ifi.MinimumWeight, tt.want)
+			}
+		})
+	}
+}
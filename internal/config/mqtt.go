@@ -0,0 +1,93 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/mqtt"
+)
+
+// MQTT is the broker that receives the state
+// of the interfaces and the events of transitions.
+type MQTT struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	TopicPrefix string
+	Commands    bool
+
+	KeepAlive time.Duration
+	QueueSize int
+}
+
+func parseMQTT(cfg cfgMQTT) (*MQTT, error) {
+	var err error
+
+	if _, _, err := mqtt.ParseBroker(cfg.Broker); err != nil {
+		return nil, fmt.Errorf("broker is incorrect: %q: %v", cfg.Broker, err)
+	}
+	if cfg.Username == "" && cfg.Password != "" {
+		return nil, fmt.Errorf("username is incorrect: must be set with password")
+	}
+	m := &MQTT{
+		Broker:   cfg.Broker,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Commands: cfg.Commands,
+	}
+
+	if cfg.ClientID != nil {
+		if *cfg.ClientID == "" || len(*cfg.ClientID) > 65535 {
+			return nil, fmt.Errorf("client_id is incorrect: %q, should be between %d and %d characters", *cfg.ClientID, 1, 65535)
+		}
+		m.ClientID = *cfg.ClientID
+	} else {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("client_id is incorrect: could not get the hostname: %v", err)
+		}
+		m.ClientID = "hodos-" + hostname
+	}
+
+	m.TopicPrefix = DEF_MQTTTOPICPREFIX
+	if cfg.TopicPrefix != nil {
+		prefix := strings.TrimSuffix(*cfg.TopicPrefix, "/")
+		if prefix == "" || strings.ContainsAny(prefix, "+#") {
+			return nil, fmt.Errorf("topic_prefix is incorrect: %q, should be a topic without wildcards", *cfg.TopicPrefix)
+		}
+		m.TopicPrefix = prefix
+	}
+
+	if m.KeepAlive, err = parseDuration(cfg.KeepAlive, DEF_MQTTKEEPALIVE); err != nil {
+		return nil, err
+	}
+	if m.KeepAlive < time.Second || m.KeepAlive > KEEPALIVE_MAX {
+		return nil, fmt.Errorf("keep_alive is incorrect: %s, should be between %s and %s", m.KeepAlive, time.Second, KEEPALIVE_MAX)
+	}
+
+	m.QueueSize = DEF_MQTTQUEUE
+	if cfg.QueueSize != nil {
+		if *cfg.QueueSize < 1 || *cfg.QueueSize > QUEUE_MAX {
+			return nil, fmt.Errorf("queue_size is incorrect: %d, should be between %d and %d", *cfg.QueueSize, 1, QUEUE_MAX)
+		}
+		m.QueueSize = *cfg.QueueSize
+	}
+
+	return m, nil
+}
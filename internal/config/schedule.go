@@ -0,0 +1,89 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/hodos/internal/schedule"
+)
+
+// A Schedule changes the metric, minimum weight or
+// admin state of an interface at the times of its cron spec.
+type Schedule struct {
+	Name      string
+	Cron      *schedule.Cron
+	Interface string
+
+	Metric        uint32 // 0 keeps the metric
+	MinimumWeight int    // 0 keeps the minimum weight
+	Admin         string // empty keeps the admin state
+}
+
+func parseSchedule(cfg cfgSchedule, c *Config) (*Schedule, error) {
+	var err error
+
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name is incorrect: must be set")
+	}
+	s := &Schedule{
+		Name:      cfg.Name,
+		Interface: cfg.Interface,
+	}
+
+	if s.Cron, err = schedule.Parse(cfg.Cron); err != nil {
+		return nil, err
+	}
+
+	var ifi *Interface
+	for i := range c.Interfaces {
+		if c.Interfaces[i].Name == cfg.Interface {
+			ifi = &c.Interfaces[i]
+		}
+	}
+	if ifi == nil {
+		return nil, fmt.Errorf("interface is incorrect: %q is not configured", cfg.Interface)
+	}
+
+	if cfg.Metric != nil {
+		if *cfg.Metric < 1 || *cfg.Metric > METRIC_MAX {
+			return nil, fmt.Errorf("metric is incorrect: %d, should be between %d and %d", *cfg.Metric, 1, METRIC_MAX)
+		}
+		if ifi.Table == 0 { // route sync must be enabled
+			return nil, fmt.Errorf("table is incorrect: must be set to non-zero on %q for metric to work", ifi.Name)
+		}
+		s.Metric = uint32(*cfg.Metric)
+	}
+
+	if cfg.MinimumWeight != nil {
+		total := ifi.maxMinimum()
+		if *cfg.MinimumWeight > total || *cfg.MinimumWeight < 1 {
+			return nil, fmt.Errorf("minimum_weight is incorrect: %d, should be between %d and %d", *cfg.MinimumWeight, 1, total)
+		}
+		s.MinimumWeight = *cfg.MinimumWeight
+	}
+
+	if cfg.Admin != nil {
+		switch *cfg.Admin {
+		case ADMIN_DOWN, ADMIN_UP, FORCE_UP:
+			s.Admin = *cfg.Admin
+		default:
+			return nil, fmt.Errorf("admin is incorrect: %q, should be one of %s, %s or %s", *cfg.Admin, ADMIN_DOWN, ADMIN_UP, FORCE_UP)
+		}
+	}
+
+	if s.Metric == 0 && s.MinimumWeight == 0 && s.Admin == "" {
+		return nil, fmt.Errorf("schedule %q changes nothing, set metric, minimum_weight or admin", s.Name)
+	}
+	return s, nil
+}
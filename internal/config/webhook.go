@@ -0,0 +1,96 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// A Webhook receives the events of the
+// state transitions as json payloads.
+type Webhook struct {
+	URL    string
+	Secret string
+	Events map[string]bool
+
+	Timeout   time.Duration
+	Retries   int
+	Backoff   time.Duration
+	QueueSize int
+}
+
+// Wants returns if the event should be posted to this webhook
+func (w Webhook) Wants(event string) bool {
+	return w.Events[event]
+}
+
+func parseWebhook(cfg cfgWebhook) (*Webhook, error) {
+	var err error
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url is incorrect: %q, should be an http or https url", cfg.URL)
+	}
+	w := &Webhook{
+		URL:    cfg.URL,
+		Secret: cfg.Secret,
+		Events: make(map[string]bool),
+	}
+
+	for _, event := range cfg.Events {
+		switch event {
+		case EVENT_FAMILY, EVENT_HOST, EVENT_ADMIN:
+			w.Events[event] = true
+		default:
+			return nil, fmt.Errorf("events is incorrect: %q, should be one of %s, %s or %s", event, EVENT_FAMILY, EVENT_HOST, EVENT_ADMIN)
+		}
+	}
+	if len(w.Events) == 0 {
+		w.Events[EVENT_FAMILY] = true
+		w.Events[EVENT_HOST] = true
+		w.Events[EVENT_ADMIN] = true
+	}
+
+	if w.Timeout, err = parseDuration(cfg.Timeout, DEF_WEBHOOKTIMEOUT); err != nil {
+		return nil, err
+	}
+	if w.Timeout <= 0 {
+		return nil, fmt.Errorf("timeout is incorrect: %s, should be positive", w.Timeout)
+	}
+	if w.Backoff, err = parseDuration(cfg.Backoff, DEF_WEBHOOKBACKOFF); err != nil {
+		return nil, err
+	}
+	if w.Backoff <= 0 {
+		return nil, fmt.Errorf("backoff is incorrect: %s, should be positive", w.Backoff)
+	}
+
+	w.Retries = DEF_WEBHOOKRETRIES
+	if cfg.Retries != nil {
+		if *cfg.Retries < 0 || *cfg.Retries > RETRIES_MAX {
+			return nil, fmt.Errorf("retries is incorrect: %d, should be between %d and %d", *cfg.Retries, 0, RETRIES_MAX)
+		}
+		w.Retries = *cfg.Retries
+	}
+
+	w.QueueSize = DEF_WEBHOOKQUEUE
+	if cfg.QueueSize != nil {
+		if *cfg.QueueSize < 1 || *cfg.QueueSize > QUEUE_MAX {
+			return nil, fmt.Errorf("queue_size is incorrect: %d, should be between %d and %d", *cfg.QueueSize, 1, QUEUE_MAX)
+		}
+		w.QueueSize = *cfg.QueueSize
+	}
+
+	return w, nil
+}
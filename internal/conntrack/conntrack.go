@@ -0,0 +1,228 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ctMsgNew    = 0 // IPCTNL_MSG_CT_NEW
+	ctMsgGet    = 1 // IPCTNL_MSG_CT_GET
+	ctMsgDelete = 2 // IPCTNL_MSG_CT_DELETE
+
+	ctaTupleOrig  = 1  // CTA_TUPLE_ORIG
+	ctaTupleReply = 2  // CTA_TUPLE_REPLY
+	ctaMark       = 8  // CTA_MARK
+	ctaID         = 12 // CTA_ID
+	ctaZone       = 18 // CTA_ZONE
+
+	ctaTupleIP = 1 // CTA_TUPLE_IP
+	ctaIPv4Dst = 2 // CTA_IP_V4_DST
+	ctaIPv6Dst = 4 // CTA_IP_V6_DST
+)
+
+// entry is the part of a conntrack entry that is needed to delete it
+type entry struct {
+	orig     []byte // the raw CTA_TUPLE_ORIG attribute
+	replyDst net.IP
+	mark     uint32
+	id       []byte
+	zone     []byte
+}
+
+// Flush deletes the conntrack entries of the family whose reply
+// tuple is destined to one of addrs, such as the connections that
+// were masqueraded behind the address of an interface.
+// It returns the number of entries deleted.
+func Flush(family uint8, addrs []net.IP) (int, error) {
+	return forEach(family, addrs, func(c *netlink.Conn, e entry) (bool, error) {
+		return true, deleteEntry(c, family, e)
+	})
+}
+
+// Mark sets the connmark of the conntrack entries of the family whose
+// reply tuple is destined to one of addrs, and that have no connmark yet.
+// It returns the number of entries marked.
+func Mark(family uint8, addrs []net.IP, mark uint32) (int, error) {
+	return forEach(family, addrs, func(c *netlink.Conn, e entry) (bool, error) {
+		if e.mark != 0 {
+			return false, nil
+		}
+		return true, markEntry(c, family, e, mark)
+	})
+}
+
+// forEach calls fn for the conntrack entries of the family whose reply
+// tuple is destined to one of addrs, and returns the number of entries
+// fn handled.
+func forEach(family uint8, addrs []net.IP, fn func(c *netlink.Conn, e entry) (bool, error)) (int, error) {
+	if len(addrs) == 0 {
+		return 0, nil
+	}
+
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	msgs, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ctMsgGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: nfgenmsg(family),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	handled := 0
+	for _, msg := range msgs {
+		e, err := parseEntry(msg.Data)
+		if err != nil || !contains(addrs, e.replyDst) {
+			continue
+		}
+		ok, err := fn(c, e)
+		if err != nil {
+			// the entry may have expired in the meantime
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return handled, err
+		}
+		if ok {
+			handled++
+		}
+	}
+	return handled, nil
+}
+
+func deleteEntry(c *netlink.Conn, family uint8, e entry) error {
+	return execute(c, ctMsgDelete, family, e, nil)
+}
+
+// markEntry updates the connmark of an existing entry
+func markEntry(c *netlink.Conn, family uint8, e entry, mark uint32) error {
+	return execute(c, ctMsgNew, family, e, func(ae *netlink.AttributeEncoder) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, mark)
+		ae.Bytes(ctaMark, b)
+	})
+}
+
+// execute sends a message about the entry, identified by its original
+// tuple, with the extra attributes added by attrs.
+func execute(c *netlink.Conn, typ uint16, family uint8, e entry, attrs func(ae *netlink.AttributeEncoder)) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(netlink.Nested|ctaTupleOrig, e.orig)
+	if e.id != nil {
+		ae.Bytes(ctaID, e.id)
+	}
+	if e.zone != nil {
+		ae.Bytes(ctaZone, e.zone)
+	}
+	if attrs != nil {
+		attrs(ae)
+	}
+	b, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	// without the create flag, a new message updates the entry
+	_, err = c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | typ),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenmsg(family), b...),
+	})
+	return err
+}
+
+// nfgenmsg returns the netfilter header for the family
+func nfgenmsg(family uint8) []byte {
+	return []byte{family, unix.NFNETLINK_V0, 0, 0}
+}
+
+func parseEntry(b []byte) (entry, error) {
+	var e entry
+	if len(b) < 4 {
+		return e, errors.New("conntrack: message too short")
+	}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return e, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			e.orig = ad.Bytes()
+		case ctaTupleReply:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				e.replyDst = tupleDst(nad)
+				return nil
+			})
+		case ctaMark:
+			e.mark = ad.Uint32()
+		case ctaID:
+			e.id = ad.Bytes()
+		case ctaZone:
+			e.zone = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return e, err
+	}
+	if e.orig == nil || e.replyDst == nil {
+		return e, errors.New("conntrack: incomplete entry")
+	}
+	return e, nil
+}
+
+// tupleDst returns the destination address of a tuple
+func tupleDst(ad *netlink.AttributeDecoder) net.IP {
+	var dst net.IP
+	for ad.Next() {
+		if ad.Type() != ctaTupleIP {
+			continue
+		}
+		ad.Nested(func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				switch nad.Type() {
+				case ctaIPv4Dst, ctaIPv6Dst:
+					dst = net.IP(nad.Bytes())
+				}
+			}
+			return nil
+		})
+	}
+	return dst
+}
+
+func contains(addrs []net.IP, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
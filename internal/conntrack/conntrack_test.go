@@ -0,0 +1,228 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+const ctaIPv4Src = 1 // CTA_IP_V4_SRC
+
+// tuple encodes a tuple from src to dst
+func tuple(t *testing.T, src, dst net.IP) []byte {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.Nested(netlink.Nested|ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+		nae.Bytes(ctaIPv4Src, src.To4())
+		nae.Bytes(ctaIPv4Dst, dst.To4())
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+// message encodes a conntrack entry of a connection from a client
+// to a server, masqueraded behind masq, with the extra attributes
+func message(t *testing.T, masq net.IP, attrs func(ae *netlink.AttributeEncoder)) []byte {
+	t.Helper()
+	client, server := net.IPv4(10, 0, 0, 2), net.IPv4(198, 51, 100, 1)
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Bytes(netlink.Nested|ctaTupleOrig, tuple(t, client, server))
+	ae.Bytes(netlink.Nested|ctaTupleReply, tuple(t, server, masq))
+	if attrs != nil {
+		attrs(ae)
+	}
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return append(nfgenmsg(unix.AF_INET), b...)
+}
+
+func TestParseEntry(t *testing.T) {
+	masq := net.IPv4(192, 0, 2, 1)
+
+	e, err := parseEntry(message(t, masq, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(ctaMark, 100)
+		ae.Bytes(ctaID, []byte{0, 0, 0, 7})
+		ae.Bytes(ctaZone, []byte{0, 1})
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !e.replyDst.Equal(masq) {
+		t.Fatalf("reply destination = %s, want %s", e.replyDst, masq)
+	}
+	if !bytes.Equal(e.orig, tuple(t, net.IPv4(10, 0, 0, 2), net.IPv4(198, 51, 100, 1))) {
+		t.Fatalf("original tuple = %x, want the tuple from the client", e.orig)
+	}
+	if e.mark != 100 || !bytes.Equal(e.id, []byte{0, 0, 0, 7}) || !bytes.Equal(e.zone, []byte{0, 1}) {
+		t.Fatalf("entry = %+v, want mark 100, id 7 and zone 1", e)
+	}
+
+	e, err = parseEntry(message(t, masq, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.mark != 0 || e.id != nil || e.zone != nil {
+		t.Fatalf("entry = %+v, want no mark, id or zone", e)
+	}
+}
+
+func TestParseEntryInvalid(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(ctaMark, 100)
+	noTuples, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "short", b: []byte{unix.AF_INET, 0}},
+		{name: "no tuples", b: append(nfgenmsg(unix.AF_INET), noTuples...)},
+		{name: "truncated attribute", b: append(nfgenmsg(unix.AF_INET), 8, 0, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseEntry(tt.b); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestExecute(t *testing.T) {
+	e, err := parseEntry(message(t, net.IPv4(192, 0, 2, 1), func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(ctaID, []byte{0, 0, 0, 7})
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func(c *netlink.Conn) error
+		typ  uint16
+		mark []byte // nil for no mark
+	}{
+		{
+			name: "delete",
+			fn:   func(c *netlink.Conn) error { return deleteEntry(c, unix.AF_INET, e) },
+			typ:  ctMsgDelete,
+		},
+		{
+			name: "mark",
+			fn:   func(c *netlink.Conn) error { return markEntry(c, unix.AF_INET, e, 100) },
+			typ:  ctMsgNew,
+			mark: []byte{0, 0, 0, 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req netlink.Message
+			c := nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+				req = reqs[0]
+				// an error of 0 acknowledges the request
+				return nltest.Error(0, reqs)
+			})
+			defer c.Close()
+
+			if err := tt.fn(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | tt.typ); req.Header.Type != want {
+				t.Fatalf("type = %#x, want %#x", req.Header.Type, want)
+			}
+			// without the create flag, so an entry is never added
+			if req.Header.Flags != netlink.Request|netlink.Acknowledge {
+				t.Fatalf("flags = %s, want request and acknowledge", req.Header.Flags)
+			}
+			if !bytes.Equal(req.Data[:4], nfgenmsg(unix.AF_INET)) {
+				t.Fatalf("header = %x, want %x", req.Data[:4], nfgenmsg(unix.AF_INET))
+			}
+
+			attrs, err := netlink.UnmarshalAttributes(req.Data[4:])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := make(map[uint16][]byte)
+			for _, a := range attrs {
+				got[a.Type&^netlink.Nested] = a.Data
+			}
+			if !bytes.Equal(got[ctaTupleOrig], e.orig) {
+				t.Fatalf("original tuple = %x, want %x", got[ctaTupleOrig], e.orig)
+			}
+			if !bytes.Equal(got[ctaID], e.id) {
+				t.Fatalf("id = %x, want %x", got[ctaID], e.id)
+			}
+			if _, ok := got[ctaZone]; ok {
+				t.Fatal("zone sent for an entry without a zone")
+			}
+			if !bytes.Equal(got[ctaMark], tt.mark) {
+				t.Fatalf("mark = %x, want %x", got[ctaMark], tt.mark)
+			}
+		})
+	}
+}
+
+func TestExecuteExpired(t *testing.T) {
+	e, err := parseEntry(message(t, net.IPv4(192, 0, 2, 1), nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		return nltest.Error(int(unix.ENOENT), reqs)
+	})
+	defer c.Close()
+
+	// an entry that expired in the meantime is reported
+	// as ENOENT, which forEach skips
+	if err := deleteEntry(c, unix.AF_INET, e); !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("deleteEntry() = %v, want ENOENT", err)
+	}
+}
+
+func TestContains(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+	for _, tt := range []struct {
+		ip   net.IP
+		want bool
+	}{
+		{ip: net.IPv4(192, 0, 2, 1).To4(), want: true},
+		{ip: net.ParseIP("2001:db8::1"), want: true},
+		{ip: net.ParseIP("192.0.2.2")},
+		{ip: nil},
+	} {
+		if got := contains(addrs, tt.ip); got != tt.want {
+			t.Fatalf("contains(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,812 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package icmp
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+
+	// heartbeat is the longest the scheduler sleeps, so it
+	// goes through its loop while no events are due
+	heartbeat = time.Second
+)
+
+// Engine sends and receives the echo requests for all monitors of
+// an address family. It owns a single socket per interface and source
+// address, schedules the bursts and probes of all monitors from a
+// single goroutine and demultiplexes the replies by sequence number.
+type Engine struct {
+	family       uint8
+	ctx          context.Context
+	l            log.Logger
+	id           uint16
+	unprivileged bool
+	listen       func(m *Monitor) (net.PacketConn, error)
+
+	mu       sync.Mutex
+	sockets  map[string]*socket
+	monitors map[*Monitor]*schedule
+	probes   map[probeKey]*probe
+	events   eventQueue
+	seq      uint16
+	wake     chan struct{}
+
+	alive int64 // unix nanoseconds of the last loop, read atomically
+}
+
+// NewEngine returns an Engine for the family (unix.AF_INET or
+// unix.AF_INET6). It runs until ctx is canceled.
+func NewEngine(ctx context.Context, family uint8, opts ...EngineOption) (*Engine, error) {
+	if family != unix.AF_INET && family != unix.AF_INET6 {
+		return nil, fmt.Errorf("icmp: unsupported family %d", family)
+	}
+	e := &Engine{
+		family: family,
+		ctx:    ctx,
+		l:      log.Default(),
+		id:     uint16(rand.Intn(1 << 16)),
+
+		sockets:  make(map[string]*socket),
+		monitors: make(map[*Monitor]*schedule),
+		probes:   make(map[probeKey]*probe),
+		wake:     make(chan struct{}, 1),
+	}
+	e.listen = e.listenSocket
+
+	for _, option := range opts {
+		if err := option(e); err != nil {
+			return nil, err
+		}
+	}
+
+	go e.run()
+	return e, nil
+}
+
+// EngineOption is a functional argument to *Engine
+type EngineOption func(e *Engine) error
+
+// EngineLogger is a functional Option to set
+// a new logger for this engine
+func EngineLogger(l log.Logger) EngineOption {
+	return func(e *Engine) error {
+		e.l = l
+		return nil
+	}
+}
+
+// Unprivileged is a functional Option to use
+// unprivileged icmp datagram sockets instead of
+// raw sockets, which need CAP_NET_RAW.
+// Defaults to false.
+func Unprivileged(unprivileged bool) EngineOption {
+	return func(e *Engine) error {
+		e.unprivileged = unprivileged
+		return nil
+	}
+}
+
+// socket is an icmp socket bound to a source address
+// on an interface, shared by all monitors using it
+// with the same socket options.
+type socket struct {
+	key  string
+	conn net.PacketConn
+	refs int
+}
+
+// schedule keeps track of the burst of a monitor
+// that is currently in progress.
+type schedule struct {
+	m       *Monitor
+	sock    *socket
+	dst     net.IP
+	burst   *burst
+	removed bool
+}
+
+type burst struct {
+	// every request of the burst is answered before the deadline
+	deadline time.Time
+
+	sent, done int
+	rtts       []time.Duration
+
+	invalid, tooBig, mtu int
+
+	// a small control request is sent when none of the
+	// larger requests is answered, to detect pmtu issues
+	controlSent, controlDone, controlOK bool
+}
+
+type probeKey struct {
+	sock string
+	peer string
+	seq  uint16
+}
+
+type probe struct {
+	s       *schedule
+	burst   *burst
+	sentAt  time.Time
+	size    int
+	control bool
+
+	// set for a single request outside of a burst
+	result chan probeResult
+	mtu    int
+}
+
+// probeResult is the result of a single request
+type probeResult struct {
+	answered bool
+	mtu      int // the path mtu from an icmp error, 0 if unknown
+}
+
+type eventKind uint8
+
+const (
+	eventBurst eventKind = iota
+	eventSend
+	eventTimeout
+)
+
+type event struct {
+	at   time.Time
+	kind eventKind
+	s    *schedule
+	key  probeKey
+}
+
+// eventQueue is a min-heap of events, ordered by time
+type eventQueue []*event
+
+func (q eventQueue) Len() int            { return len(q) }
+func (q eventQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	*q = old[:n-1]
+	return e
+}
+
+// add starts scheduling bursts for the monitor,
+// the first one after burstInterval.
+func (e *Engine) add(m *Monitor, burstInterval time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sock, err := e.socket(m)
+	if err != nil {
+		return err
+	}
+	s := &schedule{m: m, sock: sock, dst: m.dst.IP}
+	e.monitors[m] = s
+	e.push(&event{at: time.Now().Add(burstInterval), kind: eventBurst, s: s})
+	return nil
+}
+
+// remove stops scheduling bursts for the monitor.
+func (e *Engine) remove(m *Monitor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.monitors[m]
+	if !ok {
+		return
+	}
+	// pending events for this monitor are dropped once they fire
+	s.removed = true
+	delete(e.monitors, m)
+	for key, p := range e.probes {
+		if p.s == s {
+			delete(e.probes, key)
+		}
+	}
+
+	e.release(s.sock)
+}
+
+// single sends a single request of size bytes for the monitor,
+// outside of its bursts, and waits for the result.
+func (e *Engine) single(ctx context.Context, m *Monitor, size int) (probeResult, error) {
+	e.mu.Lock()
+	sock, err := e.socket(m)
+	if err != nil {
+		e.mu.Unlock()
+		return probeResult{}, err
+	}
+	defer func() {
+		e.mu.Lock()
+		e.release(sock)
+		e.mu.Unlock()
+	}()
+
+	s := &schedule{m: m, sock: sock, dst: m.dst.IP}
+	now := time.Now()
+	key, err := e.send(s, now, size)
+	if err != nil {
+		e.mu.Unlock()
+		if errors.Is(err, unix.EMSGSIZE) {
+			// the kernel knows the request does not fit the path mtu
+			return probeResult{}, nil
+		}
+		return probeResult{}, err
+	}
+	result := make(chan probeResult, 1)
+	e.probes[key] = &probe{s: s, sentAt: now, size: size, result: result}
+	e.push(&event{at: now.Add(m.singleTimeout()), kind: eventTimeout, s: s, key: key})
+	e.mu.Unlock()
+
+	select {
+	case r := <-result:
+		return r, nil
+	case <-ctx.Done():
+		e.mu.Lock()
+		delete(e.probes, key)
+		e.mu.Unlock()
+		return probeResult{}, ctx.Err()
+	}
+}
+
+// release drops a reference to the socket,
+// closing it when unused. e.mu must be held.
+func (e *Engine) release(sock *socket) {
+	sock.refs--
+	if sock.refs == 0 {
+		sock.conn.Close()
+		delete(e.sockets, sock.key)
+	}
+}
+
+// socket returns the socket for the source of the monitor,
+// opening it if needed. e.mu must be held.
+func (e *Engine) socket(m *Monitor) (*socket, error) {
+	key := fmt.Sprintf("%s|%s|%d|%d|%d|%t", m.interFace, m.src, m.mark, m.ttl, m.dscp, m.dontFragment)
+	if sock, ok := e.sockets[key]; ok {
+		sock.refs++
+		return sock, nil
+	}
+
+	conn, err := e.listen(m)
+	if err != nil {
+		return nil, err
+	}
+	sock := &socket{key: key, conn: conn, refs: 1}
+	e.sockets[key] = sock
+	go e.receive(sock)
+	return sock, nil
+}
+
+// listenSocket opens an icmp socket bound to the source of the monitor.
+func (e *Engine) listenSocket(m *Monitor) (net.PacketConn, error) {
+	if e.unprivileged {
+		return e.listenDatagram(m)
+	}
+
+	network := "ip4:icmp"
+	if e.family == unix.AF_INET6 {
+		network = "ip6:ipv6-icmp"
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = setSockopts(int(fd), e.family, m)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := lc.ListenPacket(e.ctx, network, m.src)
+	if err != nil {
+		return nil, fmt.Errorf("icmp: could not listen on %q: %w", m.src, err)
+	}
+	if e.family == unix.AF_INET6 {
+		// only wake us up for echo replies and pmtu errors
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		f.Accept(ipv6.ICMPTypePacketTooBig)
+		if err := ipv6.NewPacketConn(conn).SetICMPFilter(&f); err != nil {
+			e.l.Debugf("icmp: could not set icmp filter on %q: %s", m.src, err)
+		}
+	}
+	return conn, nil
+}
+
+// listenDatagram opens an unprivileged icmp datagram socket bound to
+// the source of the monitor. The kernel only delivers the echo replies
+// for this socket, and uses the local port as echo identifier.
+func (e *Engine) listenDatagram(m *Monitor) (net.PacketConn, error) {
+	family, proto := unix.AF_INET, protocolICMP
+	if e.family == unix.AF_INET6 {
+		family, proto = unix.AF_INET6, protocolIPv6ICMP
+	}
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("icmp: could not open datagram socket: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp:"+m.src)
+	defer f.Close()
+
+	if err := setSockopts(fd, e.family, m); err != nil {
+		return nil, err
+	}
+
+	sa, err := sockaddr(e.family, m.src)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("icmp: could not bind to %q: %w", m.src, err)
+	}
+	return net.FilePacketConn(f)
+}
+
+// setSockopts binds the socket to the interface of the monitor, so
+// the probes leave through it regardless of the routing of other
+// traffic, and sets the fwmark, ttl, dscp and df of the monitor.
+func setSockopts(fd int, family uint8, m *Monitor) error {
+	if m.interFace != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, m.interFace); err != nil {
+			return fmt.Errorf("icmp: could not bind to interface %q: %w", m.interFace, err)
+		}
+	}
+	if m.mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(m.mark)); err != nil {
+			return fmt.Errorf("icmp: could not set fwmark %d: %w", m.mark, err)
+		}
+	}
+
+	level, ttl, tos := unix.IPPROTO_IP, unix.IP_TTL, unix.IP_TOS
+	mtuDiscover, mtuDo := unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	if family == unix.AF_INET6 {
+		level, ttl, tos = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, unix.IPV6_TCLASS
+		mtuDiscover, mtuDo = unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO
+	}
+	if m.ttl != 0 {
+		if err := unix.SetsockoptInt(fd, level, ttl, m.ttl); err != nil {
+			return fmt.Errorf("icmp: could not set ttl %d: %w", m.ttl, err)
+		}
+	}
+	if m.dscp != 0 {
+		if err := unix.SetsockoptInt(fd, level, tos, m.dscp<<2); err != nil {
+			return fmt.Errorf("icmp: could not set dscp %d: %w", m.dscp, err)
+		}
+	}
+	if m.dontFragment {
+		if err := unix.SetsockoptInt(fd, level, mtuDiscover, mtuDo); err != nil {
+			return fmt.Errorf("icmp: could not set don't fragment: %w", err)
+		}
+		if family == unix.AF_INET6 {
+			if err := unix.SetsockoptInt(fd, level, unix.IPV6_DONTFRAG, 1); err != nil {
+				return fmt.Errorf("icmp: could not set don't fragment: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sockaddr returns the socket address for an address
+// with an optional zone.
+func sockaddr(family uint8, address string) (unix.Sockaddr, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, err
+	}
+	if family == unix.AF_INET {
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], ipAddr.IP.To4())
+		return sa, nil
+	}
+	sa := &unix.SockaddrInet6{}
+	copy(sa.Addr[:], ipAddr.IP.To16())
+	if ipAddr.Zone != "" {
+		ifi, err := net.InterfaceByName(ipAddr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return sa, nil
+}
+
+func (e *Engine) push(ev *event) {
+	heap.Push(&e.events, ev)
+	// wake up the scheduler, it might need to fire earlier
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Alive returns when the scheduler last went through its loop,
+// or the zero time if it is not running
+func (e *Engine) Alive() time.Time {
+	if alive := atomic.LoadInt64(&e.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
+// run is the scheduler, it fires the events in order.
+func (e *Engine) run() {
+	timer := time.NewTimer(heartbeat)
+	defer timer.Stop()
+	defer atomic.StoreInt64(&e.alive, 0)
+	for {
+		atomic.StoreInt64(&e.alive, time.Now().UnixNano())
+		e.mu.Lock()
+		now := time.Now()
+		for len(e.events) > 0 && !e.events[0].at.After(now) {
+			e.fire(heap.Pop(&e.events).(*event), now)
+		}
+		wait := heartbeat
+		if len(e.events) > 0 && e.events[0].at.Sub(now) < wait {
+			wait = e.events[0].at.Sub(now)
+		}
+		e.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-e.ctx.Done():
+			e.close()
+			return
+		case <-e.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// fire handles a single event. e.mu must be held.
+func (e *Engine) fire(ev *event, now time.Time) {
+	if ev.s.removed {
+		return
+	}
+	m := ev.s.m
+	switch ev.kind {
+	case eventBurst:
+		if ev.s.burst == nil {
+			ev.s.burst = &burst{deadline: now.Add(m.burstTimeout())}
+			e.push(&event{at: now, kind: eventSend, s: ev.s})
+		}
+		// schedule the next burst regardless of how this one ends
+		e.push(&event{at: ev.at.Add(m.burstInterval), kind: eventBurst, s: ev.s})
+	case eventSend:
+		b := ev.s.burst
+		key, err := e.send(ev.s, now, m.size)
+		b.sent++
+		if err != nil {
+			if errors.Is(err, unix.EMSGSIZE) {
+				// the kernel knows the request does not fit the path mtu
+				b.tooBig++
+			}
+			m.l.Debugf("(%s) could not send echo request to %s: %s", m.interFace, ev.s.dst, err)
+			b.done++
+		} else {
+			e.probes[key] = &probe{s: ev.s, burst: b, sentAt: now, size: m.size}
+			e.push(&event{at: b.deadline, kind: eventTimeout, s: ev.s, key: key})
+		}
+		if b.sent < m.burstsize {
+			e.push(&event{at: ev.at.Add(m.interval), kind: eventSend, s: ev.s})
+		}
+		e.finish(ev.s)
+	case eventTimeout:
+		if p, ok := e.probes[ev.key]; ok {
+			delete(e.probes, ev.key)
+			p.done(false)
+			e.finish(ev.s)
+		}
+	}
+}
+
+// finish hands the statistics to the monitor
+// once every probe of the burst is done. e.mu must be held.
+func (e *Engine) finish(s *schedule) {
+	b := s.burst
+	if b == nil || b.done < s.m.burstsize {
+		return
+	}
+	if s.m.size > minSize && len(b.rtts) == 0 && b.tooBig == 0 {
+		if !b.controlSent {
+			e.sendControl(s, b)
+		}
+		if !b.controlDone {
+			return
+		}
+	}
+	s.burst = nil
+
+	stats := newStatistics(s.m.burstsize, b.rtts)
+	stats.PacketsInvalid = b.invalid
+	stats.PacketsTooBig = b.tooBig
+	stats.PathMTU = b.mtu
+	stats.PMTUIssue = b.tooBig > 0 || b.controlOK
+	select {
+	case s.m.results <- stats:
+	default:
+		// the monitor did not process the previous burst yet
+		s.m.l.Debugf("(%s) dropping icmp results for %s", s.m.interFace, s.dst)
+	}
+}
+
+// sendControl sends an echo request with the minimal size, used when
+// none of the larger requests of the burst is answered. e.mu must be held.
+func (e *Engine) sendControl(s *schedule, b *burst) {
+	b.controlSent = true
+	now := time.Now()
+	key, err := e.send(s, now, minSize)
+	if err != nil {
+		b.controlDone = true
+		return
+	}
+	e.probes[key] = &probe{s: s, burst: b, sentAt: now, size: minSize, control: true}
+	e.push(&event{at: now.Add(s.m.singleTimeout()), kind: eventTimeout, s: s, key: key})
+}
+
+// done marks the probe as done, answered or not. e.mu must be held.
+func (p *probe) done(answered bool) {
+	if p.result != nil {
+		p.result <- probeResult{answered: answered, mtu: p.mtu}
+		return
+	}
+	if p.control {
+		p.burst.controlDone = true
+		p.burst.controlOK = answered
+		return
+	}
+	p.burst.done++
+}
+
+// send writes an echo request of size bytes for the schedule.
+// e.mu must be held.
+func (e *Engine) send(s *schedule, now time.Time, size int) (probeKey, error) {
+	e.seq++
+	key := probeKey{sock: s.sock.key, peer: s.dst.String(), seq: e.seq}
+
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if e.family == unix.AF_INET6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{
+			ID:   int(e.id),
+			Seq:  int(key.seq),
+			Data: payload(now, size),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return key, err
+	}
+	var dst net.Addr = s.m.dst
+	if e.unprivileged {
+		dst = &net.UDPAddr{IP: s.m.dst.IP, Zone: s.m.dst.Zone}
+	}
+	_, err = s.sock.conn.WriteTo(b, dst)
+	return key, err
+}
+
+// receive reads echo replies from the socket until it is closed.
+func (e *Engine) receive(sock *socket) {
+	proto := protocolICMP
+	if e.family == unix.AF_INET6 {
+		proto = protocolIPv6ICMP
+	}
+	b := make([]byte, 1<<16)
+	for {
+		n, addr, err := sock.conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			e.l.Debugf("icmp: receive error on %q: %s", sock.key, err)
+			continue
+		}
+		received := time.Now()
+
+		msg, err := icmp.ParseMessage(proto, b[:n])
+		if err != nil {
+			continue
+		}
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+				continue
+			}
+			// raw sockets receive the replies for everyone, datagram
+			// sockets only ours, but with the identifier rewritten
+			if !e.unprivileged && body.ID != int(e.id) {
+				continue
+			}
+			e.reply(probeKey{sock: sock.key, peer: peerIP(addr).String(), seq: uint16(body.Seq)}, received, body.Data)
+		case *icmp.DstUnreach:
+			// fragmentation needed, the mtu is in the unused part of the header
+			if e.family != unix.AF_INET || msg.Code != 4 || n < 8 {
+				continue
+			}
+			e.tooBig(sock.key, body.Data, int(binary.BigEndian.Uint16(b[6:8])))
+		case *icmp.PacketTooBig:
+			e.tooBig(sock.key, body.Data, body.MTU)
+		}
+	}
+}
+
+// tooBig records an icmp error reporting that a request did
+// not fit the path mtu. Only raw sockets receive these.
+func (e *Engine) tooBig(sock string, quoted []byte, mtu int) {
+	dst, id, seq, ok := quotedEcho(e.family, quoted)
+	if !ok || id != int(e.id) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := probeKey{sock: sock, peer: dst.String(), seq: seq}
+	p, ok := e.probes[key]
+	if !ok {
+		return
+	}
+	delete(e.probes, key)
+	switch {
+	case p.result != nil:
+		p.mtu = mtu
+	case !p.control:
+		p.burst.tooBig++
+		if p.burst.mtu == 0 || mtu < p.burst.mtu {
+			p.burst.mtu = mtu
+		}
+	}
+	p.done(false)
+
+	m := p.s.m
+	m.l.Debugf("(%s) request to %s does not fit the path mtu of %d: icmp_seq=%d\n", m.interFace, key.peer, mtu, seq)
+	if p.s.burst == p.burst {
+		e.finish(p.s)
+	}
+}
+
+// reply records the reply for an outstanding probe
+func (e *Engine) reply(key probeKey, received time.Time, data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, ok := e.probes[key]
+	if !ok {
+		// duplicate or late reply
+		return
+	}
+	delete(e.probes, key)
+
+	m := p.s.m
+	switch {
+	case !validPayload(data, p.size):
+		m.l.Debugf("(%s) invalid reply from %s: icmp_seq=%d, %d bytes payload, expected %d\n", m.interFace, key.peer, key.seq, len(data), p.size)
+		if p.burst != nil && !p.control {
+			p.burst.invalid++
+		}
+		p.done(false)
+	case p.result != nil:
+		m.l.Debugf("(%s) %d bytes from %s: icmp_seq=%d\n", m.interFace, len(data)+8, key.peer, key.seq)
+		p.done(true)
+	case p.control:
+		m.l.Debugf("(%s) control reply from %s: icmp_seq=%d\n", m.interFace, key.peer, key.seq)
+		p.done(true)
+	default:
+		rtt := received.Sub(p.sentAt)
+		p.burst.rtts = append(p.burst.rtts, rtt)
+		p.done(true)
+		m.l.Debugf("(%s) %d bytes from %s: icmp_seq=%d time=%v\n", m.interFace, len(data)+8, key.peer, key.seq, rtt)
+	}
+	if p.s.burst == p.burst {
+		e.finish(p.s)
+	}
+}
+
+// close closes all sockets when the engine stops.
+func (e *Engine) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, sock := range e.sockets {
+		sock.conn.Close()
+		delete(e.sockets, key)
+	}
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// pingGroupRange holds the range of groups that are
+// allowed to open unprivileged icmp datagram sockets
+const pingGroupRange = "/proc/sys/net/ipv4/ping_group_range"
+
+// UnprivilegedAllowed returns true if this process is allowed
+// to open unprivileged icmp datagram sockets.
+func UnprivilegedAllowed() bool {
+	b, err := os.ReadFile(pingGroupRange)
+	if err != nil {
+		return false
+	}
+	var low, high int
+	if _, err := fmt.Sscanf(string(b), "%d %d", &low, &high); err != nil {
+		return false
+	}
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		return false
+	}
+	groups = append(groups, os.Getegid())
+	for _, gid := range groups {
+		if gid >= low && gid <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// Privileged returns true if the icmp mode ("auto", "privileged" or
+// "unprivileged") needs raw sockets. In auto mode, unprivileged sockets
+// are used when ping_group_range allows it.
+func Privileged(mode string) bool {
+	switch mode {
+	case "privileged":
+		return true
+	case "unprivileged":
+		return false
+	default:
+		return !UnprivilegedAllowed()
+	}
+}
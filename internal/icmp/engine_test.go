@@ -0,0 +1,275 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// fakeConn answers the echo requests written to it after a delay,
+// or never when the delay is negative
+type fakeConn struct {
+	delay func(n int) time.Duration
+
+	mu   sync.Mutex
+	sent []time.Time
+
+	replies chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeConn(delay func(n int) time.Duration) *fakeConn {
+	return &fakeConn{
+		delay:   delay,
+		replies: make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg, err := icmp.ParseMessage(protocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+	echo := msg.Body.(*icmp.Echo)
+
+	c.mu.Lock()
+	n := len(c.sent)
+	c.sent = append(c.sent, time.Now())
+	c.mu.Unlock()
+
+	delay := c.delay(n)
+	if delay < 0 {
+		return len(b), nil
+	}
+	reply, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: echo}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case c.replies <- reply:
+		case <-c.closed:
+		}
+	})
+	return len(b), nil
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-c.replies:
+		return copy(b, reply), &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) sentTimes() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time(nil), c.sent...)
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr                { return &net.IPAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testEngine returns an engine whose sockets are conn
+func testEngine(t *testing.T, conn *fakeConn) *Engine {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	e, err := NewEngine(ctx, unix.AF_INET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.listen = func(m *Monitor) (net.PacketConn, error) { return conn, nil }
+	return e
+}
+
+func testMonitor(t *testing.T, e *Engine, opts ...Option) *Monitor {
+	t.Helper()
+	m, err := New(context.Background(), "192.0.2.2", net.IPv4(192, 0, 2, 1), "test0", append(opts, WithEngine(e))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single burst, unless the test schedules more
+	m.burstInterval = time.Hour
+	return m
+}
+
+func constant(d time.Duration) func(int) time.Duration {
+	return func(int) time.Duration { return d }
+}
+
+func TestEngineBurst(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    func(n int) time.Duration
+		received int
+	}{
+		{
+			name:     "fast replies",
+			delay:    constant(5 * time.Millisecond),
+			received: 3,
+		},
+		{
+			// the replies take longer than the timeout, but arrive
+			// within burstsize * (timeout + interval) = 210ms
+			name:     "replies slower than the timeout",
+			delay:    constant(120 * time.Millisecond),
+			received: 3,
+		},
+		{
+			name:     "replies after the burst deadline",
+			delay:    constant(400 * time.Millisecond),
+			received: 0,
+		},
+		{
+			name:     "no replies",
+			delay:    constant(-1),
+			received: 0,
+		},
+		{
+			name: "one lost reply",
+			delay: func(n int) time.Duration {
+				if n == 1 {
+					return -1
+				}
+				return 5 * time.Millisecond
+			},
+			received: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(tt.delay)
+			e := testEngine(t, conn)
+			m := testMonitor(t, e, Interval(20*time.Millisecond), Timeout(50*time.Millisecond), BurstSize(3))
+
+			start := time.Now()
+			if err := e.add(m, 0); err != nil {
+				t.Fatal(err)
+			}
+			defer e.remove(m)
+
+			var stats Statistics
+			select {
+			case stats = <-m.results:
+			case <-time.After(2 * time.Second):
+				t.Fatal("no statistics for the burst")
+			}
+			elapsed := time.Since(start)
+
+			if stats.PacketsSent != 3 || stats.PacketsRecv != tt.received {
+				t.Fatalf("sent/received = %d/%d, want %d/%d", stats.PacketsSent, stats.PacketsRecv, 3, tt.received)
+			}
+			if tt.received < 3 && elapsed < m.burstTimeout() {
+				t.Fatalf("burst with lost replies finished after %s, before its deadline of %s", elapsed, m.burstTimeout())
+			}
+			if tt.received == 3 && stats.PacketLoss != 0 {
+				t.Fatalf("packet loss = %v, want 0", stats.PacketLoss)
+			}
+		})
+	}
+}
+
+func TestEngineSchedule(t *testing.T) {
+	conn := newFakeConn(constant(time.Millisecond))
+	e := testEngine(t, conn)
+	interval, burstInterval := 30*time.Millisecond, 200*time.Millisecond
+	m := testMonitor(t, e, Interval(interval), Timeout(10*time.Millisecond), BurstSize(3))
+	m.burstInterval = burstInterval
+
+	start := time.Now()
+	if err := e.add(m, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-m.results:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no statistics for burst %d", i)
+		}
+	}
+	e.remove(m)
+
+	sent := conn.sentTimes()
+	if len(sent) != 6 {
+		t.Fatalf("sent %d requests, want 6", len(sent))
+	}
+	if d := sent[0].Sub(start); d < 50*time.Millisecond {
+		t.Fatalf("first burst started after %s, want at least %s", d, 50*time.Millisecond)
+	}
+	for i := 1; i < len(sent); i++ {
+		want := interval
+		if i == 3 {
+			want = burstInterval - 2*interval
+		}
+		if d := sent[i].Sub(sent[i-1]); d < want-5*time.Millisecond {
+			t.Fatalf("request %d sent %s after the previous one, want %s", i, d, want)
+		}
+	}
+	if d := sent[3].Sub(sent[0]); d < burstInterval-5*time.Millisecond {
+		t.Fatalf("second burst started %s after the first, want %s", d, burstInterval)
+	}
+}
+
+func TestEngineSingle(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		answered bool
+	}{
+		{name: "answered", delay: 5 * time.Millisecond, answered: true},
+		{name: "answered after the timeout", delay: 40 * time.Millisecond, answered: true},
+		{name: "not answered", delay: -1, answered: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(constant(tt.delay))
+			e := testEngine(t, conn)
+			m := testMonitor(t, e, Interval(30*time.Millisecond), Timeout(20*time.Millisecond))
+
+			start := time.Now()
+			r, err := e.single(context.Background(), m, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.answered != tt.answered {
+				t.Fatalf("answered = %t, want %t", r.answered, tt.answered)
+			}
+			if !tt.answered && time.Since(start) < m.singleTimeout() {
+				t.Fatalf("request timed out after %s, want %s", time.Since(start), m.singleTimeout())
+			}
+		})
+	}
+}
@@ -14,12 +14,14 @@ package icmp
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/jsimonetti/hodos/internal/log"
-	ping "github.com/prometheus-community/pro-bing"
 )
 
 type Monitor struct {
@@ -34,6 +36,17 @@ type Monitor struct {
 	l                 log.Logger
 	interval, timeout time.Duration
 	burstsize         int
+	burstInterval     time.Duration
+	mark              uint32
+	size, ttl, dscp   int
+	dontFragment      bool
+
+	engine  *Engine
+	results chan Statistics
+
+	lastMu   sync.Mutex
+	last     Statistics
+	lastTime time.Time
 
 	wg *sync.WaitGroup
 }
@@ -48,8 +61,10 @@ func New(ctx context.Context, src string, dst net.IP, ifi string, opts ...Option
 		upFunc:    func() {},
 		l:         log.Default(),
 		interval:  500 * time.Millisecond,
-		timeout:   200 * time.Millisecond,
+		timeout:   250 * time.Millisecond,
 		burstsize: 3,
+		size:      minSize,
+		results:   make(chan Statistics, 1),
 		wg:        &sync.WaitGroup{},
 	}
 	m.ctx, m.ctxCancel = context.WithCancel(ctx)
@@ -60,6 +75,10 @@ func New(ctx context.Context, src string, dst net.IP, ifi string, opts ...Option
 		}
 	}
 
+	if m.engine == nil {
+		return nil, errors.New("empty icmp engine")
+	}
+
 	if m.dst.IP.To4() == nil {
 		m.src = m.src + "%" + m.interFace
 	}
@@ -87,8 +106,11 @@ func Interval(t time.Duration) Option {
 }
 
 // Timeout is a functional Option to set
-// a timeout for replies.
-// Defaults to 200 miliseconds.
+// a timeout for replies. The replies of a burst are
+// awaited until burstsize * (timeout + interval) after
+// the start of the burst, so the replies to the first
+// requests of a burst can take longer than the timeout.
+// Defaults to 250 miliseconds.
 func Timeout(t time.Duration) Option {
 	return func(m *Monitor) error {
 		m.timeout = t
@@ -106,6 +128,66 @@ func BurstSize(s int) Option {
 	}
 }
 
+// Mark is a functional Option to set
+// the fwmark (SO_MARK) of the requests.
+// Defaults to 0 (unmarked).
+func Mark(mark uint32) Option {
+	return func(m *Monitor) error {
+		m.mark = mark
+		return nil
+	}
+}
+
+// Size is a functional Option to set
+// the payload size of the requests in bytes.
+// Defaults to 8, which is also the minimum.
+func Size(size int) Option {
+	return func(m *Monitor) error {
+		if size < minSize || size > maxSize {
+			return fmt.Errorf("icmp: size should be between %d and %d", minSize, maxSize)
+		}
+		m.size = size
+		return nil
+	}
+}
+
+// TTL is a functional Option to set the
+// TTL or hop limit of the requests.
+// Defaults to 0 (system default).
+func TTL(ttl int) Option {
+	return func(m *Monitor) error {
+		if ttl < 0 || ttl > 255 {
+			return fmt.Errorf("icmp: ttl should be between 1 and 255")
+		}
+		m.ttl = ttl
+		return nil
+	}
+}
+
+// DSCP is a functional Option to set
+// the DSCP of the requests.
+// Defaults to 0.
+func DSCP(dscp int) Option {
+	return func(m *Monitor) error {
+		if dscp < 0 || dscp > 63 {
+			return fmt.Errorf("icmp: dscp should be between 0 and 63")
+		}
+		m.dscp = dscp
+		return nil
+	}
+}
+
+// DontFragment is a functional Option to set the
+// Don't Fragment bit on the requests, so requests that
+// are larger than the path mtu are never fragmented.
+// Defaults to false.
+func DontFragment(df bool) Option {
+	return func(m *Monitor) error {
+		m.dontFragment = df
+		return nil
+	}
+}
+
 // Logger is a functional Option to set
 // a new logger for this monitor
 func Logger(l log.Logger) Option {
@@ -115,68 +197,112 @@ func Logger(l log.Logger) Option {
 	}
 }
 
-func (m *Monitor) run() error {
-	m.wg.Add(1)
-	defer m.wg.Done()
+// WithEngine is a functional Option to set
+// the engine that sends the requests for this monitor
+func WithEngine(e *Engine) Option {
+	return func(m *Monitor) error {
+		m.engine = e
+		return nil
+	}
+}
 
-	m.l.Debugf("starting monitor on %q for %s", m.interFace, m.dst.String())
+// burstTimeout returns how long after the start of a
+// burst the replies to all its requests are awaited
+func (m *Monitor) burstTimeout() time.Duration {
+	return time.Duration(m.burstsize) * (m.timeout + m.interval)
+}
 
-	pinger := ping.New("")
-	defer pinger.Stop()
+// singleTimeout returns how long the reply to a request
+// outside of a burst is awaited, as long as a burst of one
+func (m *Monitor) singleTimeout() time.Duration {
+	return m.timeout + m.interval
+}
+
+// Statistics are the results of a single burst
+type Statistics struct {
+	PacketsSent int
+	PacketsRecv int
+	PacketLoss  float64 // percentage
 
-	pinger.SetIPAddr(m.dst)
-	pinger.Source = m.src
-	pinger.Count = m.burstsize
-	pinger.Timeout = time.Duration(m.burstsize) * (m.timeout + m.interval)
-	pinger.Interval = m.interval
-	pinger.SetPrivileged(true)
+	PacketsInvalid int  // replies with an unexpected size or payload
+	PacketsTooBig  int  // requests that did not fit the path mtu
+	PathMTU        int  // the path mtu reported for the requests that were too big, 0 if unknown
+	PMTUIssue      bool // requests were too big, or only a small control request was answered
+
+	MinRtt, AvgRtt, MaxRtt, StdDevRtt time.Duration
+}
 
-	pinger.OnRecv = func(pkt *ping.Packet) {
-		m.l.Debugf("(%s) %d bytes from %s: icmp_seq=%d time=%v\n",
-			m.interFace, pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt)
+func newStatistics(sent int, rtts []time.Duration) Statistics {
+	stats := Statistics{
+		PacketsSent: sent,
+		PacketsRecv: len(rtts),
 	}
-	pinger.OnDuplicateRecv = func(pkt *ping.Packet) {
-		m.l.Debugf("(%s) %d bytes from %s: icmp_seq=%d time=%v ttl=%v (DUP!)\n",
-			m.interFace, pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.TTL)
+	if sent > 0 {
+		stats.PacketLoss = float64(sent-len(rtts)) / float64(sent) * 100
 	}
-
-	end := make(chan bool)
-	pinger.OnFinish = func(stats *ping.Statistics) {
-		m.l.Debugf("(%s) %d packets transmitted, %d packets received, %v%% packet loss\n",
-			m.interFace, stats.PacketsSent, stats.PacketsRecv, stats.PacketLoss)
-		m.l.Debugf("(%s) round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
-			m.interFace, stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt)
-		close(end)
+	if len(rtts) == 0 {
+		return stats
 	}
 
-	go func() {
-		select {
-		case <-m.ctx.Done():
-			pinger.Stop()
-		case <-end:
-			return
+	var total time.Duration
+	stats.MinRtt = rtts[0]
+	for _, rtt := range rtts {
+		total += rtt
+		if rtt < stats.MinRtt {
+			stats.MinRtt = rtt
 		}
-	}()
+		if rtt > stats.MaxRtt {
+			stats.MaxRtt = rtt
+		}
+	}
+	stats.AvgRtt = total / time.Duration(len(rtts))
 
-	if err := pinger.Run(); err != nil {
-		return err
+	var variance float64
+	for _, rtt := range rtts {
+		d := float64(rtt - stats.AvgRtt)
+		variance += d * d
 	}
+	stats.StdDevRtt = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return stats
+}
+
+// Last returns the statistics of the last burst and
+// when it was reported, the time is zero before the first burst
+func (m *Monitor) Last() (Statistics, time.Time) {
+	m.lastMu.Lock()
+	defer m.lastMu.Unlock()
+	return m.last, m.lastTime
+}
+
+func (m *Monitor) report(stats Statistics) {
+	m.lastMu.Lock()
+	m.last, m.lastTime = stats, time.Now()
+	m.lastMu.Unlock()
 
-	open := true
-	select {
-	case _, open = <-m.ctx.Done():
-	default:
+	m.l.Debugf("(%s) %d packets transmitted, %d packets received, %v%% packet loss\n",
+		m.interFace, stats.PacketsSent, stats.PacketsRecv, stats.PacketLoss)
+	m.l.Debugf("(%s) round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
+		m.interFace, stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt)
+
+	if stats.PacketsInvalid > 0 {
+		m.l.Debugf("(%s) %d invalid replies from %s\n", m.interFace, stats.PacketsInvalid, m.dst.String())
 	}
-	if open {
-		stats := pinger.Statistics()
-		if stats.PacketLoss > 75 {
-			m.downFunc()
-		} else {
-			m.upFunc()
+	if stats.PMTUIssue {
+		switch {
+		case stats.PathMTU > 0:
+			m.l.Warnf("(%s) requests with %d bytes payload to %s do not fit the path mtu of %d", m.interFace, m.size, m.dst.String(), stats.PathMTU)
+		case stats.PacketsTooBig > 0:
+			m.l.Warnf("(%s) requests with %d bytes payload to %s do not fit the path mtu", m.interFace, m.size, m.dst.String())
+		default:
+			m.l.Warnf("(%s) only small requests to %s are answered, requests with %d bytes payload are lost (possible path mtu issue)", m.interFace, m.dst.String(), m.size)
 		}
 	}
-	m.l.Debugf("stopped monitor on %q for %s", m.interFace, m.dst.String())
-	return nil
+
+	if stats.PacketLoss > 75 {
+		m.downFunc()
+	} else {
+		m.upFunc()
+	}
 }
 
 func (m *Monitor) Stop() {
@@ -185,15 +311,27 @@ func (m *Monitor) Stop() {
 	m.wg.Wait()
 }
 
+// Start registers the monitor with its engine, and reports
+// the result of every burst until the monitor is stopped.
 func (m *Monitor) Start(burstInterval time.Duration) {
-	timer := time.NewTicker(burstInterval)
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	m.burstInterval = burstInterval
+	m.l.Debugf("starting monitor on %q for %s", m.interFace, m.dst.String())
+	if err := m.engine.add(m, burstInterval); err != nil {
+		m.l.Errorf("could not start monitor on %q for %s: %s", m.interFace, m.dst.String(), err)
+		return
+	}
+	defer m.engine.remove(m)
+
 	for {
 		select {
 		case <-m.ctx.Done():
-			timer.Stop()
+			m.l.Debugf("stopped monitor on %q for %s", m.interFace, m.dst.String())
 			return
-		case <-timer.C:
-			m.run()
+		case stats := <-m.results:
+			m.report(stats)
 		}
 	}
 }
@@ -0,0 +1,104 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package icmp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// minSize is the size of the timestamp at
+	// the start of the payload of every request
+	minSize = 8
+	// maxSize is the largest payload that fits
+	// an ip packet for both families
+	maxSize = 65000
+)
+
+// payload returns the payload for an echo request of size bytes,
+// a timestamp followed by a fixed pattern.
+func payload(t time.Time, size int) []byte {
+	b := make([]byte, size)
+	copy(b, timestamp(t))
+	for i := minSize; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// validPayload returns true if data is the payload that
+// was sent in an echo request of size bytes.
+func validPayload(data []byte, size int) bool {
+	if len(data) != size {
+		return false
+	}
+	for i := minSize; i < size; i++ {
+		if data[i] != byte(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// timestamp returns the timestamp for the payload of an echo request
+func timestamp(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+// quotedEcho returns the destination, identifier and sequence of the
+// echo request quoted in an icmp error message.
+func quotedEcho(family uint8, data []byte) (net.IP, int, uint16, bool) {
+	dst, proto, transport, ok := quotedHeader(family, data)
+	if !ok || proto != protocol(family) {
+		return nil, 0, 0, false
+	}
+	if (family == unix.AF_INET && transport[0] != 8) || (family == unix.AF_INET6 && transport[0] != 128) { // echo request
+		return nil, 0, 0, false
+	}
+	return dst, int(binary.BigEndian.Uint16(transport[4:])), binary.BigEndian.Uint16(transport[6:]), true
+}
+
+// quotedHeader returns the destination, protocol and the first 8 bytes
+// of the transport header of the packet quoted in an icmp error message.
+func quotedHeader(family uint8, data []byte) (net.IP, int, []byte, bool) {
+	if family == unix.AF_INET {
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return nil, 0, nil, false
+		}
+		hl := int(data[0]&0x0f) * 4
+		if len(data) < hl+8 {
+			return nil, 0, nil, false
+		}
+		return net.IP(data[16:20]), int(data[9]), data[hl : hl+8], true
+	}
+
+	// extension headers are not followed
+	if len(data) < 48 || data[0]>>4 != 6 {
+		return nil, 0, nil, false
+	}
+	return net.IP(data[24:40]), int(data[6]), data[40:48], true
+}
+
+// protocol returns the icmp protocol number of the family
+func protocol(family uint8) int {
+	if family == unix.AF_INET6 {
+		return protocolIPv6ICMP
+	}
+	return protocolICMP
+}
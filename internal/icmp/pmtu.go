@@ -0,0 +1,119 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package icmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// the smallest mtu every link of the family must support
+	minMTUv4 = 68
+	minMTUv6 = 1280
+
+	// number of requests of a size to send before
+	// considering the size lost
+	pmtuAttempts = 2
+)
+
+// ErrNoReply is returned when the destination does not answer
+// requests of the minimum size either.
+var ErrNoReply = errors.New("no reply")
+
+// PathMTU returns the path mtu towards the destination, including the
+// ip and icmp headers. It does a binary search, between the minimum mtu
+// of the family and the mtu of the interface, for the largest request
+// with the Don't Fragment bit set that is answered. The path mtu from
+// icmp errors is used to cut the search short. The monitor must be
+// created with the DontFragment option and is not started.
+func (m *Monitor) PathMTU() (int, error) {
+	if !m.dontFragment {
+		return 0, errors.New("icmp: path mtu discovery needs the DontFragment option")
+	}
+	ifi, err := net.InterfaceByName(m.interFace)
+	if err != nil {
+		return 0, err
+	}
+
+	overhead, low := 20+8, minMTUv4
+	if m.dst.IP.To4() == nil {
+		overhead, low = 40+8, minMTUv6
+	}
+	if low < overhead+minSize {
+		low = overhead + minSize
+	}
+	high := ifi.MTU
+	if high < low {
+		return 0, fmt.Errorf("icmp: mtu %d of %q is below the minimum of %d", high, m.interFace, low)
+	}
+
+	// most of the time the whole interface mtu fits the path
+	ok, reported, err := m.fits(high - overhead)
+	if err != nil || ok {
+		return high, err
+	}
+	if ok, _, err = m.fits(low - overhead); err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrNoReply
+	}
+
+	// low fits and high does not
+	if reported > low && reported < high {
+		if ok, _, err = m.fits(reported - overhead); err != nil {
+			return 0, err
+		}
+		if ok {
+			low = reported
+		} else {
+			high = reported
+		}
+	}
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		ok, reported, err := m.fits(mid - overhead)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case ok:
+			low = mid
+		case reported > low && reported < mid:
+			high = reported + 1
+		default:
+			high = mid
+		}
+	}
+	m.l.Debugf("(%s) path mtu to %s is %d", m.interFace, m.dst.String(), low)
+	return low, nil
+}
+
+// fits returns true when a request with size bytes of payload is answered,
+// together with the path mtu from an icmp error for the last request.
+func (m *Monitor) fits(size int) (bool, int, error) {
+	var mtu int
+	for i := 0; i < pmtuAttempts; i++ {
+		r, err := m.engine.single(m.ctx, m, size)
+		if err != nil {
+			return false, 0, err
+		}
+		if r.answered {
+			return true, 0, nil
+		}
+		mtu = r.mtu
+	}
+	return false, mtu, nil
+}
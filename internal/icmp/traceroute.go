@@ -0,0 +1,427 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package icmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// TraceMethod is the kind of request sent by a traceroute
+type TraceMethod uint8
+
+const (
+	// TraceICMP sends icmp echo requests
+	TraceICMP TraceMethod = iota
+	// TraceUDP sends udp datagrams to high ports
+	TraceUDP
+)
+
+func (m TraceMethod) String() string {
+	if m == TraceUDP {
+		return "udp"
+	}
+	return "icmp"
+}
+
+// traceBasePort is the destination port of the
+// udp datagram for the first hop
+const traceBasePort = 33434
+
+// Hop is a hop on the path to the destination of a traceroute
+type Hop struct {
+	TTL     int
+	Address net.IP // nil if the hop did not answer
+	RTT     time.Duration
+}
+
+// Trace is the result of a traceroute
+type Trace struct {
+	Destination net.IP
+	Started     time.Time
+	Hops        []Hop // hop i has ttl i+1
+	Reached     bool  // the destination answered, it is the last hop
+}
+
+// Tracer does traceroutes from a source address on an interface
+// to a destination by stepping the TTL or hop limit of the requests.
+// It needs raw sockets to receive the icmp errors of the hops.
+type Tracer struct {
+	src       string
+	dst       net.IP
+	interFace string
+	family    uint8
+
+	method  TraceMethod
+	maxHops int
+	timeout time.Duration
+	mark    uint32
+	l       log.Logger
+}
+
+// NewTracer returns a Tracer for the destination
+func NewTracer(src string, dst net.IP, ifi string, opts ...TraceOption) (*Tracer, error) {
+	t := &Tracer{
+		src:       src,
+		dst:       dst,
+		interFace: ifi,
+		family:    unix.AF_INET,
+
+		method:  TraceICMP,
+		maxHops: 30,
+		timeout: 2 * time.Second,
+		l:       log.Default(),
+	}
+	if dst.To4() == nil {
+		t.family = unix.AF_INET6
+		t.src = t.src + "%" + ifi
+	}
+
+	for _, option := range opts {
+		if err := option(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// TraceOption is a functional argument to *Tracer
+type TraceOption func(t *Tracer) error
+
+// Method is a functional Option to set
+// the kind of requests to send.
+// Defaults to TraceICMP.
+func Method(m TraceMethod) TraceOption {
+	return func(t *Tracer) error {
+		t.method = m
+		return nil
+	}
+}
+
+// MaxHops is a functional Option to set
+// the highest TTL to send requests with.
+// Defaults to 30.
+func MaxHops(n int) TraceOption {
+	return func(t *Tracer) error {
+		if n < 1 || n > 255 {
+			return fmt.Errorf("icmp: max hops should be between 1 and 255")
+		}
+		t.maxHops = n
+		return nil
+	}
+}
+
+// TraceTimeout is a functional Option to set
+// how long to wait for the answers of the hops.
+// Defaults to 2 seconds.
+func TraceTimeout(d time.Duration) TraceOption {
+	return func(t *Tracer) error {
+		t.timeout = d
+		return nil
+	}
+}
+
+// TraceMark is a functional Option to set
+// the fwmark (SO_MARK) of the requests.
+func TraceMark(mark uint32) TraceOption {
+	return func(t *Tracer) error {
+		t.mark = mark
+		return nil
+	}
+}
+
+// TraceLogger is a functional Option to set
+// a new logger for this tracer
+func TraceLogger(l log.Logger) TraceOption {
+	return func(t *Tracer) error {
+		t.l = l
+		return nil
+	}
+}
+
+// Trace sends a request for every TTL at once, and collects the
+// answers until the destination and every hop before it answered,
+// or the timeout expires.
+func (t *Tracer) Trace(ctx context.Context) (*Trace, error) {
+	network := "ip4:icmp"
+	if t.family == unix.AF_INET6 {
+		network = "ip6:ipv6-icmp"
+	}
+	lc := net.ListenConfig{Control: t.control}
+	conn, err := lc.ListenPacket(ctx, network, t.src)
+	if err != nil {
+		return nil, fmt.Errorf("icmp: could not listen on %q: %w", t.src, err)
+	}
+	defer conn.Close()
+	if t.family == unix.AF_INET6 {
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		f.Accept(ipv6.ICMPTypeTimeExceeded)
+		f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+		if err := ipv6.NewPacketConn(conn).SetICMPFilter(&f); err != nil {
+			t.l.Debugf("icmp: could not set icmp filter on %q: %s", t.src, err)
+		}
+	}
+
+	// the requests are sent from the icmp socket itself, or from a udp socket
+	sender := conn
+	id := rand.Intn(1 << 16)
+	if t.method == TraceUDP {
+		network := "udp4"
+		if t.family == unix.AF_INET6 {
+			network = "udp6"
+		}
+		uc, err := lc.ListenPacket(ctx, network, net.JoinHostPort(t.src, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("icmp: could not listen on %q: %w", t.src, err)
+		}
+		defer uc.Close()
+		sender = uc
+		id = uc.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	trace := &Trace{
+		Destination: t.dst,
+		Started:     time.Now(),
+		Hops:        make([]Hop, t.maxHops),
+	}
+	sent := make([]time.Time, t.maxHops+1)
+	for ttl := 1; ttl <= t.maxHops; ttl++ {
+		trace.Hops[ttl-1].TTL = ttl
+		sent[ttl] = time.Now()
+		if err := t.send(sender, id, ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := trace.Started.Add(t.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	reached := 0
+	b := make([]byte, 1500)
+	for !t.complete(trace, reached) {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, net.ErrClosed) || isTimeout(err) {
+				break
+			}
+			return nil, err
+		}
+		received := time.Now()
+
+		from := peerIP(addr)
+		ttl, destination := t.parse(b[:n], id, from)
+		if ttl < 1 || ttl > t.maxHops || trace.Hops[ttl-1].Address != nil {
+			continue
+		}
+		trace.Hops[ttl-1].Address = from
+		trace.Hops[ttl-1].RTT = received.Sub(sent[ttl])
+		if destination && (reached == 0 || ttl < reached) {
+			reached = ttl
+		}
+	}
+
+	// the destination is the last hop, without it the
+	// path ends at the last hop that answered
+	last := reached
+	if last == 0 {
+		for i := len(trace.Hops) - 1; i >= 0; i-- {
+			if trace.Hops[i].Address != nil {
+				last = i + 1
+				break
+			}
+		}
+	}
+	trace.Hops = trace.Hops[:last]
+	trace.Reached = reached != 0
+	return trace, nil
+}
+
+// complete returns true when the destination and all hops before it answered
+func (t *Tracer) complete(trace *Trace, reached int) bool {
+	if reached == 0 {
+		return false
+	}
+	for _, hop := range trace.Hops[:reached] {
+		if hop.Address == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// send sends the request for a ttl
+func (t *Tracer) send(conn net.PacketConn, id int, ttl int) error {
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_TTL
+	if t.family == unix.AF_INET6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), level, opt, ttl)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("icmp: could not set ttl %d: %w", ttl, serr)
+	}
+
+	if t.method == TraceUDP {
+		dst := &net.UDPAddr{IP: t.dst, Port: traceBasePort + ttl, Zone: t.interFace}
+		_, err := conn.WriteTo(payload(time.Now(), minSize), dst)
+		return err
+	}
+
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if t.family == unix.AF_INET6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: id, Seq: ttl, Data: payload(time.Now(), minSize)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(b, &net.IPAddr{IP: t.dst, Zone: t.interFace})
+	return err
+}
+
+// parse returns the ttl of the request an icmp message from an address
+// answers, 0 if it is not for this trace, and whether it came from the
+// destination.
+func (t *Tracer) parse(b []byte, id int, from net.IP) (int, bool) {
+	msg, err := icmp.ParseMessage(protocol(t.family), b)
+	if err != nil {
+		return 0, false
+	}
+
+	var quoted []byte
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if t.method != TraceICMP || body.ID != id ||
+			(msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+			return 0, false
+		}
+		return body.Seq, true
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		quoted = body.Data
+	default:
+		return 0, false
+	}
+
+	dst, proto, transport, ok := quotedHeader(t.family, quoted)
+	if !ok || !dst.Equal(t.dst) {
+		return 0, false
+	}
+	// a port unreachable from the destination
+	// ends a udp trace, like an echo reply does
+	unreachable := msg.Type == ipv4.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypeDestinationUnreachable
+	unreachable = unreachable && from.Equal(t.dst)
+	switch {
+	case t.method == TraceUDP && proto == unix.IPPROTO_UDP:
+		if int(binary.BigEndian.Uint16(transport[0:])) != id {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(transport[2:])) - traceBasePort, unreachable
+	case t.method == TraceICMP && proto == protocol(t.family):
+		if int(binary.BigEndian.Uint16(transport[4:])) != id {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(transport[6:])), false
+	}
+	return 0, false
+}
+
+// control binds the sockets to the interface and sets the fwmark
+func (t *Tracer) control(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = setSockopts(int(fd), t.family, &Monitor{interFace: t.interFace, mark: t.mark})
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// String returns the addresses of the hops, with * for
+// the hops that did not answer.
+func (t *Trace) String() string {
+	s := ""
+	for i, hop := range t.Hops {
+		if i > 0 {
+			s += " "
+		}
+		if hop.Address == nil {
+			s += "*"
+			continue
+		}
+		s += hop.Address.String()
+	}
+	return s
+}
+
+// Compare compares the trace with a known good trace of the same
+// destination. It returns the ttl of the first hop that answered from
+// a different address than the known good hop, and the first ttl after
+// the last hop that answered when the destination was not reached.
+// Either is 0 when it does not apply.
+func (t *Trace) Compare(good *Trace) (changedAt int, diedAt int) {
+	if !t.Reached {
+		diedAt = len(t.Hops) + 1
+	}
+	if good == nil {
+		return 0, diedAt
+	}
+	for i, hop := range t.Hops {
+		if i >= len(good.Hops) {
+			// the path got longer
+			if hop.Address != nil {
+				return i + 1, diedAt
+			}
+			continue
+		}
+		if hop.Address != nil && good.Hops[i].Address != nil && !hop.Address.Equal(good.Hops[i].Address) {
+			return i + 1, diedAt
+		}
+	}
+	return 0, diedAt
+}
@@ -0,0 +1,114 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmp
+
+import (
+	"net"
+	"testing"
+)
+
+// trace returns a trace through the hops, "*" for a
+// hop that did not answer. It reached the destination
+// when the last hop is 192.0.2.1.
+func trace(hops ...string) *Trace {
+	t := &Trace{Destination: net.ParseIP("192.0.2.1")}
+	for i, hop := range hops {
+		h := Hop{TTL: i + 1}
+		if hop != "*" {
+			h.Address = net.ParseIP(hop)
+		}
+		t.Hops = append(t.Hops, h)
+	}
+	t.Reached = len(hops) > 0 && hops[len(hops)-1] == "192.0.2.1"
+	return t
+}
+
+func TestTraceCompare(t *testing.T) {
+	good := trace("10.0.0.1", "10.0.1.1", "10.0.2.1", "192.0.2.1")
+
+	tests := []struct {
+		name      string
+		trace     *Trace
+		good      *Trace
+		changedAt int
+		diedAt    int
+	}{
+		{
+			name:  "no known good trace",
+			trace: trace("10.0.0.1", "192.0.2.1"),
+		},
+		{
+			name:   "no known good trace, not reached",
+			trace:  trace("10.0.0.1", "*", "*"),
+			diedAt: 4,
+		},
+		{
+			name:  "same path",
+			trace: trace("10.0.0.1", "10.0.1.1", "10.0.2.1", "192.0.2.1"),
+			good:  good,
+		},
+		{
+			name:  "silent hops are no change",
+			trace: trace("10.0.0.1", "*", "10.0.2.1", "192.0.2.1"),
+			good:  good,
+		},
+		{
+			name:      "changed hop",
+			trace:     trace("10.0.0.1", "10.0.9.1", "10.0.2.1", "192.0.2.1"),
+			good:      good,
+			changedAt: 2,
+		},
+		{
+			name:      "first changed hop",
+			trace:     trace("10.0.0.1", "10.0.9.1", "10.0.8.1", "192.0.2.1"),
+			good:      good,
+			changedAt: 2,
+		},
+		{
+			name:      "longer path",
+			trace:     trace("10.0.0.1", "10.0.1.1", "10.0.2.1", "10.0.3.1", "192.0.2.1"),
+			good:      good,
+			changedAt: 4,
+		},
+		{
+			name:  "shorter path",
+			trace: trace("10.0.0.1", "10.0.1.1", "192.0.2.1"),
+			good:  trace("10.0.0.1", "10.0.1.1", "10.0.2.1", "192.0.2.1"),
+			// the destination answered at ttl 3 where 10.0.2.1 did
+			changedAt: 3,
+		},
+		{
+			name:   "died",
+			trace:  trace("10.0.0.1", "10.0.1.1", "*", "*"),
+			good:   good,
+			diedAt: 5,
+		},
+		{
+			name:      "died after a change",
+			trace:     trace("10.0.0.1", "10.0.9.1", "*"),
+			good:      good,
+			changedAt: 2,
+			diedAt:    4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changedAt, diedAt := tt.trace.Compare(tt.good)
+			if changedAt != tt.changedAt || diedAt != tt.diedAt {
+				t.Fatalf("Compare = %d, %d, want %d, %d", changedAt, diedAt, tt.changedAt, tt.diedAt)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jsimonetti/hodos/internal/config"
@@ -35,6 +36,13 @@ type Monitor struct {
 	isUp     bool
 	l        log.Logger
 
+	alive int64 // unix nanoseconds of the last loop, read atomically
+
+	statsInterval time.Duration
+	statsMu       sync.Mutex
+	stats         Statistics // guarded by statsMu
+	rateBase      Statistics // guarded by statsMu
+
 	wg *sync.WaitGroup
 }
 
@@ -104,7 +112,7 @@ func (m *Monitor) Run() error {
 	m.l.Debugf("interfaceMonitor: starting monitor on %q", m.interFace.Name)
 	nl, err := rtnetlink.Dial(&netlink.Config{Groups: unix.RTNLGRP_LINK})
 	if err != nil {
-		m.l.Printf("interfaceMonitor: could not dial rtnetlink: %s", err)
+		m.l.Errorf("interfaceMonitor: could not dial rtnetlink: %s", err)
 		return err
 	}
 	defer nl.Close()
@@ -113,9 +121,16 @@ func (m *Monitor) Run() error {
 	// bootstrap our state by getting all interfaces
 	lreq := &rtnetlink.LinkMessage{}
 	nl.Send(lreq, unix.RTM_GETLINK, netlink.Request|netlink.Dump)
+	polled := time.Now()
 
 	// endlessly loop
 	for {
+		atomic.StoreInt64(&m.alive, time.Now().UnixNano())
+		if m.statsInterval > 0 && time.Since(polled) >= m.statsInterval {
+			m.pollStats(nl)
+			polled = time.Now()
+		}
+
 		nl.SetReadDeadline(time.Now().Add(1 * time.Second))
 		select {
 		case <-m.ctx.Done():
@@ -129,7 +144,7 @@ func (m *Monitor) Run() error {
 				if e, ok := err.(net.Error); ok && e.Timeout() {
 					continue
 				}
-				m.l.Printf("interfaceMonitor: receive error: %s", err)
+				m.l.Errorf("interfaceMonitor: receive error: %s", err)
 			}
 
 			// go over the messages
@@ -143,6 +158,9 @@ func (m *Monitor) Run() error {
 					if msg.Attributes.Name != m.interFace.Name {
 						continue
 					}
+					if msg.Attributes.Stats64 != nil {
+						m.sample(msg.Attributes.Stats64, time.Now())
+					}
 					// for new links we need to decide the operational state
 					// (links going down still result in a RTM_NEWLINK message)
 					if omsgs[i].Header.Type == unix.RTM_NEWLINK {
@@ -164,6 +182,28 @@ func (m *Monitor) Run() error {
 	}
 }
 
+// Alive returns when the monitor last went through its loop,
+// or the zero time if it is not running (yet)
+func (m *Monitor) Alive() time.Time {
+	if alive := atomic.LoadInt64(&m.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
+// pollStats requests the link, its counters are
+// sampled when the reply is handled
+func (m *Monitor) pollStats(nl *rtnetlink.Conn) {
+	ifi, err := net.InterfaceByName(m.interFace.Name)
+	if err != nil {
+		return
+	}
+	req := &rtnetlink.LinkMessage{Index: uint32(ifi.Index)}
+	if _, err := nl.Send(req, unix.RTM_GETLINK, netlink.Request); err != nil {
+		m.l.Warnf("interfaceMonitor: could not request the counters of %q: %s", m.interFace.Name, err)
+	}
+}
+
 func (m *Monitor) Stop() {
 	m.l.Debugf("stopping monitor on %q", m.interFace)
 	m.ctxCancel()
@@ -0,0 +1,97 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package linkstate
+
+import (
+	"time"
+
+	"github.com/jsimonetti/rtnetlink"
+)
+
+// Statistics are the traffic counters of the link, with the
+// rates derived from the last two samples.
+type Statistics struct {
+	RXBytes, TXBytes     uint64
+	RXPackets, TXPackets uint64
+	RXErrors, TXErrors   uint64
+	RXDropped, TXDropped uint64
+
+	RXRate, TXRate             float64 // bytes per second
+	RXPacketRate, TXPacketRate float64 // packets per second
+
+	Sampled time.Time
+}
+
+// StatsInterval is a functional Option to set how
+// often the traffic counters of the link are sampled.
+// Defaults to 0 (only the counters in link events).
+func StatsInterval(t time.Duration) Option {
+	return func(m *Monitor) error {
+		m.statsInterval = t
+		return nil
+	}
+}
+
+// Stats returns the last sampled statistics, and false
+// if the link was not sampled yet.
+func (m *Monitor) Stats() (Statistics, bool) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	return m.stats, !m.stats.Sampled.IsZero()
+}
+
+// sample updates the statistics from the counters of the link. The
+// rates are only derived over at least half the stats interval, so
+// the counters of link events in between do not skew them.
+func (m *Monitor) sample(s *rtnetlink.LinkStats64, now time.Time) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	stats := Statistics{
+		RXBytes:   s.RXBytes,
+		TXBytes:   s.TXBytes,
+		RXPackets: s.RXPackets,
+		TXPackets: s.TXPackets,
+		RXErrors:  s.RXErrors,
+		TXErrors:  s.TXErrors,
+		RXDropped: s.RXDropped,
+		TXDropped: s.TXDropped,
+		Sampled:   now,
+
+		RXRate:       m.stats.RXRate,
+		TXRate:       m.stats.TXRate,
+		RXPacketRate: m.stats.RXPacketRate,
+		TXPacketRate: m.stats.TXPacketRate,
+	}
+
+	base := m.rateBase
+	elapsed := now.Sub(base.Sampled)
+	switch {
+	case base.Sampled.IsZero():
+		m.rateBase = stats
+	case elapsed < m.statsInterval/2 || elapsed <= 0:
+		// too close to the last rate sample
+	case stats.RXBytes < base.RXBytes || stats.TXBytes < base.TXBytes:
+		// the counters restarted, start over
+		stats.RXRate, stats.TXRate, stats.RXPacketRate, stats.TXPacketRate = 0, 0, 0, 0
+		m.rateBase = stats
+	default:
+		seconds := elapsed.Seconds()
+		stats.RXRate = float64(stats.RXBytes-base.RXBytes) / seconds
+		stats.TXRate = float64(stats.TXBytes-base.TXBytes) / seconds
+		stats.RXPacketRate = float64(stats.RXPackets-base.RXPackets) / seconds
+		stats.TXPacketRate = float64(stats.TXPackets-base.TXPackets) / seconds
+		m.rateBase = stats
+	}
+	m.stats = stats
+}
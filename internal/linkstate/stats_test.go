@@ -0,0 +1,71 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package linkstate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/rtnetlink"
+)
+
+func TestSample(t *testing.T) {
+	m, err := New(context.Background(), config.Interface{Name: "wan"}, StatsInterval(10*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := m.Stats(); ok {
+		t.Fatal("sampled before the first sample")
+	}
+
+	start := time.Now()
+	steps := []struct {
+		name   string
+		at     time.Duration // after start
+		rx, tx uint64        // bytes, the packets are a tenth
+		rxRate float64
+		txRate float64
+	}{
+		// the first sample has no rate yet
+		{name: "first", rx: 1000, tx: 500},
+		{name: "rates", at: 10 * time.Second, rx: 11000, tx: 2500, rxRate: 1000, txRate: 200},
+		// a link event right after keeps the last rates
+		{name: "too close", at: 11 * time.Second, rx: 50000, tx: 50000, rxRate: 1000, txRate: 200},
+		// half the interval after the last rate sample
+		{name: "half the interval", at: 15 * time.Second, rx: 21000, tx: 2500, rxRate: 2000, txRate: 0},
+		// the counters of a recreated link start over
+		{name: "restarted", at: 25 * time.Second, rx: 100, tx: 100},
+		{name: "after restart", at: 35 * time.Second, rx: 10100, tx: 100, rxRate: 1000, txRate: 0},
+	}
+
+	for _, s := range steps {
+		now := start.Add(s.at)
+		m.sample(&rtnetlink.LinkStats64{RXBytes: s.rx, TXBytes: s.tx, RXPackets: s.rx / 10, TXPackets: s.tx / 10, RXErrors: 1, TXDropped: 2}, now)
+
+		stats, ok := m.Stats()
+		if !ok {
+			t.Fatalf("%s: not sampled", s.name)
+		}
+		if stats.RXBytes != s.rx || stats.TXBytes != s.tx || stats.RXErrors != 1 || stats.TXDropped != 2 || !stats.Sampled.Equal(now) {
+			t.Fatalf("%s: stats = %+v, want the counters of the sample", s.name, stats)
+		}
+		if stats.RXRate != s.rxRate || stats.TXRate != s.txRate {
+			t.Fatalf("%s: rates = %.1f/%.1f, want %.1f/%.1f", s.name, stats.RXRate, stats.TXRate, s.rxRate, s.txRate)
+		}
+		if stats.RXPacketRate != s.rxRate/10 || stats.TXPacketRate != s.txRate/10 {
+			t.Fatalf("%s: packet rates = %.1f/%.1f, want %.1f/%.1f", s.name, stats.RXPacketRate, stats.TXPacketRate, s.rxRate/10, s.txRate/10)
+		}
+	}
+}
@@ -1,39 +0,0 @@
-// Copyright 2019-2022 Jeroen Simonetti
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-package log
-
-import "log"
-
-type DebugLogger struct {
-	*log.Logger
-}
-
-func (d *DebugLogger) Debug(a ...interface{}) {
-	d.Print(a...)
-}
-func (d *DebugLogger) Debugf(f string, a ...interface{}) {
-	d.Printf(f, a...)
-}
-
-func (d *DebugLogger) Error(a ...interface{})            { d.Print(a...) }     // NOOP
-func (d *DebugLogger) Errorf(f string, a ...interface{}) { d.Printf(f, a...) } // NOOP
-
-func (d *DebugLogger) Warn(a ...interface{})            { d.Print(a...) }     // NOOP
-func (d *DebugLogger) Warnf(f string, a ...interface{}) { d.Printf(f, a...) } // NOOP
-
-func (d *DebugLogger) Info(a ...interface{})            { d.Print(a...) }     // NOOP
-func (d *DebugLogger) Infof(f string, a ...interface{}) { d.Printf(f, a...) } // NOOP
-
-func NewDebug(l *log.Logger) Logger {
-	return &DebugLogger{l}
-}
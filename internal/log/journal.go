@@ -0,0 +1,91 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// JournalSocket is the socket of the native protocol of the systemd journal
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Journal is a sink that sends messages to the systemd journal
+// with the native protocol, with the fields as journal fields.
+type Journal struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+// NewJournal returns a sink sending to the journal socket at path
+// (usually JournalSocket), with identifier as SYSLOG_IDENTIFIER.
+func NewJournal(path string, identifier string) (*Journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{conn: conn, identifier: identifier}, nil
+}
+
+func (j *Journal) Write(level Level, msg string, fields []interface{}) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", fmt.Sprint(severity(level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", j.identifier)
+	for i := 0; i+1 < len(fields); i += 2 {
+		journalField(&b, journalName(fmt.Sprint(fields[i])), fieldValue(fields[i+1]))
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// Close closes the connection to the journal
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
+
+// journalField writes a field, a value with a newline
+// is written with its length in front of it
+func journalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=")
+		b.WriteString(value)
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString("\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteString("\n")
+}
+
+// journalName returns the name of the field as a journal field
+// name, which only has upper case letters, digits and underscores
+// and does not start with an underscore or digit
+func journalName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	n := strings.TrimLeft(string(name), "_0123456789")
+	if n == "" {
+		return "FIELD"
+	}
+	return n
+}
@@ -0,0 +1,190 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenJournal binds a unixgram socket that stands in for the journal
+func listenJournal(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+// readJournal reads a datagram of the native protocol of the journal
+func readJournal(t *testing.T, conn *net.UnixConn) []byte {
+	t.Helper()
+	b := make([]byte, 1<<16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+// parseJournal parses the fields of a datagram of the native protocol
+func parseJournal(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '\n')
+		if end < 0 {
+			t.Fatalf("field without newline: %q", b)
+		}
+		line := b[:end]
+		b = b[end+1:]
+		if i := bytes.IndexByte(line, '='); i >= 0 {
+			fields[string(line[:i])] = string(line[i+1:])
+			continue
+		}
+		// a value with a newline has its length in front of it
+		if len(b) < 8 {
+			t.Fatalf("short length of field %q", line)
+		}
+		size := binary.LittleEndian.Uint64(b[:8])
+		b = b[8:]
+		if uint64(len(b)) < size+1 || b[size] != '\n' {
+			t.Fatalf("value of field %q is not %d bytes followed by a newline", line, size)
+		}
+		fields[string(line)] = string(b[:size])
+		b = b[size+1:]
+	}
+	return fields
+}
+
+func TestJournal(t *testing.T) {
+	conn, path := listenJournal(t)
+	j, err := NewJournal(path, "hodosd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	err = j.Write(LevelWarn, "link is down", []interface{}{
+		"component", "linkstate",
+		"interface", "eth0",
+		"output", "first line\nsecond line",
+		"weight", 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := parseJournal(t, readJournal(t, conn))
+	want := map[string]string{
+		"MESSAGE":           "link is down",
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "hodosd",
+		"COMPONENT":         "linkstate",
+		"INTERFACE":         "eth0",
+		"OUTPUT":            "first line\nsecond line",
+		"WEIGHT":            "3",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("fields = %q, want %q", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Fatalf("field %s = %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []byte
+	}{
+		{
+			name:  "MESSAGE",
+			value: "hello",
+			want:  []byte("MESSAGE=hello\n"),
+		},
+		{
+			name:  "MESSAGE",
+			value: "",
+			want:  []byte("MESSAGE=\n"),
+		},
+		{
+			name:  "MESSAGE",
+			value: "a=b",
+			want:  []byte("MESSAGE=a=b\n"),
+		},
+		{
+			name:  "MESSAGE",
+			value: "a\nb",
+			want:  append([]byte("MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00"), "a\nb\n"...),
+		},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		journalField(&b, tt.name, tt.value)
+		if !bytes.Equal(b.Bytes(), tt.want) {
+			t.Errorf("journalField(%q, %q) = %q, want %q", tt.name, tt.value, b.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestJournalName(t *testing.T) {
+	tests := map[string]string{
+		"interface": "INTERFACE",
+		"host-name": "HOST_NAME",
+		"some.key":  "SOME_KEY",
+		"_private":  "PRIVATE",
+		"1st":       "ST",
+		"__":        "FIELD",
+		"family6":   "FAMILY6",
+		"-leading":  "LEADING",
+	}
+	for key, want := range tests {
+		if got := journalName(key); got != want {
+			t.Errorf("journalName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestSinkLogger(t *testing.T) {
+	conn, path := listenJournal(t)
+	j, err := NewJournal(path, "hodosd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	l := NewSinkLogger(j, log.New(io.Discard, "", 0), LevelInfo, map[string]Level{"icmp": LevelWarn})
+	l.With("component", "icmp").Infof("filtered by the level of the component")
+	l.With("component", "icmp").Errorf("probe %d failed", 3)
+
+	got := parseJournal(t, readJournal(t, conn))
+	if got["MESSAGE"] != "probe 3 failed" || got["PRIORITY"] != "3" || got["COMPONENT"] != "icmp" {
+		t.Fatalf("fields = %q, want the error of icmp", got)
+	}
+}
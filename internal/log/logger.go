@@ -30,6 +30,11 @@ type Logger interface {
 	Info(...interface{})
 	Debug(...interface{})
 	Debugf(string, ...interface{})
+
+	// With returns a logger that adds the key value pairs to every message
+	With(...interface{}) Logger
+	// WithLevel returns a logger that logs messages of the level and above
+	WithLevel(Level) Logger
 }
 
 func Default() Logger {
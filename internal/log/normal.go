@@ -1,35 +0,0 @@
-// Copyright 2019-2022 Jeroen Simonetti
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-package log
-
-import "log"
-
-type NormalLogger struct {
-	*log.Logger
-}
-
-func (NormalLogger) Debug(...interface{})          {} // NOOP
-func (NormalLogger) Debugf(string, ...interface{}) {} // NOOP
-
-func (n *NormalLogger) Error(a ...interface{})            { n.Print(a...) }
-func (n *NormalLogger) Errorf(f string, a ...interface{}) { n.Printf(f, a...) }
-
-func (n *NormalLogger) Warn(a ...interface{})            { n.Print(a...) }
-func (n *NormalLogger) Warnf(f string, a ...interface{}) { n.Printf(f, a...) }
-
-func (n *NormalLogger) Info(a ...interface{})            { n.Print(a...) }
-func (n *NormalLogger) Infof(f string, a ...interface{}) { n.Printf(f, a...) }
-
-func New(l *log.Logger) Logger {
-	return &NormalLogger{l}
-}
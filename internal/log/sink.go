@@ -0,0 +1,47 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package log
+
+import (
+	"log"
+)
+
+// A Sink receives the messages of a structured logger,
+// with their fields as key value pairs
+type Sink interface {
+	Write(level Level, msg string, fields []interface{}) error
+}
+
+// NewSinkLogger returns a logger writing to the sink, which logs
+// messages of level and above. Messages the sink fails to write
+// are written to fallback as text.
+func NewSinkLogger(sink Sink, fallback *log.Logger, level Level, levels map[string]Level) Logger {
+	return &structuredLogger{
+		out:   &output{std: fallback, format: FormatText, levels: levels, sink: sink},
+		level: level,
+	}
+}
+
+// severity returns the syslog severity of the level
+func severity(level Level) int {
+	switch level {
+	case LevelDebug:
+		return 7
+	case LevelWarn:
+		return 4
+	case LevelError:
+		return 3
+	default:
+		return 6
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown level %q, should be one of debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// the output formats of a structured logger
+const (
+	FormatText   = "text"   // the message followed by its fields
+	FormatJSON   = "json"   // a json object per message
+	FormatLogfmt = "logfmt" // key=value pairs per message
+)
+
+// output is shared by a logger and the loggers derived from it
+type output struct {
+	std    *log.Logger
+	format string
+	levels map[string]Level // level per component
+	sink   Sink             // writes the messages instead of std when set
+}
+
+// structuredLogger writes messages with key value fields
+// in the format of its output
+type structuredLogger struct {
+	out    *output
+	level  Level
+	fields []interface{} // key value pairs
+}
+
+// NewStructured returns a logger writing to l in the format, which
+// logs messages of level and above. The level of a component, set by
+// a component field, is taken from levels if present.
+func NewStructured(l *log.Logger, format string, level Level, levels map[string]Level) Logger {
+	return &structuredLogger{
+		out:   &output{std: l, format: format, levels: levels},
+		level: level,
+	}
+}
+
+// New returns a logger writing text to l, without debug messages
+func New(l *log.Logger) Logger {
+	return NewStructured(l, FormatText, LevelInfo, nil)
+}
+
+// NewDebug returns a logger writing text to l, with debug messages
+func NewDebug(l *log.Logger) Logger {
+	return NewStructured(l, FormatText, LevelDebug, nil)
+}
+
+// With returns a logger that adds the key value pairs to every
+// message, replacing the fields with the same key. A component
+// field sets the level configured for the component.
+func (s *structuredLogger) With(keyvals ...interface{}) Logger {
+	n := &structuredLogger{
+		out:    s.out,
+		level:  s.level,
+		fields: append([]interface{}{}, s.fields...),
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, value := keyvals[i], keyvals[i+1]
+		replaced := false
+		for j := 0; j+1 < len(n.fields); j += 2 {
+			if n.fields[j] == key {
+				n.fields[j+1] = value
+				replaced = true
+			}
+		}
+		if !replaced {
+			n.fields = append(n.fields, key, value)
+		}
+		if key == "component" {
+			if level, ok := s.out.levels[fmt.Sprint(value)]; ok {
+				n.level = level
+			}
+		}
+	}
+	return n
+}
+
+// WithLevel returns a logger that logs messages of level and above
+func (s *structuredLogger) WithLevel(level Level) Logger {
+	return &structuredLogger{
+		out:    s.out,
+		level:  level,
+		fields: s.fields,
+	}
+}
+
+func (s *structuredLogger) Debug(a ...interface{}) { s.log(LevelDebug, fmt.Sprint(a...)) }
+func (s *structuredLogger) Debugf(f string, a ...interface{}) {
+	s.log(LevelDebug, fmt.Sprintf(f, a...))
+}
+
+func (s *structuredLogger) Info(a ...interface{})            { s.log(LevelInfo, fmt.Sprint(a...)) }
+func (s *structuredLogger) Infof(f string, a ...interface{}) { s.log(LevelInfo, fmt.Sprintf(f, a...)) }
+
+func (s *structuredLogger) Print(a ...interface{})            { s.log(LevelInfo, fmt.Sprint(a...)) }
+func (s *structuredLogger) Printf(f string, a ...interface{}) { s.log(LevelInfo, fmt.Sprintf(f, a...)) }
+
+func (s *structuredLogger) Warn(a ...interface{})            { s.log(LevelWarn, fmt.Sprint(a...)) }
+func (s *structuredLogger) Warnf(f string, a ...interface{}) { s.log(LevelWarn, fmt.Sprintf(f, a...)) }
+
+func (s *structuredLogger) Error(a ...interface{}) { s.log(LevelError, fmt.Sprint(a...)) }
+func (s *structuredLogger) Errorf(f string, a ...interface{}) {
+	s.log(LevelError, fmt.Sprintf(f, a...))
+}
+
+func (s *structuredLogger) Fatal(a ...interface{}) {
+	s.log(LevelError, fmt.Sprint(a...))
+	os.Exit(1)
+}
+func (s *structuredLogger) Fatalf(f string, a ...interface{}) {
+	s.log(LevelError, fmt.Sprintf(f, a...))
+	os.Exit(1)
+}
+
+func (s *structuredLogger) log(level Level, msg string) {
+	if level < s.level {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+	if s.out.sink != nil {
+		// a message the sink fails to write ends up in std
+		if err := s.out.sink.Write(level, msg, s.fields); err == nil {
+			return
+		}
+	}
+
+	var b strings.Builder
+	switch s.out.format {
+	case FormatJSON:
+		b.WriteString("{")
+		writeJSON(&b, "time", time.Now().Format(time.RFC3339Nano))
+		b.WriteString(",")
+		writeJSON(&b, "level", level.String())
+		b.WriteString(",")
+		writeJSON(&b, "msg", msg)
+		for i := 0; i+1 < len(s.fields); i += 2 {
+			b.WriteString(",")
+			writeJSON(&b, fmt.Sprint(s.fields[i]), s.fields[i+1])
+		}
+		b.WriteString("}")
+	case FormatLogfmt:
+		fmt.Fprintf(&b, "time=%s level=%s msg=%s", time.Now().Format(time.RFC3339Nano), level, logfmtValue(msg))
+		for i := 0; i+1 < len(s.fields); i += 2 {
+			fmt.Fprintf(&b, " %s=%s", s.fields[i], logfmtValue(fieldValue(s.fields[i+1])))
+		}
+	default:
+		b.WriteString(msg)
+		for i := 0; i+1 < len(s.fields); i += 2 {
+			fmt.Fprintf(&b, " %s=%s", s.fields[i], logfmtValue(fieldValue(s.fields[i+1])))
+		}
+	}
+	s.out.std.Output(4, b.String())
+}
+
+// fieldValue returns the value of a field as text
+func fieldValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// logfmtValue quotes the value when it is empty or
+// contains spaces, quotes or equal signs
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// writeJSON writes a json member, numbers and booleans are
+// kept as is, anything else is written as a string
+func writeJSON(b *strings.Builder, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteString(":")
+	switch value.(type) {
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		if v, err := json.Marshal(value); err == nil {
+			b.Write(v)
+			return
+		}
+	}
+	v, _ := json.Marshal(fieldValue(value))
+	b.Write(v)
+}
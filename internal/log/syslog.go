@@ -0,0 +1,132 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// facilityDaemon is the syslog facility of system daemons
+const facilityDaemon = 3
+
+// sdID is the id of the structured data element with the fields
+const sdID = "hodos@32473"
+
+// Syslog is a sink that sends RFC 5424 messages to a syslog
+// daemon, with the fields as structured data.
+type Syslog struct {
+	network, address string
+	appName          string
+	hostname         string
+
+	mu   sync.Mutex
+	conn net.Conn // guarded by mu
+}
+
+// NewSyslog returns a sink sending to the syslog daemon at address,
+// over network unixgram (such as /dev/log) or udp (such as
+// 127.0.0.1:514), with appName as the APP-NAME.
+func NewSyslog(network string, address string, appName string) (*Syslog, error) {
+	if network != "unixgram" && network != "udp" {
+		return nil, fmt.Errorf("unsupported syslog network %q, should be unixgram or udp", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &Syslog{
+		network:  network,
+		address:  address,
+		appName:  appName,
+		hostname: hostname,
+	}
+	if s.conn, err = net.Dial(network, address); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) Write(level Level, msg string, fields []interface{}) error {
+	msgID := "-"
+	var sd strings.Builder
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if key == "component" {
+			msgID = sdName(fieldValue(fields[i+1]))
+		}
+		fmt.Fprintf(&sd, " %s=\"%s\"", sdName(key), sdValue(fieldValue(fields[i+1])))
+	}
+	data := "-"
+	if sd.Len() > 0 {
+		data = "[" + sdID + sd.String() + "]"
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		facilityDaemon*8+severity(level),
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, os.Getpid(), msgID, data, msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	// the daemon may have restarted, connect again once
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	_, err = s.conn.Write([]byte(line))
+	return err
+}
+
+// Close closes the connection to the syslog daemon
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// sdName returns the key as a structured data parameter name,
+// which has no spaces, equal signs, quotes or brackets
+func sdName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if c <= ' ' || c >= 127 || c == '=' || c == '"' || c == ']' {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return string(name)
+}
+
+// sdValue escapes the quotes, backslashes and closing
+// brackets of a structured data parameter value
+func sdValue(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]").Replace(v)
+}
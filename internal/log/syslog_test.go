@@ -0,0 +1,164 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// header matches the RFC 5424 header: PRI VERSION TIMESTAMP
+// HOSTNAME APP-NAME PROCID MSGID, then the structured data and message
+var header = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) (\S+) (-|\[.*\]) (.*)$`)
+
+func listenSyslog(t *testing.T, network string) (net.PacketConn, string) {
+	t.Helper()
+	switch network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, conn.LocalAddr().String()
+	default:
+		path := filepath.Join(t.TempDir(), "log")
+		conn, err := net.ListenPacket("unixgram", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, path
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  Level
+		fields []interface{}
+		pri    int
+		msgID  string
+		sd     string
+	}{
+		{
+			name:  "without fields",
+			level: LevelInfo,
+			pri:   3*8 + 6,
+			msgID: "-",
+			sd:    "-",
+		},
+		{
+			name:   "component as msgid",
+			level:  LevelError,
+			fields: []interface{}{"component", "icmp", "interface", "eth0"},
+			pri:    3*8 + 3,
+			msgID:  "icmp",
+			sd:     `[hodos@32473 component="icmp" interface="eth0"]`,
+		},
+		{
+			name:   "escaped values",
+			level:  LevelWarn,
+			fields: []interface{}{"output", `say "hi" [x] \ bye`, "count", 2},
+			pri:    3*8 + 4,
+			msgID:  "-",
+			sd:     `[hodos@32473 output="say \"hi\" [x\] \\ bye" count="2"]`,
+		},
+		{
+			name:   "invalid names",
+			level:  LevelDebug,
+			fields: []interface{}{"a key=\"x\"]", "v", "component", "route sync"},
+			pri:    3*8 + 7,
+			msgID:  "route_sync",
+			sd:     `[hodos@32473 a_key__x__="v" component="route sync"]`,
+		},
+	}
+
+	for _, network := range []string{"udp", "unixgram"} {
+		t.Run(network, func(t *testing.T) {
+			conn, address := listenSyslog(t, network)
+			s, err := NewSyslog(network, address, "hodosd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			hostname, _ := os.Hostname()
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					before := time.Now().Truncate(time.Microsecond)
+					if err := s.Write(tt.level, "the message", tt.fields); err != nil {
+						t.Fatal(err)
+					}
+
+					b := make([]byte, 1<<16)
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					n, _, err := conn.ReadFrom(b)
+					if err != nil {
+						t.Fatal(err)
+					}
+					line := string(b[:n])
+					m := header.FindStringSubmatch(line)
+					if m == nil {
+						t.Fatalf("%q is not an RFC 5424 message", line)
+					}
+
+					if pri, _ := strconv.Atoi(m[1]); pri != tt.pri {
+						t.Fatalf("PRI = %d, want %d", pri, tt.pri)
+					}
+					ts, err := time.Parse(time.RFC3339Nano, m[2])
+					if err != nil {
+						t.Fatalf("TIMESTAMP %q: %v", m[2], err)
+					}
+					if ts.Before(before) || ts.After(time.Now()) {
+						t.Fatalf("TIMESTAMP = %s, want the time of writing", ts)
+					}
+					if m[3] != hostname || m[4] != "hodosd" || m[5] != strconv.Itoa(os.Getpid()) {
+						t.Fatalf("HOSTNAME APP-NAME PROCID = %s %s %s, want %s hodosd %d", m[3], m[4], m[5], hostname, os.Getpid())
+					}
+					if m[6] != tt.msgID {
+						t.Fatalf("MSGID = %q, want %q", m[6], tt.msgID)
+					}
+					if m[7] != tt.sd {
+						t.Fatalf("STRUCTURED-DATA = %s, want %s", m[7], tt.sd)
+					}
+					if m[8] != "the message" {
+						t.Fatalf("MSG = %q, want %q", m[8], "the message")
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSdName(t *testing.T) {
+	tests := map[string]string{
+		"interface":                           "interface",
+		"a b":                                 "a_b",
+		"a=b":                                 "a_b",
+		`a"b]`:                                "a_b_",
+		"tab\tkey":                            "tab_key",
+		"a_very_long_parameter_name_of_forty": "a_very_long_parameter_name_of_fo",
+	}
+	for key, want := range tests {
+		if got := sdName(key); got != want {
+			t.Errorf("sdName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 10 * time.Second
+	maxBackoff     = time.Minute
+)
+
+// A Handler receives the messages published on
+// a topic that matches the filter it subscribed to
+type Handler func(topic string, payload []byte)
+
+// DialFunc opens the connection to the broker
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// A Client publishes messages to an mqtt 3.1.1 broker with qos 0,
+// and receives the messages of its subscriptions. Messages are
+// queued while the broker is slow or unreachable, and the client
+// reconnects with an exponential backoff when the connection is lost.
+type Client struct {
+	address   string
+	clientID  string
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	l             log.Logger
+	dial          DialFunc
+	username      string
+	password      string
+	keepAlive     time.Duration
+	will          *will
+	subscriptions []subscription
+	onConnect     func()
+	queue         chan packet
+
+	connected int32 // atomic
+	writeMu   sync.Mutex
+
+	wg *sync.WaitGroup
+}
+
+// ParseBroker returns the address of the broker url and whether it
+// uses tls. The url is tcp://host[:port] or mqtt://host[:port], and
+// ssl://host[:port] or mqtts://host[:port] for tls.
+func ParseBroker(broker string) (string, bool, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", false, err
+	}
+	var port string
+	var secure bool
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		port = "1883"
+	case "ssl", "tls", "mqtts":
+		port, secure = "8883", true
+	default:
+		return "", false, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("missing host in %q", broker)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), secure, nil
+}
+
+func New(ctx context.Context, broker string, clientID string, opts ...Option) (*Client, error) {
+	address, secure, err := ParseBroker(broker)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		address:  address,
+		clientID: clientID,
+
+		l:         log.Default(),
+		dial:      (&net.Dialer{Timeout: connectTimeout}).DialContext,
+		keepAlive: 30 * time.Second,
+		onConnect: func() {},
+		wg:        &sync.WaitGroup{},
+	}
+	if secure {
+		host, _, _ := net.SplitHostPort(address)
+		d := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: connectTimeout},
+			Config:    &tls.Config{ServerName: host},
+		}
+		c.dial = d.DialContext
+	}
+	c.ctx, c.ctxCancel = context.WithCancel(ctx)
+
+	for _, option := range opts {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.queue == nil {
+		c.queue = make(chan packet, 100)
+	}
+	// added here, so Stop waits for Run even when
+	// the goroutine running it did not start yet
+	c.wg.Add(1)
+	return c, nil
+}
+
+// Option is a functional argument to *Client
+type Option func(c *Client) error
+
+// Logger is a functional Option to set
+// a new logger for this client
+func Logger(l log.Logger) Option {
+	return func(c *Client) error {
+		c.l = l
+		return nil
+	}
+}
+
+// Dialer is a functional Option to set the function
+// that opens the connection to the broker, such as
+// one that connects to an in-process broker.
+// Defaults to a tcp or tls connection to the broker url.
+func Dialer(dial DialFunc) Option {
+	return func(c *Client) error {
+		c.dial = dial
+		return nil
+	}
+}
+
+// Credentials is a functional Option to set the user
+// name and password to authenticate with.
+// Defaults to no authentication.
+func Credentials(username, password string) Option {
+	return func(c *Client) error {
+		if username == "" && password != "" {
+			return fmt.Errorf("mqtt: a password needs a user name")
+		}
+		c.username, c.password = username, password
+		return nil
+	}
+}
+
+// KeepAlive is a functional Option to set the interval of the
+// pings, the connection is lost when the broker does not respond
+// within one and a half times the interval.
+// Defaults to 30 seconds.
+func KeepAlive(t time.Duration) Option {
+	return func(c *Client) error {
+		if t < time.Second || t > 65535*time.Second {
+			return fmt.Errorf("mqtt: keep alive should be between 1s and 65535s")
+		}
+		c.keepAlive = t
+		return nil
+	}
+}
+
+// Will is a functional Option to set the message the broker
+// publishes when the connection is lost. The client publishes
+// it itself when it is stopped.
+// Defaults to no message.
+func Will(topic string, payload []byte, retain bool) Option {
+	return func(c *Client) error {
+		c.will = &will{topic: topic, payload: payload, retain: retain}
+		return nil
+	}
+}
+
+// Subscribe is a functional Option to subscribe the handler
+// to the topics matching the filter on every connection
+func Subscribe(filter string, handler Handler) Option {
+	return func(c *Client) error {
+		c.subscriptions = append(c.subscriptions, subscription{filter: filter, handler: handler})
+		return nil
+	}
+}
+
+// OnConnect is a functional Option to set a function
+// that is called every time the client is connected,
+// such as to publish the retained messages again
+func OnConnect(f func()) Option {
+	return func(c *Client) error {
+		c.onConnect = f
+		return nil
+	}
+}
+
+// QueueSize is a functional Option to set how many
+// messages are queued while the broker is slow or unreachable.
+// Defaults to 100.
+func QueueSize(n int) Option {
+	return func(c *Client) error {
+		if n < 1 {
+			return fmt.Errorf("mqtt: queue size should be at least 1")
+		}
+		c.queue = make(chan packet, n)
+		return nil
+	}
+}
+
+// Publish queues the message with qos 0 without blocking. It
+// returns false when the queue is full and the message is dropped.
+func (c *Client) Publish(topic string, payload []byte, retain bool) bool {
+	select {
+	case c.queue <- publishPacket(topic, payload, retain):
+		return true
+	default:
+		return false
+	}
+}
+
+// Connected returns whether the client is connected to the broker
+func (c *Client) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// Run connects to the broker and publishes the queued
+// messages, and reconnects until the client is stopped.
+// It must be run once for every client.
+func (c *Client) Run() error {
+	defer c.wg.Done()
+	backoff := time.Second
+	for {
+		connected, err := c.session()
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			backoff = time.Second
+		}
+		c.l.Warnf("mqtt: connection to %s lost, reconnecting in %s: %s", c.address, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// session connects to the broker and publishes the queued messages
+// until the connection is lost. It returns whether it was connected.
+func (c *Client) session() (bool, error) {
+	conn, err := c.dial(c.ctx, "tcp", c.address)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if err := c.write(conn, connectPacket(c.clientID, c.username, c.password, uint16(c.keepAlive/time.Second), c.will)); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(r)
+	if err != nil {
+		return false, err
+	}
+	if err := connackError(p); err != nil {
+		return false, err
+	}
+
+	if len(c.subscriptions) > 0 {
+		filters := make([]string, 0, len(c.subscriptions))
+		for _, sub := range c.subscriptions {
+			filters = append(filters, sub.filter)
+		}
+		if err := c.write(conn, subscribePacket(1, filters)); err != nil {
+			return false, err
+		}
+	}
+
+	atomic.StoreInt32(&c.connected, 1)
+	defer atomic.StoreInt32(&c.connected, 0)
+	c.l.Printf("mqtt: connected to %s as %q", c.address, c.clientID)
+	c.onConnect()
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- c.read(conn, r)
+	}()
+
+	ping := time.NewTicker(c.keepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			if c.will != nil {
+				c.write(conn, publishPacket(c.will.topic, c.will.payload, c.will.retain))
+			}
+			c.write(conn, packet{typ: typeDisconnect})
+			return true, nil
+		case err := <-errC:
+			return true, err
+		case p := <-c.queue:
+			if err := c.write(conn, p); err != nil {
+				return true, err
+			}
+		case <-ping.C:
+			if err := c.write(conn, packet{typ: typePingreq}); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// read handles the packets from the broker until the connection is lost
+func (c *Client) read(conn net.Conn, r *bufio.Reader) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		p, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		switch p.typ {
+		case typePublish:
+			topic, payload, id, err := parsePublish(p)
+			if err != nil {
+				return err
+			}
+			if id != 0 {
+				if err := c.write(conn, pubackPacket(id)); err != nil {
+					return err
+				}
+			}
+			c.dispatch(topic, payload)
+		case typeSuback:
+			if len(p.body) < 2 {
+				return fmt.Errorf("short suback")
+			}
+			for i, code := range p.body[2:] {
+				if code == 0x80 && i < len(c.subscriptions) {
+					c.l.Warnf("mqtt: subscription to %q was refused", c.subscriptions[i].filter)
+				}
+			}
+		case typePingresp:
+		default:
+			c.l.Debugf("mqtt: ignoring unexpected packet type %d", p.typ)
+		}
+	}
+}
+
+// dispatch passes the message to the handlers of the matching subscriptions
+func (c *Client) dispatch(topic string, payload []byte) {
+	for _, sub := range c.subscriptions {
+		if Match(sub.filter, topic) {
+			sub.handler(topic, payload)
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, p packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(p.encode())
+	return err
+}
+
+// Stop publishes the will, if any, and disconnects
+// from the broker. Messages still queued are dropped.
+func (c *Client) Stop() {
+	c.l.Debugf("mqtt: stopping client for %s", c.address)
+	c.ctxCancel()
+	c.wg.Wait()
+}
@@ -0,0 +1,334 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	stdlog "log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+// broker is the end of a pipe the client dials
+type broker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// testClient returns a client that connects to the returned broker
+func testClient(t *testing.T, opts ...Option) (*Client, *broker) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return client, nil
+	}
+	opts = append([]Option{Logger(log.New(stdlog.New(io.Discard, "", 0))), Dialer(dial)}, opts...)
+	c, err := New(context.Background(), "tcp://broker.example", "hodos-test", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &broker{t: t, conn: server, r: bufio.NewReader(server)}
+}
+
+// read returns the next packet from the client
+func (b *broker) read() packet {
+	b.t.Helper()
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := readPacket(b.r)
+	if err != nil {
+		b.t.Fatalf("read packet: %v", err)
+	}
+	return p
+}
+
+// expect returns the next packet from the client, which is of type typ
+func (b *broker) expect(typ byte) packet {
+	b.t.Helper()
+	p := b.read()
+	if p.typ != typ {
+		b.t.Fatalf("packet type = %d, want %d", p.typ, typ)
+	}
+	return p
+}
+
+func (b *broker) write(p packet) {
+	b.t.Helper()
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.conn.Write(p.encode()); err != nil {
+		b.t.Fatalf("write packet: %v", err)
+	}
+}
+
+// connect accepts the connection of the client and returns the connect packet
+func (b *broker) connect() packet {
+	b.t.Helper()
+	p := b.expect(typeConnect)
+	b.write(packet{typ: typeConnack, body: []byte{0, 0}})
+	return p
+}
+
+// publish returns the topic, payload and retain flag of the next publish packet
+func (b *broker) publish() (string, string, bool) {
+	b.t.Helper()
+	p := b.expect(typePublish)
+	topic, payload, _, err := parsePublish(p)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return topic, string(payload), p.flags&0x01 == 1
+}
+
+// run runs the client until the test ends, the broker
+// is gone by then, so the client does not wait for it
+func run(t *testing.T, c *Client, b *broker) {
+	go c.Run()
+	t.Cleanup(func() {
+		b.conn.Close()
+		c.Stop()
+	})
+}
+
+func TestClientConnect(t *testing.T) {
+	c, b := testClient(t,
+		Credentials("user", "secret"),
+		KeepAlive(20*time.Second),
+		Will("hodos/status", []byte("offline"), true))
+	run(t, c, b)
+
+	p := b.connect()
+	want := appendString(nil, "MQTT")
+	want = append(want, 4, flagCleanSession|flagWill|flagWillRetain|flagUsername|flagPassword, 0, 20)
+	for _, s := range []string{"hodos-test", "hodos/status", "offline", "user", "secret"} {
+		want = appendString(want, s)
+	}
+	if !bytes.Equal(p.body, want) {
+		t.Fatalf("connect = %q, want %q", p.body, want)
+	}
+}
+
+func TestClientRefused(t *testing.T) {
+	c, b := testClient(t)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := c.session()
+		errC <- err
+	}()
+
+	b.expect(typeConnect)
+	b.write(packet{typ: typeConnack, body: []byte{0, 4}})
+	select {
+	case err := <-errC:
+		if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+			t.Fatalf("session error = %v, want a refused connection", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+	if c.Connected() {
+		t.Fatal("client is connected after a refused connection")
+	}
+}
+
+func TestClientPublish(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	c, b := testClient(t, OnConnect(func() { connected <- struct{}{} }))
+
+	// queued before the connection
+	if !c.Publish("hodos/wan/state", []byte(`{"name":"wan"}`), true) {
+		t.Fatal("message dropped")
+	}
+	run(t, c, b)
+	b.connect()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnect was not called")
+	}
+
+	if !c.Publish("hodos/wan/event", []byte(`{"type":"family"}`), false) {
+		t.Fatal("message dropped")
+	}
+	tests := []struct {
+		topic   string
+		payload string
+		retain  bool
+	}{
+		{topic: "hodos/wan/state", payload: `{"name":"wan"}`, retain: true},
+		{topic: "hodos/wan/event", payload: `{"type":"family"}`, retain: false},
+	}
+	for _, tt := range tests {
+		topic, payload, retain := b.publish()
+		if topic != tt.topic || payload != tt.payload || retain != tt.retain {
+			t.Fatalf("publish = %s %s retain %t, want %s %s retain %t", topic, payload, retain, tt.topic, tt.payload, tt.retain)
+		}
+	}
+	if !c.Connected() {
+		t.Fatal("client is not connected")
+	}
+}
+
+func TestClientQueueFull(t *testing.T) {
+	c, _ := testClient(t, QueueSize(1))
+	if !c.Publish("a", nil, false) {
+		t.Fatal("first message dropped")
+	}
+	if c.Publish("b", nil, false) {
+		t.Fatal("second message queued in a full queue")
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	type message struct{ topic, payload string }
+	received := make(chan message, 4)
+	handler := func(topic string, payload []byte) {
+		received <- message{topic, string(payload)}
+	}
+	c, b := testClient(t,
+		Subscribe("hodos/+/admin/set", handler),
+		Subscribe("other/#", handler))
+	run(t, c, b)
+	b.connect()
+
+	p := b.expect(typeSubscribe)
+	if p.flags != 0x02 {
+		t.Fatalf("subscribe flags = %#x, want 0x02", p.flags)
+	}
+	want := appendUint16(nil, 1)
+	want = append(appendString(want, "hodos/+/admin/set"), 0)
+	want = append(appendString(want, "other/#"), 0)
+	if !bytes.Equal(p.body, want) {
+		t.Fatalf("subscribe = %q, want %q", p.body, want)
+	}
+	b.write(packet{typ: typeSuback, body: []byte{0, 1, 0, 0}})
+
+	// a message that matches no subscription, then one with qos 1
+	b.write(publishPacket("hodos/wan/state", []byte("ignored"), false))
+	body := appendString(nil, "hodos/wan/admin/set")
+	body = append(appendUint16(body, 7), "admin_down"...)
+	b.write(packet{typ: typePublish, flags: 0x02, body: body})
+
+	p = b.expect(typePuback)
+	if id := binary.BigEndian.Uint16(p.body); id != 7 {
+		t.Fatalf("puback of packet %d, want 7", id)
+	}
+	select {
+	case m := <-received:
+		if m.topic != "hodos/wan/admin/set" || m.payload != "admin_down" {
+			t.Fatalf("handler received %s %s, want hodos/wan/admin/set admin_down", m.topic, m.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	select {
+	case m := <-received:
+		t.Fatalf("handler received %s %s, want no more messages", m.topic, m.payload)
+	default:
+	}
+}
+
+func TestClientStop(t *testing.T) {
+	c, b := testClient(t, Will("hodos/status", []byte("offline"), true))
+	go c.Run()
+	b.connect()
+
+	done := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(done)
+	}()
+	topic, payload, retain := b.publish()
+	if topic != "hodos/status" || payload != "offline" || !retain {
+		t.Fatalf("publish = %s %s retain %t, want the will", topic, payload, retain)
+	}
+	b.expect(typeDisconnect)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func TestPacketLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 300000} {
+		p := packet{typ: typePublish, flags: 0x01, body: bytes.Repeat([]byte{'x'}, n)}
+		got, err := readPacket(bufio.NewReader(bytes.NewReader(p.encode())))
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		if got.typ != p.typ || got.flags != p.flags || len(got.body) != n {
+			t.Fatalf("length %d: got type %d flags %#x length %d", n, got.typ, got.flags, len(got.body))
+		}
+	}
+}
+
+func TestParseBroker(t *testing.T) {
+	tests := []struct {
+		broker  string
+		address string
+		secure  bool
+		ok      bool
+	}{
+		{broker: "tcp://broker.example", address: "broker.example:1883", ok: true},
+		{broker: "mqtt://broker.example:1884", address: "broker.example:1884", ok: true},
+		{broker: "ssl://broker.example", address: "broker.example:8883", secure: true, ok: true},
+		{broker: "mqtts://[2001:db8::1]:8884", address: "[2001:db8::1]:8884", secure: true, ok: true},
+		{broker: "http://broker.example"},
+		{broker: "tcp://:1883"},
+	}
+
+	for _, tt := range tests {
+		address, secure, err := ParseBroker(tt.broker)
+		if tt.ok != (err == nil) {
+			t.Fatalf("ParseBroker(%q) error = %v, want ok %t", tt.broker, err, tt.ok)
+		}
+		if address != tt.address || secure != tt.secure {
+			t.Fatalf("ParseBroker(%q) = %s %t, want %s %t", tt.broker, address, secure, tt.address, tt.secure)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "hodos/wan/admin/set", topic: "hodos/wan/admin/set", want: true},
+		{filter: "hodos/+/admin/set", topic: "hodos/wan/admin/set", want: true},
+		{filter: "hodos/+/admin/set", topic: "hodos/wan/state", want: false},
+		{filter: "hodos/+/admin/set", topic: "hodos/wan/admin/set/more", want: false},
+		{filter: "hodos/+", topic: "hodos", want: false},
+		{filter: "hodos/#", topic: "hodos/wan/event", want: true},
+		{filter: "hodos/#", topic: "hodos", want: true},
+		{filter: "#", topic: "anything/at/all", want: true},
+		{filter: "hodos/wan", topic: "hodos/lan", want: false},
+		{filter: "+/+", topic: "a/", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// control packet types of mqtt 3.1.1
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// connect flags
+const (
+	flagCleanSession = 0x02
+	flagWill         = 0x04
+	flagWillRetain   = 0x20
+	flagPassword     = 0x40
+	flagUsername     = 0x80
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// packet is a control packet with the
+// flags of the fixed header and its body
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// encode returns the packet with its fixed header
+func (p packet) encode() []byte {
+	b := []byte{p.typ<<4 | p.flags}
+	n := len(p.body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+// readPacket reads the next control packet
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	var n, shift int
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return packet{}, errors.New("malformed remaining length")
+		}
+	}
+	p := packet{typ: header >> 4, flags: header & 0x0f, body: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendString appends the length prefixed string
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a length prefixed string, and returns the rest of b
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// will is the message the broker publishes
+// when the connection is lost unexpectedly
+type will struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func connectPacket(clientID, username, password string, keepAlive uint16, w *will) packet {
+	var flags byte = flagCleanSession
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+
+	payload := appendString(nil, clientID)
+	if w != nil {
+		flags |= flagWill
+		if w.retain {
+			flags |= flagWillRetain
+		}
+		payload = appendString(payload, w.topic)
+		payload = appendString(payload, string(w.payload))
+	}
+	if username != "" {
+		flags |= flagUsername
+		payload = appendString(payload, username)
+		if password != "" {
+			flags |= flagPassword
+			payload = appendString(payload, password)
+		}
+	}
+
+	body = append(body, flags)
+	body = appendUint16(body, keepAlive)
+	return packet{typ: typeConnect, body: append(body, payload...)}
+}
+
+// connackError returns the error of a connack packet
+func connackError(p packet) error {
+	if p.typ != typeConnack || len(p.body) != 2 {
+		return fmt.Errorf("expected connack, got packet type %d", p.typ)
+	}
+	if code := p.body[1]; code != 0 {
+		if msg, ok := connackErrors[code]; ok {
+			return fmt.Errorf("connection refused: %s", msg)
+		}
+		return fmt.Errorf("connection refused: code %d", code)
+	}
+	return nil
+}
+
+// publishPacket returns a publish packet with qos 0
+func publishPacket(topic string, payload []byte, retain bool) packet {
+	var flags byte
+	if retain {
+		flags = 0x01
+	}
+	body := appendString(nil, topic)
+	return packet{typ: typePublish, flags: flags, body: append(body, payload...)}
+}
+
+// parsePublish returns the topic, payload and, with qos 1
+// or 2, the packet identifier of a publish packet
+func parsePublish(p packet) (string, []byte, uint16, error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	var id uint16
+	if qos := (p.flags >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", nil, 0, errors.New("short packet identifier")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return topic, rest, id, nil
+}
+
+func pubackPacket(id uint16) packet {
+	return packet{typ: typePuback, body: appendUint16(nil, id)}
+}
+
+// subscribePacket subscribes to the filters with qos 0
+func subscribePacket(id uint16, filters []string) packet {
+	body := appendUint16(nil, id)
+	for _, filter := range filters {
+		body = appendString(body, filter)
+		body = append(body, 0)
+	}
+	return packet{typ: typeSubscribe, flags: 0x02, body: body}
+}
+
+// Match returns whether the topic matches the
+// filter, with the + and # wildcards of mqtt
+func Match(filter, topic string) bool {
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, f := range filters {
+		switch {
+		case f == "#":
+			return true
+		case i >= len(topics):
+			return false
+		case f != "+" && f != topics[i]:
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
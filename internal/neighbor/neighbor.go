@@ -0,0 +1,300 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package neighbor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/log"
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gatewayRefresh is the interval at which the gateways
+	// of the interface are looked up in the routing table
+	gatewayRefresh = 5 * time.Second
+
+	// receiveBackoff is the time to wait after a receive error, it
+	// doubles for every error in a row up to maxReceiveBackoff
+	receiveBackoff    = 100 * time.Millisecond
+	maxReceiveBackoff = 5 * time.Second
+)
+
+// Monitor watches the kernel neighbor table for the
+// entries of the gateways of an interface.
+// It is a passive health source, it does not send
+// any traffic by itself.
+type Monitor struct {
+	interFace config.Interface
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	downFunc func(family uint8)
+	upFunc   func(family uint8)
+	l        log.Logger
+
+	// gateways holds the known gateways of the interface
+	// and whether their neighbor entry is failed
+	gateways map[string]bool
+	lastList time.Time
+
+	alive int64 // unix nanoseconds of the last loop, read atomically
+
+	wg *sync.WaitGroup
+}
+
+func New(ctx context.Context, ifi config.Interface, opts ...Option) (*Monitor, error) {
+	m := &Monitor{
+		interFace: ifi,
+
+		downFunc: func(uint8) {},
+		upFunc:   func(uint8) {},
+		l:        log.Default(),
+		gateways: make(map[string]bool),
+		wg:       &sync.WaitGroup{},
+	}
+	m.ctx, m.ctxCancel = context.WithCancel(ctx)
+
+	for _, option := range opts {
+		if err := option(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Up is used to add a callback that is run
+// when the neighbor entries of the gateways for
+// a family become usable again.
+func (m *Monitor) Up(upFunc func(family uint8)) {
+	m.upFunc = upFunc
+}
+
+// Down is used to add a callback that is run
+// when the kernel marks the neighbor entries of
+// all gateways for a family failed or incomplete.
+func (m *Monitor) Down(downFunc func(family uint8)) {
+	m.downFunc = downFunc
+}
+
+// Option is a functional argument to *Monitor
+type Option func(m *Monitor) error
+
+// Logger is a functional Option to set
+// a new logger for this monitor
+func Logger(l log.Logger) Option {
+	return func(m *Monitor) error {
+		m.l = l
+		return nil
+	}
+}
+
+func (m *Monitor) Run() error {
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	m.l.Debugf("neighborMonitor: starting monitor on %q", m.interFace.Name)
+	nl, err := rtnetlink.Dial(&netlink.Config{Groups: unix.RTMGRP_NEIGH})
+	if err != nil {
+		m.l.Errorf("neighborMonitor: could not dial rtnetlink: %s", err)
+		return err
+	}
+	defer nl.Close()
+	defer m.l.Debugf("neighborMonitor: ended for %q", m.interFace.Name)
+
+	// bootstrap our state by getting all neighbors
+	nreq := &rtnetlink.NeighMessage{}
+	nl.Send(nreq, unix.RTM_GETNEIGH, netlink.Request|netlink.Dump)
+
+	// endlessly loop
+	backoff := receiveBackoff
+	defer atomic.StoreInt64(&m.alive, 0)
+	for {
+		atomic.StoreInt64(&m.alive, time.Now().UnixNano())
+		nl.SetReadDeadline(time.Now().Add(1 * time.Second))
+		select {
+		case <-m.ctx.Done():
+			// our caller has closed the context
+			// so we stop monitoring
+			return nil
+		default:
+			msgs, omsgs, err := nl.Receive()
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					continue
+				}
+				if closed(err) {
+					m.l.Errorf("neighborMonitor: socket closed: %s", err)
+					return err
+				}
+				m.l.Errorf("neighborMonitor: receive error, retrying in %s: %s", backoff, err)
+				if errors.Is(err, unix.ENOBUFS) {
+					// neighbor events were lost, so get all of them again
+					nl.Send(nreq, unix.RTM_GETNEIGH, netlink.Request|netlink.Dump)
+				}
+				select {
+				case <-m.ctx.Done():
+					return nil
+				case <-time.After(backoff):
+				}
+				backoff = nextBackoff(backoff)
+				continue
+			}
+			backoff = receiveBackoff
+
+			for i, msg := range msgs {
+				// deleted entries are garbage collected by the kernel,
+				// this does not tell us anything about the gateway
+				if omsgs[i].Header.Type != unix.RTM_NEWNEIGH {
+					continue
+				}
+				if msg, ok := msg.(*rtnetlink.NeighMessage); ok {
+					m.handle(msg)
+				}
+			}
+		}
+	}
+}
+
+// closed returns true if err is from a closed socket
+func closed(err error) bool {
+	return errors.Is(err, unix.EBADF) || errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed)
+}
+
+// nextBackoff returns the backoff after another receive error
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxReceiveBackoff {
+		return maxReceiveBackoff
+	}
+	return backoff
+}
+
+// Alive returns when the monitor last went through its loop,
+// or the zero time if it is not running (yet)
+func (m *Monitor) Alive() time.Time {
+	if alive := atomic.LoadInt64(&m.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
+// handle decides whether the neighbor message concerns one of our
+// gateways, and calls the up or down callback when the usability of
+// the gateways of this family changes.
+func (m *Monitor) handle(msg *rtnetlink.NeighMessage) {
+	if msg.Attributes == nil || msg.Attributes.Address == nil {
+		return
+	}
+	ifi, err := net.InterfaceByName(m.interFace.Name)
+	if err != nil || msg.Index != uint32(ifi.Index) {
+		return
+	}
+
+	m.refreshGateways(uint32(ifi.Index))
+	addr := msg.Attributes.Address.String()
+	failed, ok := m.gateways[addr]
+	if !ok {
+		return
+	}
+
+	family := uint8(unix.AF_INET)
+	if msg.Attributes.Address.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	nowFailed := msg.State&(unix.NUD_FAILED|unix.NUD_INCOMPLETE) != 0
+	m.l.Debugf("neighborMonitor: gateway %s on %q in state 0x%02x", addr, m.interFace.Name, msg.State)
+	if nowFailed == failed {
+		return
+	}
+	m.gateways[addr] = nowFailed
+
+	if nowFailed {
+		// only report down when there are no usable gateways left
+		if !m.usable(family) {
+			m.l.Printf("neighborMonitor: gateway %s on %q is unreachable", addr, m.interFace.Name)
+			m.downFunc(family)
+		}
+		return
+	}
+	m.l.Printf("neighborMonitor: gateway %s on %q is reachable", addr, m.interFace.Name)
+	m.upFunc(family)
+}
+
+// usable returns true if at least one gateway of this family
+// does not have a failed neighbor entry.
+func (m *Monitor) usable(family uint8) bool {
+	for addr, failed := range m.gateways {
+		ip := net.ParseIP(addr)
+		if (ip.To4() != nil) != (family == unix.AF_INET) {
+			continue
+		}
+		if !failed {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshGateways looks up the gateways used by routes through
+// this interface. Gateways are rate limited to prevent dumping
+// the routing table on every neighbor event.
+func (m *Monitor) refreshGateways(ifIndex uint32) {
+	if time.Since(m.lastList) < gatewayRefresh {
+		return
+	}
+	m.lastList = time.Now()
+
+	nl, err := rtnetlink.Dial(nil)
+	if err != nil {
+		m.l.Errorf("neighborMonitor: could not dial rtnetlink: %s", err)
+		return
+	}
+	defer nl.Close()
+
+	msgs, err := nl.Route.List()
+	if err != nil {
+		m.l.Errorf("neighborMonitor: could not list routes: %s", err)
+		return
+	}
+
+	gateways := make(map[string]bool)
+	for _, msg := range msgs {
+		if msg.Attributes.OutIface != ifIndex || msg.Attributes.Gateway == nil {
+			continue
+		}
+		if msg.Attributes.Table != unix.RT_TABLE_MAIN &&
+			(m.interFace.Table == 0 || msg.Attributes.Table != m.interFace.Table) {
+			continue
+		}
+		addr := msg.Attributes.Gateway.String()
+		// keep the state of gateways we already know about
+		gateways[addr] = m.gateways[addr]
+	}
+	m.gateways = gateways
+}
+
+func (m *Monitor) Stop() {
+	m.l.Debugf("stopping neighbor monitor on %q", m.interFace.Name)
+	m.ctxCancel()
+	m.wg.Wait()
+}
@@ -0,0 +1,174 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package neighbor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/log"
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestHandle(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+
+	type neigh struct {
+		addr  string
+		state uint16
+		index int // 0 for the index of the interface
+	}
+
+	tests := []struct {
+		name   string
+		neighs []neigh
+		want   []string // the callbacks, in order
+	}{
+		{
+			name:   "reachable",
+			neighs: []neigh{{addr: "192.0.2.1", state: unix.NUD_REACHABLE}, {addr: "192.0.2.1", state: unix.NUD_STALE}},
+		},
+		{
+			name:   "one of two gateways fails",
+			neighs: []neigh{{addr: "192.0.2.1", state: unix.NUD_FAILED}},
+		},
+		{
+			name: "all gateways of a family fail",
+			neighs: []neigh{
+				{addr: "192.0.2.1", state: unix.NUD_FAILED},
+				{addr: "192.0.2.2", state: unix.NUD_INCOMPLETE},
+				{addr: "192.0.2.2", state: unix.NUD_FAILED},
+			},
+			want: []string{"down ipv4"},
+		},
+		{
+			name: "a gateway recovers",
+			neighs: []neigh{
+				{addr: "192.0.2.1", state: unix.NUD_FAILED},
+				{addr: "192.0.2.2", state: unix.NUD_FAILED},
+				{addr: "192.0.2.2", state: unix.NUD_REACHABLE},
+				{addr: "192.0.2.1", state: unix.NUD_REACHABLE},
+			},
+			want: []string{"down ipv4", "up ipv4", "up ipv4"},
+		},
+		{
+			name:   "ipv6 gateway",
+			neighs: []neigh{{addr: "2001:db8::1", state: unix.NUD_FAILED}, {addr: "2001:db8::1", state: unix.NUD_DELAY}},
+			want:   []string{"down ipv6", "up ipv6"},
+		},
+		{
+			name:   "not a gateway",
+			neighs: []neigh{{addr: "192.0.2.3", state: unix.NUD_FAILED}, {addr: "2001:db8::2", state: unix.NUD_FAILED}},
+		},
+		{
+			name:   "another interface",
+			neighs: []neigh{{addr: "2001:db8::1", state: unix.NUD_FAILED, index: lo.Index + 1000}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			m, err := New(context.Background(), config.Interface{Name: lo.Name}, Logger(log.New(stdlog.New(io.Discard, "", 0))))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m.Down(func(family uint8) { got = append(got, "down "+familyName(family)) })
+			m.Up(func(family uint8) { got = append(got, "up "+familyName(family)) })
+			// the gateways were just looked up
+			m.gateways = map[string]bool{"192.0.2.1": false, "192.0.2.2": false, "2001:db8::1": false}
+			m.lastList = time.Now()
+
+			for _, n := range tt.neighs {
+				index := n.index
+				if index == 0 {
+					index = lo.Index
+				}
+				m.handle(&rtnetlink.NeighMessage{
+					Index:      uint32(index),
+					State:      n.state,
+					Attributes: &rtnetlink.NeighAttributes{Address: net.ParseIP(n.addr)},
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("callbacks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func familyName(family uint8) string {
+	if family == unix.AF_INET6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := receiveBackoff
+	var got []time.Duration
+	for i := 0; i < 8; i++ {
+		got = append(got, backoff)
+		backoff = nextBackoff(backoff)
+	}
+	want := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		1600 * time.Millisecond, 3200 * time.Millisecond, maxReceiveBackoff, maxReceiveBackoff,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("backoffs = %v, want %v", got, want)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "closed connection", err: net.ErrClosed, want: true},
+		{name: "wrapped", err: fmt.Errorf("receive: %w", net.ErrClosed), want: true},
+		{name: "bad file descriptor", err: &netlink.OpError{Op: "receive", Err: unix.EBADF}, want: true},
+		{name: "no buffer space", err: &netlink.OpError{Op: "receive", Err: unix.ENOBUFS}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := closed(tt.err); got != tt.want {
+				t.Fatalf("closed(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	// the error of a socket that is really closed
+	nl, err := rtnetlink.Dial(&netlink.Config{Groups: unix.RTMGRP_NEIGH})
+	if err != nil {
+		t.Skipf("cannot dial rtnetlink: %v", err)
+	}
+	nl.Close()
+	if _, _, err := nl.Receive(); !closed(err) {
+		t.Fatalf("closed(%v) = false for a closed socket", err)
+	}
+}
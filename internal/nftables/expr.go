@@ -0,0 +1,111 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package nftables
+
+import (
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// An expr is a single nftables expression of a rule. All expressions
+// of a rule work on the first register.
+type expr struct {
+	name string
+	data func(ae *netlink.AttributeEncoder)
+}
+
+func (e expr) encode(ae *netlink.AttributeEncoder) error {
+	ae.String(unix.NFTA_EXPR_NAME, e.name)
+	if e.data != nil {
+		ae.Nested(unix.NFTA_EXPR_DATA, func(nae *netlink.AttributeEncoder) error {
+			e.data(nae)
+			return nil
+		})
+	}
+	return nil
+}
+
+// metaLoad loads the meta key into the register
+func metaLoad(key uint32) expr {
+	return expr{name: "meta", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_META_KEY, key)
+		ae.Uint32(unix.NFTA_META_DREG, unix.NFT_REG_1)
+	}}
+}
+
+// metaSet sets the meta key from the register
+func metaSet(key uint32) expr {
+	return expr{name: "meta", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_META_KEY, key)
+		ae.Uint32(unix.NFTA_META_SREG, unix.NFT_REG_1)
+	}}
+}
+
+// ctLoad loads the conntrack key into the register
+func ctLoad(key uint32) expr {
+	return expr{name: "ct", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_CT_KEY, key)
+		ae.Uint32(unix.NFTA_CT_DREG, unix.NFT_REG_1)
+	}}
+}
+
+// ctSet sets the conntrack key from the register
+func ctSet(key uint32) expr {
+	return expr{name: "ct", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_CT_KEY, key)
+		ae.Uint32(unix.NFTA_CT_SREG, unix.NFT_REG_1)
+	}}
+}
+
+// cmp stops evaluating the rule unless the register compares to value
+func cmp(op uint32, value []byte) expr {
+	return expr{name: "cmp", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_CMP_SREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_CMP_OP, op)
+		ae.Nested(unix.NFTA_CMP_DATA, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(unix.NFTA_DATA_VALUE, value)
+			return nil
+		})
+	}}
+}
+
+// immediate loads value into the register
+func immediate(value []byte) expr {
+	return expr{name: "immediate", data: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_1)
+		ae.Nested(unix.NFTA_IMMEDIATE_DATA, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(unix.NFTA_DATA_VALUE, value)
+			return nil
+		})
+	}}
+}
+
+// masquerade translates the source address to the address of the outgoing interface
+func masquerade() expr {
+	return expr{name: "masq"}
+}
+
+// ifname returns the interface name as compared by the kernel
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// mark returns a mark in host byte order
+func mark(m uint32) []byte {
+	b := make([]byte, 4)
+	nlenc.PutUint32(b, m)
+	return b
+}
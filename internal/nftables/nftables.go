@@ -0,0 +1,272 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package nftables
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	priorityMangle = -150 // NF_IP_PRI_MANGLE
+	prioritySrcNAT = 100  // NF_IP_PRI_NAT_SRC
+
+	policyAccept = 1 // NF_ACCEPT
+)
+
+// An Interface holds the rules for an interface in the table.
+type Interface struct {
+	Name string
+	// Mark is restored from the connmark on the packets of the
+	// connections, so they are routed through the interface. 0 disables it.
+	Mark uint32
+	// Failed are the families (unix.AF_INET or unix.AF_INET6) that do not
+	// route through the interface. Their mark is not restored, so their
+	// connections take the other interfaces instead of the failed one.
+	Failed []uint8
+	// Sticky saves the mark in the connmark of the connections entering
+	// or leaving through the interface, so they stick to the interface.
+	Sticky     bool
+	Masquerade bool
+}
+
+// A chain is a base chain of the table with the rules built for each interface
+type chain struct {
+	name     string
+	typ      string
+	hook     uint32
+	priority int32
+	rules    func(ifi Interface) [][]expr
+}
+
+// chains are the chains of the table. Packets coming in through an
+// interface and leaving through it get the mark of the interface in
+// their connmark. The mark is restored on the other packets of the
+// connection, so they are routed through the table of the interface.
+var chains = []chain{
+	{
+		name: "prerouting", typ: "filter", hook: unix.NF_INET_PRE_ROUTING, priority: priorityMangle,
+		rules: func(ifi Interface) [][]expr {
+			if ifi.Mark == 0 {
+				return nil
+			}
+			var rules [][]expr
+			if ifi.Sticky {
+				// iifname <ifi> ct mark 0 ct mark set <mark>
+				rules = append(rules, []expr{metaLoad(unix.NFT_META_IIFNAME), cmp(unix.NFT_CMP_EQ, ifname(ifi.Name)), ctLoad(unix.NFT_CT_MARK), cmp(unix.NFT_CMP_EQ, mark(0)), immediate(mark(ifi.Mark)), ctSet(unix.NFT_CT_MARK)})
+			}
+			for _, family := range restored(ifi) {
+				// [meta nfproto <family>] iifname != <ifi> ct mark <mark> meta mark 0 meta mark set <mark>
+				rules = append(rules, append(family, metaLoad(unix.NFT_META_IIFNAME), cmp(unix.NFT_CMP_NEQ, ifname(ifi.Name)), ctLoad(unix.NFT_CT_MARK), cmp(unix.NFT_CMP_EQ, mark(ifi.Mark)), metaLoad(unix.NFT_META_MARK), cmp(unix.NFT_CMP_EQ, mark(0)), immediate(mark(ifi.Mark)), metaSet(unix.NFT_META_MARK)))
+			}
+			return rules
+		},
+	},
+	{
+		name: "output", typ: "route", hook: unix.NF_INET_LOCAL_OUT, priority: priorityMangle,
+		rules: func(ifi Interface) [][]expr {
+			if ifi.Mark == 0 {
+				return nil
+			}
+			var rules [][]expr
+			for _, family := range restored(ifi) {
+				// [meta nfproto <family>] ct mark <mark> meta mark 0 meta mark set <mark>
+				rules = append(rules, append(family, ctLoad(unix.NFT_CT_MARK), cmp(unix.NFT_CMP_EQ, mark(ifi.Mark)), metaLoad(unix.NFT_META_MARK), cmp(unix.NFT_CMP_EQ, mark(0)), immediate(mark(ifi.Mark)), metaSet(unix.NFT_META_MARK)))
+			}
+			return rules
+		},
+	},
+	{
+		name: "postrouting", typ: "filter", hook: unix.NF_INET_POST_ROUTING, priority: priorityMangle,
+		rules: func(ifi Interface) [][]expr {
+			if ifi.Mark == 0 || !ifi.Sticky {
+				return nil
+			}
+			return [][]expr{
+				// oifname <ifi> ct mark 0 ct mark set <mark>
+				{metaLoad(unix.NFT_META_OIFNAME), cmp(unix.NFT_CMP_EQ, ifname(ifi.Name)), ctLoad(unix.NFT_CT_MARK), cmp(unix.NFT_CMP_EQ, mark(0)), immediate(mark(ifi.Mark)), ctSet(unix.NFT_CT_MARK)},
+			}
+		},
+	},
+	{
+		name: "masquerade", typ: "nat", hook: unix.NF_INET_POST_ROUTING, priority: prioritySrcNAT,
+		rules: func(ifi Interface) [][]expr {
+			if !ifi.Masquerade {
+				return nil
+			}
+			return [][]expr{
+				// oifname <ifi> masquerade
+				{metaLoad(unix.NFT_META_OIFNAME), cmp(unix.NFT_CMP_EQ, ifname(ifi.Name)), masquerade()},
+			}
+		},
+	},
+}
+
+// restored returns the match on the family of every rule that restores
+// the mark, a single empty match when no family of the interface failed
+func restored(ifi Interface) [][]expr {
+	if len(ifi.Failed) == 0 {
+		return [][]expr{nil}
+	}
+	var matches [][]expr
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if failed(ifi, family) {
+			continue
+		}
+		proto := byte(unix.NFPROTO_IPV4)
+		if family == unix.AF_INET6 {
+			proto = unix.NFPROTO_IPV6
+		}
+		// meta nfproto <family>
+		matches = append(matches, []expr{metaLoad(unix.NFT_META_NFPROTO), cmp(unix.NFT_CMP_EQ, []byte{proto})})
+	}
+	return matches
+}
+
+func failed(ifi Interface, family uint8) bool {
+	for _, f := range ifi.Failed {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply replaces the inet table with the rules for the interfaces.
+// The table is replaced in a single transaction, so there is no
+// moment without rules.
+func Apply(table string, ifis []Interface) error {
+	// adding the table before deleting it makes sure
+	// the delete does not fail on a missing table
+	msgs := []netlink.Message{
+		message(unix.NFT_MSG_NEWTABLE, tableAttrs(table)),
+		message(unix.NFT_MSG_DELTABLE, tableAttrs(table)),
+		message(unix.NFT_MSG_NEWTABLE, tableAttrs(table)),
+	}
+	for _, c := range chains {
+		msgs = append(msgs, message(unix.NFT_MSG_NEWCHAIN, chainAttrs(table, c)))
+		for _, ifi := range ifis {
+			for _, rule := range c.rules(ifi) {
+				msgs = append(msgs, message(unix.NFT_MSG_NEWRULE, ruleAttrs(table, c.name, rule)))
+			}
+		}
+	}
+	return send(msgs)
+}
+
+// Delete removes the table, if it exists.
+func Delete(table string) error {
+	return send([]netlink.Message{
+		message(unix.NFT_MSG_NEWTABLE, tableAttrs(table)),
+		message(unix.NFT_MSG_DELTABLE, tableAttrs(table)),
+	})
+}
+
+// send sends the messages as a single batch, and waits for an
+// acknowledgement of every message.
+func send(msgs []netlink.Message) error {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	batch := []netlink.Message{batchMessage(unix.NFNL_MSG_BATCH_BEGIN)}
+	batch = append(batch, msgs...)
+	batch = append(batch, batchMessage(unix.NFNL_MSG_BATCH_END))
+	if _, err := c.SendMessages(batch); err != nil {
+		return err
+	}
+
+	// if a message fails, the whole batch is aborted and
+	// the error is returned for the failed message
+	for acked := 0; acked < len(msgs); {
+		replies, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		if len(replies) == 0 {
+			return errors.New("nftables: no acknowledgement")
+		}
+		acked += len(replies)
+	}
+	return nil
+}
+
+func message(typ uint16, attrs func(ae *netlink.AttributeEncoder)) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	attrs(ae)
+	// the encoders only fail on oversized attributes,
+	// which are not produced by this package
+	b, _ := ae.Encode()
+
+	flags := netlink.Request | netlink.Acknowledge
+	if typ != unix.NFT_MSG_DELTABLE {
+		flags |= netlink.Create
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | typ),
+			Flags: flags,
+		},
+		Data: append([]byte{unix.NFPROTO_INET, unix.NFNETLINK_V0, 0, 0}, b...),
+	}
+}
+
+// batchMessage returns the message that begins or ends a batch
+func batchMessage(typ uint16) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(typ),
+			Flags: netlink.Request,
+		},
+		Data: []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	}
+}
+
+func tableAttrs(table string) func(ae *netlink.AttributeEncoder) {
+	return func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, table)
+	}
+}
+
+func chainAttrs(table string, c chain) func(ae *netlink.AttributeEncoder) {
+	return func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_CHAIN_TABLE, table)
+		ae.String(unix.NFTA_CHAIN_NAME, c.name)
+		ae.Nested(unix.NFTA_CHAIN_HOOK, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint32(unix.NFTA_HOOK_HOOKNUM, c.hook)
+			nae.Int32(unix.NFTA_HOOK_PRIORITY, c.priority)
+			return nil
+		})
+		ae.Uint32(unix.NFTA_CHAIN_POLICY, policyAccept)
+		ae.String(unix.NFTA_CHAIN_TYPE, c.typ)
+	}
+}
+
+func ruleAttrs(table string, chain string, exprs []expr) func(ae *netlink.AttributeEncoder) {
+	return func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, table)
+		ae.String(unix.NFTA_RULE_CHAIN, chain)
+		ae.Nested(unix.NFTA_RULE_EXPRESSIONS, func(nae *netlink.AttributeEncoder) error {
+			for _, e := range exprs {
+				nae.Nested(unix.NFTA_LIST_ELEM, e.encode)
+			}
+			return nil
+		})
+	}
+}
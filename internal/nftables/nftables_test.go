@@ -0,0 +1,321 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+var keys = map[uint32]string{
+	unix.NFT_META_IIFNAME: "iifname",
+	unix.NFT_META_OIFNAME: "oifname",
+	unix.NFT_META_MARK:    "mark",
+	unix.NFT_META_NFPROTO: "nfproto",
+}
+
+// describe encodes the rule as it is sent to the kernel, and
+// decodes it again into a line such as "meta load iifname, cmp == wan"
+func describe(t *testing.T, rule []expr) string {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ruleAttrs("hodos", "prerouting", rule)(ae)
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var exprs []string
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		if ad.Type() != unix.NFTA_RULE_EXPRESSIONS {
+			continue
+		}
+		ad.Nested(func(lad *netlink.AttributeDecoder) error {
+			for lad.Next() {
+				lad.Nested(func(ead *netlink.AttributeDecoder) error {
+					exprs = append(exprs, describeExpr(ead))
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	if err := ad.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func describeExpr(ad *netlink.AttributeDecoder) string {
+	var name string
+	attrs := make(map[uint16]uint32)
+	var value []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_EXPR_NAME:
+			name = ad.String()
+		case unix.NFTA_EXPR_DATA:
+			ad.Nested(func(dad *netlink.AttributeDecoder) error {
+				for dad.Next() {
+					switch {
+					case name == "cmp" && dad.Type() == unix.NFTA_CMP_DATA,
+						name == "immediate" && dad.Type() == unix.NFTA_IMMEDIATE_DATA:
+						dad.Nested(func(vad *netlink.AttributeDecoder) error {
+							for vad.Next() {
+								value = vad.Bytes()
+							}
+							return nil
+						})
+					default:
+						attrs[dad.Type()] = dad.Uint32()
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	switch name {
+	case "meta":
+		if _, ok := attrs[unix.NFTA_META_SREG]; ok {
+			return "meta set " + keys[attrs[unix.NFTA_META_KEY]]
+		}
+		return "meta load " + keys[attrs[unix.NFTA_META_KEY]]
+	case "ct":
+		if attrs[unix.NFTA_CT_KEY] != unix.NFT_CT_MARK {
+			return "ct ?"
+		}
+		if _, ok := attrs[unix.NFTA_CT_SREG]; ok {
+			return "ct set mark"
+		}
+		return "ct load mark"
+	case "cmp":
+		op := "=="
+		if attrs[unix.NFTA_CMP_OP] == unix.NFT_CMP_NEQ {
+			op = "!="
+		}
+		return "cmp " + op + " " + describeValue(value)
+	case "immediate":
+		return "immediate " + describeValue(value)
+	default:
+		return name
+	}
+}
+
+func describeValue(b []byte) string {
+	switch len(b) {
+	case unix.IFNAMSIZ:
+		return string(bytes.TrimRight(b, "\x00"))
+	case 4:
+		return fmt.Sprint(nlenc.Uint32(b))
+	case 1:
+		if b[0] == unix.NFPROTO_IPV6 {
+			return "ipv6"
+		}
+		return "ipv4"
+	default:
+		return fmt.Sprintf("%x", b)
+	}
+}
+
+const (
+	restoreIn  = "meta load iifname, cmp != wan, ct load mark, cmp == 100, meta load mark, cmp == 0, immediate 100, meta set mark"
+	restoreOut = "ct load mark, cmp == 100, meta load mark, cmp == 0, immediate 100, meta set mark"
+	saveIn     = "meta load iifname, cmp == wan, ct load mark, cmp == 0, immediate 100, ct set mark"
+	saveOut    = "meta load oifname, cmp == wan, ct load mark, cmp == 0, immediate 100, ct set mark"
+	onlyIPv4   = "meta load nfproto, cmp == ipv4, "
+	onlyIPv6   = "meta load nfproto, cmp == ipv6, "
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name string
+		ifi  Interface
+		want map[string][]string // the rules of each chain
+	}{
+		{
+			name: "nothing",
+			ifi:  Interface{Name: "wan"},
+			want: map[string][]string{},
+		},
+		{
+			name: "sticky without a mark",
+			ifi:  Interface{Name: "wan", Sticky: true},
+			want: map[string][]string{},
+		},
+		{
+			name: "masquerade",
+			ifi:  Interface{Name: "wan", Masquerade: true},
+			want: map[string][]string{
+				"masquerade": {"meta load oifname, cmp == wan, masq"},
+			},
+		},
+		{
+			name: "mark",
+			ifi:  Interface{Name: "wan", Mark: 100},
+			want: map[string][]string{
+				"prerouting": {restoreIn},
+				"output":     {restoreOut},
+			},
+		},
+		{
+			name: "sticky",
+			ifi:  Interface{Name: "wan", Mark: 100, Sticky: true, Masquerade: true},
+			want: map[string][]string{
+				"prerouting":  {saveIn, restoreIn},
+				"output":      {restoreOut},
+				"postrouting": {saveOut},
+				"masquerade":  {"meta load oifname, cmp == wan, masq"},
+			},
+		},
+		{
+			name: "ipv4 failed",
+			ifi:  Interface{Name: "wan", Mark: 100, Sticky: true, Failed: []uint8{unix.AF_INET}},
+			want: map[string][]string{
+				"prerouting":  {saveIn, onlyIPv6 + restoreIn},
+				"output":      {onlyIPv6 + restoreOut},
+				"postrouting": {saveOut},
+			},
+		},
+		{
+			name: "ipv6 failed",
+			ifi:  Interface{Name: "wan", Mark: 100, Failed: []uint8{unix.AF_INET6}},
+			want: map[string][]string{
+				"prerouting": {onlyIPv4 + restoreIn},
+				"output":     {onlyIPv4 + restoreOut},
+			},
+		},
+		{
+			name: "both failed",
+			ifi:  Interface{Name: "wan", Mark: 100, Sticky: true, Failed: []uint8{unix.AF_INET, unix.AF_INET6}},
+			want: map[string][]string{
+				// connections are still saved, so they
+				// return to the interface once it is up
+				"prerouting":  {saveIn},
+				"postrouting": {saveOut},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string][]string)
+			for _, c := range chains {
+				for _, rule := range c.rules(tt.ifi) {
+					got[c.name] = append(got[c.name], describe(t, rule))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("rules = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		typ   uint16
+		flags netlink.HeaderFlags
+	}{
+		{typ: unix.NFT_MSG_NEWTABLE, flags: netlink.Request | netlink.Acknowledge | netlink.Create},
+		// deleting a table fails on the create flag
+		{typ: unix.NFT_MSG_DELTABLE, flags: netlink.Request | netlink.Acknowledge},
+		{typ: unix.NFT_MSG_NEWCHAIN, flags: netlink.Request | netlink.Acknowledge | netlink.Create},
+		{typ: unix.NFT_MSG_NEWRULE, flags: netlink.Request | netlink.Acknowledge | netlink.Create},
+	}
+
+	for _, tt := range tests {
+		m := message(tt.typ, tableAttrs("hodos"))
+		if want := netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | tt.typ); m.Header.Type != want {
+			t.Fatalf("type = %#x, want %#x", m.Header.Type, want)
+		}
+		if m.Header.Flags != tt.flags {
+			t.Fatalf("message %d: flags = %s, want %s", tt.typ, m.Header.Flags, tt.flags)
+		}
+		if m.Data[0] != unix.NFPROTO_INET {
+			t.Fatalf("message %d: family = %d, want inet", tt.typ, m.Data[0])
+		}
+		attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(attrs) != 1 || attrs[0].Type != unix.NFTA_TABLE_NAME || nlenc.String(attrs[0].Data) != "hodos" {
+			t.Fatalf("message %d: attributes = %+v, want the table name", tt.typ, attrs)
+		}
+	}
+}
+
+func TestChainAttrs(t *testing.T) {
+	for _, c := range chains {
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		chainAttrs("hodos", c)(ae)
+		b, err := ae.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ad, err := netlink.NewAttributeDecoder(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ad.ByteOrder = binary.BigEndian
+		var (
+			name, typ    string
+			hook, policy uint32
+			priority     int32
+		)
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_CHAIN_NAME:
+				name = ad.String()
+			case unix.NFTA_CHAIN_TYPE:
+				typ = ad.String()
+			case unix.NFTA_CHAIN_POLICY:
+				policy = ad.Uint32()
+			case unix.NFTA_CHAIN_HOOK:
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					for nad.Next() {
+						switch nad.Type() {
+						case unix.NFTA_HOOK_HOOKNUM:
+							hook = nad.Uint32()
+						case unix.NFTA_HOOK_PRIORITY:
+							priority = nad.Int32()
+						}
+					}
+					return nil
+				})
+			}
+		}
+		if err := ad.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name != c.name || typ != c.typ || hook != c.hook || priority != c.priority || policy != policyAccept {
+			t.Fatalf("chain %s: decoded %s %s hook %d priority %d policy %d", c.name, name, typ, hook, priority, policy)
+		}
+	}
+}
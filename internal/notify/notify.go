@@ -0,0 +1,90 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package notify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// the states that are sent to the service manager
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state with a free-form status line
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Send sends the states, separated by newlines, to the service manager
+// at NOTIFY_SOCKET. It returns false when not run by a service manager
+// that supports notifications.
+func Send(states ...string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// a leading @ is an abstract socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var msg []byte
+	for i, state := range states {
+		if i > 0 {
+			msg = append(msg, '\n')
+		}
+		msg = append(msg, state...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service
+// manager expects a watchdog ping, or 0 if the watchdog is disabled
+// or meant for another process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, err
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+	u, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if u <= 0 {
+		return 0, nil
+	}
+	return time.Duration(u) * time.Microsecond, nil
+}
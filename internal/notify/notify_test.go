@@ -0,0 +1,133 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package notify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen returns a datagram socket at path, as the service manager has
+func listen(t *testing.T, path string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func read(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	b := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestSend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn := listen(t, path)
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	ok, err := Send(Ready, Status("eth0 ipv4 up"))
+	if err != nil || !ok {
+		t.Fatalf("Send() = %t, %v, want true", ok, err)
+	}
+	if got, want := read(t, conn), "READY=1\nSTATUS=eth0 ipv4 up"; got != want {
+		t.Fatalf("message = %q, want %q", got, want)
+	}
+
+	ok, err = Send(Watchdog)
+	if err != nil || !ok {
+		t.Fatalf("Send() = %t, %v, want true", ok, err)
+	}
+	if got := read(t, conn); got != Watchdog {
+		t.Fatalf("message = %q, want %q", got, Watchdog)
+	}
+}
+
+func TestSendAbstract(t *testing.T) {
+	name := "hodos-notify-test-" + strconv.Itoa(os.Getpid())
+	conn := listen(t, "@"+name)
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+
+	if ok, err := Send(Stopping); err != nil || !ok {
+		t.Fatalf("Send() = %t, %v, want true", ok, err)
+	}
+	if got := read(t, conn); got != Stopping {
+		t.Fatalf("message = %q, want %q", got, Stopping)
+	}
+}
+
+func TestSendWithoutServiceManager(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Send(Ready); err != nil || ok {
+		t.Fatalf("Send() = %t, %v, want false without an error", ok, err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if ok, err := Send(Ready); err == nil || ok {
+		t.Fatalf("Send() = %t, %v, want an error for a missing socket", ok, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+		err  bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", usec: "30000000", want: 30 * time.Second},
+		{name: "our pid", usec: "500000", pid: pid, want: 500 * time.Millisecond},
+		{name: "another pid", usec: "500000", pid: "1"},
+		{name: "zero", usec: "0"},
+		{name: "negative", usec: "-1"},
+		{name: "invalid interval", usec: "30s", err: true},
+		{name: "invalid pid", usec: "500000", pid: "hodos", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+
+			got, err := WatchdogInterval()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("WatchdogInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// ErrNoAddress is returned when a name has no addresses
+// of the requested family.
+var ErrNoAddress = errors.New("no addresses found")
+
+// Resolver is a minimal stub resolver that, unlike the resolver
+// from the net package, returns the TTL of the records and can
+// send its queries through a specific interface.
+type Resolver struct {
+	servers   []string
+	interFace string
+	src       net.IP
+	mark      uint32
+	timeout   time.Duration
+}
+
+// New returns a Resolver. Without the Servers option, the
+// nameservers from /etc/resolv.conf are used.
+func New(opts ...Option) (*Resolver, error) {
+	r := &Resolver{
+		timeout: 2 * time.Second,
+	}
+
+	for _, option := range opts {
+		if err := option(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.servers) == 0 {
+		servers, err := systemServers()
+		if err != nil {
+			return nil, err
+		}
+		r.servers = servers
+	}
+	return r, nil
+}
+
+// Option is a functional argument to *Resolver
+type Option func(r *Resolver) error
+
+// Servers is a functional Option to set
+// the nameservers to query.
+func Servers(servers ...string) Option {
+	return func(r *Resolver) error {
+		for _, s := range servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(s, "53")
+			}
+			r.servers = append(r.servers, s)
+		}
+		return nil
+	}
+}
+
+// Interface is a functional Option to send
+// queries through an interface using a source address.
+func Interface(ifi string, src net.IP) Option {
+	return func(r *Resolver) error {
+		r.interFace = ifi
+		r.src = src
+		return nil
+	}
+}
+
+// Mark is a functional Option to set
+// the fwmark (SO_MARK) of the queries.
+func Mark(mark uint32) Option {
+	return func(r *Resolver) error {
+		r.mark = mark
+		return nil
+	}
+}
+
+// Timeout is a functional Option to set
+// the timeout for a single query.
+// Defaults to 2 seconds.
+func Timeout(t time.Duration) Option {
+	return func(r *Resolver) error {
+		r.timeout = t
+		return nil
+	}
+}
+
+// Lookup returns the addresses of name for the family together with
+// the lowest TTL of the records. Every nameserver is tried in turn.
+func (r *Resolver) Lookup(ctx context.Context, name string, family uint8) ([]net.IP, time.Duration, error) {
+	qtype := dnsmessage.TypeA
+	if family == unix.AF_INET6 {
+		qtype = dnsmessage.TypeAAAA
+	}
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range r.servers {
+		ips, ttl, err := r.query(ctx, server, qname, qtype)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("lookup %s: %w", name, lastErr)
+}
+
+func (r *Resolver) query(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	req, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.exchange(ctx, "udp", server, req, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.Truncated {
+		// the answer did not fit in a datagram, ask again over tcp
+		if resp, err = r.exchange(ctx, "tcp", server, req, id); err != nil {
+			return nil, 0, fmt.Errorf("server %s truncated its answer: %w", server, err)
+		}
+		if h, err = p.Start(resp); err != nil {
+			return nil, 0, err
+		}
+		if h.Truncated {
+			return nil, 0, fmt.Errorf("server %s truncated its answer over tcp", server)
+		}
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("server %s returned %s", server, h.RCode)
+	}
+	return parseAnswers(&p, qtype)
+}
+
+// exchange sends the request to the server over the
+// network and returns the response to it.
+func (r *Resolver) exchange(ctx context.Context, network string, server string, req []byte, id uint16) ([]byte, error) {
+	conn, err := r.dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if network == "tcp" {
+		// messages over tcp are prefixed with their length
+		// (RFC 1035 section 4.2.2)
+		b := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(b, uint16(len(req)))
+		copy(b[2:], req)
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(b[:2]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if !answers(resp, id) {
+			return nil, fmt.Errorf("server %s did not answer the query", server)
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1232)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		if answers(resp[:n], id) {
+			return resp[:n], nil
+		}
+		// not our answer, keep waiting
+	}
+}
+
+// answers returns true if resp is the response to the query with id
+func answers(resp []byte, id uint16) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.ID == id && h.Response
+}
+
+// parseAnswers returns the addresses from the answer section,
+// following any CNAME records the server included.
+func parseAnswers(p *dnsmessage.Parser, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.Type != qtype || h.Class != dnsmessage.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(ips) == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+		switch qtype {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrNoAddress
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// dial connects to the server over the network, bound to the
+// interface, source address and fwmark when those are set.
+func (r *Resolver) dial(ctx context.Context, network string, server string) (net.Conn, error) {
+	d := net.Dialer{}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	// only bind to the source address if the server is of the same family
+	if ip := net.ParseIP(host); r.src != nil && ip != nil && (ip.To4() == nil) == (r.src.To4() == nil) {
+		if network == "tcp" {
+			d.LocalAddr = &net.TCPAddr{IP: r.src}
+		} else {
+			d.LocalAddr = &net.UDPAddr{IP: r.src}
+		}
+	}
+	if r.interFace != "" || r.mark != 0 {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if r.interFace != "" {
+					serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, r.interFace)
+				}
+				if serr == nil && r.mark != 0 {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(r.mark))
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return d.DialContext(ctx, network, server)
+}
+
+// systemServers returns the nameservers from resolv.conf
+func systemServers() ([]string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no nameservers found in %s", resolvConf)
+	}
+	return servers, nil
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,302 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+type record struct {
+	name  string
+	ttl   uint32
+	a     string // A or AAAA record
+	cname string
+}
+
+// answer builds the answer to the query in req with the records
+func answer(req []byte, truncated bool, records ...record) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Truncated: truncated})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		rh := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(r.name), Class: dnsmessage.ClassINET, TTL: r.ttl}
+		switch ip := net.ParseIP(r.a); {
+		case r.cname != "":
+			err = b.CNAMEResource(rh, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(r.cname)})
+		case ip.To4() != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			err = b.AResource(rh, a)
+		default:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			err = b.AAAAResource(rh, aaaa)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// query builds a query for name
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req, err := b.Finish()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return req
+}
+
+func TestParseAnswers(t *testing.T) {
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		records []record
+		want    []string
+		ttl     time.Duration
+		err     error
+	}{
+		{
+			name:    "a",
+			qtype:   dnsmessage.TypeA,
+			records: []record{{name: "host.example.", ttl: 300, a: "192.0.2.1"}},
+			want:    []string{"192.0.2.1"},
+			ttl:     300 * time.Second,
+		},
+		{
+			name:  "lowest ttl",
+			qtype: dnsmessage.TypeA,
+			records: []record{
+				{name: "host.example.", ttl: 300, a: "192.0.2.1"},
+				{name: "host.example.", ttl: 60, a: "192.0.2.2"},
+				{name: "host.example.", ttl: 120, a: "192.0.2.3"},
+			},
+			want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+			ttl:  time.Minute,
+		},
+		{
+			name:  "cname",
+			qtype: dnsmessage.TypeAAAA,
+			records: []record{
+				{name: "host.example.", ttl: 10, cname: "other.example."},
+				{name: "other.example.", ttl: 30, a: "2001:db8::1"},
+			},
+			want: []string{"2001:db8::1"},
+			ttl:  30 * time.Second,
+		},
+		{
+			name:    "other family",
+			qtype:   dnsmessage.TypeAAAA,
+			records: []record{{name: "host.example.", ttl: 300, a: "192.0.2.1"}},
+			err:     ErrNoAddress,
+		},
+		{
+			name:  "no answers",
+			qtype: dnsmessage.TypeA,
+			err:   ErrNoAddress,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := answer(query(t, "host.example.", tt.qtype), false, tt.records...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ips, ttl, err := parseAnswers(&p, tt.qtype)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseAnswers() error = %v, want %v", err, tt.err)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) || ttl != tt.ttl {
+				t.Fatalf("parseAnswers() = %v, %s, want %v, %s", got, ttl, tt.want, tt.ttl)
+			}
+		})
+	}
+}
+
+// serve answers the queries on pc, truncated without records if truncate is set
+func serve(pc net.PacketConn, truncate bool, records ...record) {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if truncate {
+			records = nil
+		}
+		if resp, err := answer(b[:n], truncate, records...); err == nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+// serveTCP answers the queries on l
+func serveTCP(l net.Listener, records ...record) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		req := make([]byte, 512)
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			req = req[:binary.BigEndian.Uint16(length[:])]
+			if _, err := io.ReadFull(conn, req); err == nil {
+				if resp, err := answer(req, false, records...); err == nil {
+					binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+					conn.Write(append(length[:], resp...))
+				}
+			}
+		}
+		conn.Close()
+	}
+}
+
+// server returns the address of a nameserver answering over udp,
+// or truncating its answers over udp and answering over tcp
+func server(t *testing.T, tcp bool) string {
+	t.Helper()
+	records := []record{{name: "host.example.", ttl: 60, a: "192.0.2.1"}}
+	if !tcp {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go serve(pc, false, records...)
+		return pc.LocalAddr().String()
+	}
+
+	// tcp and udp on the same port
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pc, err := net.ListenPacket("udp4", l.Addr().String())
+		if err != nil {
+			l.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			l.Close()
+			pc.Close()
+		})
+		go serve(pc, true)
+		go serveTCP(l, records...)
+		return pc.LocalAddr().String()
+	}
+	t.Fatal("no free port for both tcp and udp")
+	return ""
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		tcp  bool
+	}{
+		{name: "udp"},
+		{name: "truncated over udp", tcp: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(Servers(server(t, tt.tcp)), Timeout(time.Second))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ips, ttl, err := r.Lookup(context.Background(), "host.example", unix.AF_INET)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || ttl != time.Minute {
+				t.Fatalf("Lookup() = %v, %s, want [192.0.2.1], 1m0s", ips, ttl)
+			}
+		})
+	}
+}
+
+func TestLookupTruncatedWithoutTCP(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pc.Close()
+	go serve(pc, true)
+
+	r, err := New(Servers(pc.LocalAddr().String()), Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ips, _, err := r.Lookup(context.Background(), "host.example", unix.AF_INET); err == nil {
+		t.Fatalf("Lookup() = %v for a truncated answer, want an error", ips)
+	}
+}
+
+func TestServers(t *testing.T) {
+	r, err := New(Servers("192.0.2.53", "192.0.2.54:5353", "2001:db8::53"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"192.0.2.53:53", "192.0.2.54:5353", "[2001:db8::53]:53"}
+	if !reflect.DeepEqual(r.servers, want) {
+		t.Fatalf("servers = %v, want %v", r.servers, want)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jsimonetti/hodos/internal/log"
@@ -46,6 +47,8 @@ type Sync struct {
 	myPid  uint32
 	nlconn *rtnetlink.Conn
 	metric uint32
+
+	alive int64 // unix nanoseconds of the last loop, read atomically
 }
 
 // New will return an initialised route sync object
@@ -119,6 +122,15 @@ func (s *Sync) Wait() {
 	s.wg.Wait()
 }
 
+// Alive returns when the sync last went through its loop,
+// or the zero time if it is not running (yet)
+func (s *Sync) Alive() time.Time {
+	if alive := atomic.LoadInt64(&s.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
 func (s *Sync) Run() error {
 	// We use a waitgroup to allow cleanup to happen before
 	// we are closed
@@ -134,6 +146,7 @@ func (s *Sync) Run() error {
 
 	ifIndex := uint32(0)
 	for {
+		atomic.StoreInt64(&s.alive, time.Now().UnixNano())
 		select {
 		case <-s.ctx.Done():
 			// our caller has closed the context
@@ -164,6 +177,7 @@ NEXT:
 		// To prevent blocking indefinately, we use a read
 		// deadline on the netlink socket
 		nl.SetReadDeadline(time.Now().Add(1 * time.Second))
+		atomic.StoreInt64(&s.alive, time.Now().UnixNano())
 		select {
 		case <-s.ctx.Done():
 			// our caller has closed the context
@@ -177,7 +191,7 @@ NEXT:
 					// and can unblock
 					continue
 				}
-				s.l.Printf("RouteMonitor receive error: %s", err)
+				s.l.Errorf("RouteMonitor receive error: %s", err)
 			}
 
 			for i, msg := range msgs {
@@ -239,7 +253,7 @@ func (s *Sync) cleanup() error {
 	// remove routing and rules
 	nl, err := rtnetlink.Dial(nil)
 	if err != nil {
-		s.l.Printf("routeCleanup: could not dial rtnetlink: %s", err)
+		s.l.Errorf("routeCleanup: could not dial rtnetlink: %s", err)
 		return err
 	}
 	defer nl.Close()
@@ -250,7 +264,7 @@ func (s *Sync) cleanup() error {
 	for _, msg := range rumsgs {
 		if *msg.Attributes.Table == s.table {
 			if err = nl.Rule.Delete(&msg); err != nil {
-				s.l.Printf("routeCleanup: error deleting route from table %d: %s", s.table, err)
+				s.l.Errorf("routeCleanup: error deleting route from table %d: %s", s.table, err)
 			}
 		}
 	}
@@ -260,7 +274,7 @@ func (s *Sync) cleanup() error {
 		if msg.Attributes.Table == s.table {
 			msg.Flags = 0 // don't use flags
 			if err = nl.Route.Delete(&msg); err != nil {
-				s.l.Printf("routeCleanup: error deleting route from table %d: %s", s.table, err)
+				s.l.Errorf("routeCleanup: error deleting route from table %d: %s", s.table, err)
 			}
 			if msg.Attributes.Gateway != nil {
 				msg.Table = unix.RT_TABLE_MAIN
@@ -268,13 +282,13 @@ func (s *Sync) cleanup() error {
 
 				// restore the original route back to the main table
 				if err := s.nlconn.Route.Add(&msg); err != nil {
-					s.l.Printf("routeCleanup: error restoring route from table %d: %s", s.table, err)
+					s.l.Errorf("routeCleanup: error restoring route from table %d: %s", s.table, err)
 				}
 
 				// remove any failed/non-failed route from main table
 				msg.Attributes.Priority = s.metric
 				if err := s.nlconn.Route.Delete(&msg); err != nil {
-					s.l.Printf("could not delete route with ifi metric: %+v: %s", msg, err)
+					s.l.Errorf("could not delete route with ifi metric: %+v: %s", msg, err)
 				}
 			}
 		}
@@ -306,7 +320,7 @@ func (s *Sync) routeUpAction(m *rtnetlink.RouteMessage) error {
 			if err := ChangeMetric(s.nlconn, *m, s.metric); err != nil {
 				// this error can be expected at initial startup
 				// since the interface will already have routes
-				s.l.Printf("routeUpAction: change error: %s", err)
+				s.l.Errorf("routeUpAction: change error: %s", err)
 			}
 		}
 		m.Table = uint8(s.table)
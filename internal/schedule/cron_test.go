@@ -0,0 +1,278 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func location(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// at returns the wall clock time in the location
+func at(t *testing.T, name string, value string) time.Time {
+	t.Helper()
+	tm, err := time.ParseInLocation("2006-01-02 15:04", value, location(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// utc returns the time in utc, to tell the two
+// times of a repeated wall clock time apart
+func utc(t *testing.T, name string, value string) time.Time {
+	t.Helper()
+	tm, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm.In(location(t, name))
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from func(t *testing.T) time.Time
+		want func(t *testing.T) time.Time // nil for no match
+	}{
+		{
+			name: "later today",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 09:00") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 11:00") },
+		},
+		{
+			name: "strictly after",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 11:00") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-11 11:00") },
+		},
+		{
+			name: "step",
+			spec: "*/15 * * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 10:07") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 10:15") },
+		},
+		{
+			name: "half hour offset",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Asia/Kolkata", "2024-01-10 09:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Asia/Kolkata", "2024-01-10 11:00") },
+		},
+		{
+			name: "quarter hour offset",
+			spec: "30 * * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Asia/Kathmandu", "2024-01-10 10:50") },
+			want: func(t *testing.T) time.Time { return at(t, "Asia/Kathmandu", "2024-01-10 11:30") },
+		},
+		{
+			name: "day of month or day of week",
+			spec: "0 0 13 * 5",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-01 00:00") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-05 00:00") },
+		},
+		{
+			name: "next month",
+			spec: "0 6 1 * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-01-31 23:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-02-01 06:00") },
+		},
+		{
+			name: "hour after daylight saving time starts",
+			spec: "0 3 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-31 00:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-31 03:00") },
+		},
+		{
+			name: "skipped hour when daylight saving time starts",
+			spec: "30 2 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-31 00:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-04-01 02:30") },
+		},
+		{
+			// once a day, in the second of the repeated hours
+			name: "repeated hour when daylight saving time ends",
+			spec: "30 2 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-10-27 00:00") },
+			want: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 01:30") },
+		},
+		{
+			name: "from the first of the repeated hours when daylight saving time ends",
+			spec: "30 2 * * *",
+			from: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 00:15") },
+			want: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 00:30") },
+		},
+		{
+			name: "after the repeated hour",
+			spec: "0 3 * * *",
+			from: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 00:30") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-10-27 03:00") },
+		},
+		{
+			name: "never",
+			spec: "0 0 31 2 *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-01 00:00") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.Next(tt.from(t))
+			if tt.want == nil {
+				if !got.IsZero() {
+					t.Fatalf("Next = %s, want no match", got)
+				}
+				return
+			}
+			if want := tt.want(t); !got.Equal(want) {
+				t.Fatalf("Next = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from func(t *testing.T) time.Time
+		want func(t *testing.T) time.Time // nil for no match
+	}{
+		{
+			name: "earlier today",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 13:00") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 11:00") },
+		},
+		{
+			name: "at the time",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 11:00") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 11:00") },
+		},
+		{
+			name: "yesterday",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-10 10:59") },
+			want: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-09 11:00") },
+		},
+		{
+			name: "half hour offset",
+			spec: "0 11 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Asia/Kolkata", "2024-01-10 10:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Asia/Kolkata", "2024-01-09 11:00") },
+		},
+		{
+			name: "quarter hour offset",
+			spec: "0 * * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Asia/Kathmandu", "2024-01-10 10:50") },
+			want: func(t *testing.T) time.Time { return at(t, "Asia/Kathmandu", "2024-01-10 10:00") },
+		},
+		{
+			name: "previous month",
+			spec: "0 6 28 * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-01 00:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-02-28 06:00") },
+		},
+		{
+			name: "skipped hour when daylight saving time starts",
+			spec: "30 2 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-31 12:00") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-03-30 02:30") },
+		},
+		{
+			name: "second of the repeated hour when daylight saving time ends",
+			spec: "30 2 * * *",
+			from: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-10-27 04:00") },
+			want: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 01:30") },
+		},
+		{
+			name: "before the repeated hour",
+			spec: "0 1 * * *",
+			from: func(t *testing.T) time.Time { return utc(t, "Europe/Amsterdam", "2024-10-27 00:30") },
+			want: func(t *testing.T) time.Time { return at(t, "Europe/Amsterdam", "2024-10-27 01:00") },
+		},
+		{
+			name: "never",
+			spec: "0 0 30 2 *",
+			from: func(t *testing.T) time.Time { return at(t, "UTC", "2024-01-01 00:00") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.Prev(tt.from(t))
+			if tt.want == nil {
+				if !got.IsZero() {
+					t.Fatalf("Prev = %s, want no match", got)
+				}
+				return
+			}
+			if want := tt.want(t); !got.Equal(want) {
+				t.Fatalf("Prev = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{spec: "* * * * *", ok: true},
+		{spec: "0 8-18/2 * * 1-5", ok: true},
+		{spec: "0,30 * 1,15 * 0,7", ok: true},
+		{spec: "5/10 * * * *", ok: true},
+		{spec: "* * * *"},
+		{spec: "60 * * * *"},
+		{spec: "* 24 * * *"},
+		{spec: "* * 0 * *"},
+		{spec: "* * * 13 *"},
+		{spec: "* * * * 8"},
+		{spec: "*/0 * * * *"},
+		{spec: "5-1 * * * *"},
+		{spec: "a * * * *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			if tt.ok && err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("Parse succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// the admin states of an interface
+const (
+	adminDown = config.ADMIN_DOWN // the gateways are failed, the probes continue
+	adminUp   = config.ADMIN_UP   // clears the override, the health decides again
+	forceUp   = config.FORCE_UP   // the gateways are used regardless of the health
+)
+
+// adminState returns the admin override of the
+// interface, or an empty string when there is none.
+func (s *Server) adminState(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Admin[name]
+}
+
+// overridden returns whether the health of the family of the
+// interface is overridden by its admin state, and logs it.
+func (s *Server) overridden(ifi *config.Interface, family uint8) bool {
+	state := s.adminState(ifi.Name)
+	if state == "" {
+		return false
+	}
+	s.logFamily(ifi, family).Printf("overridden: family %s, interface %q is %s", fam(family), ifi.Name, state)
+	return true
+}
+
+// SetAdmin sets the admin state of the interface. admin_down fails the
+// gateways of the interface while its probes continue, force_up uses them
+// regardless of the health of the interface, and admin_up clears the
+// override. The override is kept across restarts until it is cleared.
+func (s *Server) SetAdmin(name string, state string) error {
+	return s.setAdmin(name, state, time.Now())
+}
+
+// adminChanged returns when the admin state of the interface was
+// last set, the zero time when it was never set
+func (s *Server) adminChanged(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.AdminChanged[name]
+}
+
+// setAdmin sets the admin state of the interface as it was set at
+func (s *Server) setAdmin(name string, state string, at time.Time) error {
+	ifi, ok := s.interfaces[name]
+	if !ok {
+		return fmt.Errorf("unknown interface %q", name)
+	}
+	switch state {
+	case adminDown, adminUp, forceUp:
+	default:
+		return fmt.Errorf("unknown admin state %q, should be one of %s, %s or %s", state, adminDown, adminUp, forceUp)
+	}
+
+	s.mu.Lock()
+	previous := s.state.Admin[name]
+	if state == adminUp {
+		delete(s.state.Admin, name)
+	} else {
+		s.state.Admin[name] = state
+	}
+	s.state.AdminChanged[name] = at
+	if err := s.saveState(); err != nil {
+		s.l.Errorf("SetAdmin: could not save the admin state: %s", err)
+	}
+	s.mu.Unlock()
+
+	s.l.Printf("SetAdmin: interface %q is %s (was %q)", name, state, previous)
+	for _, family := range families(ifi) {
+		s.applyAdmin(ifi, family, state, previous)
+		s.adminEvent(ifi, family, state, previous)
+	}
+	return nil
+}
+
+// applyAdmin applies a changed admin state to the family of the interface
+func (s *Server) applyAdmin(ifi *config.Interface, family uint8, state string, previous string) {
+	switch state {
+	case adminDown:
+		s.runScript("ADMIN_DOWN", family, ifi)
+		if err := s.failGatewaysFor(ifi, family); err != nil {
+			s.logFamily(ifi, family).Errorf("applyAdmin: failed to mark the gateway as down: %s", err)
+		}
+		if ifi.ConntrackFlush {
+			s.flushConntrack(ifi, family)
+		}
+	case forceUp:
+		s.runScript("FORCE_UP", family, ifi)
+		if err := s.addGatewaysFor(ifi, family); err != nil {
+			s.logFamily(ifi, family).Errorf("applyAdmin: could not set avail: %s", err)
+		}
+	case adminUp:
+		// the health decides again, without waiting
+		// for the up delay or failback policy
+		if ifi.Available(family) {
+			if previous != forceUp {
+				s.failback(ifi, family)
+			}
+			return
+		}
+		if previous == forceUp {
+			s.runScript("DOWN", family, ifi)
+			if err := s.failGatewaysFor(ifi, family); err != nil {
+				s.logFamily(ifi, family).Errorf("applyAdmin: failed to mark the gateway as down: %s", err)
+			}
+		}
+	}
+}
+
+// startGatewaysFor sets the gateways of the family of the interface
+// when its link comes up. We start with everything down, unless the
+// interface is forced up.
+func (s *Server) startGatewaysFor(ifi *config.Interface, family uint8) {
+	s.failGatewaysFor(ifi, family)
+	if s.adminState(ifi.Name) == forceUp {
+		if err := s.addGatewaysFor(ifi, family); err != nil {
+			s.logFamily(ifi, family).Errorf("startGatewaysFor: could not set avail: %s", err)
+		}
+	}
+}
+
+// families returns the families monitored on the interface
+func families(ifi *config.Interface) []uint8 {
+	var hasipv4, hasipv6 bool
+	for _, host := range ifi.Hosts {
+		hasipv4 = hasipv4 || host.Family == unix.AF_INET
+		hasipv6 = hasipv6 || host.Family == unix.AF_INET6
+	}
+	for _, b := range ifi.BFD {
+		hasipv4 = hasipv4 || b.Family == unix.AF_INET
+		hasipv6 = hasipv6 || b.Family == unix.AF_INET6
+	}
+	var families []uint8
+	if hasipv4 {
+		families = append(families, unix.AF_INET)
+	}
+	if hasipv6 {
+		families = append(families, unix.AF_INET6)
+	}
+	return families
+}
+
+// serveAdmin sets the admin state given by the state parameter
+// (admin_down, admin_up or force_up) of the interface given by
+// the interface parameter.
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("interface")
+	if err := s.SetAdmin(name, r.FormValue("state")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.interfaceStatus(s.interfaces[name]))
+}
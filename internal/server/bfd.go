@@ -0,0 +1,74 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net"
+
+	"github.com/jsimonetti/hodos/internal/bfd"
+	"github.com/jsimonetti/hodos/internal/config"
+)
+
+// addBFDSessions starts the bfd sessions of this family for the interface.
+// The family is held down until the session comes up.
+func (s *Server) addBFDSessions(ifi *config.Interface, src string, family uint8) {
+	for _, b := range ifi.BFD {
+		if b.Family != family {
+			continue
+		}
+		if err := s.addBFDSession(ifi, src, b); err != nil {
+			s.logFamily(ifi, family).Errorf("addBFDSession: could not start bfd session %q: %q -> %s (%q)", ifi.Name, src, b.Peer, err)
+		}
+	}
+}
+
+func (s *Server) addBFDSession(ifi *config.Interface, src string, b config.BFD) error {
+	s.logFor("server", ifi).Debugf("addBFDSession: add session on interface %q for peer %s", ifi.Name, b.Peer)
+	m, err := bfd.New(s.ctx, net.ParseIP(src), *b.Peer, ifi.Name, bfd.Logger(s.logFor("bfd", ifi, "peer", b.Peer.String(), "family", familyName(b.Family))),
+		bfd.MinTx(b.MinTx),
+		bfd.MinRx(b.MinRx),
+		bfd.Multiplier(b.Multiplier))
+	if err != nil {
+		return err
+	}
+
+	// start with the session down
+	ifi.SourceDown(b.Family, config.SourceBFD)
+	m.Down(func() {
+		s.sourceFail(ifi, b.Family, config.SourceBFD)
+	})
+	m.Up(func() {
+		s.sourceAvailable(ifi, b.Family, config.SourceBFD)
+	})
+	s.mu.Lock()
+	s.bfdSessions[ifi.Name][b.Peer.String()] = m
+	s.mu.Unlock()
+
+	go func() {
+		if err := m.Run(); err != nil {
+			s.logFor("server", ifi).Errorf("addBFDSession: session on %q to %s failed: %s", ifi.Name, b.Peer, err)
+		}
+	}()
+	return nil
+}
+
+// bfdSessionsFor returns the bfd sessions of the interface.
+func (s *Server) bfdSessionsFor(name string) []*bfd.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*bfd.Session, 0, len(s.bfdSessions[name]))
+	for _, m := range s.bfdSessions[name] {
+		sessions = append(sessions, m)
+	}
+	return sessions
+}
@@ -0,0 +1,77 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// flushConntrack deletes the conntrack entries of the connections
+// that were set up behind the addresses of the family on the interface,
+// so they do not hang on the failed interface.
+func (s *Server) flushConntrack(ifi *config.Interface, family uint8) {
+	addrs := interfaceAddresses(ifi.Name, family)
+	if len(addrs) == 0 {
+		s.logFamily(ifi, family).Debugf("flushConntrack: no %s addresses on %q", fam(family), ifi.Name)
+		return
+	}
+
+	flushed, err := conntrack.Flush(family, addrs)
+	if err != nil {
+		s.logFamily(ifi, family).Errorf("flushConntrack: could not flush %s conntrack entries of %q: %s", fam(family), ifi.Name, err)
+	} else {
+		s.logFamily(ifi, family).Printf("flushConntrack: flushed %d %s conntrack entries of %q", flushed, fam(family), ifi.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conntrackFlushed[ifi.Name] == nil {
+		s.conntrackFlushed[ifi.Name] = make(map[uint8]uint64)
+	}
+	s.conntrackFlushed[ifi.Name][family] += uint64(flushed)
+}
+
+// flushedConntrack returns the number of conntrack entries
+// flushed for the family of the interface.
+func (s *Server) flushedConntrack(ifi string, family uint8) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conntrackFlushed[ifi][family]
+}
+
+// interfaceAddresses returns the addresses of the family on the interface
+func interfaceAddresses(name string, family uint8) []net.IP {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == (family == unix.AF_INET) {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
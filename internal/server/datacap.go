@@ -0,0 +1,281 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+// dataUsage is the data used by an interface in a billing period
+type dataUsage struct {
+	Period    time.Time  `json:"period"`               // start of the billing period
+	Bytes     uint64     `json:"bytes"`                // bytes received and sent in the period
+	Warned    int        `json:"warned,omitempty"`     // highest percentage warned at
+	Reached   bool       `json:"reached,omitempty"`    // the data cap was reached
+	AdminDown *time.Time `json:"admin_down,omitempty"` // when the data cap set the interface admin down
+}
+
+// meterDataCap reads the byte counters of the interface every
+// data_cap_interval and adds them to the usage of the billing
+// period, until the server stops.
+func (s *Server) meterDataCap(ifi *config.Interface) error {
+	// a data cap that was reached before
+	// a restart is still in effect
+	s.mu.Lock()
+	u, ok := s.state.Usage[ifi.Name]
+	reached := ok && u.Reached && u.Period.Equal(billingPeriod(time.Now(), ifi.DataCapResetDay))
+	s.mu.Unlock()
+	if reached {
+		s.logFor("server", ifi).Printf("meterDataCap: data cap of interface %q is reached", ifi.Name)
+		s.enforceDataCap(ifi)
+	}
+
+	var index uint32
+	var last uint64
+	s.addUsage(ifi, 0)
+	ticker := time.NewTicker(ifi.DataCapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		var used uint64
+		idx, stats, err := s.linkStats(ifi.Name)
+		if err != nil {
+			s.logFor("server", ifi).Debugf("meterDataCap: could not read the counters of %q: %s", ifi.Name, err)
+		} else {
+			total := stats.RXBytes + stats.TXBytes
+			switch {
+			case index == 0:
+				// the first sample is where we start counting
+			case idx != index || total < last:
+				// the link was recreated or its counters restarted
+				used = total
+			default:
+				used = total - last
+			}
+			index, last = idx, total
+		}
+		// a new billing period is also noticed without counters
+		s.addUsage(ifi, used)
+	}
+}
+
+// addUsage adds the bytes to the usage of the interface, and
+// warns, enforces or releases the data cap when this crossed
+// a threshold or started a new billing period.
+func (s *Server) addUsage(ifi *config.Interface, used uint64) {
+	period := billingPeriod(time.Now(), ifi.DataCapResetDay)
+
+	s.mu.Lock()
+	u, ok := s.state.Usage[ifi.Name]
+	if !ok {
+		u = &dataUsage{Period: period}
+		s.state.Usage[ifi.Name] = u
+	}
+	reset, wasReached, adminDown := false, false, u.AdminDown
+	if !u.Period.Equal(period) {
+		reset, wasReached = true, u.Reached
+		*u = dataUsage{Period: period}
+	}
+	u.Bytes += used
+
+	percent := usedPercent(u.Bytes, ifi.DataCap)
+	warn := 0
+	for _, w := range ifi.DataCapWarnings {
+		if percent >= float64(w) && w > u.Warned {
+			warn = w
+		}
+	}
+	if warn > 0 {
+		u.Warned = warn
+	}
+	reached := !u.Reached && u.Bytes >= ifi.DataCap
+	if reached {
+		u.Reached = true
+	}
+	env := dataCapEnv(ifi, u.Bytes)
+	if used > 0 || reset || warn > 0 || reached || !ok {
+		if err := s.saveState(); err != nil {
+			s.logFor("server", ifi).Errorf("addUsage: could not save the data usage: %s", err)
+		}
+	}
+	s.mu.Unlock()
+
+	if reset {
+		s.logFor("server", ifi).Printf("addUsage: billing period of interface %q started at %s", ifi.Name, period.Format(time.RFC3339))
+		s.runScript("DATA_CAP_RESET", unix.AF_UNSPEC, ifi, env...)
+		if wasReached {
+			s.releaseDataCap(ifi, adminDown)
+		}
+	}
+	if warn > 0 {
+		s.logFor("server", ifi).Printf("addUsage: interface %q used %.1f%% of its data cap", ifi.Name, percent)
+		s.runScript("DATA_CAP_WARNING", unix.AF_UNSPEC, ifi, env...)
+	}
+	if reached {
+		s.logFor("server", ifi).Printf("addUsage: interface %q reached its data cap of %d bytes", ifi.Name, ifi.DataCap)
+		s.runScript("DATA_CAP_REACHED", unix.AF_UNSPEC, ifi, env...)
+		s.enforceDataCap(ifi)
+	}
+}
+
+// enforceDataCap applies the data cap policy of the interface. A
+// demoted interface has its routes moved behind those of the other
+// interfaces, so it is still used as a backup. An interface is set
+// admin down once per billing period, so an operator can set it up
+// again before the period ends.
+func (s *Server) enforceDataCap(ifi *config.Interface) {
+	switch ifi.DataCapPolicy {
+	case config.DATACAP_DEMOTE:
+		s.mu.Lock()
+		_, demoted := s.demoted[ifi.Name]
+		if !demoted {
+			s.demoted[ifi.Name] = ifi.RouteMetric()
+		}
+		s.mu.Unlock()
+		if !demoted {
+			s.changeMetric(ifi, ifi.DataCapMetric)
+		}
+	case config.DATACAP_ADMINDOWN:
+		at := time.Now()
+		s.mu.Lock()
+		u := s.state.Usage[ifi.Name]
+		set := u != nil && u.AdminDown == nil && s.state.Admin[ifi.Name] != adminDown
+		if set {
+			u.AdminDown = &at
+		}
+		s.mu.Unlock()
+		if !set {
+			return
+		}
+		if err := s.setAdmin(ifi.Name, adminDown, at); err != nil {
+			s.logFor("server", ifi).Errorf("enforceDataCap: could not set the admin state: %s", err)
+		}
+	}
+}
+
+// releaseDataCap undoes the data cap policy of the interface once a
+// new billing period starts. The admin state is only cleared when it
+// is still the admin down the data cap set at adminDown.
+func (s *Server) releaseDataCap(ifi *config.Interface, adminDown *time.Time) {
+	switch ifi.DataCapPolicy {
+	case config.DATACAP_DEMOTE:
+		s.mu.Lock()
+		metric, demoted := s.demoted[ifi.Name]
+		delete(s.demoted, ifi.Name)
+		s.mu.Unlock()
+		if demoted {
+			s.changeMetric(ifi, metric)
+		}
+	case config.DATACAP_ADMINDOWN:
+		if adminDown == nil || !s.adminChanged(ifi.Name).Equal(*adminDown) {
+			return
+		}
+		if err := s.SetAdmin(ifi.Name, adminUp); err != nil {
+			s.logFor("server", ifi).Errorf("releaseDataCap: could not set the admin state: %s", err)
+		}
+	}
+}
+
+// demotedMetric keeps the metric for a demoted interface to move
+// back to once its data cap is released, and returns whether the
+// interface is demoted.
+func (s *Server) demotedMetric(ifi *config.Interface, metric uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.demoted[ifi.Name]; !ok {
+		return false
+	}
+	s.demoted[ifi.Name] = metric
+	s.logFor("server", ifi).Printf("demotedMetric: interface %q is demoted, moving to metric %d once its data cap is released", ifi.Name, metric)
+	return true
+}
+
+// linkStats returns the index and the statistics of the link
+func (s *Server) linkStats(name string) (uint32, *rtnetlink.LinkStats64, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg, err := s.nlconn.Link.Get(uint32(ifi.Index))
+	if err != nil {
+		return 0, nil, err
+	}
+	if msg.Attributes == nil || msg.Attributes.Stats64 == nil {
+		return 0, nil, fmt.Errorf("no statistics for link %q", name)
+	}
+	return msg.Index, msg.Attributes.Stats64, nil
+}
+
+// billingPeriod returns the start of the billing period at t
+func billingPeriod(t time.Time, day int) time.Time {
+	start := resetDate(t.Year(), t.Month(), day, t.Location())
+	if t.Before(start) {
+		start = resetDate(t.Year(), t.Month()-1, day, t.Location())
+	}
+	return start
+}
+
+// resetDate returns the reset day of the month,
+// which is the last day in shorter months
+func resetDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+func usedPercent(used uint64, limit uint64) float64 {
+	return float64(used) / float64(limit) * 100
+}
+
+func dataCapEnv(ifi *config.Interface, used uint64) []string {
+	return []string{
+		fmt.Sprintf("DATA_CAP=%d", ifi.DataCap),
+		fmt.Sprintf("DATA_USED=%d", used),
+		fmt.Sprintf("DATA_PERCENT=%.1f", usedPercent(used, ifi.DataCap)),
+	}
+}
+
+// dataCapStatus returns the data usage of the interface,
+// or nil if it has no data cap
+func (s *Server) dataCapStatus(ifi *config.Interface) *DataCapStatus {
+	if ifi.DataCap == 0 {
+		return nil
+	}
+	now := time.Now()
+	period := billingPeriod(now, ifi.DataCapResetDay)
+	status := &DataCapStatus{
+		Cap:    ifi.DataCap,
+		Period: period,
+		Reset:  resetDate(period.Year(), period.Month()+1, ifi.DataCapResetDay, period.Location()),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.state.Usage[ifi.Name]; ok && u.Period.Equal(period) {
+		status.Used = u.Bytes
+		status.Reached = u.Reached
+	}
+	status.Percent = usedPercent(status.Used, ifi.DataCap)
+	return status
+}
@@ -0,0 +1,322 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	stdlog "log"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestBillingPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		day  int
+		want time.Time
+	}{
+		{name: "first of the month", t: date(2024, 3, 15), day: 1, want: date(2024, 3, 1)},
+		{name: "before the reset day", t: date(2024, 3, 15), day: 20, want: date(2024, 2, 20)},
+		{name: "at the reset day", t: date(2024, 3, 20), day: 20, want: date(2024, 3, 20)},
+		{name: "just before the reset day", t: date(2024, 3, 20).Add(-time.Second), day: 20, want: date(2024, 2, 20)},
+		{name: "previous year", t: date(2024, 1, 10), day: 15, want: date(2023, 12, 15)},
+		{name: "31st after a leap february", t: date(2024, 3, 15), day: 31, want: date(2024, 2, 29)},
+		{name: "31st after february", t: date(2023, 3, 15), day: 31, want: date(2023, 2, 28)},
+		{name: "30th after february", t: date(2024, 3, 1), day: 30, want: date(2024, 2, 29)},
+		{name: "29th after february", t: date(2023, 3, 28), day: 29, want: date(2023, 2, 28)},
+		{name: "31st of a short month", t: date(2024, 4, 30), day: 31, want: date(2024, 4, 30)},
+		{name: "before the 31st of a short month", t: date(2024, 4, 29), day: 31, want: date(2024, 3, 31)},
+		{name: "31st of a long month", t: date(2024, 3, 31), day: 31, want: date(2024, 3, 31)},
+		{name: "30th of a leap february", t: date(2024, 2, 29), day: 30, want: date(2024, 2, 29)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := billingPeriod(tt.t, tt.day); !got.Equal(tt.want) {
+				t.Fatalf("billingPeriod = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResetDate(t *testing.T) {
+	tests := []struct {
+		year  int
+		month time.Month
+		day   int
+		want  time.Time
+	}{
+		{year: 2024, month: time.January, day: 31, want: date(2024, 1, 31)},
+		{year: 2024, month: time.February, day: 29, want: date(2024, 2, 29)},
+		{year: 2024, month: time.February, day: 30, want: date(2024, 2, 29)},
+		{year: 2024, month: time.February, day: 31, want: date(2024, 2, 29)},
+		{year: 2023, month: time.February, day: 29, want: date(2023, 2, 28)},
+		{year: 2024, month: time.April, day: 31, want: date(2024, 4, 30)},
+		{year: 2024, month: time.June, day: 15, want: date(2024, 6, 15)},
+		// the month after december, as for the next reset
+		{year: 2024, month: time.December + 1, day: 31, want: date(2025, 1, 31)},
+		{year: 2024, month: time.January + 1, day: 31, want: date(2024, 2, 29)},
+		// the month before january, as for the previous period
+		{year: 2024, month: time.January - 1, day: 31, want: date(2023, 12, 31)},
+	}
+
+	for _, tt := range tests {
+		got := resetDate(tt.year, tt.month, tt.day, time.UTC)
+		if !got.Equal(tt.want) {
+			t.Errorf("resetDate(%d, %d, %d) = %s, want %s", tt.year, tt.month, tt.day, got, tt.want)
+		}
+	}
+}
+
+// testServer returns a server without state file
+// or netlink, enough to keep the data usage
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	state, err := loadState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		config:     &config.Config{},
+		l:          log.New(stdlog.New(io.Discard, "", 0)),
+		ctx:        ctx,
+		ctxCancel:  cancel,
+		interfaces: make(map[string]*config.Interface),
+		demoted:    make(map[string]uint32),
+		scheduled:  make(map[string]time.Time),
+		state:      state,
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	const resetDay = 1
+	period := billingPeriod(time.Now(), resetDay)
+	previous := billingPeriod(period.Add(-time.Hour), resetDay)
+
+	tests := []struct {
+		name     string
+		usage    *dataUsage // nil for an interface without usage yet
+		used     uint64
+		warnings []int
+		want     dataUsage
+	}{
+		{
+			name: "first usage",
+			used: 100,
+			want: dataUsage{Period: period, Bytes: 100},
+		},
+		{
+			name:  "adds to the usage",
+			usage: &dataUsage{Period: period, Bytes: 100},
+			used:  50,
+			want:  dataUsage{Period: period, Bytes: 150},
+		},
+		{
+			name:     "below the warnings",
+			usage:    &dataUsage{Period: period, Bytes: 100},
+			used:     100,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 200},
+		},
+		{
+			name:     "crosses a warning",
+			usage:    &dataUsage{Period: period, Bytes: 400},
+			used:     150,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 550, Warned: 50},
+		},
+		{
+			name:     "at a warning",
+			usage:    &dataUsage{Period: period, Bytes: 400},
+			used:     100,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 500, Warned: 50},
+		},
+		{
+			name:     "crosses two warnings at once",
+			usage:    &dataUsage{Period: period, Bytes: 400},
+			used:     450,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 850, Warned: 80},
+		},
+		{
+			name:     "warned before",
+			usage:    &dataUsage{Period: period, Bytes: 850, Warned: 80},
+			used:     10,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 860, Warned: 80},
+		},
+		{
+			name:     "reaches the cap",
+			usage:    &dataUsage{Period: period, Bytes: 900, Warned: 80},
+			used:     100,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 1000, Warned: 80, Reached: true},
+		},
+		{
+			name:  "beyond the cap",
+			usage: &dataUsage{Period: period, Bytes: 1200, Reached: true},
+			used:  100,
+			want:  dataUsage{Period: period, Bytes: 1300, Reached: true},
+		},
+		{
+			name:     "new billing period resets the counters",
+			usage:    &dataUsage{Period: previous, Bytes: 1200, Warned: 80, Reached: true},
+			used:     10,
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period, Bytes: 10},
+		},
+		{
+			name:     "new billing period without traffic",
+			usage:    &dataUsage{Period: previous, Bytes: 600, Warned: 50},
+			warnings: []int{50, 80},
+			want:     dataUsage{Period: period},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			ifi := &config.Interface{
+				Name:            "test0",
+				DataCap:         1000,
+				DataCapResetDay: resetDay,
+				DataCapWarnings: tt.warnings,
+				DataCapPolicy:   config.DATACAP_WARN,
+			}
+			if tt.usage != nil {
+				s.state.Usage[ifi.Name] = tt.usage
+			}
+
+			s.addUsage(ifi, tt.used)
+
+			got := s.state.Usage[ifi.Name]
+			if got == nil {
+				t.Fatal("no usage")
+			}
+			if !got.Period.Equal(tt.want.Period) || got.Bytes != tt.want.Bytes || got.Warned != tt.want.Warned || got.Reached != tt.want.Reached {
+				t.Fatalf("usage = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataCapDemote(t *testing.T) {
+	const resetDay = 1
+	period := billingPeriod(time.Now(), resetDay)
+	previous := billingPeriod(period.Add(-time.Hour), resetDay)
+
+	s := testServer(t)
+	ifi := &config.Interface{
+		Name:            "test0",
+		Metric:          100,
+		DataCap:         1000,
+		DataCapResetDay: resetDay,
+		DataCapPolicy:   config.DATACAP_DEMOTE,
+		DataCapMetric:   config.DEF_DATACAPMETRIC,
+	}
+	s.interfaces[ifi.Name] = ifi
+	s.state.Usage[ifi.Name] = &dataUsage{Period: period, Bytes: 900}
+
+	s.addUsage(ifi, 100)
+	if got := ifi.RouteMetric(); got != config.DEF_DATACAPMETRIC {
+		t.Fatalf("metric after reaching the cap = %d, want %d", got, config.DEF_DATACAPMETRIC)
+	}
+
+	// a schedule changing the metric of a demoted interface
+	// changes the metric it moves back to
+	s.applySchedule(config.Schedule{Name: "night", Interface: ifi.Name, Metric: 200}, time.Now())
+	if got := ifi.RouteMetric(); got != config.DEF_DATACAPMETRIC {
+		t.Fatalf("metric after a schedule = %d, want %d", got, config.DEF_DATACAPMETRIC)
+	}
+
+	s.state.Usage[ifi.Name].Period = previous
+	s.addUsage(ifi, 0)
+	if got := ifi.RouteMetric(); got != 200 {
+		t.Fatalf("metric in a new billing period = %d, want %d", got, 200)
+	}
+}
+
+func TestDataCapAdminDown(t *testing.T) {
+	const resetDay = 1
+	period := billingPeriod(time.Now(), resetDay)
+	previous := billingPeriod(period.Add(-time.Hour), resetDay)
+
+	tests := []struct {
+		name string
+		// the admin state set by an operator before the cap
+		// is reached, and after it was reached
+		before, after string
+		reached       string // the admin state once the cap is reached
+		want          string // the admin state in the next billing period
+	}{
+		{name: "set by the data cap", reached: adminDown, want: ""},
+		{name: "set before the data cap", before: adminDown, reached: adminDown, want: adminDown},
+		{name: "forced up before the data cap", before: forceUp, reached: adminDown, want: ""},
+		{name: "cleared by an operator", after: adminUp, reached: adminDown, want: ""},
+		{name: "set again by an operator", after: adminDown, reached: adminDown, want: adminDown},
+		{name: "forced up by an operator", after: forceUp, reached: adminDown, want: forceUp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			ifi := &config.Interface{
+				Name:            "test0",
+				DataCap:         1000,
+				DataCapResetDay: resetDay,
+				DataCapPolicy:   config.DATACAP_ADMINDOWN,
+			}
+			s.interfaces[ifi.Name] = ifi
+			s.state.Usage[ifi.Name] = &dataUsage{Period: period, Bytes: 900}
+
+			if tt.before != "" {
+				if err := s.SetAdmin(ifi.Name, tt.before); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			s.addUsage(ifi, 100)
+			if got := s.adminState(ifi.Name); got != tt.reached {
+				t.Fatalf("admin state after reaching the cap = %q, want %q", got, tt.reached)
+			}
+
+			// a restart within the billing period enforces the cap again
+			s.enforceDataCap(ifi)
+
+			if tt.after != "" {
+				// the clock has to move on for the change to be noticed
+				time.Sleep(time.Millisecond)
+				if err := s.SetAdmin(ifi.Name, tt.after); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			s.state.Usage[ifi.Name].Period = previous
+			s.addUsage(ifi, 0)
+			if got := s.adminState(ifi.Name); got != tt.want {
+				t.Fatalf("admin state in a new billing period = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/webhook"
+)
+
+const (
+	stateUp      = "up"
+	stateDown    = "down"
+	stateUnknown = "unknown"
+)
+
+// Event is a state transition of a family, a host or the admin
+// state of an interface, together with the state of the family
+type Event struct {
+	Type      string `json:"type"` // family, host or admin
+	Interface string `json:"interface"`
+	Family    string `json:"family"`
+	Host      string `json:"host,omitempty"` // id of the host of a host event
+	OldState  string `json:"old_state"`
+	NewState  string `json:"new_state"`
+
+	Available     bool     `json:"available"`
+	UpWeight      int32    `json:"up_weight"`
+	MinimumWeight int32    `json:"minimum_weight"`
+	HostsUp       int      `json:"hosts_up"`
+	Hosts         int      `json:"hosts"`
+	FailedSources []string `json:"failed_sources,omitempty"`
+
+	Probes []ProbeStatus `json:"probes,omitempty"` // the host of a host event, or all hosts of the family
+
+	Time time.Time `json:"time"`
+}
+
+// ProbeStatus are the statistics of the last burst of probes to a host
+type ProbeStatus struct {
+	Host     string     `json:"host"`
+	Name     string     `json:"name"`
+	Address  string     `json:"address"`
+	Up       bool       `json:"up"`
+	Sent     int        `json:"sent"`
+	Received int        `json:"received"`
+	Loss     float64    `json:"loss"` // percentage
+	MinRTT   float64    `json:"min_rtt_ms"`
+	AvgRTT   float64    `json:"avg_rtt_ms"`
+	MaxRTT   float64    `json:"max_rtt_ms"`
+	Probed   *time.Time `json:"probed,omitempty"` // unset until the first burst
+}
+
+// eventHook is a webhook together with its configuration
+type eventHook struct {
+	*webhook.Webhook
+	cfg config.Webhook
+}
+
+func (s *Server) addWebhook(cfg config.Webhook) error {
+	w, err := webhook.New(s.ctx, cfg.URL, webhook.Logger(s.l.With("component", "webhook")),
+		webhook.Secret(cfg.Secret),
+		webhook.Timeout(cfg.Timeout),
+		webhook.Retries(cfg.Retries),
+		webhook.Backoff(cfg.Backoff),
+		webhook.QueueSize(cfg.QueueSize))
+	if err != nil {
+		return err
+	}
+	s.webhooks = append(s.webhooks, &eventHook{Webhook: w, cfg: cfg})
+	return nil
+}
+
+// emit queues the event on the webhooks that want it and on the
+// mqtt client. It never blocks, events for a full queue are dropped.
+func (s *Server) emit(ev Event) {
+	if len(s.webhooks) == 0 && s.mqtt == nil {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		s.l.Errorf("emit: could not encode the %s event of interface %q: %s", ev.Type, ev.Interface, err)
+		return
+	}
+	for _, hook := range s.webhooks {
+		if !hook.cfg.Wants(ev.Type) {
+			continue
+		}
+		if !hook.Send(payload) {
+			s.l.Warnf("emit: queue of webhook %s is full, dropping the %s event of interface %q", hook.cfg.URL, ev.Type, ev.Interface)
+		}
+	}
+	if s.mqtt != nil {
+		s.publishEvent(ev, payload)
+	}
+}
+
+// familyEvent emits a family event when the state of
+// the family of the interface differs from the last one
+func (s *Server) familyEvent(ifi *config.Interface, family uint8, state string) {
+	s.mu.Lock()
+	if s.familyStates[ifi.Name] == nil {
+		s.familyStates[ifi.Name] = make(map[uint8]string)
+	}
+	old := s.familyStates[ifi.Name][family]
+	s.familyStates[ifi.Name][family] = state
+	s.mu.Unlock()
+
+	if old == state {
+		return
+	}
+	if old == "" {
+		old = stateUnknown
+	}
+	s.emit(s.newEvent(config.EVENT_FAMILY, ifi, family, nil, old, state))
+}
+
+// hostEvent emits a host event for the debounced state of the host
+func (s *Server) hostEvent(ifi *config.Interface, im *icmpMonitor, up bool) {
+	old, state := stateUp, stateDown
+	if up {
+		old, state = stateDown, stateUp
+	}
+	s.emit(s.newEvent(config.EVENT_HOST, ifi, im.host.Family, im, old, state))
+}
+
+// adminEvent emits an admin event for the family of the interface
+func (s *Server) adminEvent(ifi *config.Interface, family uint8, state string, previous string) {
+	if previous == "" {
+		previous = adminUp
+	}
+	if previous == state {
+		return
+	}
+	s.emit(s.newEvent(config.EVENT_ADMIN, ifi, family, nil, previous, state))
+}
+
+// newEvent returns an event with the state of the family of the
+// interface, and the probes of the host, or of all hosts of the family
+func (s *Server) newEvent(typ string, ifi *config.Interface, family uint8, host *icmpMonitor, old, state string) Event {
+	ev := Event{
+		Type:          typ,
+		Interface:     ifi.Name,
+		Family:        familyName(family),
+		OldState:      old,
+		NewState:      state,
+		Available:     ifi.Available(family),
+		UpWeight:      ifi.Up(family),
+		MinimumWeight: ifi.Minimum(),
+		Time:          time.Now(),
+	}
+	for _, src := range ifi.Failed(family).List() {
+		ev.FailedSources = append(ev.FailedSources, src.String())
+	}
+	if host != nil {
+		ev.Host = host.host.ID()
+	}
+
+	for _, m := range s.icmpMonitorsFor(ifi.Name) {
+		if m.host.Family != family {
+			continue
+		}
+		probe := s.probeStatus(m)
+		ev.Hosts++
+		if probe.Up {
+			ev.HostsUp++
+		}
+		if host == nil || m == host {
+			ev.Probes = append(ev.Probes, probe)
+		}
+	}
+	return ev
+}
+
+// probeStatus returns the statistics of the last burst to the host
+func (s *Server) probeStatus(m *icmpMonitor) ProbeStatus {
+	stats, at := m.Last()
+	ps := ProbeStatus{
+		Host:     m.host.ID(),
+		Name:     m.host.Name,
+		Address:  m.address().String(),
+		Up:       m.up(s),
+		Sent:     stats.PacketsSent,
+		Received: stats.PacketsRecv,
+		Loss:     stats.PacketLoss,
+		MinRTT:   milliseconds(stats.MinRtt),
+		AvgRTT:   milliseconds(stats.AvgRtt),
+		MaxRTT:   milliseconds(stats.MaxRtt),
+	}
+	if !at.IsZero() {
+		ps.Probed = &at
+	}
+	return ps
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,186 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// failbackState is the failback state of a family of an interface
+type failbackState struct {
+	active  bool        // the family has been taken into use before
+	pending bool        // the family is available, but its failback is held
+	at      time.Time   // when a delayed failback happens
+	timer   *time.Timer // the timer of a delayed failback
+}
+
+// failbackStateFor returns the failback state of the family of the
+// interface. It must be called with mu held.
+func (s *Server) failbackStateFor(name string, family uint8) *failbackState {
+	if s.failbacks[name] == nil {
+		s.failbacks[name] = make(map[uint8]*failbackState)
+	}
+	if s.failbacks[name][family] == nil {
+		s.failbacks[name][family] = &failbackState{}
+	}
+	return s.failbacks[name][family]
+}
+
+// activated marks the family of the interface as taken into use, and
+// returns whether it was taken into use before, which makes this a failback.
+func (s *Server) activated(ifi *config.Interface, family uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.failbackStateFor(ifi.Name, family)
+	active := st.active
+	st.active = true
+	return active
+}
+
+// holdFailback returns whether the failback policy of the interface
+// holds the family that became available. The family is only held when
+// it recovers from a failure, at startup it is taken into use immediately.
+func (s *Server) holdFailback(ifi *config.Interface, family uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.failbackStateFor(ifi.Name, family)
+	if !st.active {
+		return false
+	}
+
+	switch ifi.Failback {
+	case config.FAILBACK_DELAY:
+		s.logFamily(ifi, family).Printf("holdFailback: family %s, interface %q, failback in %s", fam(family), ifi.Name, ifi.FailbackDelay)
+		st.pending = true
+		st.at = time.Now().Add(ifi.FailbackDelay)
+		var timer *time.Timer
+		timer = time.AfterFunc(ifi.FailbackDelay, func() {
+			s.releaseFailback(ifi, family, timer)
+		})
+		st.timer = timer
+		return true
+	case config.FAILBACK_MANUAL:
+		s.logFamily(ifi, family).Printf("holdFailback: family %s, interface %q, waiting for a manual failback", fam(family), ifi.Name)
+		st.pending = true
+		return true
+	}
+	return false
+}
+
+// cancelFailback cancels a held failback of the family
+// of the interface, as it is no longer available.
+func (s *Server) cancelFailback(ifi *config.Interface, family uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.failbackStateFor(ifi.Name, family)
+	if st.pending {
+		s.logFamily(ifi, family).Printf("cancelFailback: family %s, interface %q", fam(family), ifi.Name)
+	}
+	st.pending = false
+	st.at = time.Time{}
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+// releaseFailback takes the held family of the interface into use. A
+// delayed failback passes its timer, so a failback that was canceled
+// and held again in the meantime does not happen early.
+func (s *Server) releaseFailback(ifi *config.Interface, family uint8, timer *time.Timer) bool {
+	s.mu.Lock()
+	st := s.failbackStateFor(ifi.Name, family)
+	if !st.pending || (timer != nil && st.timer != timer) {
+		s.mu.Unlock()
+		return false
+	}
+	st.pending = false
+	st.at = time.Time{}
+	st.timer = nil
+	s.mu.Unlock()
+
+	s.logFamily(ifi, family).Printf("releaseFailback: family %s, interface %q", fam(family), ifi.Name)
+	s.failback(ifi, family)
+	return true
+}
+
+// failbackStatus returns whether a failback of the family of the
+// interface is held, and when a delayed failback happens.
+func (s *Server) failbackStatus(name string, family uint8) (bool, *time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.failbacks[name][family]
+	if !ok || !st.pending {
+		return false, nil
+	}
+	if st.at.IsZero() {
+		return true, nil
+	}
+	at := st.at
+	return true, &at
+}
+
+// pinConnections keeps the established connections on the interfaces
+// they use, by setting the mark of the interface they are masqueraded
+// behind in their connmark. The nftables rules restore the mark on their
+// packets, so they keep being routed through the table of that interface
+// when ifi takes over again. The configuration makes sure the other
+// interfaces have a probe_mark and table.
+func (s *Server) pinConnections(ifi *config.Interface, family uint8) {
+	for _, other := range s.config.Interfaces {
+		if other.Name == ifi.Name {
+			continue
+		}
+		pinned, err := conntrack.Mark(family, interfaceAddresses(other.Name, family), other.ProbeMark)
+		if err != nil {
+			s.logFamily(ifi, family).Errorf("pinConnections: could not pin %s connections to %q: %s", fam(family), other.Name, err)
+			continue
+		}
+		s.logFamily(ifi, family).Printf("pinConnections: pinned %d %s connections to %q", pinned, fam(family), other.Name)
+	}
+}
+
+// serveFailback releases the held failback of the interface given by the
+// interface parameter, for the family given by the family parameter
+// (ipv4 or ipv6) or for both families.
+func (s *Server) serveFailback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ifi, ok := s.interfaces[r.FormValue("interface")]
+	if !ok {
+		http.Error(w, "unknown interface", http.StatusNotFound)
+		return
+	}
+
+	var released []string
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if f := r.FormValue("family"); f != "" && f != familyName(family) {
+			continue
+		}
+		if s.releaseFailback(ifi, family, nil) {
+			released = append(released, familyName(family))
+		}
+	}
+	if len(released) == 0 {
+		http.Error(w, "no failback pending", http.StatusConflict)
+		return
+	}
+	writeJSON(w, released)
+}
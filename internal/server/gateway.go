@@ -0,0 +1,68 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// gatewayInterval is the interval at which the routing table
+// is checked for a changed gateway (e.g. by DHCP)
+const gatewayInterval = 5 * time.Second
+
+var errNoGateway = errors.New("no gateway found")
+
+// followGateway probes the gateway of the interface and moves the
+// icmp monitor along when the gateway changes.
+// It runs until the link goes down.
+func (s *Server) followGateway(ifi *config.Interface, src string, host config.Host, shutdown chan bool) {
+	s.followTarget(ifi, src, host, shutdown, func(current *net.IP) (net.IP, time.Duration, error) {
+		gw, err := s.findGateway(ifi, host.Family, current)
+		return gw, gatewayInterval, err
+	})
+}
+
+// findGateway returns the gateway of the default route for the family
+// through this interface. When there are multiple, the current gateway
+// is kept as long as it is still in use.
+func (s *Server) findGateway(ifi *config.Interface, family uint8, current *net.IP) (net.IP, error) {
+	ifIndex, err := net.InterfaceByName(ifi.Name)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := s.nlconn.Route.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var gateways []net.IP
+	for _, msg := range msgs {
+		if msg.Family == family &&
+			msg.DstLength == 0 &&
+			msg.Attributes.OutIface == uint32(ifIndex.Index) &&
+			msg.Attributes.Gateway != nil &&
+			(msg.Attributes.Table == unix.RT_TABLE_MAIN ||
+				(ifi.Table != 0 && msg.Attributes.Table == ifi.Table)) {
+			gateways = append(gateways, msg.Attributes.Gateway)
+		}
+	}
+	if len(gateways) == 0 {
+		return nil, errNoGateway
+	}
+	return pickAddress(gateways, current), nil
+}
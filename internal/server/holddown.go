@@ -0,0 +1,183 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"math"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+)
+
+// upState is the state of a family of an interface that has to pass
+// its up delay, hold down and flap dampening before it is taken into use.
+type upState struct {
+	available bool
+	since     time.Time // when the family became available
+	downSince time.Time // when the family last failed
+
+	penalty    float64
+	decayed    time.Time // when the penalty was last decayed
+	suppressed bool
+
+	until time.Time   // when the held family is taken into use
+	timer *time.Timer // the timer that takes the held family into use
+}
+
+// upStateFor returns the state of the family of the
+// interface. It must be called with mu held.
+func (s *Server) upStateFor(name string, family uint8) *upState {
+	if s.upStates[name] == nil {
+		s.upStates[name] = make(map[uint8]*upState)
+	}
+	if s.upStates[name][family] == nil {
+		s.upStates[name][family] = &upState{}
+	}
+	return s.upStates[name][family]
+}
+
+// decay decays the penalty of the family, and ends
+// the suppression once the penalty is below reuse.
+func (st *upState) decay(ifi *config.Interface, now time.Time) {
+	if ifi.DampeningHalfLife == 0 {
+		return
+	}
+	if !st.decayed.IsZero() {
+		st.penalty *= math.Pow(0.5, float64(now.Sub(st.decayed))/float64(ifi.DampeningHalfLife))
+	}
+	st.decayed = now
+	if st.suppressed && st.penalty <= float64(ifi.DampeningReuse) {
+		st.suppressed = false
+	}
+}
+
+// penalize adds the penalty of a failure, and suppresses the family
+// once the penalty is above suppress. The penalty is capped so the
+// family is suppressed for at most the maximum suppress time.
+func (st *upState) penalize(ifi *config.Interface, now time.Time) {
+	if ifi.DampeningHalfLife == 0 {
+		return
+	}
+	st.decay(ifi, now)
+	st.penalty += float64(ifi.DampeningPenalty)
+	ceiling := float64(ifi.DampeningReuse) * math.Pow(2, float64(ifi.DampeningMaxSuppress)/float64(ifi.DampeningHalfLife))
+	if st.penalty > ceiling {
+		st.penalty = ceiling
+	}
+	if st.penalty >= float64(ifi.DampeningSuppress) {
+		st.suppressed = true
+	}
+}
+
+// wait returns how long the available family
+// has to wait before it is taken into use.
+func (st *upState) wait(ifi *config.Interface, now time.Time) time.Duration {
+	wait := st.since.Add(ifi.UpDelay).Sub(now)
+	if !st.downSince.IsZero() {
+		if d := st.downSince.Add(ifi.HoldDown).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	st.decay(ifi, now)
+	if st.suppressed {
+		// the time for the penalty to decay to reuse
+		d := time.Duration(float64(ifi.DampeningHalfLife)*math.Log2(st.penalty/float64(ifi.DampeningReuse))) + time.Millisecond
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// familyAvailable is called when the family of the interface becomes
+// available, and takes it into use once it is no longer held.
+func (s *Server) familyAvailable(ifi *config.Interface, family uint8) {
+	s.mu.Lock()
+	st := s.upStateFor(ifi.Name, family)
+	st.available = true
+	st.since = time.Now()
+	s.mu.Unlock()
+
+	s.promote(ifi, family, nil)
+}
+
+// familyUnavailable is called when the family of the interface fails,
+// and penalizes the family when it was available.
+func (s *Server) familyUnavailable(ifi *config.Interface, family uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.upStateFor(ifi.Name, family)
+	now := time.Now()
+	if st.available {
+		st.downSince = now
+		st.penalize(ifi, now)
+		if st.suppressed {
+			s.logFamily(ifi, family).Printf("familyUnavailable: family %s, interface %q is suppressed, penalty %.0f", fam(family), ifi.Name, st.penalty)
+		}
+	}
+	st.available = false
+	st.until = time.Time{}
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+// promote takes the available family of the interface into use, or
+// holds it until its up delay, hold down and suppression have passed.
+// A held family is promoted again by its timer.
+func (s *Server) promote(ifi *config.Interface, family uint8, timer *time.Timer) {
+	s.mu.Lock()
+	st := s.upStateFor(ifi.Name, family)
+	if !st.available || (timer != nil && st.timer != timer) {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if wait := st.wait(ifi, now); wait > 0 {
+		s.logFamily(ifi, family).Printf("promote: family %s, interface %q, held for %s (suppressed: %t)", fam(family), ifi.Name, wait.Round(time.Second), st.suppressed)
+		st.until = now.Add(wait)
+		var t *time.Timer
+		t = time.AfterFunc(wait, func() {
+			s.promote(ifi, family, t)
+		})
+		st.timer = t
+		s.mu.Unlock()
+		return
+	}
+	st.until = time.Time{}
+	st.timer = nil
+	s.mu.Unlock()
+
+	if s.holdFailback(ifi, family) {
+		return
+	}
+	s.failback(ifi, family)
+}
+
+// upStatus returns the penalty and suppression of the family of
+// the interface, and until when the available family is held.
+func (s *Server) upStatus(ifi *config.Interface, family uint8) (float64, bool, *time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.upStates[ifi.Name][family]
+	if !ok {
+		return 0, false, nil
+	}
+	st.decay(ifi, time.Now())
+	if st.until.IsZero() {
+		return st.penalty, st.suppressed, nil
+	}
+	until := st.until
+	return st.penalty, st.suppressed, &until
+}
@@ -13,40 +13,91 @@
 package server
 
 import (
+	"net"
+
 	"github.com/jsimonetti/hodos/internal/config"
 	"github.com/jsimonetti/hodos/internal/icmp"
 )
 
-func (s *Server) addICMPMonitor(ifi *config.Interface, src string, host config.Host) error {
-	s.l.Debugf("addICMPMonitor: add monitor on interface %q for host %+v", ifi.Name, host)
-	m, err := icmp.New(s.ctx, src, *host.Host, ifi.Name, icmp.Logger(s.l),
+// icmpMonitor keeps the debounced state of a host
+// together with the monitor that is probing it.
+// isUp is guarded by s.mu.
+type icmpMonitor struct {
+	*icmp.Monitor
+	host config.Host
+	src  string
+	isUp bool
+}
+
+func (s *Server) addICMPMonitor(ifi *config.Interface, src string, host config.Host, isUp bool) error {
+	s.logFor("server", ifi).Debugf("addICMPMonitor: add monitor on interface %q for host %+v", ifi.Name, host)
+	m, err := icmp.New(s.ctx, src, *host.Host, ifi.Name, icmp.Logger(s.logForHost("icmp", ifi, host)),
+		icmp.WithEngine(s.icmpEngines[host.Family]),
 		icmp.Interval(host.ICMPInterval),
 		icmp.Timeout(host.ICMPTimeout),
-		icmp.BurstSize(host.BurstSize))
+		icmp.BurstSize(host.BurstSize),
+		icmp.Mark(ifi.ProbeMark),
+		icmp.Size(host.Size),
+		icmp.TTL(host.TTL),
+		icmp.DSCP(host.DSCP),
+		icmp.DontFragment(host.DontFragment))
 
 	if err != nil {
 		return err
 	}
 
-	// start with the host dowm
-	isUp := false
+	im := &icmpMonitor{Monitor: m, host: host, src: src, isUp: isUp}
 	m.Down(func() {
 		// debounce down
-		if isUp {
-			s.nextHopFail(ifi, host.Family, false)
-			isUp = false
+		if im.setUp(s, false) {
+			s.hostEvent(ifi, im, false)
+			s.nextHopFail(ifi, host.Family, host.Weight, false)
 		}
 	})
 	m.Up(func() {
 		// debounce up
-		if !isUp {
-			s.nextHopAvailable(ifi, host.Family)
-			isUp = true
+		if !im.setUp(s, true) {
+			s.hostEvent(ifi, im, true)
+			s.nextHopAvailable(ifi, host.Family, host.Weight)
 		}
 	})
-	s.icmpMonitors[ifi.Name][host.Name] = m
+	s.mu.Lock()
+	s.icmpMonitors[ifi.Name][host.ID()] = im
+	s.mu.Unlock()
 
 	go m.Start(host.BurstInterval)
 
 	return nil
 }
+
+// setUp sets the debounced state, and returns the previous state.
+func (im *icmpMonitor) setUp(s *Server, up bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	was := im.isUp
+	im.isUp = up
+	return was
+}
+
+// up returns the debounced state.
+func (im *icmpMonitor) up(s *Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return im.isUp
+}
+
+// address returns the address that is probed.
+func (im *icmpMonitor) address() net.IP {
+	return *im.host.Host
+}
+
+// icmpMonitorsFor returns the icmp monitors of the interface.
+func (s *Server) icmpMonitorsFor(name string) []*icmpMonitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	monitors := make([]*icmpMonitor, 0, len(s.icmpMonitors[name]))
+	for _, m := range s.icmpMonitors[name] {
+		monitors = append(monitors, m)
+	}
+	return monitors
+}
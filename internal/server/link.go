@@ -13,63 +13,50 @@
 package server
 
 import (
-	"fmt"
 	"net"
 	"time"
 
+	"github.com/jsimonetti/hodos/internal/bfd"
 	"github.com/jsimonetti/hodos/internal/config"
-	"github.com/jsimonetti/hodos/internal/icmp"
 	"github.com/jsimonetti/hodos/internal/linkstate"
-	"github.com/jsimonetti/rtnetlink"
 	"golang.org/x/sys/unix"
 )
 
 func (s *Server) linkDown(ifi *config.Interface) {
-	s.l.Debugf("linkDown event: %q (%p)", ifi.Name, ifi)
-	for _, m := range s.icmpMonitors[ifi.Name] {
+	s.logFor("server", ifi).Debugf("linkDown event: %q (%p)", ifi.Name, ifi)
+	for _, m := range s.icmpMonitorsFor(ifi.Name) {
 		m.Stop()
 	}
-
-	if ifi.Table != 0 {
-		// remove route rules
-		nl, err := rtnetlink.Dial(nil)
-		if err != nil {
-			s.l.Printf("linkDown: could not dial rtnetlink: %s", err)
-		}
-		defer nl.Close()
-
-		// first get all rules for this table
-		// benefit of this, it works for all address families
-		rumsgs, _ := nl.Rule.List()
-		for _, msg := range rumsgs {
-			if *msg.Attributes.Table == ifi.Table {
-				if err = nl.Rule.Delete(&msg); err != nil {
-					s.l.Printf("linkDown: error deleting route rules for table %d: %s", ifi.Table, err)
-				}
-			}
-		}
+	for _, m := range s.bfdSessionsFor(ifi.Name) {
+		m.Stop()
 	}
 
 	s.nextHopFailLink(ifi)
+	s.setNFTables(ifi, false)
 }
 
 func (s *Server) linkUp(ifi *config.Interface, shutdown chan bool) {
-	s.l.Debugf("linkUp event: %q (%p)", ifi.Name, ifi)
+	s.logFor("server", ifi).Debugf("linkUp event: %q (%p)", ifi.Name, ifi)
+	s.setNFTables(ifi, true)
 
 	hasipv6 := false
 	hasipv4 := false
 
 	for _, host := range ifi.Hosts {
 		if !hasipv4 && host.Family == unix.AF_INET {
-			s.l.Debugf("linkUp: enabling IPv4 support for interface %q", ifi.Name)
+			s.logFor("server", ifi).Debugf("linkUp: enabling IPv4 support for interface %q", ifi.Name)
 			hasipv4 = true
 			continue
 		}
 		if !hasipv6 && host.Family == unix.AF_INET6 {
-			s.l.Debugf("linkUp: enabling IPv6 support for interface %q", ifi.Name)
+			s.logFor("server", ifi).Debugf("linkUp: enabling IPv6 support for interface %q", ifi.Name)
 			hasipv6 = true
 		}
 	}
+	for _, b := range ifi.BFD {
+		hasipv4 = hasipv4 || b.Family == unix.AF_INET
+		hasipv6 = hasipv6 || b.Family == unix.AF_INET6
+	}
 
 	// we need to wait untill we have a valid ip address
 	// on the interface before we can start an icmp monitor
@@ -95,27 +82,35 @@ func (s *Server) linkUp(ifi *config.Interface, shutdown chan bool) {
 				}
 				timer4.Reset(backoff4 * time.Second)
 				// try to find an ip address and start the monitor
-				s.l.Debugf("linkUp: trying to find an ipv4 address on interface %q", ifi.Name)
+				s.logFor("server", ifi).Debugf("linkUp: trying to find an ipv4 address on interface %q", ifi.Name)
 				if src := findLocalAddressv4(ifi.Name); src != "" {
-					s.l.Printf("linkUp: using IPv4 source %q for interface %q", src, ifi.Name)
+					s.logFor("server", ifi).Printf("linkUp: using IPv4 source %q for interface %q", src, ifi.Name)
 					timer4.Stop()
 					if hasipv4 {
 						for _, host := range ifi.Hosts {
 							if host.Family == unix.AF_INET {
-								if ifi.Table != 0 {
-									_, from, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", src, 32))
-									_, to, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", host.Host, 32))
-									if err := s.ruleAdd(from, to, ifi.Table, 1, unix.AF_INET); err != nil {
-										s.l.Printf("linkUp: could not add route rule %q: %q-> (%q)", ifi.Name, from, to, err)
-									}
+								if host.Gateway {
+									// the monitor is started once the gateway is found
+									go s.followGateway(ifi, src, host, shutdown)
+									continue
 								}
-								if err := s.addICMPMonitor(ifi, src, host); err != nil {
-									s.l.Printf("linkUp: could not start icmp monitor %q: %q -> %d (%q)", ifi.Name, src, host.Name, err)
+								if host.Hostname != "" {
+									// the monitor is started once the hostname resolves
+									go s.resolveHost(ifi, src, host, shutdown)
+									continue
 								}
+								s.addTarget(ifi, src, host, false)
 							}
 						}
 						// we start with everything down
-						s.failGatewaysFor(ifi, unix.AF_INET)
+						s.startGatewaysFor(ifi, unix.AF_INET)
+						s.addBFDSessions(ifi, src, unix.AF_INET)
+						if ifi.PMTUInterval > 0 {
+							go s.discoverPMTU(ifi, src, unix.AF_INET, shutdown)
+						}
+						if ifi.TracerouteInterval > 0 {
+							go s.runTraceroute(ifi, unix.AF_INET, shutdown)
+						}
 					}
 				}
 			case <-timer6.C:
@@ -125,27 +120,35 @@ func (s *Server) linkUp(ifi *config.Interface, shutdown chan bool) {
 				}
 				timer6.Reset(backoff6 * time.Second)
 				// try to find an ip address and start the monitor
-				s.l.Debugf("linkUp: trying to find an ipv6 address on interface %q", ifi.Name)
+				s.logFor("server", ifi).Debugf("linkUp: trying to find an ipv6 address on interface %q", ifi.Name)
 				if src := findLocalAddressv6(ifi.Name); src != "" {
-					s.l.Printf("linkUp: using IPv6 source %q for interface %q", src, ifi.Name)
+					s.logFor("server", ifi).Printf("linkUp: using IPv6 source %q for interface %q", src, ifi.Name)
 					timer6.Stop()
-					if hasipv4 {
+					if hasipv6 {
 						for _, host := range ifi.Hosts {
 							if host.Family == unix.AF_INET6 {
-								if ifi.Table != 0 {
-									_, from, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", src, 128))
-									_, to, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", host.Host, 128))
-									if err := s.ruleAdd(from, to, ifi.Table, 1, unix.AF_INET6); err != nil {
-										s.l.Printf("linkUp: could not add route rule %q: %q-> (%q)", ifi.Name, from, to, err)
-									}
+								if host.Gateway {
+									// the monitor is started once the gateway is found
+									go s.followGateway(ifi, src, host, shutdown)
+									continue
 								}
-								if err := s.addICMPMonitor(ifi, src, host); err != nil {
-									s.l.Printf("linkUp: could not start icmp monitor %q: %q -> %d (%q)", ifi.Name, src, host.Name, err)
+								if host.Hostname != "" {
+									// the monitor is started once the hostname resolves
+									go s.resolveHost(ifi, src, host, shutdown)
+									continue
 								}
+								s.addTarget(ifi, src, host, false)
 							}
 						}
 						// we start with everything down
-						s.failGatewaysFor(ifi, unix.AF_INET6)
+						s.startGatewaysFor(ifi, unix.AF_INET6)
+						s.addBFDSessions(ifi, src, unix.AF_INET6)
+						if ifi.PMTUInterval > 0 {
+							go s.discoverPMTU(ifi, src, unix.AF_INET6, shutdown)
+						}
+						if ifi.TracerouteInterval > 0 {
+							go s.runTraceroute(ifi, unix.AF_INET6, shutdown)
+						}
 					}
 				}
 			case <-shutdown:
@@ -158,7 +161,7 @@ func (s *Server) linkUp(ifi *config.Interface, shutdown chan bool) {
 
 func (s *Server) addLinkMonitor(ifi config.Interface) error {
 	s.l.Debugf("addLinkMonitor: add monitor for interface %q", ifi.Name)
-	m, err := linkstate.New(s.ctx, ifi, linkstate.Logger(s.l))
+	m, err := linkstate.New(s.ctx, ifi, linkstate.Logger(s.logFor("linkstate", &ifi)), linkstate.StatsInterval(s.config.StatsInterval))
 	if err != nil {
 		return err
 	}
@@ -172,7 +175,18 @@ func (s *Server) addLinkMonitor(ifi config.Interface) error {
 		s.linkUp(&ifi, shutdown)
 	})
 	s.linkMonitors[ifi.Name] = m
-	s.icmpMonitors[ifi.Name] = make(map[string]*icmp.Monitor)
+	s.interfaces[ifi.Name] = &ifi
+	s.icmpMonitors[ifi.Name] = make(map[string]*icmpMonitor)
+	s.bfdSessions[ifi.Name] = make(map[string]*bfd.Session)
+
+	if ifi.NeighborMonitor {
+		if err := s.addNeighborMonitor(&ifi); err != nil {
+			return err
+		}
+	}
+	if ifi.PassiveMonitor {
+		return s.addPassiveMonitor(&ifi)
+	}
 	return nil
 }
 
@@ -203,3 +217,31 @@ func findLocalAddressv6(interfaceName string) string {
 	}
 	return ""
 }
+
+// trafficStatus returns the traffic counters of the link,
+// or nil if they were not sampled yet
+func (s *Server) trafficStatus(name string) *TrafficStatus {
+	m, ok := s.linkMonitors[name]
+	if !ok {
+		return nil
+	}
+	stats, ok := m.Stats()
+	if !ok {
+		return nil
+	}
+	return &TrafficStatus{
+		RXBytes:      stats.RXBytes,
+		TXBytes:      stats.TXBytes,
+		RXPackets:    stats.RXPackets,
+		TXPackets:    stats.TXPackets,
+		RXErrors:     stats.RXErrors,
+		TXErrors:     stats.TXErrors,
+		RXDropped:    stats.RXDropped,
+		TXDropped:    stats.TXDropped,
+		RXRate:       stats.RXRate,
+		TXRate:       stats.TXRate,
+		RXPacketRate: stats.RXPacketRate,
+		TXPacketRate: stats.TXPacketRate,
+		Sampled:      stats.Sampled,
+	}
+}
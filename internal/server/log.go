@@ -0,0 +1,49 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/log"
+	"golang.org/x/sys/unix"
+)
+
+// logFor returns the logger of the component for the interface, with
+// the key value pairs as fields. It logs debug messages when debug is
+// set on the interface.
+func (s *Server) logFor(component string, ifi *config.Interface, keyvals ...interface{}) log.Logger {
+	l := s.l.With(append([]interface{}{"component", component, "interface", ifi.Name}, keyvals...)...)
+	if ifi.Debug {
+		l = l.WithLevel(log.LevelDebug)
+	}
+	return l
+}
+
+// logForHost returns the logger of the component for the host of the
+// interface. It logs debug messages when debug is set on the host.
+func (s *Server) logForHost(component string, ifi *config.Interface, host config.Host) log.Logger {
+	l := s.logFor(component, ifi, "host", host.Name, "family", familyName(host.Family))
+	if host.Debug {
+		l = l.WithLevel(log.LevelDebug)
+	}
+	return l
+}
+
+// logFamily returns the logger of the server for the family of
+// the interface. Events of the whole interface have no family.
+func (s *Server) logFamily(ifi *config.Interface, family uint8) log.Logger {
+	if family == unix.AF_UNSPEC {
+		return s.logFor("server", ifi)
+	}
+	return s.logFor("server", ifi, "family", familyName(family))
+}
@@ -0,0 +1,92 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/mqtt"
+)
+
+// addMQTT adds the mqtt client, the options are
+// applied after those of the configuration
+func (s *Server) addMQTT(cfg *config.MQTT, extra ...mqtt.Option) error {
+	opts := []mqtt.Option{
+		mqtt.Logger(s.l.With("component", "mqtt")),
+		mqtt.Credentials(cfg.Username, cfg.Password),
+		mqtt.KeepAlive(cfg.KeepAlive),
+		mqtt.QueueSize(cfg.QueueSize),
+		mqtt.Will(s.topic("status"), []byte("offline"), true),
+		mqtt.OnConnect(s.publishAll),
+	}
+	if cfg.Commands {
+		opts = append(opts, mqtt.Subscribe(s.topic("+", "admin", "set"), s.mqttCommand))
+	}
+	opts = append(opts, extra...)
+	c, err := mqtt.New(s.ctx, cfg.Broker, cfg.ClientID, opts...)
+	if err != nil {
+		return err
+	}
+	s.mqtt = c
+	return nil
+}
+
+// topic returns the topic of the levels below the topic prefix
+func (s *Server) topic(levels ...string) string {
+	return s.config.MQTT.TopicPrefix + "/" + strings.Join(levels, "/")
+}
+
+// publishAll publishes the availability and the state of all
+// interfaces, every time the client is connected to the broker
+func (s *Server) publishAll() {
+	s.mqtt.Publish(s.topic("status"), []byte("online"), true)
+	for _, ifi := range s.interfaces {
+		s.publishState(ifi)
+	}
+}
+
+// publishState publishes the state of the interface as a retained message
+func (s *Server) publishState(ifi *config.Interface) {
+	payload, err := json.Marshal(s.interfaceStatus(ifi))
+	if err != nil {
+		s.l.Errorf("publishState: could not encode the state of interface %q: %s", ifi.Name, err)
+		return
+	}
+	if !s.mqtt.Publish(s.topic(ifi.Name, "state"), payload, true) {
+		s.l.Warnf("publishState: mqtt queue is full, dropping the state of interface %q", ifi.Name)
+	}
+}
+
+// publishEvent publishes the event, and the state of its interface
+func (s *Server) publishEvent(ev Event, payload []byte) {
+	if !s.mqtt.Publish(s.topic(ev.Interface, "event"), payload, false) {
+		s.l.Warnf("publishEvent: mqtt queue is full, dropping the %s event of interface %q", ev.Type, ev.Interface)
+	}
+	if ifi, ok := s.interfaces[ev.Interface]; ok {
+		s.publishState(ifi)
+	}
+}
+
+// mqttCommand sets the admin state of the interface
+// to the payload of <prefix>/<interface>/admin/set
+func (s *Server) mqttCommand(topic string, payload []byte) {
+	name := strings.TrimSuffix(strings.TrimPrefix(topic, s.topic()), "/admin/set")
+	state := strings.TrimSpace(string(payload))
+	s.l.Printf("mqttCommand: setting interface %q to %q", name, state)
+	if err := s.SetAdmin(name, state); err != nil {
+		s.l.Warnf("mqttCommand: %s", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/mqtt"
+)
+
+// broker is the end of a pipe the mqtt client of the server dials
+type broker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// read returns the type and body of the next packet from the client
+func (b *broker) read() (byte, []byte) {
+	b.t.Helper()
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := b.r.ReadByte()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	n, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(b.r, body); err != nil {
+		b.t.Fatal(err)
+	}
+	return header, body
+}
+
+// expect returns the body of the next packet, which is of type typ
+func (b *broker) expect(typ byte) []byte {
+	b.t.Helper()
+	header, body := b.read()
+	if header>>4 != typ {
+		b.t.Fatalf("packet type = %d, want %d", header>>4, typ)
+	}
+	return body
+}
+
+// publish returns the topic, payload and retain flag of the next publish packet
+func (b *broker) publish() (string, []byte, bool) {
+	b.t.Helper()
+	header, body := b.read()
+	if header>>4 != 3 {
+		b.t.Fatalf("packet type = %d, want publish", header>>4)
+	}
+	n := binary.BigEndian.Uint16(body)
+	return string(body[2 : 2+n]), body[2+n:], header&0x01 == 1
+}
+
+// write writes a packet with a body of less than 128 bytes
+func (b *broker) write(header byte, body []byte) {
+	b.t.Helper()
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.conn.Write(append([]byte{header, byte(len(body))}, body...)); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// send publishes the message to the client with qos 0
+func (b *broker) send(topic string, payload string) {
+	b.t.Helper()
+	body := append([]byte{byte(len(topic) >> 8), byte(len(topic))}, topic...)
+	b.write(3<<4, append(body, payload...))
+}
+
+// testMQTT returns the server with an mqtt client that
+// accepts commands, connected to the returned broker
+func testMQTT(t *testing.T, s *Server) *broker {
+	t.Helper()
+	client, server := net.Pipe()
+	s.config.MQTT = &config.MQTT{
+		Broker:      "tcp://broker.example",
+		ClientID:    "hodos-test",
+		TopicPrefix: "hodos",
+		Commands:    true,
+		KeepAlive:   config.DEF_MQTTKEEPALIVE,
+		QueueSize:   config.DEF_MQTTQUEUE,
+	}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return client, nil
+	}
+	if err := s.addMQTT(s.config.MQTT, mqtt.Dialer(dial)); err != nil {
+		t.Fatal(err)
+	}
+	go s.mqtt.Run()
+	t.Cleanup(func() {
+		server.Close()
+		s.mqtt.Stop()
+	})
+
+	b := &broker{t: t, conn: server, r: bufio.NewReader(server)}
+	connect := b.expect(1)
+	if !bytes.Contains(connect, []byte("hodos/status")) || !bytes.Contains(connect, []byte("offline")) {
+		t.Fatalf("connect %q without the will on hodos/status", connect)
+	}
+	b.write(2<<4, []byte{0, 0})
+	if subscribe := b.expect(8); !bytes.Contains(subscribe, []byte("hodos/+/admin/set")) {
+		t.Fatalf("subscribe %q, want hodos/+/admin/set", subscribe)
+	}
+	return b
+}
+
+func TestMQTTConnect(t *testing.T) {
+	s := testServer(t)
+	s.interfaces["wan"] = &config.Interface{Name: "wan", Description: "uplink"}
+	s.state.Admin["wan"] = forceUp
+	b := testMQTT(t, s)
+
+	topic, payload, retain := b.publish()
+	if topic != "hodos/status" || string(payload) != "online" || !retain {
+		t.Fatalf("publish = %s %s retain %t, want the retained status online", topic, payload, retain)
+	}
+
+	topic, payload, retain = b.publish()
+	if topic != "hodos/wan/state" || !retain {
+		t.Fatalf("publish = %s retain %t, want the retained state of wan", topic, retain)
+	}
+	var state InterfaceStatus
+	if err := json.Unmarshal(payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Name != "wan" || state.Description != "uplink" || state.Admin != forceUp {
+		t.Fatalf("state = %s, want wan with admin %s", payload, forceUp)
+	}
+}
+
+func TestMQTTCommand(t *testing.T) {
+	s := testServer(t)
+	s.interfaces["wan"] = &config.Interface{Name: "wan"}
+	b := testMQTT(t, s)
+
+	// the handler runs the commands in order, so the
+	// last one is applied after the rejected ones
+	b.send("hodos/lan/admin/set", adminDown)
+	b.send("hodos/wan/admin/set", "sideways")
+	b.send("hodos/wan/admin/set", adminDown+"\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.adminState("wan") != adminDown {
+		if time.Now().After(deadline) {
+			t.Fatalf("admin state = %q, want %s", s.adminState("wan"), adminDown)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if changed := s.adminChanged("lan"); !changed.IsZero() {
+		t.Fatalf("admin state of unknown interface lan changed at %s", changed)
+	}
+}
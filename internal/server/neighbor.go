@@ -0,0 +1,34 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/neighbor"
+)
+
+func (s *Server) addNeighborMonitor(ifi *config.Interface) error {
+	s.logFor("server", ifi).Debugf("addNeighborMonitor: add monitor for interface %q", ifi.Name)
+	m, err := neighbor.New(s.ctx, *ifi, neighbor.Logger(s.logFor("neighbor", ifi)))
+	if err != nil {
+		return err
+	}
+	m.Down(func(family uint8) {
+		s.sourceFail(ifi, family, config.SourceNeighbor)
+	})
+	m.Up(func(family uint8) {
+		s.sourceAvailable(ifi, family, config.SourceNeighbor)
+	})
+	s.neighborMonitors[ifi.Name] = m
+	return nil
+}
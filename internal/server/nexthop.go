@@ -13,9 +13,13 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/jsimonetti/hodos/internal/config"
 	"github.com/jsimonetti/hodos/internal/routesync"
@@ -23,59 +27,110 @@ import (
 )
 
 func (s *Server) nextHopFailLink(ifi *config.Interface) {
-	s.nextHopFail(ifi, unix.AF_INET, true)
-	s.nextHopFail(ifi, unix.AF_INET6, true)
+	s.nextHopFail(ifi, unix.AF_INET, 0, true)
+	s.nextHopFail(ifi, unix.AF_INET6, 0, true)
 }
 
-func (s *Server) nextHopFail(ifi *config.Interface, family uint8, linkDown bool) {
+func (s *Server) nextHopFail(ifi *config.Interface, family uint8, weight int, linkDown bool) {
 	var belowMinimum bool
 	if linkDown {
 		ifi.LinkDown()
-		s.l.Debugf("linkDown: interface %v", ifi)
+		s.logFamily(ifi, family).Debugf("linkDown: interface %v", ifi)
 	} else {
-		belowMinimum = ifi.HostDown(family)
-		s.l.Printf("hostDown: family %s, interface %s, up %d/%d, below: %t", fam(family), ifi.Name, ifi.Up(family), ifi.MinimumUp, belowMinimum)
+		belowMinimum = ifi.HostDown(family, weight)
+		s.logFamily(ifi, family).Printf("hostDown: family %s, interface %s, up %d/%d, below: %t", fam(family), ifi.Name, ifi.Up(family), ifi.Minimum(), belowMinimum)
 	}
 	if linkDown || belowMinimum {
-		s.l.Printf("nextHopFail: family %s, interface %q", fam(family), ifi.Name)
-		out, err := s.execScript("DOWN", family, ifi)
-		if err != nil {
-			s.l.Printf("nextHopFail: could not run down_action: %s", err)
-		}
-		if len(out) > 0 {
-			s.l.Printf(">>> %q", string(out))
-		}
-
-		// delete all gateway routes from main for this interface
-		if err := s.failGatewaysFor(ifi, family); err != nil {
-			s.l.Printf("failed to mark the gateway as down: %s", err)
-		}
+		s.familyDown(ifi, family)
+	}
+	if belowMinimum && ifi.TracerouteOnFailover {
+		go s.traceFamily(ifi, family, true)
 	}
 }
 
-func (s *Server) nextHopAvailable(ifi *config.Interface, family uint8) {
-	atMinimum := ifi.HostUp(family)
-	s.l.Printf("hostUp: family %s, interface %s, up %d/%d, at: %t", fam(family), ifi.Name, ifi.Up(family), ifi.MinimumUp, atMinimum)
+func (s *Server) nextHopAvailable(ifi *config.Interface, family uint8, weight int) {
+	atMinimum := ifi.HostUp(family, weight)
+	s.logFamily(ifi, family).Printf("hostUp: family %s, interface %s, up %d/%d, at: %t", fam(family), ifi.Name, ifi.Up(family), ifi.Minimum(), atMinimum)
 	if atMinimum {
-		s.l.Printf("nextHopAvailable: family %s, interface %q", fam(family), ifi.Name)
-		out, err := s.execScript("UP", family, ifi)
-		if err != nil {
-			s.l.Printf("nextHopAvailable: could not run up_action: %s", err)
-		}
-		if len(out) > 0 {
-			s.l.Printf(">>> %q", string(out))
-		}
+		s.familyUp(ifi, family)
+	}
+}
 
-		// copy all gateway routes from interface table to main and modify
-		// route priority to set metric
-		if err := s.addGatewaysFor(ifi, family); err != nil {
-			s.l.Printf("could not set avail: %s", err)
+// sourceFail is called when a health source other then the
+// icmp monitors considers the family of an interface down.
+func (s *Server) sourceFail(ifi *config.Interface, family uint8, src config.Source) {
+	unavailable := ifi.SourceDown(family, src)
+	s.logFamily(ifi, family).Printf("sourceDown: family %s, interface %s, source %s, unavailable: %t", fam(family), ifi.Name, src, unavailable)
+	if unavailable {
+		s.familyDown(ifi, family)
+		if ifi.TracerouteOnFailover {
+			go s.traceFamily(ifi, family, true)
 		}
 	}
 }
 
+// sourceAvailable is called when a health source other then the
+// icmp monitors considers the family of an interface up again.
+func (s *Server) sourceAvailable(ifi *config.Interface, family uint8, src config.Source) {
+	available := ifi.SourceUp(family, src)
+	s.logFamily(ifi, family).Printf("sourceUp: family %s, interface %s, source %s, available: %t", fam(family), ifi.Name, src, available)
+	if available {
+		s.familyUp(ifi, family)
+	}
+}
+
+func (s *Server) familyDown(ifi *config.Interface, family uint8) {
+	s.logFamily(ifi, family).Printf("nextHopFail: family %s, interface %q", fam(family), ifi.Name)
+	s.familyUnavailable(ifi, family)
+	s.cancelFailback(ifi, family)
+	s.familyEvent(ifi, family, stateDown)
+	if s.overridden(ifi, family) {
+		return
+	}
+	l := s.logFamily(ifi, family).With("event", "DOWN")
+	s.runScript("DOWN", family, ifi)
+
+	// delete all gateway routes from main for this interface
+	if err := s.failGatewaysFor(ifi, family); err != nil {
+		l.Errorf("failed to mark the gateway as down: %s", err)
+	}
+
+	// connections behind the addresses of this interface
+	// are set up again over the remaining interfaces
+	if ifi.ConntrackFlush {
+		s.flushConntrack(ifi, family)
+	}
+}
+
+func (s *Server) familyUp(ifi *config.Interface, family uint8) {
+	s.logFamily(ifi, family).Printf("nextHopAvailable: family %s, interface %q", fam(family), ifi.Name)
+	s.familyAvailable(ifi, family)
+}
+
+// failback takes the family of the interface into use
+func (s *Server) failback(ifi *config.Interface, family uint8) {
+	s.familyEvent(ifi, family, stateUp)
+	if s.overridden(ifi, family) {
+		return
+	}
+	if s.activated(ifi, family) && ifi.Failback == config.FAILBACK_NEWCONNECTIONS {
+		s.pinConnections(ifi, family)
+	}
+
+	l := s.logFamily(ifi, family).With("event", "UP")
+	s.runScript("UP", family, ifi)
+
+	// copy all gateway routes from interface table to main and modify
+	// route priority to set metric
+	if err := s.addGatewaysFor(ifi, family); err != nil {
+		l.Errorf("could not set avail: %s", err)
+	}
+}
+
 func (s *Server) addGatewaysFor(ifi *config.Interface, family uint8) error {
-	routesync.WithMetric(ifi.Metric)(s.routeSync[ifi.Name])
+	s.failNFTables(ifi, family, false)
+	metric := ifi.RouteMetric()
+	routesync.WithMetric(metric)(s.routeSync[ifi.Name])
 	ifIndex, err := net.InterfaceByName(ifi.Name)
 	if err != nil {
 		return err
@@ -93,11 +148,11 @@ func (s *Server) addGatewaysFor(ifi *config.Interface, family uint8) error {
 			// Add this route to the main table
 			msg.Table = unix.RT_TABLE_MAIN
 			msg.Attributes.Table = unix.RT_TABLE_MAIN
-			msg.Attributes.Priority = maxMetric + ifi.Metric
-			if err := routesync.ChangeMetric(s.nlconn, msg, ifi.Metric); err != nil {
+			msg.Attributes.Priority = maxMetric + metric
+			if err := routesync.ChangeMetric(s.nlconn, msg, metric); err != nil {
 				// this error can be expected at initial startup
 				// since the interface will already have routes with a different metric
-				s.l.Printf("error adding gateway route %+v: %s", msg, err)
+				s.logFamily(ifi, family).With("table", ifi.Table).Errorf("error adding gateway route %+v: %s", msg, err)
 				return err
 			}
 		}
@@ -108,7 +163,9 @@ func (s *Server) addGatewaysFor(ifi *config.Interface, family uint8) error {
 var maxMetric uint32 = 65534 // uint16 max size -1 so we never overflow
 
 func (s *Server) failGatewaysFor(ifi *config.Interface, family uint8) error {
-	routesync.WithMetric(maxMetric + ifi.Metric)(s.routeSync[ifi.Name])
+	s.failNFTables(ifi, family, true)
+	metric := ifi.RouteMetric()
+	routesync.WithMetric(maxMetric + metric)(s.routeSync[ifi.Name])
 	ifIndex, err := net.InterfaceByName(ifi.Name)
 	if err != nil {
 		return err
@@ -123,8 +180,8 @@ func (s *Server) failGatewaysFor(ifi *config.Interface, family uint8) error {
 			msg.Family == family &&
 			msg.Attributes.OutIface == uint32(ifIndex.Index) &&
 			msg.Attributes.Gateway != nil {
-			if err := routesync.ChangeMetric(s.nlconn, msg, maxMetric+ifi.Metric); err != nil {
-				s.l.Debugf("error failing gateway route %+v: %s", msg, err)
+			if err := routesync.ChangeMetric(s.nlconn, msg, maxMetric+metric); err != nil {
+				s.logFamily(ifi, family).With("table", ifi.Table).Debugf("error failing gateway route %+v: %s", msg, err)
 				return err
 			}
 		}
@@ -132,19 +189,79 @@ func (s *Server) failGatewaysFor(ifi *config.Interface, family uint8) error {
 	return nil
 }
 
-func (s *Server) execScript(event string, family uint8, ifi *config.Interface) ([]byte, error) {
-	script := ifi.UpAction
-	if event == "DOWN" {
-		script = ifi.DownAction
+// scriptFor returns the action of the interface for the event
+func scriptFor(event string, ifi *config.Interface) string {
+	switch event {
+	case "DOWN", "ADMIN_DOWN":
+		return ifi.DownAction
+	case "PMTU_LOW":
+		return ifi.PMTUAction
+	case "TRACE":
+		return ifi.TracerouteAction
+	case "DATA_CAP_WARNING", "DATA_CAP_REACHED", "DATA_CAP_RESET":
+		return ifi.DataCapAction
+	default:
+		return ifi.UpAction
 	}
+}
+
+// execScript runs the action for the event, with the state of the
+// interface and env in its environment. The action is killed together
+// with its children when it runs longer than the action timeout.
+func (s *Server) execScript(event string, family uint8, ifi *config.Interface, env ...string) ([]byte, error) {
+	script := scriptFor(event, ifi)
 	if script == "" {
 		return nil, nil
 	}
-	cmd := exec.CommandContext(s.ctx, "/run/current-system/sw/bin/env", "sh", "-c", "'"+script+"'")
+	// the monitor running the action does not go through its
+	// loop until the action ends, which the liveness check allows
+	atomic.AddInt32(&s.actionsRunning, 1)
+	defer func() {
+		atomic.StoreInt64(&s.actionEnded, time.Now().UnixNano())
+		atomic.AddInt32(&s.actionsRunning, -1)
+	}()
+
+	var out bytes.Buffer
+	cmd := exec.Command("/run/current-system/sw/bin/env", "sh", "-c", "'"+script+"'")
 	cmd.Env = []string{"EVENT=" + event, "FAMILY=" + fam(family)}
 	cmd.Env = append(cmd.Env, ifiToEnv(ifi)...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
 
-	return cmd.CombinedOutput()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(s.config.ActionTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.Bytes(), fmt.Errorf("killed after running for %s", s.config.ActionTimeout)
+	case <-s.ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.Bytes(), s.ctx.Err()
+	}
+}
+
+// runScript runs the action for the event and logs its output
+func (s *Server) runScript(event string, family uint8, ifi *config.Interface, env ...string) {
+	l := s.logFamily(ifi, family).With("event", event)
+	out, err := s.execScript(event, family, ifi, env...)
+	if err != nil {
+		l.Errorf("runScript: could not run the action for %s: %s", event, err)
+	}
+	if len(out) > 0 {
+		l.Printf(">>> %q", string(out))
+	}
 }
 
 func ifiToEnv(ifi *config.Interface) []string {
@@ -152,9 +269,12 @@ func ifiToEnv(ifi *config.Interface) []string {
 		"NAME=" + ifi.Name,
 		"DESCRIPTION='" + ifi.Description + "'",
 		"TABLE=" + fmt.Sprintf("%d", ifi.Table),
-		"UP_HOSTS4=" + fmt.Sprintf("%d", ifi.Up4()),
-		"UP_HOSTS6=" + fmt.Sprintf("%d", ifi.Up6()),
+		"UP_HOSTS4=" + fmt.Sprintf("%d", ifi.UpHosts(unix.AF_INET)),
+		"UP_HOSTS6=" + fmt.Sprintf("%d", ifi.UpHosts(unix.AF_INET6)),
+		"UP_WEIGHT4=" + fmt.Sprintf("%d", ifi.Up4()),
+		"UP_WEIGHT6=" + fmt.Sprintf("%d", ifi.Up6()),
 		"MINIMUM_UP=" + fmt.Sprintf("%d", ifi.MinimumUp),
+		"MINIMUM_WEIGHT=" + fmt.Sprintf("%d", ifi.Minimum()),
 	}
 }
 
@@ -0,0 +1,92 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// setNFTables records the link state of the interface, and replaces
+// the nftables table with the rules of the interfaces that are up.
+func (s *Server) setNFTables(ifi *config.Interface, up bool) {
+	if !s.config.NFTables || !nftInterface(ifi) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nftLinks[ifi.Name] = up
+	if err := s.applyNFTables(); err != nil {
+		s.logFor("server", ifi).Errorf("setNFTables: could not update table %q: %s", s.config.NFTablesTable, err)
+	}
+}
+
+// failNFTables records whether the family of the interface failed, and
+// replaces the nftables table so that the mark of the connections that
+// stick to the interface is only restored while the family routes.
+func (s *Server) failNFTables(ifi *config.Interface, family uint8, failed bool) {
+	if !s.config.NFTables || !nftInterface(ifi) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nftFailed[ifi.Name] == nil {
+		s.nftFailed[ifi.Name] = make(map[uint8]bool)
+	}
+	if s.nftFailed[ifi.Name][family] == failed {
+		return
+	}
+	s.nftFailed[ifi.Name][family] = failed
+	if !s.nftLinks[ifi.Name] {
+		return
+	}
+	if err := s.applyNFTables(); err != nil {
+		s.logFamily(ifi, family).Errorf("failNFTables: could not update table %q: %s", s.config.NFTablesTable, err)
+	}
+}
+
+// applyNFTables replaces the nftables table. It must be called with mu held.
+func (s *Server) applyNFTables() error {
+	var ifis []nftables.Interface
+	for _, ifi := range s.config.Interfaces {
+		if !s.nftLinks[ifi.Name] {
+			continue
+		}
+		rules := nftables.Interface{
+			Name:       ifi.Name,
+			Sticky:     ifi.Sticky,
+			Masquerade: ifi.Masquerade,
+		}
+		if ifi.Table != 0 {
+			rules.Mark = ifi.ProbeMark
+		}
+		for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+			if s.nftFailed[ifi.Name][family] {
+				rules.Failed = append(rules.Failed, family)
+			}
+		}
+		ifis = append(ifis, rules)
+	}
+	s.l.Debugf("applyNFTables: updating table %q with %d interfaces", s.config.NFTablesTable, len(ifis))
+	return nftables.Apply(s.config.NFTablesTable, ifis)
+}
+
+// nftInterface returns whether the interface has rules in the nftables
+// table. The mark of an interface is restored on the connections that
+// were pinned to it, as done by the new-connections-only failback.
+func nftInterface(ifi *config.Interface) bool {
+	return ifi.Masquerade || ifi.Sticky || (ifi.ProbeMark != 0 && ifi.Table != 0)
+}
@@ -0,0 +1,196 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/notify"
+)
+
+const (
+	// livenessTimeout is the time within which every monitor, route
+	// sync and icmp engine has to go through its loop to be alive.
+	// Their loops wake up at least every 5 seconds.
+	livenessTimeout = 15 * time.Second
+	// statusInterval is how often the status line is updated
+	statusInterval = 10 * time.Second
+)
+
+// runNotify tells the service manager when the monitors are
+// running, keeps the status line up to date and pings the watchdog
+// while the monitors are alive, until the server stops.
+func (s *Server) runNotify() error {
+	watchdog, err := notify.WatchdogInterval()
+	if err != nil {
+		s.l.Printf("runNotify: watchdog disabled: %s", err)
+	}
+
+	// wait until every monitor went through its loop
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for !s.started() {
+		select {
+		case <-s.ctx.Done():
+			ticker.Stop()
+			return nil
+		case <-ticker.C:
+		}
+	}
+	ticker.Stop()
+
+	if ok, err := notify.Send(notify.Ready, notify.Status(s.statusLine())); err != nil {
+		s.l.Warnf("runNotify: could not notify readiness: %s", err)
+	} else if !ok {
+		// not run by a service manager
+		return nil
+	}
+	s.l.Debugf("runNotify: notified readiness")
+
+	interval := statusInterval
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		states := []string{notify.Status(s.statusLine())}
+		if watchdog > 0 {
+			if err := s.alive(); err != nil {
+				// withhold the ping, so the service manager restarts us
+				s.l.Warnf("runNotify: not pinging the watchdog: %s", err)
+			} else {
+				states = append(states, notify.Watchdog)
+			}
+		}
+		if _, err := notify.Send(states...); err != nil {
+			s.l.Warnf("runNotify: could not notify: %s", err)
+		}
+	}
+}
+
+// started returns true when all link, neighbor and
+// passive monitors and route syncs are running
+func (s *Server) started() bool {
+	for _, m := range s.linkMonitors {
+		if m.Alive().IsZero() {
+			return false
+		}
+	}
+	for _, m := range s.neighborMonitors {
+		if m.Alive().IsZero() {
+			return false
+		}
+	}
+	for _, m := range s.passiveMonitors {
+		if m.Alive().IsZero() {
+			return false
+		}
+	}
+	for _, m := range s.routeSync {
+		if m.Alive().IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// alive returns an error naming a monitor, route sync or icmp
+// engine that did not go through its loop within the liveness
+// timeout. Bfd sessions are only checked while they run, they
+// are started and stopped with the link.
+func (s *Server) alive() error {
+	now := time.Now()
+	// a loop running an action is held up until the action ends, which
+	// is bounded by the action timeout, and is given the liveness
+	// timeout after the action to go through its loop again
+	if atomic.LoadInt32(&s.actionsRunning) > 0 {
+		return nil
+	}
+	if ended := atomic.LoadInt64(&s.actionEnded); now.Sub(time.Unix(0, ended)) < livenessTimeout {
+		return nil
+	}
+	for name, m := range s.linkMonitors {
+		if at := m.Alive(); now.Sub(at) > livenessTimeout {
+			return fmt.Errorf("link monitor of %q is stuck since %s", name, at.Format(time.RFC3339))
+		}
+	}
+	for name, m := range s.routeSync {
+		if at := m.Alive(); now.Sub(at) > livenessTimeout {
+			return fmt.Errorf("route sync of %q is stuck since %s", name, at.Format(time.RFC3339))
+		}
+	}
+	for name, m := range s.neighborMonitors {
+		if at := m.Alive(); now.Sub(at) > livenessTimeout {
+			return fmt.Errorf("neighbor monitor of %q is stuck since %s", name, at.Format(time.RFC3339))
+		}
+	}
+	for name, m := range s.passiveMonitors {
+		if at := m.Alive(); now.Sub(at) > livenessTimeout {
+			return fmt.Errorf("passive monitor of %q is stuck since %s", name, at.Format(time.RFC3339))
+		}
+	}
+	for family, e := range s.icmpEngines {
+		if at := e.Alive(); now.Sub(at) > livenessTimeout {
+			return fmt.Errorf("icmp engine of %s is stuck since %s", familyName(family), at.Format(time.RFC3339))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, sessions := range s.bfdSessions {
+		for peer, m := range sessions {
+			if at := m.Alive(); !at.IsZero() && now.Sub(at) > livenessTimeout {
+				return fmt.Errorf("bfd session of %q to %s is stuck since %s", name, peer, at.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+// statusLine summarizes the state of the interfaces,
+// such as "eth0 ipv4 up ipv6 down, lte0 admin_down"
+func (s *Server) statusLine() string {
+	var parts []string
+	for _, cfg := range s.config.Interfaces {
+		ifi, ok := s.interfaces[cfg.Name]
+		if !ok {
+			continue
+		}
+		parts = append(parts, s.interfaceLine(ifi))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *Server) interfaceLine(ifi *config.Interface) string {
+	if state := s.adminState(ifi.Name); state != "" {
+		return ifi.Name + " " + state
+	}
+	line := ifi.Name
+	for _, family := range families(ifi) {
+		state := "down"
+		if ifi.Available(family) {
+			state = "up"
+		}
+		line += " " + familyName(family) + " " + state
+	}
+	return line
+}
@@ -0,0 +1,85 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/linkstate"
+	"golang.org/x/sys/unix"
+)
+
+func TestAlive(t *testing.T) {
+	tests := []struct {
+		name    string
+		running int32
+		ended   time.Duration // ago, 0 for no action yet
+		stuck   bool
+	}{
+		{name: "stuck", stuck: true},
+		{name: "action running", running: 1},
+		{name: "action just ended", ended: time.Second},
+		{name: "action ended long ago", ended: 2 * livenessTimeout, stuck: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			// a link monitor that never went through its loop
+			m, err := linkstate.New(context.Background(), config.Interface{Name: "wan"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			s.linkMonitors = map[string]*linkstate.Monitor{"wan": m}
+			if s.started() {
+				t.Fatal("started with a link monitor that is not running")
+			}
+
+			atomic.StoreInt32(&s.actionsRunning, tt.running)
+			if tt.ended > 0 {
+				atomic.StoreInt64(&s.actionEnded, time.Now().Add(-tt.ended).UnixNano())
+			}
+			err = s.alive()
+			if tt.stuck && (err == nil || !strings.Contains(err.Error(), `link monitor of "wan"`)) {
+				t.Fatalf("alive() = %v, want the link monitor of wan stuck", err)
+			}
+			if !tt.stuck && err != nil {
+				t.Fatalf("alive() = %v, want alive", err)
+			}
+		})
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	s := testServer(t)
+	wan := &config.Interface{Name: "wan", Hosts: []config.Host{{Family: unix.AF_INET}, {Family: unix.AF_INET6}}}
+	lte := &config.Interface{Name: "lte", Hosts: []config.Host{{Family: unix.AF_INET}}}
+	s.config.Interfaces = []config.Interface{{Name: "wan"}, {Name: "lte"}, {Name: "unmonitored"}}
+	s.interfaces["wan"] = wan
+	s.interfaces["lte"] = lte
+
+	wan.SourceDown(unix.AF_INET6, config.SourceNeighbor)
+	if got, want := s.statusLine(), "wan ipv4 up ipv6 down, lte ipv4 up"; got != want {
+		t.Fatalf("statusLine() = %q, want %q", got, want)
+	}
+
+	s.state.Admin["lte"] = adminDown
+	if got, want := s.statusLine(), "wan ipv4 up ipv6 down, lte "+adminDown; got != want {
+		t.Fatalf("statusLine() = %q, want %q", got, want)
+	}
+}
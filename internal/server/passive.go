@@ -0,0 +1,55 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/sockdiag"
+)
+
+func (s *Server) addPassiveMonitor(ifi *config.Interface) error {
+	s.logFor("server", ifi).Debugf("addPassiveMonitor: add monitor for interface %q", ifi.Name)
+	m, err := sockdiag.New(s.ctx, *ifi,
+		sockdiag.Logger(s.logFor("sockdiag", ifi)),
+		sockdiag.Interval(ifi.PassiveInterval),
+		sockdiag.MaxRetransmits(ifi.PassiveMaxRetransmits),
+		sockdiag.MaxRTT(ifi.PassiveMaxRTT),
+		sockdiag.MinimumScore(ifi.PassiveMinimumScore),
+	)
+	if err != nil {
+		return err
+	}
+	m.Down(func(family uint8) {
+		s.logFor("server", ifi).Printf("addPassiveMonitor: passive score of %q (%s) is %d, below %d", ifi.Name, fam(family), m.Score(family), ifi.PassiveMinimumScore)
+		s.sourceFail(ifi, family, config.SourcePassive)
+	})
+	m.Up(func(family uint8) {
+		s.sourceAvailable(ifi, family, config.SourcePassive)
+	})
+	s.passiveMonitors[ifi.Name] = m
+	return nil
+}
+
+// passiveScore returns the last passive score of the
+// family of the interface, or nil when it is not known.
+func (s *Server) passiveScore(ifi string, family uint8) *int {
+	m, ok := s.passiveMonitors[ifi]
+	if !ok {
+		return nil
+	}
+	score := m.Score(family)
+	if score == sockdiag.ScoreUnknown {
+		return nil
+	}
+	return &score
+}
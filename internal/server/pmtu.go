@@ -0,0 +1,116 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/icmp"
+)
+
+// discoverPMTU discovers the path mtu to each host of the family every
+// pmtu_interval. When a path mtu drops below pmtu_minimum, the pmtu
+// action is run and the family is held down if pmtu_degrade is set.
+// It runs until the link goes down.
+func (s *Server) discoverPMTU(ifi *config.Interface, src string, family uint8, shutdown chan bool) {
+	low := ifi.Failed(family)&config.SourcePMTU != 0
+
+	// give the hosts that are resolved at runtime a chance to resolve
+	timer := time.NewTimer(ifi.BurstInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		var measured int
+		lowest := 0
+		for _, m := range s.icmpMonitorsFor(ifi.Name) {
+			if m.host.Family != family {
+				continue
+			}
+			mtu, err := s.pathMTU(ifi, src, m)
+			s.setPMTU(ifi.Name, m.host.ID(), mtu, err)
+			if err != nil {
+				s.logFamily(ifi, family).Warnf("discoverPMTU: could not discover the path mtu to %q (%s) on %q: %s", m.host.Name, fam(family), ifi.Name, err)
+				continue
+			}
+			s.logFamily(ifi, family).Debugf("discoverPMTU: path mtu to %q (%s) on %q is %d", m.host.Name, fam(family), ifi.Name, mtu)
+			measured++
+			if lowest == 0 || mtu < lowest {
+				lowest = mtu
+			}
+		}
+		timer.Reset(ifi.PMTUInterval)
+
+		if ifi.PMTUMinimum == 0 || measured == 0 {
+			continue
+		}
+		below := lowest < ifi.PMTUMinimum
+		switch {
+		case below && !low:
+			s.logFamily(ifi, family).Printf("discoverPMTU: path mtu %d (%s) on %q is below the minimum of %d", lowest, fam(family), ifi.Name, ifi.PMTUMinimum)
+			s.runScript("PMTU_LOW", family, ifi,
+				fmt.Sprintf("PMTU=%d", lowest),
+				fmt.Sprintf("PMTU_MINIMUM=%d", ifi.PMTUMinimum))
+			if ifi.PMTUDegrade {
+				s.sourceFail(ifi, family, config.SourcePMTU)
+			}
+		case !below && low:
+			s.logFamily(ifi, family).Printf("discoverPMTU: path mtu %d (%s) on %q is at the minimum of %d again", lowest, fam(family), ifi.Name, ifi.PMTUMinimum)
+			if ifi.PMTUDegrade {
+				s.sourceAvailable(ifi, family, config.SourcePMTU)
+			}
+		}
+		low = below
+	}
+}
+
+// pathMTU discovers the path mtu to the host of the monitor, using
+// the same packet options as the monitor besides the size.
+func (s *Server) pathMTU(ifi *config.Interface, src string, im *icmpMonitor) (int, error) {
+	host := im.host
+	m, err := icmp.New(s.ctx, src, im.address(), ifi.Name, icmp.Logger(s.logForHost("pmtu", ifi, im.host)),
+		icmp.WithEngine(s.icmpEngines[host.Family]),
+		icmp.Timeout(host.ICMPTimeout),
+		icmp.Mark(ifi.ProbeMark),
+		icmp.TTL(host.TTL),
+		icmp.DSCP(host.DSCP),
+		icmp.DontFragment(true))
+	if err != nil {
+		return 0, err
+	}
+	defer m.Stop()
+	return m.PathMTU()
+}
+
+// setPMTU records the result of a path mtu discovery
+func (s *Server) setPMTU(name string, id string, mtu int, err error) {
+	status := PMTUStatus{MTU: mtu, Checked: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pmtu[name] == nil {
+		s.pmtu[name] = make(map[string]PMTUStatus)
+	}
+	s.pmtu[name][id] = status
+}
@@ -0,0 +1,72 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/resolve"
+)
+
+const (
+	// bounds for the TTL based re-resolution of hostnames
+	resolveMin = 30 * time.Second
+	resolveMax = time.Hour
+	// time to wait after a failed resolution
+	resolveRetry = 30 * time.Second
+)
+
+// resolveHost resolves the hostname of the host on a TTL based schedule
+// and moves the icmp monitor along when its address changes.
+// It runs until the link goes down.
+func (s *Server) resolveHost(ifi *config.Interface, src string, host config.Host, shutdown chan bool) {
+	opts := []resolve.Option{resolve.Servers(host.Resolvers...)}
+	if host.ResolveViaInterface {
+		opts = append(opts, resolve.Interface(ifi.Name, net.ParseIP(src)), resolve.Mark(ifi.ProbeMark))
+	}
+	r, err := resolve.New(opts...)
+	if err != nil {
+		s.logFor("server", ifi).Warnf("resolveHost: could not create resolver for %q on %q: %s", host.Hostname, ifi.Name, err)
+		return
+	}
+
+	s.followTarget(ifi, src, host, shutdown, func(current *net.IP) (net.IP, time.Duration, error) {
+		ips, ttl, err := r.Lookup(s.ctx, host.Hostname, host.Family)
+		if err != nil {
+			return nil, resolveRetry, err
+		}
+		if ttl < resolveMin {
+			ttl = resolveMin
+		}
+		if ttl > resolveMax {
+			ttl = resolveMax
+		}
+		s.logFor("server", ifi).Debugf("resolveHost: resolving %q (%s) on %q again in %s", host.Hostname, fam(host.Family), ifi.Name, ttl)
+		return pickAddress(ips, current), ttl, nil
+	})
+}
+
+// pickAddress keeps the current address as long as it is
+// still returned, to prevent churn on round robin records.
+func pickAddress(ips []net.IP, current *net.IP) net.IP {
+	if current != nil {
+		for _, ip := range ips {
+			if ip.Equal(*current) {
+				return ip
+			}
+		}
+	}
+	return ips[0]
+}
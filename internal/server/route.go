@@ -19,10 +19,10 @@ import (
 
 func (s *Server) addRouteSync(ifi config.Interface) error {
 	m, err := routesync.New(s.ctx, ifi.Name, ifi.Table,
-		routesync.Logger(s.l),
+		routesync.Logger(s.logFor("routesync", &ifi, "table", ifi.Table)),
 		routesync.WithPid(s.pid),
 		routesync.WithRTConn(s.nlconn),
-		routesync.WithMetric(maxMetric+ifi.Metric))
+		routesync.WithMetric(maxMetric+ifi.RouteMetric()))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,47 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// probeRulePriority is the priority of the fwmark rules, which
+// sort before the default rules so probes never use the main table
+const probeRulePriority = 1
+
+// addProbeRules adds a rule per family that routes the probes,
+// marked with the probe mark of the interface, through its table.
+// Rules left behind by a previous run are replaced.
+func (s *Server) addProbeRules(ifi config.Interface) error {
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		_ = s.ruleDel(ifi.ProbeMark, ifi.Table, probeRulePriority, family)
+		if err := s.ruleAdd(ifi.ProbeMark, ifi.Table, probeRulePriority, family); err != nil {
+			return fmt.Errorf("could not add probe rule for %q (%s): %w", ifi.Name, fam(family), err)
+		}
+		s.l.Debugf("addProbeRules: fwmark %d lookup %d for %q (%s)", ifi.ProbeMark, ifi.Table, ifi.Name, fam(family))
+	}
+	return nil
+}
+
+// delProbeRules removes the rules added by addProbeRules.
+func (s *Server) delProbeRules(ifi config.Interface) {
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if err := s.ruleDel(ifi.ProbeMark, ifi.Table, probeRulePriority, family); err != nil {
+			s.l.Errorf("delProbeRules: could not remove probe rule for %q (%s): %s", ifi.Name, fam(family), err)
+		}
+	}
+}
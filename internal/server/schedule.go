@@ -0,0 +1,211 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/routesync"
+	"golang.org/x/sys/unix"
+)
+
+// runSchedules applies the schedules at the times of their cron
+// spec until the server stops. At startup the schedules are applied
+// in the order they last fired, so the interfaces start out in the
+// state the schedules describe. An admin state that was set after
+// a schedule last fired is kept.
+func (s *Server) runSchedules() error {
+	schedules := s.config.Schedules
+
+	now := time.Now()
+	last := make([]time.Time, len(schedules))
+	var fired []int
+	for i, sched := range schedules {
+		if last[i] = sched.Cron.Prev(now); !last[i].IsZero() {
+			fired = append(fired, i)
+		}
+	}
+	sort.SliceStable(fired, func(a, b int) bool {
+		return last[fired[a]].Before(last[fired[b]])
+	})
+	for _, i := range fired {
+		s.applySchedule(schedules[i], last[i])
+	}
+
+	for {
+		var next time.Time
+		for _, sched := range schedules {
+			if at := sched.Cron.Next(now); !at.IsZero() && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		if next.IsZero() {
+			s.l.Printf("runSchedules: no schedule fires again")
+			return nil
+		}
+
+		// wake up at least every minute to follow
+		// changes of the wall clock
+		for wait := time.Until(next); wait > 0; wait = time.Until(next) {
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+		}
+
+		for _, sched := range schedules {
+			if sched.Cron.Next(now).Equal(next) {
+				s.applySchedule(sched, next)
+			}
+		}
+		now = next
+	}
+}
+
+// applySchedule changes the interface as the schedule describes
+func (s *Server) applySchedule(sched config.Schedule, at time.Time) {
+	ifi := s.interfaces[sched.Interface]
+	s.l.Printf("applySchedule: applying %q (%s) to interface %q", sched.Name, at.Format(time.RFC3339), ifi.Name)
+
+	s.mu.Lock()
+	s.scheduled[sched.Name] = at
+	s.mu.Unlock()
+
+	if sched.Metric != 0 && !s.demotedMetric(ifi, sched.Metric) {
+		s.changeMetric(ifi, sched.Metric)
+	}
+	if sched.MinimumWeight != 0 {
+		s.changeMinimum(ifi, sched.MinimumWeight)
+	}
+	if sched.Admin == "" {
+		return
+	}
+	if changed := s.adminChanged(ifi.Name); at.Before(changed) {
+		s.l.Printf("applySchedule: keeping the admin state of interface %q, it was set at %s", ifi.Name, changed.Format(time.RFC3339))
+		return
+	}
+	if sched.Admin != s.adminState(ifi.Name) &&
+		!(sched.Admin == adminUp && s.adminState(ifi.Name) == "") {
+		if err := s.setAdmin(ifi.Name, sched.Admin, at); err != nil {
+			s.l.Errorf("applySchedule: could not set the admin state: %s", err)
+		}
+	}
+}
+
+// changeMetric moves the gateway routes of the interface in main to the
+// metric. Routes that are in use stay in use, failed routes stay failed.
+func (s *Server) changeMetric(ifi *config.Interface, metric uint32) {
+	old := ifi.SetRouteMetric(metric)
+	if old == metric {
+		return
+	}
+	s.logFor("server", ifi).Printf("changeMetric: interface %q, metric %d -> %d", ifi.Name, old, metric)
+
+	ifIndex, err := net.InterfaceByName(ifi.Name)
+	if err != nil {
+		s.logFor("server", ifi).Errorf("changeMetric: %s", err)
+		return
+	}
+	msgs, err := s.nlconn.Route.List()
+	if err != nil {
+		s.logFor("server", ifi).Errorf("changeMetric: could not list routes: %s", err)
+		return
+	}
+
+	inUse := false
+	for _, msg := range msgs {
+		if msg.Attributes.Table != unix.RT_TABLE_MAIN ||
+			msg.Attributes.OutIface != uint32(ifIndex.Index) ||
+			msg.Attributes.Gateway == nil {
+			continue
+		}
+		var to uint32
+		switch msg.Attributes.Priority {
+		case old:
+			to = metric
+			inUse = true
+		case maxMetric + old:
+			to = maxMetric + metric
+		default:
+			continue
+		}
+		if err := routesync.ChangeMetric(s.nlconn, msg, to); err != nil {
+			s.logFor("server", ifi).Errorf("changeMetric: error moving gateway route %+v: %s", msg, err)
+		}
+	}
+
+	// routes synced from the table of the interface
+	// follow the routes that are already there
+	if m, ok := s.routeSync[ifi.Name]; ok {
+		if inUse {
+			routesync.WithMetric(metric)(m)
+		} else {
+			routesync.WithMetric(maxMetric + metric)(m)
+		}
+	}
+}
+
+// changeMinimum changes the minimum weight of the interface, and
+// takes the families down or up when this changed their availability.
+func (s *Server) changeMinimum(ifi *config.Interface, weight int) {
+	if ifi.Minimum() == int32(weight) {
+		return
+	}
+	s.logFor("server", ifi).Printf("changeMinimum: interface %q, minimum weight %d -> %d", ifi.Name, ifi.Minimum(), weight)
+
+	available := make(map[uint8]bool)
+	for _, family := range families(ifi) {
+		available[family] = ifi.Available(family)
+	}
+	ifi.SetMinimum(weight)
+	for _, family := range families(ifi) {
+		switch now := ifi.Available(family); {
+		case available[family] && !now:
+			s.familyDown(ifi, family)
+		case !available[family] && now:
+			s.familyUp(ifi, family)
+		}
+	}
+}
+
+// scheduleStatus returns the state of the schedules
+func (s *Server) scheduleStatus() []ScheduleStatus {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var status []ScheduleStatus
+	for _, sched := range s.config.Schedules {
+		ss := ScheduleStatus{
+			Name:      sched.Name,
+			Cron:      sched.Cron.String(),
+			Interface: sched.Interface,
+		}
+		if at, ok := s.scheduled[sched.Name]; ok {
+			ss.Applied = &at
+		}
+		if next := sched.Cron.Next(now); !next.IsZero() {
+			ss.Next = &next
+		}
+		status = append(status, ss)
+	}
+	return status
+}
@@ -14,17 +14,23 @@ package server
 
 import (
 	"context"
-	"fmt"
-	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/jsimonetti/hodos/internal/bfd"
 	"github.com/jsimonetti/hodos/internal/config"
 	"github.com/jsimonetti/hodos/internal/icmp"
 	"github.com/jsimonetti/hodos/internal/linkstate"
 	"github.com/jsimonetti/hodos/internal/log"
+	"github.com/jsimonetti/hodos/internal/mqtt"
+	"github.com/jsimonetti/hodos/internal/neighbor"
+	"github.com/jsimonetti/hodos/internal/nftables"
+	"github.com/jsimonetti/hodos/internal/notify"
 	"github.com/jsimonetti/hodos/internal/routesync"
+	"github.com/jsimonetti/hodos/internal/sockdiag"
 	"github.com/jsimonetti/rtnetlink"
 	"github.com/mdlayher/netlink"
 
@@ -39,27 +45,71 @@ type Server struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
-	linkMonitors map[string]*linkstate.Monitor
-	routeSync    map[string]*routesync.Sync
-	icmpMonitors map[string]map[string]*icmp.Monitor
+	interfaces       map[string]*config.Interface
+	linkMonitors     map[string]*linkstate.Monitor
+	neighborMonitors map[string]*neighbor.Monitor
+	passiveMonitors  map[string]*sockdiag.Monitor
+	routeSync        map[string]*routesync.Sync
+	icmpMonitors     map[string]map[string]*icmpMonitor // guarded by mu
+	icmpEngines      map[uint8]*icmp.Engine
+	bfdSessions      map[string]map[string]*bfd.Session  // guarded by mu
+	pmtu             map[string]map[string]PMTUStatus    // guarded by mu
+	traces           map[string]map[string]*traceState   // guarded by mu
+	conntrackFlushed map[string]map[uint8]uint64         // guarded by mu
+	nftLinks         map[string]bool                     // guarded by mu
+	nftFailed        map[string]map[uint8]bool           // guarded by mu
+	failbacks        map[string]map[uint8]*failbackState // guarded by mu
+	upStates         map[string]map[uint8]*upState       // guarded by mu
+	scheduled        map[string]time.Time                // guarded by mu
+	demoted          map[string]uint32                   // metric before the data cap demoted the interface, guarded by mu
+	familyStates     map[string]map[uint8]string         // guarded by mu
+	state            persistentState                     // guarded by mu
+	webhooks         []*eventHook
+	mqtt             *mqtt.Client // nil without a broker
+	actionsRunning   int32        // read atomically
+	actionEnded      int64        // unix nanoseconds, read atomically
+
+	mu sync.Mutex
 
 	pid    uint32
 	nlconn *rtnetlink.Conn // We need to open the first netlink conn to force our PID
 }
 
-func New(ctx context.Context, l log.Logger, config *config.Config) (*Server, error) {
+func New(ctx context.Context, l log.Logger, cfg *config.Config) (*Server, error) {
 	var err error
 	s := &Server{
-		config:       config,
-		l:            l,
-		linkMonitors: make(map[string]*linkstate.Monitor),
-		routeSync:    make(map[string]*routesync.Sync),
-		icmpMonitors: make(map[string]map[string]*icmp.Monitor),
+		config:           cfg,
+		l:                l.With("component", "server"),
+		interfaces:       make(map[string]*config.Interface),
+		linkMonitors:     make(map[string]*linkstate.Monitor),
+		neighborMonitors: make(map[string]*neighbor.Monitor),
+		passiveMonitors:  make(map[string]*sockdiag.Monitor),
+		routeSync:        make(map[string]*routesync.Sync),
+		icmpMonitors:     make(map[string]map[string]*icmpMonitor),
+		icmpEngines:      make(map[uint8]*icmp.Engine),
+		bfdSessions:      make(map[string]map[string]*bfd.Session),
+		pmtu:             make(map[string]map[string]PMTUStatus),
+		traces:           make(map[string]map[string]*traceState),
+		conntrackFlushed: make(map[string]map[uint8]uint64),
+		nftLinks:         make(map[string]bool),
+		nftFailed:        make(map[string]map[uint8]bool),
+		failbacks:        make(map[string]map[uint8]*failbackState),
+		upStates:         make(map[string]map[uint8]*upState),
+		scheduled:        make(map[string]time.Time),
+		demoted:          make(map[string]uint32),
+		familyStates:     make(map[string]map[uint8]string),
 
 		pid: uint32(os.Getpid()),
 	}
 	s.ctx, s.ctxCancel = context.WithCancel(ctx)
 
+	if s.state, err = loadState(cfg.StateFile); err != nil {
+		return nil, err
+	}
+	for name, state := range s.state.Admin {
+		s.l.Printf("interface %q is %s", name, state)
+	}
+
 	// we force the kernel to assign our pid
 	// we need this to be able to distinguish external netlink
 	// from our own (we want to ignore our own)
@@ -68,6 +118,36 @@ func New(ctx context.Context, l log.Logger, config *config.Config) (*Server, err
 		return nil, err
 	}
 
+	// all icmp monitors of a family share a single engine
+	unprivileged := !icmp.Privileged(s.config.ICMPMode)
+	if unprivileged {
+		s.l.Printf("using unprivileged icmp datagram sockets")
+	}
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if s.icmpEngines[family], err = icmp.NewEngine(s.ctx, family, icmp.EngineLogger(s.l.With("component", "icmp", "family", familyName(family))), icmp.Unprivileged(unprivileged)); err != nil {
+			return nil, err
+		}
+	}
+
+	// start with an empty table, the rules of an
+	// interface are added once its link is up
+	if s.config.NFTables {
+		if err := s.applyNFTables(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hook := range s.config.Webhooks {
+		if err := s.addWebhook(hook); err != nil {
+			return nil, err
+		}
+	}
+	if s.config.MQTT != nil {
+		if err := s.addMQTT(s.config.MQTT); err != nil {
+			return nil, err
+		}
+	}
+
 	// set up a monitoring
 	for _, ifi := range s.config.Interfaces {
 		if err := s.addLinkMonitor(ifi); err != nil {
@@ -78,6 +158,11 @@ func New(ctx context.Context, l log.Logger, config *config.Config) (*Server, err
 			if err := s.addRouteSync(ifi); err != nil {
 				return nil, err
 			}
+			if ifi.ProbeMark != 0 {
+				if err := s.addProbeRules(ifi); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 	return s, nil
@@ -105,6 +190,8 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) Stop() error {
+	notify.Send(notify.Stopping)
+
 	// remove routes
 	//	s.l.Debugf("Server: removing temporary routes")
 	//	for _, ifi := range s.config.Interfaces {
@@ -114,8 +201,14 @@ func (s *Server) Stop() error {
 
 	s.l.Debugf("Server: tearing down icmp monitors")
 	// tear down monitoring
-	for ifi := range s.icmpMonitors {
-		for _, m := range s.icmpMonitors[ifi] {
+	for ifi := range s.interfaces {
+		for _, m := range s.icmpMonitorsFor(ifi) {
+			m.Stop()
+		}
+	}
+	s.l.Debugf("Server: tearing down bfd sessions")
+	for ifi := range s.interfaces {
+		for _, m := range s.bfdSessionsFor(ifi) {
 			m.Stop()
 		}
 	}
@@ -123,6 +216,18 @@ func (s *Server) Stop() error {
 	for _, m := range s.linkMonitors {
 		m.Stop()
 	}
+	if len(s.neighborMonitors) > 0 {
+		s.l.Debugf("Server: tearing down neighbor monitors")
+		for _, m := range s.neighborMonitors {
+			m.Stop()
+		}
+	}
+	if len(s.passiveMonitors) > 0 {
+		s.l.Debugf("Server: tearing down passive monitors")
+		for _, m := range s.passiveMonitors {
+			m.Stop()
+		}
+	}
 	// if no interface has a non-zero table configured,
 	// route table sync is not running
 	if len(s.routeSync) > 0 {
@@ -131,6 +236,28 @@ func (s *Server) Stop() error {
 			m.Stop()
 		}
 	}
+	s.l.Debugf("Server: removing probe rules")
+	for _, ifi := range s.config.Interfaces {
+		if ifi.Table != 0 && ifi.ProbeMark != 0 {
+			s.delProbeRules(ifi)
+		}
+	}
+	if len(s.webhooks) > 0 {
+		s.l.Debugf("Server: stopping webhooks")
+		for _, hook := range s.webhooks {
+			hook.Stop()
+		}
+	}
+	if s.mqtt != nil {
+		s.l.Debugf("Server: stopping mqtt client")
+		s.mqtt.Stop()
+	}
+	if s.config.NFTables {
+		s.l.Debugf("Server: removing nftables table")
+		if err := nftables.Delete(s.config.NFTablesTable); err != nil {
+			s.l.Errorf("Server: could not remove nftables table %q: %s", s.config.NFTablesTable, err)
+		}
+	}
 	defer s.ctxCancel()
 	return nil
 }
@@ -144,6 +271,20 @@ func (s *Server) run() error {
 		errGroup.Go(m.Run)
 	}
 
+	if len(s.neighborMonitors) > 0 {
+		s.l.Debugf("Server: starting neighbor monitors")
+		for _, m := range s.neighborMonitors {
+			errGroup.Go(m.Run)
+		}
+	}
+
+	if len(s.passiveMonitors) > 0 {
+		s.l.Debugf("Server: starting passive monitors")
+		for _, m := range s.passiveMonitors {
+			errGroup.Go(m.Run)
+		}
+	}
+
 	// if no interface has a non-zero table configured,
 	// route table sync is not running
 	if len(s.routeSync) > 0 {
@@ -153,42 +294,54 @@ func (s *Server) run() error {
 		}
 	}
 
+	for _, ifi := range s.interfaces {
+		if ifi.DataCap > 0 {
+			ifi := ifi
+			errGroup.Go(func() error { return s.meterDataCap(ifi) })
+		}
+	}
+
+	if len(s.config.Schedules) > 0 {
+		s.l.Debugf("Server: starting schedules")
+		errGroup.Go(s.runSchedules)
+	}
+
+	if len(s.webhooks) > 0 {
+		s.l.Debugf("Server: starting webhooks")
+		for _, hook := range s.webhooks {
+			errGroup.Go(hook.Run)
+		}
+	}
+
+	if s.mqtt != nil {
+		s.l.Debugf("Server: starting mqtt client")
+		errGroup.Go(s.mqtt.Run)
+	}
+
+	errGroup.Go(s.runNotify)
+
 	return errGroup.Wait()
 }
 
-func (s *Server) ruleAdd(from *net.IPNet, to *net.IPNet, table uint32, priority uint32, family uint8) error {
-	if from == nil {
-		return fmt.Errorf("ipRuleDo: from ip is nil")
-	}
+func (s *Server) ruleAdd(mark uint32, table uint32, priority uint32, family uint8) error {
+	return s.nlconn.Rule.Add(ruleMessage(mark, table, priority, family))
+}
 
-	srcSize, _ := from.Mask.Size()
-	dstSize, _ := to.Mask.Size()
+func (s *Server) ruleDel(mark uint32, table uint32, priority uint32, family uint8) error {
+	return s.nlconn.Rule.Delete(ruleMessage(mark, table, priority, family))
+}
 
-	msg := &rtnetlink.RuleMessage{
-		Family:    family,
-		SrcLength: uint8(srcSize),
-		DstLength: uint8(dstSize),
-		Action:    unix.FR_ACT_TO_TBL,
+// ruleMessage returns a rule sending traffic with the fwmark to the table
+func ruleMessage(mark uint32, table uint32, priority uint32, family uint8) *rtnetlink.RuleMessage {
+	mask := uint32(0xffffffff)
+	return &rtnetlink.RuleMessage{
+		Family: family,
+		Action: unix.FR_ACT_TO_TBL,
 		Attributes: &rtnetlink.RuleAttributes{
-			Src:      netIPPtr(from.IP),
-			Dst:      netIPPtr(to.IP),
+			FwMark:   &mark,
+			FwMask:   &mask,
 			Table:    &table,
 			Priority: &priority,
 		},
 	}
-	if from.IP.To4() == nil {
-		msg.Family = unix.AF_INET6
-	}
-
-	return s.nlconn.Rule.Add(msg)
-}
-
-func netIPPtr(v net.IP) *net.IP {
-	if ip4 := v.To4(); ip4 != nil {
-		// By default net.IP returns the 16 byte representation.
-		// But netlink requires us to provide only four bytes
-		// for legacy IPs.
-		return &ip4
-	}
-	return &v
 }
@@ -0,0 +1,87 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistentState is the state that is kept across restarts
+type persistentState struct {
+	Admin        map[string]string     `json:"admin,omitempty"`         // admin override per interface
+	AdminChanged map[string]time.Time  `json:"admin_changed,omitempty"` // when the admin state of the interface was last set
+	Usage        map[string]*dataUsage `json:"usage,omitempty"`         // data usage per interface with a data cap
+}
+
+// loadState reads the state from path. A missing file is an empty state.
+func loadState(path string) (persistentState, error) {
+	state := persistentState{
+		Admin:        make(map[string]string),
+		AdminChanged: make(map[string]time.Time),
+		Usage:        make(map[string]*dataUsage),
+	}
+	if path == "" {
+		return state, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, err
+	}
+	if state.Admin == nil {
+		state.Admin = make(map[string]string)
+	}
+	if state.AdminChanged == nil {
+		state.AdminChanged = make(map[string]time.Time)
+	}
+	if state.Usage == nil {
+		state.Usage = make(map[string]*dataUsage)
+	}
+	return state, nil
+}
+
+// saveState writes the state to the state file, replacing
+// it atomically. It must be called with mu held.
+func (s *Server) saveState() error {
+	path := s.config.StateFile
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,411 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// Status is the state of the monitored interfaces
+type Status struct {
+	Interfaces []InterfaceStatus `json:"interfaces"`
+	Schedules  []ScheduleStatus  `json:"schedules,omitempty"`
+}
+
+// InterfaceStatus is the state of an interface
+type InterfaceStatus struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Table       uint32         `json:"table,omitempty"`
+	Metric      uint32         `json:"metric,omitempty"`
+	Admin       string         `json:"admin,omitempty"` // admin_down or force_up while overridden
+	DataCap     *DataCapStatus `json:"data_cap,omitempty"`
+	Traffic     *TrafficStatus `json:"traffic,omitempty"` // unset until the counters are sampled
+	Families    []FamilyStatus `json:"families"`
+	Hosts       []HostStatus   `json:"hosts"`
+}
+
+// FamilyStatus is the state of a family of an interface
+type FamilyStatus struct {
+	Family           string   `json:"family"`
+	Available        bool     `json:"available"`
+	UpWeight         int32    `json:"up_weight"`
+	MinimumWeight    int32    `json:"minimum_weight"`
+	FailedSources    []string `json:"failed_sources,omitempty"`
+	PassiveScore     *int     `json:"passive_score,omitempty"` // unset without enough tcp traffic
+	ConntrackFlushed uint64   `json:"conntrack_flushed"`
+
+	FailbackPending bool       `json:"failback_pending,omitempty"` // available, but held by the failback policy
+	FailbackAt      *time.Time `json:"failback_at,omitempty"`      // when a delayed failback happens
+
+	Penalty    float64    `json:"penalty,omitempty"`    // flap dampening penalty
+	Suppressed bool       `json:"suppressed,omitempty"` // held until the penalty decays
+	HeldUntil  *time.Time `json:"held_until,omitempty"` // when the available family is taken into use
+}
+
+// DataCapStatus is the data usage of an interface in the billing period
+type DataCapStatus struct {
+	Cap     uint64    `json:"cap"`
+	Used    uint64    `json:"used"`
+	Percent float64   `json:"percent"`
+	Period  time.Time `json:"period"` // start of the billing period
+	Reset   time.Time `json:"reset"`  // start of the next billing period
+	Reached bool      `json:"reached"`
+}
+
+// TrafficStatus are the traffic counters of an interface,
+// with the rates over the last sample interval
+type TrafficStatus struct {
+	RXBytes   uint64 `json:"rx_bytes"`
+	TXBytes   uint64 `json:"tx_bytes"`
+	RXPackets uint64 `json:"rx_packets"`
+	TXPackets uint64 `json:"tx_packets"`
+	RXErrors  uint64 `json:"rx_errors"`
+	TXErrors  uint64 `json:"tx_errors"`
+	RXDropped uint64 `json:"rx_dropped"`
+	TXDropped uint64 `json:"tx_dropped"`
+
+	RXRate       float64 `json:"rx_bytes_per_second"`
+	TXRate       float64 `json:"tx_bytes_per_second"`
+	RXPacketRate float64 `json:"rx_packets_per_second"`
+	TXPacketRate float64 `json:"tx_packets_per_second"`
+
+	Sampled time.Time `json:"sampled"`
+}
+
+// ScheduleStatus is the state of a schedule
+type ScheduleStatus struct {
+	Name      string     `json:"name"`
+	Cron      string     `json:"cron"`
+	Interface string     `json:"interface"`
+	Applied   *time.Time `json:"applied,omitempty"` // when the schedule last fired, unset until it did
+	Next      *time.Time `json:"next,omitempty"`    // unset if the schedule never fires again
+}
+
+// HostStatus is the state of a host of an interface
+type HostStatus struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Family  string       `json:"family"`
+	Address string       `json:"address,omitempty"` // empty until a hostname or gateway is found
+	Up      bool         `json:"up"`
+	PMTU    *PMTUStatus  `json:"pmtu,omitempty"`
+	Trace   *TraceStatus `json:"trace,omitempty"`
+}
+
+// PMTUStatus is the result of the last path mtu discovery for a host
+type PMTUStatus struct {
+	MTU     int       `json:"mtu"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// TraceStatus is the result of the last traceroute to a host,
+// compared to the last traceroute that reached the host
+type TraceStatus struct {
+	Started   time.Time   `json:"started"`
+	Reached   bool        `json:"reached"`
+	Hops      []HopStatus `json:"hops"`
+	KnownGood []HopStatus `json:"known_good,omitempty"`
+	ChangedAt int         `json:"changed_at,omitempty"` // ttl of the first hop that differs from the known good path
+	DiedAt    int         `json:"died_at,omitempty"`    // first ttl after the last hop that answered
+	Error     string      `json:"error,omitempty"`
+}
+
+// HopStatus is a hop of a traceroute
+type HopStatus struct {
+	TTL     int     `json:"ttl"`
+	Address string  `json:"address,omitempty"` // empty if the hop did not answer
+	RTT     float64 `json:"rtt_ms,omitempty"`
+}
+
+// Status returns the current state of the monitored interfaces
+func (s *Server) Status() Status {
+	var status Status
+	for _, cfg := range s.config.Interfaces {
+		ifi, ok := s.interfaces[cfg.Name]
+		if !ok {
+			continue
+		}
+		status.Interfaces = append(status.Interfaces, s.interfaceStatus(ifi))
+	}
+	status.Schedules = s.scheduleStatus()
+	return status
+}
+
+func (s *Server) interfaceStatus(ifi *config.Interface) InterfaceStatus {
+	is := InterfaceStatus{
+		Name:        ifi.Name,
+		Description: ifi.Description,
+		Table:       ifi.Table,
+		Metric:      ifi.RouteMetric(),
+		Admin:       s.adminState(ifi.Name),
+		DataCap:     s.dataCapStatus(ifi),
+		Traffic:     s.trafficStatus(ifi.Name),
+		Hosts:       make([]HostStatus, 0, len(ifi.Hosts)),
+	}
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		fs := FamilyStatus{
+			Family:           familyName(family),
+			Available:        ifi.Available(family),
+			UpWeight:         ifi.Up(family),
+			MinimumWeight:    ifi.Minimum(),
+			PassiveScore:     s.passiveScore(ifi.Name, family),
+			ConntrackFlushed: s.flushedConntrack(ifi.Name, family),
+		}
+		fs.FailbackPending, fs.FailbackAt = s.failbackStatus(ifi.Name, family)
+		fs.Penalty, fs.Suppressed, fs.HeldUntil = s.upStatus(ifi, family)
+		for _, src := range ifi.Failed(family).List() {
+			fs.FailedSources = append(fs.FailedSources, src.String())
+		}
+		is.Families = append(is.Families, fs)
+	}
+
+	monitors := make(map[string]*icmpMonitor)
+	for _, m := range s.icmpMonitorsFor(ifi.Name) {
+		monitors[m.host.ID()] = m
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range ifi.Hosts {
+		hs := HostStatus{
+			ID:     host.ID(),
+			Name:   host.Name,
+			Family: familyName(host.Family),
+		}
+		if m, ok := monitors[host.ID()]; ok {
+			hs.Address = m.address().String()
+			hs.Up = m.isUp
+		}
+		if pmtu, ok := s.pmtu[ifi.Name][host.ID()]; ok {
+			hs.PMTU = &pmtu
+		}
+		hs.Trace = s.traceStatus(ifi.Name, host.ID())
+		is.Hosts = append(is.Hosts, hs)
+	}
+	return is
+}
+
+// RegisterHandlers adds the read-only status
+// api (/status) and the metrics (/metrics) to mux.
+func (s *Server) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+}
+
+// RegisterControlHandlers adds the status api and the metrics, and
+// the on demand traceroute (/traceroute), the manual failback
+// (/failback) and the admin state (/admin) to mux. These act on the
+// interfaces without authentication, so mux should only be served
+// on the control listener.
+func (s *Server) RegisterControlHandlers(mux *http.ServeMux) {
+	s.RegisterHandlers(mux)
+	mux.HandleFunc("/traceroute", s.serveTraceroute)
+	mux.HandleFunc("/failback", s.serveFailback)
+	mux.HandleFunc("/admin", s.serveAdmin)
+}
+
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serveMetrics serves the status in the prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	status := s.Status()
+
+	metric(w, "hodos_interface_admin_down", "Whether the interface is set admin down.")
+	for _, is := range status.Interfaces {
+		sample(w, "hodos_interface_admin_down", boolValue(is.Admin == adminDown), "interface", is.Name)
+	}
+	metric(w, "hodos_interface_force_up", "Whether the interface is forced up.")
+	for _, is := range status.Interfaces {
+		sample(w, "hodos_interface_force_up", boolValue(is.Admin == forceUp), "interface", is.Name)
+	}
+	metric(w, "hodos_interface_metric", "Metric of the routes of the interface.")
+	for _, is := range status.Interfaces {
+		sample(w, "hodos_interface_metric", float64(is.Metric), "interface", is.Name)
+	}
+	for _, c := range []struct {
+		name, help string
+		value      func(ts *TrafficStatus) uint64
+	}{
+		{"hodos_interface_rx_bytes_total", "Bytes received on the interface.", func(ts *TrafficStatus) uint64 { return ts.RXBytes }},
+		{"hodos_interface_tx_bytes_total", "Bytes sent on the interface.", func(ts *TrafficStatus) uint64 { return ts.TXBytes }},
+		{"hodos_interface_rx_packets_total", "Packets received on the interface.", func(ts *TrafficStatus) uint64 { return ts.RXPackets }},
+		{"hodos_interface_tx_packets_total", "Packets sent on the interface.", func(ts *TrafficStatus) uint64 { return ts.TXPackets }},
+		{"hodos_interface_rx_errors_total", "Receive errors on the interface.", func(ts *TrafficStatus) uint64 { return ts.RXErrors }},
+		{"hodos_interface_tx_errors_total", "Transmit errors on the interface.", func(ts *TrafficStatus) uint64 { return ts.TXErrors }},
+		{"hodos_interface_rx_dropped_total", "Received packets dropped on the interface.", func(ts *TrafficStatus) uint64 { return ts.RXDropped }},
+		{"hodos_interface_tx_dropped_total", "Packets to send dropped on the interface.", func(ts *TrafficStatus) uint64 { return ts.TXDropped }},
+	} {
+		counter(w, c.name, c.help)
+		for _, is := range status.Interfaces {
+			if is.Traffic != nil {
+				sample(w, c.name, float64(c.value(is.Traffic)), "interface", is.Name)
+			}
+		}
+	}
+	metric(w, "hodos_interface_rx_bytes_per_second", "Bytes received per second over the last sample interval.")
+	for _, is := range status.Interfaces {
+		if is.Traffic != nil {
+			sample(w, "hodos_interface_rx_bytes_per_second", is.Traffic.RXRate, "interface", is.Name)
+		}
+	}
+	metric(w, "hodos_interface_tx_bytes_per_second", "Bytes sent per second over the last sample interval.")
+	for _, is := range status.Interfaces {
+		if is.Traffic != nil {
+			sample(w, "hodos_interface_tx_bytes_per_second", is.Traffic.TXRate, "interface", is.Name)
+		}
+	}
+	metric(w, "hodos_data_cap_bytes", "Data cap of the interface per billing period.")
+	for _, is := range status.Interfaces {
+		if is.DataCap != nil {
+			sample(w, "hodos_data_cap_bytes", float64(is.DataCap.Cap), "interface", is.Name)
+		}
+	}
+	metric(w, "hodos_data_used_bytes", "Bytes received and sent by the interface in the billing period.")
+	for _, is := range status.Interfaces {
+		if is.DataCap != nil {
+			sample(w, "hodos_data_used_bytes", float64(is.DataCap.Used), "interface", is.Name)
+		}
+	}
+	metric(w, "hodos_data_cap_reached", "Whether the interface reached its data cap.")
+	for _, is := range status.Interfaces {
+		if is.DataCap != nil {
+			sample(w, "hodos_data_cap_reached", boolValue(is.DataCap.Reached), "interface", is.Name)
+		}
+	}
+	metric(w, "hodos_family_available", "Whether the family of the interface is available.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_available", boolValue(fs.Available), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_family_up_weight", "Total weight of the hosts of the family that are up.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_up_weight", float64(fs.UpWeight), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_family_passive_score", "Passive health score of the tcp connections of the family.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			if fs.PassiveScore != nil {
+				sample(w, "hodos_family_passive_score", float64(*fs.PassiveScore), "interface", is.Name, "family", fs.Family)
+			}
+		}
+	}
+	metric(w, "hodos_family_failback_pending", "Whether the family is available, but held by the failback policy.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_failback_pending", boolValue(fs.FailbackPending), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_family_penalty", "Flap dampening penalty of the family.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_penalty", fs.Penalty, "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_family_suppressed", "Whether the family is suppressed by flap dampening.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_suppressed", boolValue(fs.Suppressed), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	counter(w, "hodos_conntrack_flushed_total", "Conntrack entries deleted when the family went down.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_conntrack_flushed_total", float64(fs.ConntrackFlushed), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_family_minimum_weight", "Minimum weight of the hosts of the family that have to be up.")
+	for _, is := range status.Interfaces {
+		for _, fs := range is.Families {
+			sample(w, "hodos_family_minimum_weight", float64(fs.MinimumWeight), "interface", is.Name, "family", fs.Family)
+		}
+	}
+	metric(w, "hodos_schedule_applied_timestamp_seconds", "When the schedule last fired.")
+	for _, ss := range status.Schedules {
+		if ss.Applied != nil {
+			sample(w, "hodos_schedule_applied_timestamp_seconds", float64(ss.Applied.Unix()), "schedule", ss.Name, "interface", ss.Interface)
+		}
+	}
+	metric(w, "hodos_host_up", "Whether the host is up.")
+	for _, is := range status.Interfaces {
+		for _, hs := range is.Hosts {
+			sample(w, "hodos_host_up", boolValue(hs.Up), "interface", is.Name, "host", hs.ID, "family", hs.Family)
+		}
+	}
+	metric(w, "hodos_host_pmtu_bytes", "Path mtu to the host from the last discovery.")
+	for _, is := range status.Interfaces {
+		for _, hs := range is.Hosts {
+			if hs.PMTU != nil && hs.PMTU.Error == "" {
+				sample(w, "hodos_host_pmtu_bytes", float64(hs.PMTU.MTU), "interface", is.Name, "host", hs.ID, "family", hs.Family)
+			}
+		}
+	}
+}
+
+// metric writes the header of a gauge
+func metric(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// counter writes the header of a counter
+func counter(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+}
+
+// sample writes a sample with labels given as name, value pairs
+func sample(w io.Writer, name string, value float64, labels ...string) {
+	fmt.Fprint(w, name, "{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, "%s=%q", labels[i], labels[i+1])
+	}
+	fmt.Fprintf(w, "} %g\n", value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// familyName returns the name of the family as used in the configuration
+func familyName(family uint8) string {
+	if family == unix.AF_INET6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
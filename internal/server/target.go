@@ -0,0 +1,84 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+)
+
+// lookupFunc returns the address of a host that is discovered at runtime,
+// together with the time after which to look it up again. The address
+// currently in use, if any, is passed in as current.
+type lookupFunc func(current *net.IP) (net.IP, time.Duration, error)
+
+// followTarget looks up the address of the host using lookup, and moves
+// the icmp monitor along when the address changes.
+// It runs until the link goes down.
+func (s *Server) followTarget(ifi *config.Interface, src string, host config.Host, shutdown chan bool, lookup lookupFunc) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		ip, next, err := lookup(host.Host)
+		if err != nil {
+			s.logFor("server", ifi).Warnf("followTarget: could not find address for %q (%s) on %q: %s", host.Name, fam(host.Family), ifi.Name, err)
+			timer.Reset(next)
+			continue
+		}
+
+		if host.Host == nil || !host.Host.Equal(ip) {
+			s.logFor("server", ifi).Printf("followTarget: using address %s for %q (%s) on %q", ip, host.Name, fam(host.Family), ifi.Name)
+			// keep the debounced state of the previous
+			// address, so a changed address does not flap the host
+			isUp := false
+			if host.Host != nil {
+				isUp = s.removeTarget(ifi, host)
+			}
+			host.Host = &ip
+			s.addTarget(ifi, src, host, isUp)
+		}
+		timer.Reset(next)
+	}
+}
+
+// addTarget starts monitoring the host with the debounced state isUp.
+func (s *Server) addTarget(ifi *config.Interface, src string, host config.Host, isUp bool) {
+	if err := s.addICMPMonitor(ifi, src, host, isUp); err != nil {
+		s.logFor("server", ifi).Errorf("linkUp: could not start icmp monitor %q: %q -> %s (%q)", ifi.Name, src, host.Name, err)
+	}
+}
+
+// removeTarget stops monitoring the host, and returns its
+// debounced state. The monitor is taken out of the map in the
+// same critical section, so no other goroutine picks it up.
+func (s *Server) removeTarget(ifi *config.Interface, host config.Host) bool {
+	s.mu.Lock()
+	m, ok := s.icmpMonitors[ifi.Name][host.ID()]
+	isUp := ok && m.isUp
+	delete(s.icmpMonitors[ifi.Name], host.ID())
+	s.mu.Unlock()
+	if ok {
+		m.Stop()
+	}
+	return isUp
+}
@@ -0,0 +1,224 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/icmp"
+)
+
+var errTracing = errors.New("a trace to the host is already running")
+
+// traceState keeps the traces to a host
+type traceState struct {
+	last      *icmp.Trace
+	good      *icmp.Trace // the last trace that reached the host
+	changedAt int
+	diedAt    int
+	err       error
+	tracing   bool // a trace is running, only one runs at a time
+}
+
+// runTraceroute traces the path to each host of the family
+// every traceroute_interval. It runs until the link goes down.
+func (s *Server) runTraceroute(ifi *config.Interface, family uint8, shutdown chan bool) {
+	// give the hosts that are resolved at runtime a chance to resolve
+	timer := time.NewTimer(ifi.BurstInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		s.traceFamily(ifi, family, false)
+		timer.Reset(ifi.TracerouteInterval)
+	}
+}
+
+// traceFamily traces the path to each host of the family. The traceroute
+// action runs for every path that changed or died, or for every path when
+// the trace is done because of a failover.
+func (s *Server) traceFamily(ifi *config.Interface, family uint8, failover bool) {
+	for _, m := range s.icmpMonitorsFor(ifi.Name) {
+		if m.host.Family != family {
+			continue
+		}
+		state, err := s.traceHost(ifi, m)
+		if errors.Is(err, errTracing) {
+			continue
+		}
+		if err != nil {
+			s.logFamily(ifi, family).Warnf("traceFamily: could not trace the path to %q (%s) on %q: %s", m.host.Name, fam(family), ifi.Name, err)
+			continue
+		}
+		if failover || state.changedAt != 0 || state.diedAt != 0 {
+			s.traceAction(ifi, m.host, state)
+		}
+	}
+}
+
+// traceHost traces the path to the host of the monitor, and
+// compares it with the last trace that reached the host. It
+// returns errTracing while another trace to the host runs.
+func (s *Server) traceHost(ifi *config.Interface, m *icmpMonitor) (traceState, error) {
+	method := icmp.TraceICMP
+	if ifi.TracerouteMethod == config.TRACEROUTE_UDP {
+		method = icmp.TraceUDP
+	}
+	t, err := icmp.NewTracer(m.src, m.address(), ifi.Name,
+		icmp.Method(method),
+		icmp.TraceMark(ifi.ProbeMark),
+		icmp.TraceLogger(s.logForHost("traceroute", ifi, m.host)))
+	if err != nil {
+		return traceState{}, err
+	}
+
+	s.mu.Lock()
+	if s.traces[ifi.Name] == nil {
+		s.traces[ifi.Name] = make(map[string]*traceState)
+	}
+	state, ok := s.traces[ifi.Name][m.host.ID()]
+	if !ok {
+		state = &traceState{}
+		s.traces[ifi.Name][m.host.ID()] = state
+	}
+	if state.tracing {
+		s.mu.Unlock()
+		return traceState{}, errTracing
+	}
+	state.tracing = true
+	s.mu.Unlock()
+
+	trace, err := t.Trace(s.ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state.tracing = false
+	state.err = err
+	if err != nil {
+		return *state, err
+	}
+
+	state.last = trace
+	state.changedAt, state.diedAt = trace.Compare(state.good)
+	if trace.Reached {
+		state.good = trace
+	}
+	s.logFor("server", ifi).Debugf("traceHost: path to %q on %q: %s (changed at %d, died at %d)", m.host.Name, ifi.Name, trace, state.changedAt, state.diedAt)
+	return *state, nil
+}
+
+// traceAction runs the traceroute action with the result of a trace
+func (s *Server) traceAction(ifi *config.Interface, host config.Host, state traceState) {
+	if state.changedAt != 0 {
+		s.logFor("server", ifi).Printf("traceroute: path to %q on %q changed at hop %d", host.Name, ifi.Name, state.changedAt)
+	}
+	if state.diedAt != 0 {
+		s.logFor("server", ifi).Printf("traceroute: path to %q on %q died at hop %d", host.Name, ifi.Name, state.diedAt)
+	}
+
+	env := []string{
+		"TRACE_HOST=" + host.Name,
+		"TRACE_ADDRESS=" + state.last.Destination.String(),
+		fmt.Sprintf("TRACE_REACHED=%t", state.last.Reached),
+		"TRACE_HOPS=" + state.last.String(),
+		fmt.Sprintf("TRACE_CHANGED_AT=%d", state.changedAt),
+		fmt.Sprintf("TRACE_DIED_AT=%d", state.diedAt),
+	}
+	if state.good != nil {
+		env = append(env, "TRACE_KNOWN_GOOD="+state.good.String())
+	}
+	s.runScript("TRACE", host.Family, ifi, env...)
+}
+
+// traceStatus returns the status of the traces to a host. s.mu must be held.
+func (s *Server) traceStatus(name string, id string) *TraceStatus {
+	state, ok := s.traces[name][id]
+	if !ok {
+		return nil
+	}
+	ts := &TraceStatus{
+		ChangedAt: state.changedAt,
+		DiedAt:    state.diedAt,
+	}
+	if state.err != nil {
+		ts.Error = state.err.Error()
+	}
+	if state.last != nil {
+		ts.Started = state.last.Started
+		ts.Reached = state.last.Reached
+		ts.Hops = hopStatus(state.last)
+	}
+	if state.good != nil {
+		ts.KnownGood = hopStatus(state.good)
+	}
+	return ts
+}
+
+func hopStatus(trace *icmp.Trace) []HopStatus {
+	hops := make([]HopStatus, 0, len(trace.Hops))
+	for _, hop := range trace.Hops {
+		hs := HopStatus{TTL: hop.TTL}
+		if hop.Address != nil {
+			hs.Address = hop.Address.String()
+			hs.RTT = float64(hop.RTT) / float64(time.Millisecond)
+		}
+		hops = append(hops, hs)
+	}
+	return hops
+}
+
+// serveTraceroute traces the path to a host on demand, the
+// host is selected by the interface and host parameters.
+func (s *Server) serveTraceroute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, id := r.FormValue("interface"), r.FormValue("host")
+	ifi, ok := s.interfaces[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown interface %q", name), http.StatusNotFound)
+		return
+	}
+	var monitor *icmpMonitor
+	for _, m := range s.icmpMonitorsFor(name) {
+		if m.host.ID() == id || (m.host.Name == id && monitor == nil) {
+			monitor = m
+		}
+	}
+	if monitor == nil {
+		http.Error(w, fmt.Sprintf("unknown or inactive host %q on %q", id, name), http.StatusNotFound)
+		return
+	}
+
+	if _, err := s.traceHost(ifi, monitor); errors.Is(err, errTracing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	ts := s.traceStatus(name, monitor.host.ID())
+	s.mu.Unlock()
+	writeJSON(w, ts)
+}
@@ -0,0 +1,401 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sockdiag
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/config"
+	"github.com/jsimonetti/hodos/internal/log"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagInfo     = 2  // INET_DIAG_INFO
+
+	inetDiagReqLen = 56
+	inetDiagMsgLen = 72
+
+	// the minimum amount of segments sent during a sample
+	// for the score to say something about the link
+	minSegments = 100
+
+	// heartbeat is the longest the monitor waits
+	// between samples without going through its loop
+	heartbeat = time.Second
+)
+
+// ScoreUnknown is the score of a family without
+// enough traffic to judge the link by.
+const ScoreUnknown = -1
+
+// Monitor samples the TCP sockets with a source address on an
+// interface through NETLINK_SOCK_DIAG. It aggregates the retransmits
+// and round trip times into a passive health score per family.
+// It is a passive health source, it does not send any traffic by itself.
+type Monitor struct {
+	interFace config.Interface
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	downFunc func(family uint8)
+	upFunc   func(family uint8)
+	l        log.Logger
+
+	interval       time.Duration
+	maxRetransmits float64 // percentage of the segments sent
+	maxRTT         time.Duration
+	minimumScore   int
+
+	// counters of the sockets at the previous sample
+	sockets map[uint8]map[uint64]counters
+	primed  map[uint8]bool
+	down    map[uint8]bool
+	scorev4 int32
+	scorev6 int32
+
+	alive int64 // unix nanoseconds of the last loop, read atomically
+
+	wg *sync.WaitGroup
+}
+
+type counters struct {
+	retrans, segsOut uint32
+}
+
+func New(ctx context.Context, ifi config.Interface, opts ...Option) (*Monitor, error) {
+	m := &Monitor{
+		interFace: ifi,
+
+		downFunc: func(uint8) {},
+		upFunc:   func(uint8) {},
+		l:        log.Default(),
+
+		interval:       10 * time.Second,
+		maxRetransmits: 5,
+		minimumScore:   50,
+
+		sockets: make(map[uint8]map[uint64]counters),
+		primed:  make(map[uint8]bool),
+		down:    make(map[uint8]bool),
+		scorev4: ScoreUnknown,
+		scorev6: ScoreUnknown,
+		wg:      &sync.WaitGroup{},
+	}
+	m.ctx, m.ctxCancel = context.WithCancel(ctx)
+
+	for _, option := range opts {
+		if err := option(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Up is used to add a callback that is run when
+// the score of a family is at the minimum again.
+func (m *Monitor) Up(upFunc func(family uint8)) {
+	m.upFunc = upFunc
+}
+
+// Down is used to add a callback that is run when
+// the score of a family drops below the minimum.
+func (m *Monitor) Down(downFunc func(family uint8)) {
+	m.downFunc = downFunc
+}
+
+// Option is a functional argument to *Monitor
+type Option func(m *Monitor) error
+
+// Logger is a functional Option to set
+// a new logger for this monitor
+func Logger(l log.Logger) Option {
+	return func(m *Monitor) error {
+		m.l = l
+		return nil
+	}
+}
+
+// Interval is a functional Option to set
+// the interval between samples.
+// Defaults to 10 seconds.
+func Interval(t time.Duration) Option {
+	return func(m *Monitor) error {
+		m.interval = t
+		return nil
+	}
+}
+
+// MaxRetransmits is a functional Option to set the percentage of
+// retransmitted segments at which the score drops to 50.
+// Defaults to 5.
+func MaxRetransmits(p float64) Option {
+	return func(m *Monitor) error {
+		m.maxRetransmits = p
+		return nil
+	}
+}
+
+// MaxRTT is a functional Option to set the average
+// round trip time at which the score drops to 50.
+// Defaults to 0 (round trip time is not scored).
+func MaxRTT(t time.Duration) Option {
+	return func(m *Monitor) error {
+		m.maxRTT = t
+		return nil
+	}
+}
+
+// MinimumScore is a functional Option to set the
+// score below which the family is considered down.
+// Defaults to 50.
+func MinimumScore(score int) Option {
+	return func(m *Monitor) error {
+		m.minimumScore = score
+		return nil
+	}
+}
+
+// Score returns the last score of the family, from 0 to 100,
+// or ScoreUnknown.
+func (m *Monitor) Score(family uint8) int {
+	if family == unix.AF_INET6 {
+		return int(atomic.LoadInt32(&m.scorev6))
+	}
+	return int(atomic.LoadInt32(&m.scorev4))
+}
+
+func (m *Monitor) Run() error {
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	m.l.Debugf("sockdiagMonitor: starting monitor on %q", m.interFace.Name)
+	nl, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+	if err != nil {
+		m.l.Errorf("sockdiagMonitor: could not dial sock_diag: %s", err)
+		return err
+	}
+	defer nl.Close()
+	defer m.l.Debugf("sockdiagMonitor: ended for %q", m.interFace.Name)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	beat := time.NewTicker(heartbeat)
+	defer beat.Stop()
+	defer atomic.StoreInt64(&m.alive, 0)
+	for {
+		atomic.StoreInt64(&m.alive, time.Now().UnixNano())
+		select {
+		case <-m.ctx.Done():
+			return nil
+		case <-beat.C:
+			continue
+		case <-ticker.C:
+		}
+
+		local, err := m.localAddresses()
+		if err != nil {
+			m.l.Debugf("sockdiagMonitor: could not get the addresses of %q: %s", m.interFace.Name, err)
+			continue
+		}
+		for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+			if err := m.sample(nl, family, local); err != nil {
+				m.l.Warnf("sockdiagMonitor: could not sample %q: %s", m.interFace.Name, err)
+			}
+		}
+	}
+}
+
+// Alive returns when the monitor last went through its loop,
+// or the zero time if it is not running (yet)
+func (m *Monitor) Alive() time.Time {
+	if alive := atomic.LoadInt64(&m.alive); alive != 0 {
+		return time.Unix(0, alive)
+	}
+	return time.Time{}
+}
+
+func (m *Monitor) Stop() {
+	m.l.Debugf("stopping sockdiag monitor on %q", m.interFace.Name)
+	m.ctxCancel()
+	m.wg.Wait()
+}
+
+// sample dumps the established TCP sockets of the family, and
+// scores the retransmits and round trip times since the last sample
+// of the sockets with a local address on the interface.
+func (m *Monitor) sample(nl *netlink.Conn, family uint8, local map[string]bool) error {
+	req := make([]byte, inetDiagReqLen)
+	req[0] = family
+	req[1] = unix.IPPROTO_TCP
+	req[2] = 1 << (inetDiagInfo - 1)
+	binary.LittleEndian.PutUint32(req[4:8], 1<<unix.BPF_TCP_ESTABLISHED)
+
+	msgs, err := nl.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  sockDiagByFamily,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: req,
+	})
+	if err != nil {
+		return err
+	}
+
+	previous := m.sockets[family]
+	current := make(map[uint64]counters)
+	var retrans, segsOut uint32
+	var rttSum float64
+	for _, msg := range msgs {
+		cookie, src, info, ok := parseMessage(family, msg.Data)
+		if !ok || !local[src.String()] {
+			continue
+		}
+		c := counters{
+			retrans: binary.LittleEndian.Uint32(info[100:104]), // tcpi_total_retrans
+			segsOut: binary.LittleEndian.Uint32(info[136:140]), // tcpi_segs_out
+		}
+		current[cookie] = c
+
+		// new sockets count from zero
+		prev := previous[cookie]
+		if c.segsOut <= prev.segsOut {
+			continue
+		}
+		sent := c.segsOut - prev.segsOut
+		retrans += c.retrans - prev.retrans
+		segsOut += sent
+		rtt := binary.LittleEndian.Uint32(info[68:72]) // tcpi_rtt in microseconds
+		rttSum += float64(rtt) * float64(sent)
+	}
+	m.sockets[family] = current
+
+	// the counters of the sockets at startup
+	// are not from the last interval
+	if !m.primed[family] {
+		m.primed[family] = true
+		return nil
+	}
+
+	score := ScoreUnknown
+	if segsOut >= minSegments {
+		rate := float64(retrans) / float64(segsOut) * 100
+		rtt := time.Duration(rttSum/float64(segsOut)) * time.Microsecond
+		score = scoreOf(rate, m.maxRetransmits)
+		if m.maxRTT > 0 {
+			if s := scoreOf(float64(rtt), float64(m.maxRTT)); s < score {
+				score = s
+			}
+		}
+		m.l.Debugf("sockdiagMonitor: %q (%d): %d segments, %.2f%% retransmitted, rtt %s, score %d", m.interFace.Name, family, segsOut, rate, rtt, score)
+	}
+	m.setScore(family, score)
+	m.judge(family, score)
+	return nil
+}
+
+// judge holds the family down on a score below the minimum, and
+// releases it on a measured score at or above the minimum. Without
+// enough traffic there is no evidence either way, so an unknown score
+// keeps the family as it is. Once it is held down its traffic leaves
+// the interface, which does not mean the link recovered.
+func (m *Monitor) judge(family uint8, score int) {
+	if score == ScoreUnknown {
+		return
+	}
+	down := score < m.minimumScore
+	if down == m.down[family] {
+		return
+	}
+	m.down[family] = down
+	if down {
+		m.downFunc(family)
+	} else {
+		m.upFunc(family)
+	}
+}
+
+// scoreOf returns 100 for a value of 0, 50 at the maximum
+// and 0 at twice the maximum.
+func scoreOf(value float64, max float64) int {
+	score := int(100 * (1 - value/(2*max)))
+	if score < 0 {
+		return 0
+	}
+	if score > 100 {
+		return 100
+	}
+	return score
+}
+
+func (m *Monitor) setScore(family uint8, score int) {
+	if family == unix.AF_INET6 {
+		atomic.StoreInt32(&m.scorev6, int32(score))
+		return
+	}
+	atomic.StoreInt32(&m.scorev4, int32(score))
+}
+
+// parseMessage returns the cookie, source address and tcp_info
+// of an inet_diag_msg.
+func parseMessage(family uint8, b []byte) (uint64, net.IP, []byte, bool) {
+	if len(b) < inetDiagMsgLen || b[0] != family {
+		return 0, nil, nil, false
+	}
+	src := net.IP(b[8:24])
+	if family == unix.AF_INET {
+		src = net.IP(b[8:12])
+	}
+	cookie := binary.LittleEndian.Uint64(b[44:52])
+
+	ad, err := netlink.NewAttributeDecoder(b[inetDiagMsgLen:])
+	if err != nil {
+		return 0, nil, nil, false
+	}
+	var info []byte
+	for ad.Next() {
+		if ad.Type() == inetDiagInfo {
+			info = ad.Bytes()
+		}
+	}
+	if ad.Err() != nil || len(info) < 140 {
+		return 0, nil, nil, false
+	}
+	return cookie, src, info, true
+}
+
+// localAddresses returns the addresses of the interface
+func (m *Monitor) localAddresses() (map[string]bool, error) {
+	ifi, err := net.InterfaceByName(m.interFace.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+	return local, nil
+}
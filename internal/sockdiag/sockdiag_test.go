@@ -0,0 +1,90 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockdiag
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestScoreOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		max   float64
+		want  int
+	}{
+		{name: "none", value: 0, max: 5, want: 100},
+		{name: "half of the maximum", value: 2.5, max: 5, want: 75},
+		{name: "at the maximum", value: 5, max: 5, want: 50},
+		{name: "one and a half times the maximum", value: 7.5, max: 5, want: 25},
+		{name: "twice the maximum", value: 10, max: 5, want: 0},
+		{name: "beyond twice the maximum", value: 50, max: 5, want: 0},
+		{name: "negative", value: -1, max: 5, want: 100},
+		{name: "fraction", value: 0.01, max: 0.02, want: 75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scoreOf(tt.value, tt.max); got != tt.want {
+				t.Fatalf("scoreOf(%v, %v) = %d, want %d", tt.value, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJudge(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []int
+		want   []string // the callbacks, in order
+	}{
+		{name: "good", scores: []int{100, 80, 50}},
+		{name: "unknown", scores: []int{ScoreUnknown, ScoreUnknown}},
+		{name: "bad", scores: []int{80, 40, 30}, want: []string{"down"}},
+		{name: "recovers", scores: []int{40, 60, 70}, want: []string{"down", "up"}},
+		{
+			// the traffic left the interface that is held down
+			name:   "unknown while down",
+			scores: []int{40, ScoreUnknown, ScoreUnknown},
+			want:   []string{"down"},
+		},
+		{
+			name:   "measured again after unknown",
+			scores: []int{40, ScoreUnknown, 55, ScoreUnknown, 10},
+			want:   []string{"down", "up", "down"},
+		},
+		{name: "at the minimum", scores: []int{49, 50}, want: []string{"down", "up"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			m := &Monitor{
+				minimumScore: 50,
+				down:         make(map[uint8]bool),
+				downFunc:     func(uint8) { got = append(got, "down") },
+				upFunc:       func(uint8) { got = append(got, "up") },
+			}
+			for _, score := range tt.scores {
+				m.judge(unix.AF_INET, score)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("callbacks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
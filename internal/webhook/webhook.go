@@ -0,0 +1,235 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+// SignatureHeader carries the hmac-sha256 of the body with the secret
+const SignatureHeader = "X-Hodos-Signature"
+
+// maxBackoff caps the time between two attempts
+const maxBackoff = time.Minute
+
+// A Webhook posts payloads to a url from a bounded queue, so a
+// slow endpoint never blocks the sender. Failed posts are retried
+// with an exponential backoff.
+type Webhook struct {
+	url       string
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	l       log.Logger
+	client  *http.Client
+	secret  []byte
+	retries int
+	backoff time.Duration
+	queue   chan []byte
+
+	wg *sync.WaitGroup
+}
+
+func New(ctx context.Context, url string, opts ...Option) (*Webhook, error) {
+	w := &Webhook{
+		url: url,
+
+		l:       log.Default(),
+		client:  &http.Client{Timeout: 5 * time.Second},
+		retries: 5,
+		backoff: time.Second,
+		wg:      &sync.WaitGroup{},
+	}
+	w.ctx, w.ctxCancel = context.WithCancel(ctx)
+
+	for _, option := range opts {
+		if err := option(w); err != nil {
+			return nil, err
+		}
+	}
+	if w.queue == nil {
+		w.queue = make(chan []byte, 100)
+	}
+	// added here, so Stop waits for Run even when
+	// the goroutine running it did not start yet
+	w.wg.Add(1)
+	return w, nil
+}
+
+// Option is a functional argument to *Webhook
+type Option func(w *Webhook) error
+
+// Logger is a functional Option to set
+// a new logger for this webhook
+func Logger(l log.Logger) Option {
+	return func(w *Webhook) error {
+		w.l = l
+		return nil
+	}
+}
+
+// Secret is a functional Option to set the secret
+// that signs the payloads in the signature header.
+// Defaults to no signature.
+func Secret(secret string) Option {
+	return func(w *Webhook) error {
+		if secret != "" {
+			w.secret = []byte(secret)
+		}
+		return nil
+	}
+}
+
+// Timeout is a functional Option to set
+// the timeout of a single post.
+// Defaults to 5 seconds.
+func Timeout(t time.Duration) Option {
+	return func(w *Webhook) error {
+		w.client.Timeout = t
+		return nil
+	}
+}
+
+// Retries is a functional Option to set how often
+// a failed post is retried before it is dropped.
+// Defaults to 5.
+func Retries(n int) Option {
+	return func(w *Webhook) error {
+		w.retries = n
+		return nil
+	}
+}
+
+// Backoff is a functional Option to set the time
+// before the first retry, which doubles every retry.
+// Defaults to 1 second.
+func Backoff(t time.Duration) Option {
+	return func(w *Webhook) error {
+		w.backoff = t
+		return nil
+	}
+}
+
+// QueueSize is a functional Option to set how many
+// payloads are queued while the endpoint is slow.
+// Defaults to 100.
+func QueueSize(n int) Option {
+	return func(w *Webhook) error {
+		if n < 1 {
+			return fmt.Errorf("webhook: queue size should be at least 1")
+		}
+		w.queue = make(chan []byte, n)
+		return nil
+	}
+}
+
+// Send queues the payload without blocking. It returns
+// false when the queue is full and the payload is dropped.
+func (w *Webhook) Send(payload []byte) bool {
+	select {
+	case w.queue <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run posts the queued payloads until the webhook is stopped.
+// It must be run once for every webhook.
+func (w *Webhook) Run() error {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil
+		case payload := <-w.queue:
+			w.deliver(payload)
+		}
+	}
+}
+
+// deliver posts the payload, and retries until it is
+// accepted, the retries run out or the webhook stops
+func (w *Webhook) deliver(payload []byte) {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(payload)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.retries {
+			w.l.Warnf("webhook: dropping payload for %s after %d attempts: %s", w.url, attempt+1, err)
+			return
+		}
+		w.l.Debugf("webhook: post to %s failed, retrying in %s: %s", w.url, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post posts the payload once. It returns whether
+// a failure is worth retrying.
+func (w *Webhook) post(payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hodos")
+	if w.secret != nil {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(payload)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		// the endpoint does not want this payload
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// Stop stops posting, payloads still queued are dropped
+func (w *Webhook) Stop() {
+	w.l.Debugf("webhook: stopping %s", w.url)
+	w.ctxCancel()
+	w.wg.Wait()
+}
@@ -0,0 +1,244 @@
+// Copyright 2019-2022 Jeroen Simonetti
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/hodos/internal/log"
+)
+
+// endpoint answers with the statuses in turn, the last one
+// repeating, and passes the received requests to requests
+func endpoint(t *testing.T, statuses ...int) (string, <-chan *http.Request, *int32) {
+	t.Helper()
+	requests := make(chan *http.Request, 100)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(&byteReader{b: body})
+		n := int(atomic.AddInt32(&attempts, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+		requests <- r
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests, &attempts
+}
+
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func testWebhook(t *testing.T, url string, opts ...Option) *Webhook {
+	t.Helper()
+	opts = append([]Option{Logger(log.New(stdlog.New(io.Discard, "", 0))), Backoff(time.Millisecond)}, opts...)
+	w, err := New(context.Background(), url, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go w.Run()
+	t.Cleanup(w.Stop)
+	return w
+}
+
+func receive(t *testing.T, requests <-chan *http.Request) *http.Request {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return nil
+	}
+}
+
+func TestSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{name: "signed", secret: "s3cret"},
+		{name: "unsigned"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests, _ := endpoint(t, http.StatusOK)
+			w := testWebhook(t, url, Secret(tt.secret))
+			payload := []byte(`{"type":"family"}`)
+			if !w.Send(payload) {
+				t.Fatal("payload not queued")
+			}
+
+			r := receive(t, requests)
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != string(payload) {
+				t.Fatalf("body = %q, want %q", body, payload)
+			}
+			if got := r.Header.Get("Content-Type"); got != "application/json" {
+				t.Fatalf("content type = %q, want application/json", got)
+			}
+
+			want := ""
+			if tt.secret != "" {
+				mac := hmac.New(sha256.New, []byte(tt.secret))
+				mac.Write(payload)
+				want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			}
+			if got := r.Header.Get(SignatureHeader); got != want {
+				t.Fatalf("signature = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		want     int32 // attempts
+	}{
+		{name: "accepted", statuses: []int{http.StatusNoContent}, retries: 3, want: 1},
+		{name: "server error", statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, retries: 3, want: 3},
+		{name: "too many requests", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, retries: 3, want: 2},
+		{name: "retries run out", statuses: []int{http.StatusServiceUnavailable}, retries: 2, want: 3},
+		{name: "rejected", statuses: []int{http.StatusBadRequest}, retries: 3, want: 1},
+		{name: "no retries", statuses: []int{http.StatusInternalServerError}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests, attempts := endpoint(t, tt.statuses...)
+			w := testWebhook(t, url, Retries(tt.retries))
+			w.Send([]byte(`{"n":1}`))
+			for i := int32(0); i < tt.want; i++ {
+				receive(t, requests)
+			}
+
+			// a second payload is only posted once the
+			// first one was delivered or dropped
+			w.Send([]byte(`{"n":2}`))
+			r := receive(t, requests)
+			if body, _ := io.ReadAll(r.Body); string(body) != `{"n":2}` {
+				t.Fatalf("attempt %d posted %s, want the second payload", atomic.LoadInt32(attempts), body)
+			}
+			if got := atomic.LoadInt32(attempts) - 1; got != tt.want {
+				t.Fatalf("attempts = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	url, requests, _ := endpoint(t, http.StatusInternalServerError)
+	w := testWebhook(t, url, Retries(3), Backoff(20*time.Millisecond))
+	w.Send([]byte(`{}`))
+
+	var at []time.Time
+	for i := 0; i < 4; i++ {
+		receive(t, requests)
+		at = append(at, time.Now())
+	}
+	// the backoff doubles from 20ms every retry
+	for i, min := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		if got := at[i+1].Sub(at[i]); got < min {
+			t.Fatalf("retry %d after %s, want at least %s", i+1, got, min)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	w, err := New(context.Background(), "http://127.0.0.1:1", Logger(log.New(stdlog.New(io.Discard, "", 0))), QueueSize(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// not running, so nothing is taken from the queue
+	for i, want := range []bool{true, true, false, false} {
+		if got := w.Send([]byte(`{}`)); got != want {
+			t.Fatalf("send %d = %t, want %t", i, got, want)
+		}
+	}
+
+	if _, err := New(context.Background(), "http://127.0.0.1:1", QueueSize(0)); err == nil {
+		t.Fatal("queue size 0 accepted")
+	}
+}
+
+func TestStop(t *testing.T) {
+	url, requests, _ := endpoint(t, http.StatusInternalServerError)
+	w, err := New(context.Background(), url, Logger(log.New(stdlog.New(io.Discard, "", 0))), Backoff(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// stopping before the goroutine running the webhook
+	// started still waits for it to return
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stopped before running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	go w.Run()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped")
+	}
+
+	// a retry waiting for its backoff is abandoned
+	w, err = New(context.Background(), url, Logger(log.New(stdlog.New(io.Discard, "", 0))), Backoff(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go w.Run()
+	w.Send([]byte(`{}`))
+	receive(t, requests)
+	done := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped while waiting to retry")
+	}
+}
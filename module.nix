@@ -88,9 +88,14 @@ in
       startLimitIntervalSec = 30;
       startLimitBurst = 5;
       serviceConfig = {
+        Type = "notify";
+        WatchdogSec = "30s";
         Restart = "on-failure";
         RestartSec = "5s";
         DynamicUser = true;
+        StateDirectory = "hodos";
+        # for a control socket, such as listen = "unix:///run/hodos/control.sock"
+        RuntimeDirectory = "hodos";
         MemoryHigh = "128M";
         MemoryMax = "256M";
         NoNewPrivileges = true;
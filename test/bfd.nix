@@ -0,0 +1,109 @@
+{ nixpkgs ? <nixpkgs>
+, pkgs ? import <nixpkgs> { inherit system; config = { }; }
+, system ? builtins.currentSystem
+} @args:
+
+let
+  # the router has a session to another hodos on vlan 1 (eth1)
+  # and to frr bfdd, an independent implementation, on vlan 2 (eth2),
+  # since hodos takes a single bfd peer per family on an interface
+  routerAddress = "192.168.1.10";
+  peerAddress = "192.168.1.20";
+  routerFrrAddress = "192.168.2.10";
+  frrAddress = "192.168.2.30";
+
+  # the addresses on the vlans are set explicitly,
+  # the test driver numbers the nodes alphabetically otherwise
+  vlanNode = addresses: { lib, ... }: {
+    virtualisation.vlans = map (a: a.vlan) addresses;
+    networking.interfaces = builtins.listToAttrs (map
+      (a: {
+        name = "eth${toString a.vlan}";
+        value.ipv4.addresses = lib.mkForce [
+          { address = a.address; prefixLength = 24; }
+        ];
+      })
+      addresses);
+    # single-hop bfd control packets
+    networking.firewall.allowedUDPPorts = [ 3784 ];
+  };
+
+  # hodos with a bfd session towards a peer on each vlan
+  hodosNode = addresses: { ... }: {
+    imports = [
+      ../module.nix
+      (vlanNode addresses)
+    ];
+
+    services.hodos.enable = true;
+    services.hodos.settings =
+      {
+        interfaces = map
+          (a: {
+            name = "eth${toString a.vlan}";
+            bfd = [
+              {
+                peer = a.peer;
+                min_tx = "100ms";
+                min_rx = "100ms";
+                multiplier = 3;
+              }
+            ];
+          })
+          addresses;
+      };
+  };
+in
+import "${nixpkgs}/nixos/tests/make-test-python.nix"
+  ({ pkgs, ... }: {
+    name = "hodos-bfd";
+
+    nodes.router = hodosNode [
+      { vlan = 1; address = routerAddress; peer = peerAddress; }
+      { vlan = 2; address = routerFrrAddress; peer = frrAddress; }
+    ];
+    nodes.peer = hodosNode [
+      { vlan = 1; address = peerAddress; peer = routerAddress; }
+    ];
+    nodes.frr = { ... }: {
+      imports = [
+        (vlanNode [{ vlan = 2; address = frrAddress; }])
+      ];
+
+      services.frr.bfdd.enable = true;
+      services.frr.config = ''
+        bfd
+         peer ${routerFrrAddress} interface eth2
+          receive-interval 100
+          transmit-interval 100
+          detect-multiplier 3
+         exit
+        exit
+      '';
+    };
+
+    testScript = ''
+      start_all()
+      with subtest("Wait for Hodos, FRR and network ready"):
+          router.wait_for_unit("network-online.target")
+          router.wait_for_unit("hodos.service")
+          peer.wait_for_unit("hodos.service")
+          frr.wait_for_unit("frr.service")
+
+      with subtest("BFD session to hodos comes up"):
+          router.wait_until_succeeds("journalctl -u hodos.service | grep 'to ${peerAddress} changed from .* to Up'")
+
+      with subtest("BFD session to frr comes up on both ends"):
+          router.wait_until_succeeds("journalctl -u hodos.service | grep 'to ${frrAddress} changed from .* to Up'")
+          frr.wait_until_succeeds("vtysh -c 'show bfd peer ${routerFrrAddress}' | grep -i 'status: up'")
+
+      with subtest("BFD session goes down when the hodos peer stops"):
+          peer.systemctl("stop hodos.service")
+          router.wait_until_succeeds("journalctl -u hodos.service | grep 'to ${peerAddress} changed from Up to Down'")
+
+      with subtest("BFD session goes down when frr stops"):
+          frr.systemctl("stop frr.service")
+          router.wait_until_succeeds("journalctl -u hodos.service | grep 'to ${frrAddress} changed from Up to Down'")
+    '';
+  })
+  args